@@ -65,11 +65,277 @@ func register_ipkvm_apis(mux *http.ServeMux) {
 		dezukvmManager.HandleAudioStreams(w, r, instanceUUID)
 	}, mux)
 
+	authManager.HandleFunc("/api/v1/stream/{uuid}/recover", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		instanceUUID := r.PathValue("uuid")
+		dezukvmManager.HandleCaptureRecovery(w, r, instanceUUID)
+	}, mux)
+
 	authManager.HandleFunc("/api/v1/hid/{uuid}/events", func(w http.ResponseWriter, r *http.Request) {
 		instanceUUID := r.PathValue("uuid")
 		dezukvmManager.HandleHIDEvents(w, r, instanceUUID)
 	}, mux)
 
+	authManager.HandleFunc("/api/v1/hid/{uuid}/type", func(w http.ResponseWriter, r *http.Request) {
+		instanceUUID := r.PathValue("uuid")
+		switch r.Method {
+		case http.MethodPost:
+			dezukvmManager.HandleTypeText(w, r, instanceUUID)
+		case http.MethodGet:
+			dezukvmManager.HandleTypeTextStatus(w, r, instanceUUID)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}, mux)
+
+	authManager.HandleFunc("/api/v1/hid/{uuid}/type/cancel", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		instanceUUID := r.PathValue("uuid")
+		dezukvmManager.HandleCancelTypeText(w, r, instanceUUID)
+	}, mux)
+
+	authManager.HandleFunc("/api/v1/hid/{uuid}/control", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		instanceUUID := r.PathValue("uuid")
+		dezukvmManager.HandleControlState(w, r, instanceUUID)
+	}, mux)
+
+	authManager.HandleFunc("/api/v1/hid/{uuid}/release", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		instanceUUID := r.PathValue("uuid")
+		dezukvmManager.HandleReleaseAll(w, r, instanceUUID)
+	}, mux)
+
+	authManager.HandleFunc("/api/v1/hid/{uuid}/metrics", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodDelete {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		instanceUUID := r.PathValue("uuid")
+		dezukvmManager.HandleCommandMetrics(w, r, instanceUUID)
+	}, mux)
+
+	authManager.HandleFunc("/api/v1/hid/{uuid}/keys", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		instanceUUID := r.PathValue("uuid")
+		dezukvmManager.HandleSendKeys(w, r, instanceUUID)
+	}, mux)
+
+	authManager.HandleFunc("/api/v1/hid/{uuid}/media", func(w http.ResponseWriter, r *http.Request) {
+		instanceUUID := r.PathValue("uuid")
+		switch r.Method {
+		case http.MethodPost:
+			dezukvmManager.HandleMediaKey(w, r, instanceUUID)
+		case http.MethodGet:
+			dezukvmManager.HandleListMediaKeys(w, r, instanceUUID)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}, mux)
+
+	authManager.HandleFunc("/api/v1/hid/{uuid}/config", func(w http.ResponseWriter, r *http.Request) {
+		instanceUUID := r.PathValue("uuid")
+		switch r.Method {
+		case http.MethodGet:
+			dezukvmManager.HandleGetChipConfig(w, r, instanceUUID)
+		case http.MethodPost:
+			dezukvmManager.HandleSetChipConfig(w, r, instanceUUID)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}, mux)
+
+	authManager.HandleFunc("/api/v1/hid/{uuid}/calibration", func(w http.ResponseWriter, r *http.Request) {
+		instanceUUID := r.PathValue("uuid")
+		switch r.Method {
+		case http.MethodGet:
+			dezukvmManager.HandleGetPointerCalibration(w, r, instanceUUID)
+		case http.MethodPost:
+			dezukvmManager.HandleSetPointerCalibration(w, r, instanceUUID)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}, mux)
+
+	authManager.HandleFunc("/api/v1/hid/{uuid}/macro/record/start", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		instanceUUID := r.PathValue("uuid")
+		dezukvmManager.HandleMacroRecord(w, r, instanceUUID, true)
+	}, mux)
+
+	authManager.HandleFunc("/api/v1/hid/{uuid}/macro/record/stop", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		instanceUUID := r.PathValue("uuid")
+		dezukvmManager.HandleMacroRecord(w, r, instanceUUID, false)
+	}, mux)
+
+	authManager.HandleFunc("/api/v1/hid/{uuid}/macro/play", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		instanceUUID := r.PathValue("uuid")
+		dezukvmManager.HandleMacroPlay(w, r, instanceUUID)
+	}, mux)
+
+	authManager.HandleFunc("/api/v1/hid/{uuid}/macro/abort", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		instanceUUID := r.PathValue("uuid")
+		dezukvmManager.HandleMacroAbort(w, r, instanceUUID)
+	}, mux)
+
+	authManager.HandleFunc("/api/v1/hid/{uuid}/macro/status", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		instanceUUID := r.PathValue("uuid")
+		dezukvmManager.HandleMacroStatus(w, r, instanceUUID)
+	}, mux)
+
+	authManager.HandleFunc("/api/v1/macros", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		macroManager.HandleListMacros(w, r)
+	}, mux)
+
+	authManager.HandleFunc("/api/v1/macros/{name}", func(w http.ResponseWriter, r *http.Request) {
+		macroName := r.PathValue("name")
+		switch r.Method {
+		case http.MethodGet:
+			macroManager.HandleGetMacro(w, r, macroName)
+		case http.MethodDelete:
+			macroManager.HandleDeleteMacro(w, r, macroName)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}, mux)
+
+	authManager.HandleFunc("/api/v1/hid/{uuid}/script", func(w http.ResponseWriter, r *http.Request) {
+		instanceUUID := r.PathValue("uuid")
+		switch r.Method {
+		case http.MethodPost:
+			dezukvmManager.HandleRunScript(w, r, instanceUUID)
+		case http.MethodGet:
+			dezukvmManager.HandleScriptStatus(w, r, instanceUUID)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}, mux)
+
+	authManager.HandleFunc("/api/v1/hid/{uuid}/script/cancel", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		instanceUUID := r.PathValue("uuid")
+		dezukvmManager.HandleCancelScript(w, r, instanceUUID)
+	}, mux)
+
+	authManager.HandleFunc("/api/v1/hid/{uuid}/bootkey", func(w http.ResponseWriter, r *http.Request) {
+		instanceUUID := r.PathValue("uuid")
+		switch r.Method {
+		case http.MethodPost:
+			dezukvmManager.HandleStartBootKey(w, r, instanceUUID)
+		case http.MethodGet:
+			dezukvmManager.HandleBootKeyStatus(w, r, instanceUUID)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}, mux)
+
+	authManager.HandleFunc("/api/v1/hid/{uuid}/bootkey/cancel", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		instanceUUID := r.PathValue("uuid")
+		dezukvmManager.HandleCancelBootKey(w, r, instanceUUID)
+	}, mux)
+
+	authManager.HandleFunc("/api/v1/power/{uuid}", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		instanceUUID := r.PathValue("uuid")
+		dezukvmManager.HandlePowerStatus(w, r, instanceUUID)
+	}, mux)
+
+	authManager.HandleFunc("/api/v1/power/{uuid}/{action}", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		instanceUUID := r.PathValue("uuid")
+		dezukvmManager.HandlePowerAction(w, r, instanceUUID, r.PathValue("action"))
+	}, mux)
+
+	authManager.HandleFunc("/api/v1/hid/{uuid}/audit/sensitive", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		instanceUUID := r.PathValue("uuid")
+		dezukvmManager.HandleSetAuditSensitive(w, r, instanceUUID)
+	}, mux)
+
+	authManager.HandleFunc("/api/v1/audit", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		dezukvmManager.HandleQueryAudit(w, r)
+	}, mux)
+
+	authManager.HandleFunc("/api/v1/aux/{uuid}/status", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		instanceUUID := r.PathValue("uuid")
+		dezukvmManager.HandleAuxStatus(w, r, instanceUUID)
+	}, mux)
+
+	authManager.HandleFunc("/api/v1/aux/{uuid}/events", func(w http.ResponseWriter, r *http.Request) {
+		instanceUUID := r.PathValue("uuid")
+		dezukvmManager.HandleAuxStatusEvents(w, r, instanceUUID)
+	}, mux)
+
+	authManager.HandleFunc("/api/v1/script/validate", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		dezukvmManager.HandleValidateScript(w, r)
+	}, mux)
+
 	authManager.HandleFunc("/api/v1/mass_storage/switch", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -20,6 +20,8 @@ type UsbKvmConfig struct {
 	CaptureResolutionFPS    int
 	USBKVMBaudrate          int
 	AuxMCUBaudrate          int
+	USBManufacturer         string // USB manufacturer string reported to the target
+	USBProduct              string // USB product string reported to the target
 }
 
 var (
@@ -36,6 +38,8 @@ var (
 		CaptureResolutionFPS:    25,
 		USBKVMBaudrate:          115200,
 		AuxMCUBaudrate:          115200,
+		USBManufacturer:         "imuslab",
+		USBProduct:              "RemdesKVM",
 	}
 )
 
@@ -99,7 +103,14 @@ func SetupHIDCommunication(config *UsbKvmConfig) error {
 
 	log.Println("Setting chip USB device properties...")
 	time.Sleep(2 * time.Second) // Wait for the controller to initialize
-	_, err = usbKVM.WriteChipProperties()
+	manufacturer, product := config.USBManufacturer, config.USBProduct
+	if manufacturer == "" {
+		manufacturer = defaultUsbKvmConfig.USBManufacturer
+	}
+	if product == "" {
+		product = defaultUsbKvmConfig.USBProduct
+	}
+	_, err = usbKVM.WriteChipProperties(manufacturer, product)
 	if err != nil {
 		log.Fatalf("Failed to write chip properties: %v", err)
 		return err
@@ -12,6 +12,7 @@ import (
 	"github.com/gorilla/csrf"
 	"imuslab.com/dezukvm/dezukvmd/mod/auth"
 	"imuslab.com/dezukvm/dezukvmd/mod/dezukvm"
+	"imuslab.com/dezukvm/dezukvmd/mod/kvmmacro"
 	"imuslab.com/dezukvm/dezukvmd/mod/logger"
 )
 
@@ -19,6 +20,7 @@ var (
 	dezukvmManager     *dezukvm.DezukVM
 	listeningServerMux *http.ServeMux
 	authManager        *auth.AuthManager
+	macroManager       *kvmmacro.Manager
 	systemLogger       *logger.Logger
 )
 
@@ -48,9 +50,18 @@ func init_ipkvm_mode() error {
 		return err
 	}
 
+	// Initialize the HID macro manager, macros are stored in the system database
+	macroManager, err = kvmmacro.NewManager(authManager.Database())
+	if err != nil {
+		log.Fatal("Failed to initialize Macro Manager:", err)
+		return err
+	}
+
 	//Create a new DezukVM manager
 	dezukvmManager = dezukvm.NewKvmHostInstance(&dezukvm.RuntimeOptions{
-		EnableLog: true,
+		EnableLog:    true,
+		MacroManager: macroManager,
+		Database:     authManager.Database(),
 	})
 
 	// Experimental
@@ -18,6 +18,7 @@ const (
 	USB_KVM_CFG_PATH = CONFIG_PATH + "/usbkvm.json"
 	UUID_FILE        = CONFIG_PATH + "/uuid.cfg"
 	DB_FILE_PATH     = CONFIG_PATH + "/sys.db"
+	HID_GADGET_NAME  = "dezukvm" // configfs name of the USB HID gadget, see -tool=setup-hid-gadget
 )
 
 var (
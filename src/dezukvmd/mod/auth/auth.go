@@ -170,6 +170,11 @@ func (a *AuthManager) LogoutUser(w http.ResponseWriter, r *http.Request) error {
 	return nil
 }
 
+// Database returns the underlying DB so other modules can store their data in it.
+func (a *AuthManager) Database() *bolt.DB {
+	return a.db
+}
+
 // Close closes the underlying DB.
 func (a *AuthManager) Close() error {
 	return a.db.Close()
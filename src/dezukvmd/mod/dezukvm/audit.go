@@ -0,0 +1,574 @@
+package dezukvm
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"github.com/boltdb/bolt"
+	"imuslab.com/dezukvm/dezukvmd/mod/kvmhid"
+)
+
+/*
+	audit.go
+
+	Input audit log. Records who sent input to which instance and when.
+	Input of each HID session is summarized into entries covering at most
+	auditSpanLength: key presses as text like "ls -la<Enter>", mouse activity
+	as counts only, text typed with the type text event as is. Spans marked as sensitive (e.g. while typing a password)
+	keep the counts but have their key text redacted. Input sent through the
+	REST API is recorded as actions without its content.
+
+	Entries are stored in the system database and rotated by count and age.
+	Entries dropped because the database could not keep up are counted and
+	reported by the query API.
+*/
+
+const (
+	inputAuditBucket        = "input_audit"
+	DefaultAuditMaxEntries  = 100000
+	DefaultAuditRetention   = 90 * 24 * time.Hour
+	DefaultAuditQueryLimit  = 100
+	MaxAuditQueryLimit      = 1000
+	auditSpanLength         = 10 * time.Second // Longest time covered by one input entry
+	auditMaxKeyTextLength   = 1024             // Key text length that closes an input entry early
+	auditWriteQueueSize     = 256
+	auditRedactedText       = "[redacted]"
+	auditKeyboardLayoutName = "us" // Layout used to turn key presses into text
+)
+
+// Audit entry kinds
+const (
+	AuditKindSessionStart = "session_start" // A HID session connected
+	AuditKindSessionEnd   = "session_end"   // A HID session disconnected
+	AuditKindInput        = "input"         // Summarized input of a HID session
+	AuditKindAction       = "action"        // Input sent through the REST API
+)
+
+// AuditEntry is a single record of the input audit log
+type AuditEntry struct {
+	ID          uint64 `json:"id"`
+	Kind        string `json:"kind"`
+	Instance    string `json:"instance"`             // Instance UUID
+	SessionID   string `json:"session_id,omitempty"` // HID session ID, empty for REST API actions
+	User        string `json:"user,omitempty"`       // Display name given by the HID client
+	RemoteAddr  string `json:"remote_addr"`
+	Start       int64  `json:"start"` // Unix time in milliseconds
+	End         int64  `json:"end"`   // Unix time in milliseconds
+	Action      string `json:"action,omitempty"`
+	Keys        string `json:"keys,omitempty"` // Key presses as text, special keys and shortcuts in <>
+	KeyCount    int    `json:"key_count,omitempty"`
+	MouseMoves  int    `json:"mouse_moves,omitempty"`
+	MouseClicks int    `json:"mouse_clicks,omitempty"`
+	MouseScroll int    `json:"mouse_scroll,omitempty"`
+	Sensitive   bool   `json:"sensitive,omitempty"` // Key text was redacted
+}
+
+// AuditQuery filters audit entries, empty fields match everything
+type AuditQuery struct {
+	Instance  string
+	SessionID string
+	User      string
+	Kind      string
+	Since     int64 // Unix time in milliseconds
+	Until     int64 // Unix time in milliseconds
+	Limit     int
+}
+
+// auditSession is the input state of a HID session being audited
+type auditSession struct {
+	info      kvmhid.SessionInfo
+	instance  string
+	sensitive bool
+	modifiers uint8 // Modifier bits currently held
+	pending   *AuditEntry
+	keys      strings.Builder
+}
+
+// inputAudit summarizes HID session input and writes it to the database
+type inputAudit struct {
+	db         *bolt.DB
+	maxEntries uint64
+	retention  time.Duration
+	layout     *kvmhid.KeyboardLayout
+	sessions   map[string]*auditSession // By HID session ID
+	mu         sync.Mutex
+	writes     chan AuditEntry
+	dropped    atomic.Uint64 // Entries dropped because the write queue was full
+	stop       chan struct{}
+	done       chan struct{}
+}
+
+// newInputAudit creates the audit bucket and starts the writer
+func newInputAudit(db *bolt.DB, maxEntries int, retention time.Duration) (*inputAudit, error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte(inputAuditBucket))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if maxEntries <= 0 {
+		maxEntries = DefaultAuditMaxEntries
+	}
+	if retention <= 0 {
+		retention = DefaultAuditRetention
+	}
+	layout, err := kvmhid.GetKeyboardLayout(auditKeyboardLayoutName)
+	if err != nil {
+		return nil, err
+	}
+	a := &inputAudit{
+		db:         db,
+		maxEntries: uint64(maxEntries),
+		retention:  retention,
+		layout:     layout,
+		sessions:   make(map[string]*auditSession),
+		writes:     make(chan AuditEntry, auditWriteQueueSize),
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	go a.run()
+	return a, nil
+}
+
+// run writes queued entries and closes input entries older than auditSpanLength
+func (a *inputAudit) run() {
+	defer close(a.done)
+	ticker := time.NewTicker(auditSpanLength / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case entry := <-a.writes:
+			a.store(entry)
+		case <-ticker.C:
+			a.mu.Lock()
+			now := time.Now()
+			for _, s := range a.sessions {
+				if s.pending != nil && now.Sub(time.UnixMilli(s.pending.Start)) >= auditSpanLength {
+					a.flushLocked(s)
+				}
+			}
+			a.mu.Unlock()
+		case <-a.stop:
+			for {
+				select {
+				case entry := <-a.writes:
+					a.store(entry)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// Close writes all pending entries and stops the writer
+func (a *inputAudit) Close() {
+	a.mu.Lock()
+	for _, s := range a.sessions {
+		a.flushLocked(s)
+	}
+	a.mu.Unlock()
+	close(a.stop)
+	<-a.done
+}
+
+// record queues an entry for writing, it is dropped if the database cannot keep up
+func (a *inputAudit) record(entry AuditEntry) {
+	select {
+	case a.writes <- entry:
+	default:
+		dropped := a.dropped.Add(1)
+		log.Printf("Input audit queue full, dropped %s entry of instance %s (%d dropped in total)", entry.Kind, entry.Instance, dropped)
+	}
+}
+
+// Dropped returns the number of entries dropped since start because the write queue was full
+func (a *inputAudit) Dropped() uint64 {
+	return a.dropped.Load()
+}
+
+// store writes an entry and removes entries beyond the count and age limits
+func (a *inputAudit) store(entry AuditEntry) {
+	err := a.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(inputAuditBucket))
+		id, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		entry.ID = id
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		if err := b.Put(auditKey(id), data); err != nil {
+			return err
+		}
+
+		// Keys are in insertion order, so the oldest entries are always first
+		cutoff := time.Now().Add(-a.retention).UnixMilli()
+		c := b.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.First() {
+			old := AuditEntry{}
+			expired := json.Unmarshal(v, &old) == nil && old.End < cutoff
+			if binary.BigEndian.Uint64(k)+a.maxEntries > id && !expired {
+				break
+			}
+			if err := c.Delete(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Failed to write input audit entry: %v", err)
+	}
+}
+
+// Query returns the entries matching the query, newest first
+func (a *inputAudit) Query(q AuditQuery) ([]AuditEntry, error) {
+	if q.Limit <= 0 {
+		q.Limit = DefaultAuditQueryLimit
+	}
+	if q.Limit > MaxAuditQueryLimit {
+		q.Limit = MaxAuditQueryLimit
+	}
+	entries := []AuditEntry{}
+	err := a.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket([]byte(inputAuditBucket)).Cursor()
+		for k, v := c.Last(); k != nil && len(entries) < q.Limit; k, v = c.Prev() {
+			entry := AuditEntry{}
+			if err := json.Unmarshal(v, &entry); err != nil {
+				continue
+			}
+			if (q.Since > 0 && entry.End < q.Since) ||
+				(q.Until > 0 && entry.Start > q.Until) ||
+				(q.Instance != "" && entry.Instance != q.Instance) ||
+				(q.SessionID != "" && entry.SessionID != q.SessionID) ||
+				(q.User != "" && entry.User != q.User) ||
+				(q.Kind != "" && entry.Kind != q.Kind) {
+				continue
+			}
+			entries = append(entries, entry)
+		}
+		return nil
+	})
+	return entries, err
+}
+
+// attach starts auditing the HID sessions of an instance and returns the listener IDs
+func (a *inputAudit) attach(instance string, controller *kvmhid.Controller) []int {
+	sessionListener := controller.AddSessionListener(func(info kvmhid.SessionInfo, connected bool) {
+		a.handleSession(instance, info, connected)
+	})
+	commandListener := controller.AddCommandListener(a.handleCommand)
+	return []int{sessionListener, commandListener}
+}
+
+// detach stops auditing an instance and writes its pending entries
+func (a *inputAudit) detach(instance string, controller *kvmhid.Controller, listenerIDs []int) {
+	if len(listenerIDs) == 2 {
+		controller.RemoveSessionListener(listenerIDs[0])
+		controller.RemoveCommandListener(listenerIDs[1])
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for id, s := range a.sessions {
+		if s.instance == instance {
+			a.flushLocked(s)
+			delete(a.sessions, id)
+		}
+	}
+}
+
+func (a *inputAudit) handleSession(instance string, info kvmhid.SessionInfo, connected bool) {
+	now := time.Now().UnixMilli()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	s, ok := a.sessions[info.ID]
+	if connected {
+		if !ok {
+			s = &auditSession{info: info, instance: instance}
+			a.sessions[info.ID] = s
+		}
+		a.record(s.newEntry(AuditKindSessionStart, now))
+		return
+	}
+	if !ok {
+		s = &auditSession{info: info, instance: instance}
+	}
+	a.flushLocked(s)
+	delete(a.sessions, info.ID)
+	a.record(s.newEntry(AuditKindSessionEnd, now))
+}
+
+func (a *inputAudit) handleCommand(sessionID string, cmd *kvmhid.HIDCommand) {
+	if !kvmhid.IsInputEvent(cmd.Event) && cmd.Event != kvmhid.EventTypeTypeText {
+		return
+	}
+	now := time.Now()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	s, ok := a.sessions[sessionID]
+	if !ok {
+		return
+	}
+	if s.pending != nil && now.Sub(time.UnixMilli(s.pending.Start)) >= auditSpanLength {
+		a.flushLocked(s)
+	}
+	if s.pending == nil {
+		entry := s.newEntry(AuditKindInput, now.UnixMilli())
+		entry.Sensitive = s.sensitive
+		s.pending = &entry
+		s.keys.Reset()
+	}
+	s.pending.End = now.UnixMilli()
+
+	switch cmd.Event {
+	case kvmhid.EventTypeMouseMove:
+		s.pending.MouseMoves++
+	case kvmhid.EventTypeMousePress:
+		s.pending.MouseClicks++
+	case kvmhid.EventTypeMouseScroll:
+		s.pending.MouseScroll++
+	case kvmhid.EventTypeTypeText:
+		// Redacted on flush like key presses if the span is sensitive
+		s.pending.KeyCount += utf8.RuneCountInString(cmd.Text)
+		s.keys.WriteString(cmd.Text)
+	case kvmhid.EventTypeMediaKeyPress:
+		s.pending.KeyCount++
+		s.keys.WriteString("<" + cmd.MediaKey + ">")
+	case kvmhid.EventTypeReleaseAll, kvmhid.EventTypeHIDReset:
+		s.modifiers = 0x00
+	default:
+		usage, pressed, ok := cmd.KeyUsage()
+		if !ok {
+			break
+		}
+		if bit, isModifier := auditModifierBit(usage); isModifier {
+			if pressed {
+				s.modifiers |= bit
+			} else {
+				s.modifiers &^= bit
+			}
+			break
+		}
+		if pressed {
+			s.pending.KeyCount++
+			s.keys.WriteString(a.describeKey(usage, s.modifiers))
+		}
+	}
+	if s.keys.Len() >= auditMaxKeyTextLength {
+		a.flushLocked(s)
+	}
+}
+
+// describeKey turns a key press into text, e.g. "a", "A", "<Enter>" or "<Ctrl+Alt+Delete>"
+func (a *inputAudit) describeKey(usage uint8, modifiers uint8) string {
+	shortcut := modifiers&^(kvmhid.MOD_LSHIFT|kvmhid.MOD_RSHIFT|kvmhid.MOD_RALT) != 0
+	if !shortcut {
+		if r, ok := a.layout.Character(usage, modifiers); ok {
+			return string(r)
+		}
+	}
+	name := kvmhid.HIDUsageToKeyboardCode(usage)
+	if strings.HasPrefix(name, "Key") && len(name) == 4 {
+		name = name[3:]
+	} else if strings.HasPrefix(name, "Digit") && len(name) == 6 {
+		name = name[5:]
+	}
+	parts := []string{}
+	for _, mod := range []struct {
+		bits uint8
+		name string
+	}{
+		{kvmhid.MOD_LCTRL | kvmhid.MOD_RCTRL, "Ctrl"},
+		{kvmhid.MOD_LALT | kvmhid.MOD_RALT, "Alt"},
+		{kvmhid.MOD_LSHIFT | kvmhid.MOD_RSHIFT, "Shift"},
+		{kvmhid.MOD_LGUI | kvmhid.MOD_RGUI, "Win"},
+	} {
+		if modifiers&mod.bits != 0 {
+			parts = append(parts, mod.name)
+		}
+	}
+	return "<" + strings.Join(append(parts, name), "+") + ">"
+}
+
+// flushLocked queues the pending input entry of a session, a.mu must be held
+func (a *inputAudit) flushLocked(s *auditSession) {
+	if s.pending == nil {
+		return
+	}
+	entry := *s.pending
+	if entry.Sensitive {
+		if entry.KeyCount > 0 {
+			entry.Keys = auditRedactedText
+		}
+	} else {
+		entry.Keys = s.keys.String()
+	}
+	s.pending = nil
+	s.keys.Reset()
+	a.record(entry)
+}
+
+// SetSensitive marks the input of a session, or of all sessions of an instance
+// if sessionID is empty, as sensitive. Returns the number of sessions changed.
+func (a *inputAudit) SetSensitive(instance string, sessionID string, sensitive bool) int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	changed := 0
+	for id, s := range a.sessions {
+		if s.instance != instance || (sessionID != "" && id != sessionID) {
+			continue
+		}
+		if s.sensitive != sensitive {
+			// Close the current entry so no entry mixes redacted and plain text
+			a.flushLocked(s)
+			s.sensitive = sensitive
+		}
+		changed++
+	}
+	return changed
+}
+
+// newEntry creates an entry of this session starting at the given time
+func (s *auditSession) newEntry(kind string, at int64) AuditEntry {
+	return AuditEntry{
+		Kind:       kind,
+		Instance:   s.instance,
+		SessionID:  s.info.ID,
+		User:       s.info.Name,
+		RemoteAddr: s.info.RemoteAddr,
+		Start:      at,
+		End:        at,
+	}
+}
+
+// auditModifierBit returns the modifier bit of a modifier key usage
+func auditModifierBit(usage uint8) (uint8, bool) {
+	if usage < 0xE0 || usage > 0xE7 {
+		return 0x00, false
+	}
+	return 1 << (usage - 0xE0), true
+}
+
+func auditKey(id uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, id)
+	return key
+}
+
+// initInputAudit starts the input audit log if a database is configured
+func (d *DezukVM) initInputAudit() error {
+	if d.option == nil || d.option.Database == nil {
+		return nil
+	}
+	audit, err := newInputAudit(d.option.Database, d.option.AuditMaxEntries, time.Duration(d.option.AuditRetentionDays)*24*time.Hour)
+	if err != nil {
+		return err
+	}
+	d.audit = audit
+	return nil
+}
+
+// auditAction records input sent to an instance through the REST API
+func (d *DezukVM) auditAction(instanceUuid string, r *http.Request, action string) {
+	if d.audit == nil {
+		return
+	}
+	now := time.Now().UnixMilli()
+	d.audit.record(AuditEntry{
+		Kind:       AuditKindAction,
+		Instance:   instanceUuid,
+		RemoteAddr: r.RemoteAddr,
+		Start:      now,
+		End:        now,
+		Action:     action,
+	})
+}
+
+// HandleQueryAudit returns input audit entries, newest first. The number of entries dropped
+// since start because the database could not keep up is returned in the X-Audit-Dropped header.
+// Accept GET parameters instance, session, user, kind, since, until (Unix time in milliseconds) and limit
+func (d *DezukVM) HandleQueryAudit(w http.ResponseWriter, r *http.Request) {
+	if d.audit == nil {
+		http.Error(w, "Input audit log is not enabled", http.StatusServiceUnavailable)
+		return
+	}
+	query := r.URL.Query()
+	q := AuditQuery{
+		Instance:  query.Get("instance"),
+		SessionID: query.Get("session"),
+		User:      query.Get("user"),
+		Kind:      query.Get("kind"),
+	}
+	for name, target := range map[string]*int64{"since": &q.Since, "until": &q.Until} {
+		if value := query.Get(name); value != "" {
+			parsed, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				http.Error(w, "Invalid "+name+" parameter", http.StatusBadRequest)
+				return
+			}
+			*target = parsed
+		}
+	}
+	if value := query.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil {
+			http.Error(w, "Invalid limit parameter", http.StatusBadRequest)
+			return
+		}
+		q.Limit = limit
+	}
+
+	entries, err := d.audit.Query(q)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Audit-Dropped", strconv.FormatUint(d.audit.Dropped(), 10))
+	json.NewEncoder(w).Encode(entries)
+}
+
+// HandleSetAuditSensitive marks HID session input on the given instance as sensitive, redacting its key text
+// Accept POST parameters sensitive (true or false) and session (optional, all sessions of the instance if empty)
+func (d *DezukVM) HandleSetAuditSensitive(w http.ResponseWriter, r *http.Request, instanceUuid string) {
+	if _, err := d.GetInstanceByUUID(instanceUuid); err != nil {
+		http.Error(w, "Instance with specified UUID not found", http.StatusNotFound)
+		return
+	}
+	if d.audit == nil {
+		http.Error(w, "Input audit log is not enabled", http.StatusServiceUnavailable)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Invalid form data", http.StatusBadRequest)
+		return
+	}
+	sensitive, err := strconv.ParseBool(r.Form.Get("sensitive"))
+	if err != nil {
+		http.Error(w, "Missing or invalid sensitive parameter", http.StatusBadRequest)
+		return
+	}
+	sessionID := r.Form.Get("session")
+	changed := d.audit.SetSensitive(instanceUuid, sessionID, sensitive)
+	if sessionID != "" && changed == 0 {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"sensitive": sensitive,
+		"sessions":  changed,
+	})
+}
@@ -0,0 +1,375 @@
+package dezukvm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"imuslab.com/dezukvm/dezukvmd/mod/kvmhid"
+	"imuslab.com/dezukvm/dezukvmd/mod/usbcapture"
+)
+
+/*
+	bootkey.go
+
+	Boot key helper. Optionally presses the power button through the AuxMCU,
+	unless the PWR LED shows the target is already running, then keeps
+	tapping the firmware setup or boot menu keys (e.g. Del, F2, F12) until
+	the captured video shows the firmware screen has changed, or until the
+	timeout passes. Screen changes are only seen while a client streams the
+	video, without one the keys are tapped until the timeout. The job holds
+	the input job lock of the HID controller, so no macro, script or text
+	typing runs while it taps.
+
+	Screen changes are tracked on coarse frame signatures. The first picture
+	after a black screen (usually the vendor logo) becomes the reference, and
+	it keeps following the screen while it settles (fade-in animations). The
+	job stops once a later picture differs from the reference, e.g. when the
+	setup menu replaces the logo.
+*/
+
+const (
+	DefaultBootKeyTimeout     = 60 * time.Second
+	MaxBootKeyTimeout         = 5 * time.Minute
+	DefaultBootKeyInterval    = 200 * time.Millisecond
+	MinBootKeyInterval        = 50 * time.Millisecond
+	DefaultBootKeyPowerHold   = 500 * time.Millisecond
+	MaxBootKeyPowerHold       = 10 * time.Second
+	DefaultBootKeySettle      = 1500 * time.Millisecond
+	bootKeyTapHold            = 50 // Milliseconds each boot key is held down
+	bootKeyScreenThreshold    = 12.0
+	bootKeyFrameCheckInterval = 250 * time.Millisecond
+)
+
+// Boot key job states
+const (
+	BootKeyStateRunning   = "running"
+	BootKeyStateDone      = "done"
+	BootKeyStateCancelled = "cancelled"
+	BootKeyStateFailed    = "failed"
+)
+
+// Boot key job results
+const (
+	BootKeyResultScreenChanged = "screen_changed" // The firmware screen changed while tapping
+	BootKeyResultTimeout       = "timeout"        // The timeout passed without a screen change
+)
+
+// ErrBootKeyBusy is returned when a boot key job is already running on the instance
+var ErrBootKeyBusy = errors.New("a boot key job is already running on this instance")
+
+// ErrNoPowerLED is returned for power_on when the board does not report the PWR LED.
+// Pressing power on a running target would ask it to shut down, so it is never pressed blindly.
+var ErrNoPowerLED = errors.New("the board does not report the PWR LED, cannot tell if the target is already on")
+
+// BootKeyOptions configures a boot key job
+type BootKeyOptions struct {
+	Keys         []string `json:"keys"`           // Keys tapped in turn, default Delete and F2
+	PowerOn      bool     `json:"power_on"`       // Press the power button before tapping, skipped if the PWR LED shows the target is on
+	PowerHold    int      `json:"power_hold"`     // Milliseconds to hold the power button, default 500
+	Interval     int      `json:"interval"`       // Milliseconds between taps, default 200
+	Timeout      int      `json:"timeout"`        // Milliseconds to keep tapping, default 60000
+	Settle       int      `json:"settle"`         // Milliseconds a new picture may keep changing before it counts as the reference, default 1500
+	StopOnChange *bool    `json:"stop_on_change"` // Stop when the screen changes, default true
+}
+
+// BootKeyStatus is the progress or result of a boot key job
+type BootKeyStatus struct {
+	State      string   `json:"state"`
+	Result     string   `json:"result,omitempty"`
+	Keys       []string `json:"keys"`
+	PoweredOn  bool     `json:"powered_on"`
+	AlreadyOn  bool     `json:"already_on,omitempty"` // Power was not pressed, the PWR LED showed the target running
+	Taps       int      `json:"taps"`
+	StartedAt  int64    `json:"started_at"`            // Unix time in milliseconds
+	FinishedAt int64    `json:"finished_at,omitempty"` // Unix time in milliseconds
+	Error      string   `json:"error,omitempty"`
+}
+
+// bootKeyJob is a running or finished boot key helper run on one instance
+type bootKeyJob struct {
+	status       BootKeyStatus
+	controlToken string // Control token of the HID session the job was started from, it must keep input control
+	cancel       context.CancelFunc
+	done         chan struct{}
+	mu           sync.Mutex
+}
+
+func (j *bootKeyJob) Status() BootKeyStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	status := j.status
+	status.Keys = append([]string{}, j.status.Keys...)
+	return status
+}
+
+func (j *bootKeyJob) update(fn func(s *BootKeyStatus)) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	fn(&j.status)
+}
+
+// screenChangeDetector tracks frame signatures to tell when the firmware screen changes
+type screenChangeDetector struct {
+	reference   usbcapture.FrameSignature
+	referenceAt time.Time
+	settle      time.Duration
+}
+
+// Feed adds a frame signature and reports if the screen changed from the reference
+func (d *screenChangeDetector) Feed(sig usbcapture.FrameSignature, now time.Time) bool {
+	if sig.IsBlack() {
+		// Power on, reboot or resolution change, wait for the next picture
+		d.reference = nil
+		return false
+	}
+	if d.reference == nil {
+		d.reference = sig
+		d.referenceAt = now
+		return false
+	}
+	if sig.Difference(d.reference) < bootKeyScreenThreshold {
+		return false
+	}
+	if now.Sub(d.referenceAt) < d.settle {
+		// The picture is still settling, e.g. a fading logo
+		d.reference = sig
+		d.referenceAt = now
+		return false
+	}
+	return true
+}
+
+// StartBootKeyJob starts the boot key helper on the instance
+func (i *UsbKvmDeviceInstance) StartBootKeyJob(opts BootKeyOptions, controlToken string) (*bootKeyJob, error) {
+	keys := opts.Keys
+	if len(keys) == 0 {
+		keys = []string{"Delete", "F2"}
+	}
+	for _, key := range keys {
+		if _, err := kvmhid.ParseKeyName(key); err != nil {
+			return nil, err
+		}
+	}
+	timeout, err := parseDurationMs(opts.Timeout, DefaultBootKeyTimeout, MaxBootKeyTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("invalid timeout: %v", err)
+	}
+	interval, err := parseDurationMs(opts.Interval, DefaultBootKeyInterval, kvmhid.MaxKeyChordDuration)
+	if err != nil || interval < MinBootKeyInterval {
+		return nil, errors.New("invalid interval")
+	}
+	powerHold, err := parseDurationMs(opts.PowerHold, DefaultBootKeyPowerHold, MaxBootKeyPowerHold)
+	if err != nil {
+		return nil, fmt.Errorf("invalid power hold time: %v", err)
+	}
+	settle, err := parseDurationMs(opts.Settle, DefaultBootKeySettle, MaxBootKeyTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("invalid settle time: %v", err)
+	}
+	stopOnChange := opts.StopOnChange == nil || *opts.StopOnChange
+	if opts.PowerOn && i.auxMCUController == nil {
+		return nil, errors.New("auxiliary MCU controller not initialized or missing, cannot press power")
+	}
+	if opts.PowerOn && i.powerLED() == nil {
+		return nil, ErrNoPowerLED
+	}
+	if err := i.usbKVMController.CheckControl(controlToken); err != nil {
+		return nil, err
+	}
+	if opts.PowerOn {
+		// Fail right away rather than in the job if the ATX buttons are in use
+		i.powerMu.Lock()
+		action := i.powerAction
+		i.powerMu.Unlock()
+		if action != "" {
+			return nil, fmt.Errorf("%w: %s", ErrPowerActionBusy, action)
+		}
+	}
+
+	i.bootKeyMu.Lock()
+	defer i.bootKeyMu.Unlock()
+	if i.bootKeyJob != nil && i.bootKeyJob.Status().State == BootKeyStateRunning {
+		return nil, ErrBootKeyBusy
+	}
+	endInputJob, err := i.usbKVMController.BeginInputJob("boot keys")
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout+powerHold)
+	job := &bootKeyJob{
+		status: BootKeyStatus{
+			State:     BootKeyStateRunning,
+			Keys:      keys,
+			StartedAt: time.Now().UnixMilli(),
+		},
+		controlToken: controlToken,
+		cancel:       cancel,
+		done:         make(chan struct{}),
+	}
+	i.bootKeyJob = job
+
+	go func() {
+		defer close(job.done)
+		defer cancel()
+		result, err := i.runBootKeyJob(ctx, job, keys, opts.PowerOn, powerHold, interval, settle, stopOnChange)
+		job.update(func(s *BootKeyStatus) {
+			// Free the controller before the job shows as finished, so a new job can start right away
+			endInputJob()
+			s.FinishedAt = time.Now().UnixMilli()
+			switch {
+			case err == nil:
+				s.State = BootKeyStateDone
+				s.Result = result
+			case errors.Is(err, context.Canceled):
+				s.State = BootKeyStateCancelled
+			default:
+				s.State = BootKeyStateFailed
+				s.Error = err.Error()
+			}
+		})
+		status := job.Status()
+		log.Printf("Boot key job on instance %s finished: %s %s after %d taps", i.uuid, status.State, status.Result, status.Taps)
+	}()
+	return job, nil
+}
+
+// runBootKeyJob presses power if asked and taps the keys until the screen changes or the context ends
+func (i *UsbKvmDeviceInstance) runBootKeyJob(ctx context.Context, job *bootKeyJob, keys []string, powerOn bool, powerHold, interval, settle time.Duration, stopOnChange bool) (string, error) {
+	if powerOn {
+		// A short press on a running target asks it to shut down
+		led := i.powerLED()
+		switch {
+		case led == nil:
+			return "", ErrNoPowerLED
+		case *led:
+			job.update(func(s *BootKeyStatus) { s.AlreadyOn = true })
+		default:
+			if err := i.pressPowerButton(ctx, powerHold); err != nil {
+				return "", err
+			}
+			job.update(func(s *BootKeyStatus) { s.PoweredOn = true })
+		}
+	}
+
+	detector := &screenChangeDetector{settle: settle}
+	var lastCheck time.Time
+	for tap := 0; ; tap++ {
+		// Stop tapping once another session takes input control
+		if err := i.usbKVMController.CheckControl(job.controlToken); err != nil {
+			return "", err
+		}
+		key := keys[tap%len(keys)]
+		err := i.usbKVMController.SendKeyChords(ctx, []kvmhid.KeyChord{{Keys: []string{key}, Hold: bootKeyTapHold}})
+		if err != nil && ctx.Err() == nil {
+			return "", err
+		}
+		job.update(func(s *BootKeyStatus) { s.Taps++ })
+
+		if stopOnChange && i.usbCaptureDevice != nil && time.Since(lastCheck) >= bootKeyFrameCheckInterval {
+			lastCheck = time.Now()
+			if frame, err := i.usbCaptureDevice.CaptureFrame(interval); err == nil {
+				if sig, err := usbcapture.NewFrameSignature(frame); err == nil && detector.Feed(sig, lastCheck) {
+					return BootKeyResultScreenChanged, nil
+				}
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return BootKeyResultTimeout, nil
+			}
+			return "", ctx.Err()
+		case <-time.After(interval):
+		}
+	}
+}
+
+// pressPowerButton presses the power button for the given time, it is released even if the context ends early
+func (i *UsbKvmDeviceInstance) pressPowerButton(ctx context.Context, hold time.Duration) error {
+	ctx, end, err := i.beginPowerAction(ctx, "boot_key")
+	if err != nil {
+		return err
+	}
+	defer end()
+	return pressATXButton(ctx, "power", i.auxMCUController.PressPowerButton, i.auxMCUController.ReleasePowerButton, hold)
+}
+
+// HandleStartBootKey starts the boot key helper on the given instance
+// Accept a JSON body with the BootKeyOptions fields, all optional, only from the session holding input control
+func (d *DezukVM) HandleStartBootKey(w http.ResponseWriter, r *http.Request, instanceUuid string) {
+	targetInstance, err := d.GetInstanceByUUID(instanceUuid)
+	if err != nil {
+		http.Error(w, "Instance with specified UUID not found", http.StatusNotFound)
+		return
+	}
+	var opts BootKeyOptions
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&opts); err != nil {
+			http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+			return
+		}
+	}
+	job, err := targetInstance.StartBootKeyJob(opts, kvmhid.RequestControlToken(r))
+	if err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, ErrBootKeyBusy) || errors.Is(err, ErrPowerActionBusy) ||
+			errors.Is(err, kvmhid.ErrNoInputControl) || errors.Is(err, kvmhid.ErrInputJobBusy) {
+			status = http.StatusConflict
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	d.auditAction(targetInstance.UUID(), r, "boot_key")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(job.Status())
+}
+
+// HandleBootKeyStatus returns the progress or result of the last boot key job on the given instance
+func (d *DezukVM) HandleBootKeyStatus(w http.ResponseWriter, r *http.Request, instanceUuid string) {
+	targetInstance, err := d.GetInstanceByUUID(instanceUuid)
+	if err != nil {
+		http.Error(w, "Instance with specified UUID not found", http.StatusNotFound)
+		return
+	}
+	targetInstance.bootKeyMu.Lock()
+	job := targetInstance.bootKeyJob
+	targetInstance.bootKeyMu.Unlock()
+	if job == nil {
+		http.Error(w, "No boot key job found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(job.Status())
+}
+
+// HandleCancelBootKey cancels the boot key job running on the given instance, only from the session holding input control
+func (d *DezukVM) HandleCancelBootKey(w http.ResponseWriter, r *http.Request, instanceUuid string) {
+	targetInstance, err := d.GetInstanceByUUID(instanceUuid)
+	if err != nil {
+		http.Error(w, "Instance with specified UUID not found", http.StatusNotFound)
+		return
+	}
+	if err := targetInstance.usbKVMController.CheckControl(kvmhid.RequestControlToken(r)); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	targetInstance.bootKeyMu.Lock()
+	job := targetInstance.bootKeyJob
+	targetInstance.bootKeyMu.Unlock()
+	if job == nil {
+		http.Error(w, "No boot key job found", http.StatusNotFound)
+		return
+	}
+	job.cancel()
+	<-job.done
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(job.Status())
+}
@@ -0,0 +1,212 @@
+package dezukvm
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"imuslab.com/dezukvm/dezukvmd/mod/kvmhid"
+	"imuslab.com/dezukvm/dezukvmd/mod/usbcapture"
+)
+
+/*
+	calibration.go
+
+	Absolute pointer calibration of USB KVM instances. The active picture
+	area inside the captured video is either set by hand, computed from the
+	target resolution, or detected from captured frames. Calibrations are
+	stored in the system database by instance UUID, so they survive restarts
+	as long as the instance UUID comes from the AuxMCU.
+*/
+
+const (
+	pointerCalibrationBucket = "pointer_calibration"
+	autoCalibrationInterval  = 5 * time.Second // Interval between picture area detections in auto mode
+	autoCalibrationTolerance = 0.005           // Ignore detected area changes smaller than this fraction of the frame
+	calibrationFrameTimeout  = 2 * time.Second
+)
+
+// initCalibrationStore creates the calibration bucket if a database is configured
+func (d *DezukVM) initCalibrationStore() error {
+	if d.option == nil || d.option.Database == nil {
+		return nil
+	}
+	return d.option.Database.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte(pointerCalibrationBucket))
+		return err
+	})
+}
+
+// loadPointerCalibration applies the stored calibration of this instance to its HID controller
+func (i *UsbKvmDeviceInstance) loadPointerCalibration() {
+	db := i.database()
+	if db == nil {
+		return
+	}
+	var cal *kvmhid.PointerCalibration
+	err := db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket([]byte(pointerCalibrationBucket)).Get([]byte(i.uuid))
+		if data == nil {
+			return nil
+		}
+		cal = &kvmhid.PointerCalibration{}
+		return json.Unmarshal(data, cal)
+	})
+	if err != nil {
+		log.Printf("Failed to load pointer calibration of instance %s: %v", i.uuid, err)
+		return
+	}
+	if cal == nil {
+		return
+	}
+	if err := i.usbKVMController.SetPointerCalibration(*cal); err != nil {
+		log.Printf("Ignoring invalid pointer calibration of instance %s: %v", i.uuid, err)
+	}
+}
+
+// savePointerCalibration applies a calibration and stores it for this instance
+func (i *UsbKvmDeviceInstance) savePointerCalibration(cal kvmhid.PointerCalibration) error {
+	if err := i.usbKVMController.SetPointerCalibration(cal); err != nil {
+		return err
+	}
+	db := i.database()
+	if db == nil {
+		return nil
+	}
+	data, err := json.Marshal(i.usbKVMController.GetPointerCalibration())
+	if err != nil {
+		return err
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(pointerCalibrationBucket)).Put([]byte(i.uuid), data)
+	})
+}
+
+// detectPointerCalibration detects the active picture area from a captured frame
+func (i *UsbKvmDeviceInstance) detectPointerCalibration() (kvmhid.PointerCalibration, error) {
+	if i.usbCaptureDevice == nil {
+		return kvmhid.PointerCalibration{}, errors.New("video capture device not started")
+	}
+	frame, err := i.usbCaptureDevice.CaptureFrame(calibrationFrameTimeout)
+	if err != nil {
+		return kvmhid.PointerCalibration{}, err
+	}
+	area, size, err := usbcapture.DetectActiveArea(frame)
+	if err != nil {
+		return kvmhid.PointerCalibration{}, err
+	}
+	return kvmhid.NewAreaCalibration(kvmhid.PointerCalibrationAuto, size.X, size.Y, area.Min.X, area.Min.Y, area.Dx(), area.Dy())
+}
+
+// runAutoCalibration keeps the detected picture area up to date while the
+// instance is in auto calibration mode, e.g. when the target switches from a
+// 4:3 BIOS screen to a 16:9 desktop
+func (i *UsbKvmDeviceInstance) runAutoCalibration(stop chan struct{}) {
+	ticker := time.NewTicker(autoCalibrationInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		current := i.usbKVMController.GetPointerCalibration()
+		if current.Mode != kvmhid.PointerCalibrationAuto {
+			continue
+		}
+		detected, err := i.detectPointerCalibration()
+		if err != nil {
+			// Black or missing frames, keep the last detected area
+			continue
+		}
+		if calibrationAreaEqual(current, detected) {
+			continue
+		}
+		log.Printf("Picture area of instance %s changed to %.3f,%.3f %.3fx%.3f", i.uuid, detected.Left, detected.Top, detected.Width, detected.Height)
+		if err := i.savePointerCalibration(detected); err != nil {
+			log.Printf("Failed to save pointer calibration of instance %s: %v", i.uuid, err)
+		}
+	}
+}
+
+func (i *UsbKvmDeviceInstance) database() *bolt.DB {
+	if i.parent == nil || i.parent.option == nil {
+		return nil
+	}
+	return i.parent.option.Database
+}
+
+// calibrationAreaEqual checks if two calibrations have about the same active area
+func calibrationAreaEqual(a, b kvmhid.PointerCalibration) bool {
+	return math.Abs(a.Left-b.Left) < autoCalibrationTolerance &&
+		math.Abs(a.Top-b.Top) < autoCalibrationTolerance &&
+		math.Abs(a.Width-b.Width) < autoCalibrationTolerance &&
+		math.Abs(a.Height-b.Height) < autoCalibrationTolerance
+}
+
+// HandleGetPointerCalibration returns the absolute pointer calibration of the given instance
+func (d *DezukVM) HandleGetPointerCalibration(w http.ResponseWriter, r *http.Request, instanceUuid string) {
+	targetInstance, err := d.GetInstanceByUUID(instanceUuid)
+	if err != nil {
+		http.Error(w, "Instance with specified UUID not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(targetInstance.usbKVMController.GetPointerCalibration())
+}
+
+// HandleSetPointerCalibration sets the absolute pointer calibration of the given instance.
+// Accept a JSON body with mode set to one of
+//   - none: the picture fills the whole video frame
+//   - manual: left, top, width and height of the picture as fractions of the frame
+//   - resolution: target_width and target_height of the target screen
+//   - auto: detect the picture area from the video now and whenever it changes
+func (d *DezukVM) HandleSetPointerCalibration(w http.ResponseWriter, r *http.Request, instanceUuid string) {
+	targetInstance, err := d.GetInstanceByUUID(instanceUuid)
+	if err != nil {
+		http.Error(w, "Instance with specified UUID not found", http.StatusNotFound)
+		return
+	}
+
+	var req kvmhid.PointerCalibration
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+
+	cal := req
+	switch req.Mode {
+	case kvmhid.PointerCalibrationNone:
+		cal = kvmhid.DefaultPointerCalibration()
+	case kvmhid.PointerCalibrationManual:
+		cal.TargetWidth, cal.TargetHeight = 0, 0
+		cal.UpdatedAt = time.Now().UnixMilli()
+	case kvmhid.PointerCalibrationResolution:
+		res := targetInstance.videoResoltuionConfig
+		cal, err = kvmhid.NewResolutionCalibration(res.Width, res.Height, req.TargetWidth, req.TargetHeight)
+	case kvmhid.PointerCalibrationAuto:
+		cal, err = targetInstance.detectPointerCalibration()
+		if err != nil {
+			http.Error(w, "Failed to detect picture area: "+err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+	default:
+		http.Error(w, "Invalid calibration mode", http.StatusBadRequest)
+		return
+	}
+	if err == nil {
+		err = targetInstance.savePointerCalibration(cal)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(targetInstance.usbKVMController.GetPointerCalibration())
+}
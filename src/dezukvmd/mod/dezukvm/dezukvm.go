@@ -2,17 +2,29 @@ package dezukvm
 
 import (
 	"errors"
+	"fmt"
+	"log"
+	"time"
 
+	"imuslab.com/dezukvm/dezukvmd/mod/kvmscript"
 	"imuslab.com/dezukvm/dezukvmd/mod/usbcapture"
 )
 
 // NewKvmHostInstance creates a new instance of DezukVM, which can manage multiple USB KVM devices.
 func NewKvmHostInstance(option *RuntimeOptions) *DezukVM {
-	return &DezukVM{
+	d := &DezukVM{
 		UsbKvmInstance: []*UsbKvmDeviceInstance{},
 		occupiedUUIDs:  make(map[string]bool),
 		option:         option,
+		scriptRunner:   kvmscript.NewRunner(),
 	}
+	if err := d.initCalibrationStore(); err != nil {
+		log.Println("Failed to initialize pointer calibration store: " + err.Error())
+	}
+	if err := d.initInputAudit(); err != nil {
+		log.Println("Failed to initialize input audit log: " + err.Error())
+	}
+	return d
 }
 
 // AddUsbKvmDevice adds a new USB KVM device instance to the DezukVM manager.
@@ -136,5 +148,25 @@ func (d *DezukVM) GetInstanceByUUID(uuid string) (*UsbKvmDeviceInstance, error)
 }
 
 func (d *DezukVM) Close() error {
-	return d.StopAllUsbKvmDevices()
+	err := d.StopAllUsbKvmDevices()
+	if d.audit != nil {
+		d.audit.Close()
+	}
+	return err
+}
+
+// parseDurationMs converts an optional millisecond API parameter into a duration.
+// 0 means def, the caller sets the longest allowed duration with max.
+func parseDurationMs(ms int, def time.Duration, max time.Duration) (time.Duration, error) {
+	if ms < 0 {
+		return 0, errors.New("must not be negative")
+	}
+	if ms == 0 {
+		return def, nil
+	}
+	d := time.Duration(ms) * time.Millisecond
+	if d > max {
+		return 0, fmt.Errorf("must not be longer than %v", max)
+	}
+	return d, nil
 }
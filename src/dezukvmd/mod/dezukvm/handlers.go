@@ -3,6 +3,8 @@ package dezukvm
 import (
 	"encoding/json"
 	"net/http"
+
+	"imuslab.com/dezukvm/dezukvmd/mod/kvmaux"
 )
 
 func (d *DezukVM) HandleVideoStreams(w http.ResponseWriter, r *http.Request, instanceUuid string) {
@@ -33,6 +35,217 @@ func (d *DezukVM) HandleHIDEvents(w http.ResponseWriter, r *http.Request, instan
 	targetInstance.usbKVMController.HIDWebSocketHandler(w, r)
 }
 
+// HandleTypeText starts typing text on the target of the given instance
+func (d *DezukVM) HandleTypeText(w http.ResponseWriter, r *http.Request, instanceUuid string) {
+	targetInstance, err := d.GetInstanceByUUID(instanceUuid)
+	if err != nil {
+		http.Error(w, "Instance with specified UUID not found", http.StatusNotFound)
+		return
+	}
+	d.auditAction(targetInstance.UUID(), r, "type_text")
+	targetInstance.usbKVMController.HandleTypeText(w, r)
+}
+
+// HandleTypeTextStatus returns the progress of the text typing job of the given instance
+func (d *DezukVM) HandleTypeTextStatus(w http.ResponseWriter, r *http.Request, instanceUuid string) {
+	targetInstance, err := d.GetInstanceByUUID(instanceUuid)
+	if err != nil {
+		http.Error(w, "Instance with specified UUID not found", http.StatusNotFound)
+		return
+	}
+	targetInstance.usbKVMController.HandleTypeTextStatus(w, r)
+}
+
+// HandleCancelTypeText cancels the text typing job of the given instance
+func (d *DezukVM) HandleCancelTypeText(w http.ResponseWriter, r *http.Request, instanceUuid string) {
+	targetInstance, err := d.GetInstanceByUUID(instanceUuid)
+	if err != nil {
+		http.Error(w, "Instance with specified UUID not found", http.StatusNotFound)
+		return
+	}
+	targetInstance.usbKVMController.HandleCancelTypeText(w, r)
+}
+
+// HandleControlState returns the HID input ownership of the given instance
+func (d *DezukVM) HandleControlState(w http.ResponseWriter, r *http.Request, instanceUuid string) {
+	targetInstance, err := d.GetInstanceByUUID(instanceUuid)
+	if err != nil {
+		http.Error(w, "Instance with specified UUID not found", http.StatusNotFound)
+		return
+	}
+	targetInstance.usbKVMController.HandleControlState(w, r)
+}
+
+// HandleReleaseAll releases every key and mouse button held on the target of the given instance
+func (d *DezukVM) HandleReleaseAll(w http.ResponseWriter, r *http.Request, instanceUuid string) {
+	targetInstance, err := d.GetInstanceByUUID(instanceUuid)
+	if err != nil {
+		http.Error(w, "Instance with specified UUID not found", http.StatusNotFound)
+		return
+	}
+	d.auditAction(targetInstance.UUID(), r, "release_all")
+	targetInstance.usbKVMController.HandleReleaseAll(w, r)
+}
+
+// HandleCommandMetrics returns or clears the HID command latency and error metrics of the given instance
+func (d *DezukVM) HandleCommandMetrics(w http.ResponseWriter, r *http.Request, instanceUuid string) {
+	targetInstance, err := d.GetInstanceByUUID(instanceUuid)
+	if err != nil {
+		http.Error(w, "Instance with specified UUID not found", http.StatusNotFound)
+		return
+	}
+	targetInstance.usbKVMController.HandleCommandMetrics(w, r)
+}
+
+// HandleMediaKey presses a multimedia or ACPI system key on the target of the given instance
+func (d *DezukVM) HandleMediaKey(w http.ResponseWriter, r *http.Request, instanceUuid string) {
+	targetInstance, err := d.GetInstanceByUUID(instanceUuid)
+	if err != nil {
+		http.Error(w, "Instance with specified UUID not found", http.StatusNotFound)
+		return
+	}
+	d.auditAction(targetInstance.UUID(), r, "media_key")
+	targetInstance.usbKVMController.HandleMediaKey(w, r)
+}
+
+// HandleSendKeys sends a sequence of key chords to the given instance
+func (d *DezukVM) HandleSendKeys(w http.ResponseWriter, r *http.Request, instanceUuid string) {
+	targetInstance, err := d.GetInstanceByUUID(instanceUuid)
+	if err != nil {
+		http.Error(w, "Instance with specified UUID not found", http.StatusNotFound)
+		return
+	}
+	d.auditAction(targetInstance.UUID(), r, "send_keys")
+	targetInstance.usbKVMController.HandleSendKeys(w, r)
+}
+
+// HandleListMediaKeys lists the multimedia and system keys supported by the given instance
+func (d *DezukVM) HandleListMediaKeys(w http.ResponseWriter, r *http.Request, instanceUuid string) {
+	targetInstance, err := d.GetInstanceByUUID(instanceUuid)
+	if err != nil {
+		http.Error(w, "Instance with specified UUID not found", http.StatusNotFound)
+		return
+	}
+	targetInstance.usbKVMController.HandleListMediaKeys(w, r)
+}
+
+// HandleGetChipConfig returns the HID chip configuration of the given instance
+func (d *DezukVM) HandleGetChipConfig(w http.ResponseWriter, r *http.Request, instanceUuid string) {
+	targetInstance, err := d.GetInstanceByUUID(instanceUuid)
+	if err != nil {
+		http.Error(w, "Instance with specified UUID not found", http.StatusNotFound)
+		return
+	}
+	targetInstance.usbKVMController.HandleGetChipConfig(w, r)
+}
+
+// HandleSetChipConfig updates the HID chip configuration of the given instance
+func (d *DezukVM) HandleSetChipConfig(w http.ResponseWriter, r *http.Request, instanceUuid string) {
+	targetInstance, err := d.GetInstanceByUUID(instanceUuid)
+	if err != nil {
+		http.Error(w, "Instance with specified UUID not found", http.StatusNotFound)
+		return
+	}
+	targetInstance.usbKVMController.HandleSetChipConfig(w, r)
+}
+
+// HandleMacroRecord starts or stops recording a HID macro on the given instance
+func (d *DezukVM) HandleMacroRecord(w http.ResponseWriter, r *http.Request, instanceUuid string, start bool) {
+	targetInstance, err := d.GetInstanceByUUID(instanceUuid)
+	if err != nil {
+		http.Error(w, "Instance with specified UUID not found", http.StatusNotFound)
+		return
+	}
+	if d.option.MacroManager == nil {
+		http.Error(w, "Macro manager not initialized", http.StatusInternalServerError)
+		return
+	}
+	if start {
+		d.option.MacroManager.HandleStartRecording(w, r, targetInstance.UUID(), targetInstance.usbKVMController)
+	} else {
+		d.option.MacroManager.HandleStopRecording(w, r, targetInstance.UUID())
+	}
+}
+
+// HandleMacroPlay plays a stored HID macro on the given instance
+func (d *DezukVM) HandleMacroPlay(w http.ResponseWriter, r *http.Request, instanceUuid string) {
+	targetInstance, err := d.GetInstanceByUUID(instanceUuid)
+	if err != nil {
+		http.Error(w, "Instance with specified UUID not found", http.StatusNotFound)
+		return
+	}
+	if d.option.MacroManager == nil {
+		http.Error(w, "Macro manager not initialized", http.StatusInternalServerError)
+		return
+	}
+	d.auditAction(targetInstance.UUID(), r, "macro_play")
+	d.option.MacroManager.HandlePlay(w, r, targetInstance.UUID(), targetInstance.usbKVMController)
+}
+
+// HandleMacroAbort aborts the HID macro playing on the given instance
+func (d *DezukVM) HandleMacroAbort(w http.ResponseWriter, r *http.Request, instanceUuid string) {
+	targetInstance, err := d.GetInstanceByUUID(instanceUuid)
+	if err != nil {
+		http.Error(w, "Instance with specified UUID not found", http.StatusNotFound)
+		return
+	}
+	if d.option.MacroManager == nil {
+		http.Error(w, "Macro manager not initialized", http.StatusInternalServerError)
+		return
+	}
+	d.option.MacroManager.HandleAbort(w, r, targetInstance.UUID(), targetInstance.usbKVMController)
+}
+
+// HandleMacroStatus returns the macro recording and playback status of the given instance
+func (d *DezukVM) HandleMacroStatus(w http.ResponseWriter, r *http.Request, instanceUuid string) {
+	targetInstance, err := d.GetInstanceByUUID(instanceUuid)
+	if err != nil {
+		http.Error(w, "Instance with specified UUID not found", http.StatusNotFound)
+		return
+	}
+	if d.option.MacroManager == nil {
+		http.Error(w, "Macro manager not initialized", http.StatusInternalServerError)
+		return
+	}
+	d.option.MacroManager.HandlePlaybackStatus(w, r, targetInstance.UUID())
+}
+
+// HandleRunScript starts running a DuckyScript payload on the given instance
+func (d *DezukVM) HandleRunScript(w http.ResponseWriter, r *http.Request, instanceUuid string) {
+	targetInstance, err := d.GetInstanceByUUID(instanceUuid)
+	if err != nil {
+		http.Error(w, "Instance with specified UUID not found", http.StatusNotFound)
+		return
+	}
+	d.auditAction(targetInstance.UUID(), r, "run_script")
+	d.scriptRunner.HandleRunScript(w, r, targetInstance.UUID(), targetInstance.usbKVMController)
+}
+
+// HandleScriptStatus returns the status of the DuckyScript job on the given instance
+func (d *DezukVM) HandleScriptStatus(w http.ResponseWriter, r *http.Request, instanceUuid string) {
+	targetInstance, err := d.GetInstanceByUUID(instanceUuid)
+	if err != nil {
+		http.Error(w, "Instance with specified UUID not found", http.StatusNotFound)
+		return
+	}
+	d.scriptRunner.HandleScriptStatus(w, r, targetInstance.UUID())
+}
+
+// HandleCancelScript cancels the DuckyScript job on the given instance
+func (d *DezukVM) HandleCancelScript(w http.ResponseWriter, r *http.Request, instanceUuid string) {
+	targetInstance, err := d.GetInstanceByUUID(instanceUuid)
+	if err != nil {
+		http.Error(w, "Instance with specified UUID not found", http.StatusNotFound)
+		return
+	}
+	d.scriptRunner.HandleCancelScript(w, r, targetInstance.UUID(), targetInstance.usbKVMController)
+}
+
+// HandleValidateScript checks a DuckyScript payload for errors without running it
+func (d *DezukVM) HandleValidateScript(w http.ResponseWriter, r *http.Request) {
+	d.scriptRunner.HandleValidateScript(w, r)
+}
+
 // HandleMassStorageSideSwitch handles the request to switch the USB mass storage side.
 // there is only two state for the USB mass storage side, KVM side or Remote side.
 // isKvmSide = true means switch to KVM side, otherwise switch to Remote side.
@@ -59,9 +272,45 @@ func (d *DezukVM) HandleMassStorageSideSwitch(w http.ResponseWriter, r *http.Req
 	w.Write([]byte("OK"))
 }
 
+// HandleAuxStatus returns the ATX power / HDD LED and USB mass storage side reported by the aux MCU
+func (d *DezukVM) HandleAuxStatus(w http.ResponseWriter, r *http.Request, instanceUuid string) {
+	targetInstance, err := d.GetInstanceByUUID(instanceUuid)
+	if err != nil {
+		http.Error(w, "Instance with specified UUID not found", http.StatusNotFound)
+		return
+	}
+	if targetInstance.auxMCUController == nil {
+		http.Error(w, "Auxiliary MCU controller not initialized or missing", http.StatusNotFound)
+		return
+	}
+	targetInstance.auxMCUController.HandleGetStatus(w, r)
+}
+
+// HandleAuxStatusEvents pushes aux MCU status changes over a websocket
+func (d *DezukVM) HandleAuxStatusEvents(w http.ResponseWriter, r *http.Request, instanceUuid string) {
+	targetInstance, err := d.GetInstanceByUUID(instanceUuid)
+	if err != nil {
+		http.Error(w, "Instance with specified UUID not found", http.StatusNotFound)
+		return
+	}
+	if targetInstance.auxMCUController == nil {
+		http.Error(w, "Auxiliary MCU controller not initialized or missing", http.StatusNotFound)
+		return
+	}
+	targetInstance.auxMCUController.HandleStatusWebSocket(w, r)
+}
+
 func (d *DezukVM) HandleListInstances(w http.ResponseWriter, r *http.Request) {
 	instances := []map[string]interface{}{}
 	for _, instance := range d.UsbKvmInstance {
+		// Instances without an aux MCU have no side and no ATX status
+		var usbMassStorageSide interface{}
+		var auxStatus *kvmaux.AuxStatus
+		if instance.auxMCUController != nil {
+			usbMassStorageSide = instance.auxMCUController.GetUSBMassStorageSide()
+			status := instance.auxMCUController.GetStatus()
+			auxStatus = &status
+		}
 		instances = append(instances, map[string]interface{}{
 			"uuid":                    instance.UUID(),
 			"video_capture_dev":       instance.Config.VideoCaptureDevicePath,
@@ -74,7 +323,13 @@ func (d *DezukVM) HandleListInstances(w http.ResponseWriter, r *http.Request) {
 			"stream_info":             instance.usbCaptureDevice.GetStreamInfo(),
 			"usb_kvm_device":          instance.Config.USBKVMDevicePath,
 			"aux_mcu_device":          instance.Config.AuxMCUDevicePath,
-			"usb_mass_storage_side":   instance.auxMCUController.GetUSBMassStorageSide(),
+			"usb_mass_storage_side":   usbMassStorageSide,
+			"aux_status":              auxStatus,
+			"hid_backend":             instance.usbKVMController.BackendName(),
+			"hid_status":              instance.usbKVMController.GetChipStatus(),
+			"hid_connection":          instance.usbKVMController.GetConnectionStatus(),
+			"pointer_calibration":     instance.usbKVMController.GetPointerCalibration(),
+			"capture_recovery":        instance.GetCaptureRecoveryStatus(),
 		})
 	}
 	w.Header().Set("Content-Type", "application/json")
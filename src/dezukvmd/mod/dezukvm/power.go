@@ -0,0 +1,339 @@
+package dezukvm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+/*
+	power.go
+
+	ATX power actions through the AuxMCU:
+
+	short: Press power briefly, powers on or asks the OS to shut down
+	long:  Hold power until the board forces the target off
+	reset: Pulse the reset button
+	cycle: Force off, wait, then power on again
+
+	Buttons are always released, even if a press fails or the instance is
+	stopped during the hold. Only one action that presses an ATX button
+	runs per instance at a time, including the power on of the boot key
+	helper. If the firmware reports the PWR LED (see kvmaux/status.go),
+	the result is checked against it.
+*/
+
+// ATX power actions
+const (
+	PowerActionShort = "short"
+	PowerActionLong  = "long"
+	PowerActionReset = "reset"
+	PowerActionCycle = "cycle"
+)
+
+const (
+	DefaultPowerShortHold     = 500 * time.Millisecond
+	DefaultPowerLongHold      = 5 * time.Second
+	DefaultResetHold          = 200 * time.Millisecond
+	DefaultPowerCycleOffDelay = 5 * time.Second
+	DefaultPowerVerifyTimeout = 10 * time.Second
+	MaxPowerHold              = 15 * time.Second
+	MaxPowerCycleOffDelay     = time.Minute
+	MaxPowerVerifyTimeout     = time.Minute
+	powerLEDPollInterval      = 100 * time.Millisecond
+	atxReleaseRetries         = 3 // Extra attempts to release a button if the release command fails
+)
+
+// ErrPowerActionBusy is returned when another action is pressing an ATX button on the instance
+var ErrPowerActionBusy = errors.New("another power action is running on this instance")
+
+// PowerActionOptions configures a power action, all durations in milliseconds and optional
+type PowerActionOptions struct {
+	Hold          int `json:"hold"`           // Time to hold the button, default 500 for short, 5000 for long and 200 for reset. Power on press of a cycle.
+	OffHold       int `json:"off_hold"`       // Time to hold power to force the target off in a cycle, default 5000
+	OffDelay      int `json:"off_delay"`      // Time to stay off in a cycle, default 5000
+	VerifyTimeout int `json:"verify_timeout"` // Time to wait for the PWR LED to change, default 10000
+}
+
+// PowerActionResult is the outcome of a power action
+type PowerActionResult struct {
+	Action         string `json:"action"`
+	PowerLEDBefore *bool  `json:"power_led_before,omitempty"` // Not set if the board does not report the PWR LED
+	PowerLEDAfter  *bool  `json:"power_led_after,omitempty"`
+	Verified       *bool  `json:"verified,omitempty"` // PWR LED ended up as expected, not set if it cannot be checked
+	StartedAt      int64  `json:"started_at"`         // Unix time in milliseconds
+	FinishedAt     int64  `json:"finished_at"`        // Unix time in milliseconds
+	Error          string `json:"error,omitempty"`
+}
+
+// beginPowerAction reserves the ATX buttons of the instance for an action. The returned
+// context is cancelled when the instance stops, end must be called once the buttons are released.
+func (i *UsbKvmDeviceInstance) beginPowerAction(parent context.Context, action string) (context.Context, func(), error) {
+	if i.auxMCUController == nil {
+		return nil, nil, errors.New("auxiliary MCU controller not initialized or missing")
+	}
+	i.powerMu.Lock()
+	defer i.powerMu.Unlock()
+	if i.powerAction != "" {
+		return nil, nil, fmt.Errorf("%w: %s", ErrPowerActionBusy, i.powerAction)
+	}
+	ctx, cancel := context.WithCancel(parent)
+	done := make(chan struct{})
+	i.powerAction = action
+	i.powerCancel = cancel
+	i.powerDone = done
+	end := func() {
+		cancel()
+		i.powerMu.Lock()
+		i.powerAction = ""
+		i.powerCancel = nil
+		i.powerDone = nil
+		i.powerMu.Unlock()
+		close(done)
+	}
+	return ctx, end, nil
+}
+
+// cancelPowerAction stops a running power action and waits for its buttons to be released
+func (i *UsbKvmDeviceInstance) cancelPowerAction() {
+	i.powerMu.Lock()
+	cancel, done := i.powerCancel, i.powerDone
+	i.powerMu.Unlock()
+	if cancel == nil {
+		return
+	}
+	cancel()
+	<-done
+}
+
+// RunningPowerAction returns the power action running on the instance, empty if none
+func (i *UsbKvmDeviceInstance) RunningPowerAction() string {
+	i.powerMu.Lock()
+	defer i.powerMu.Unlock()
+	return i.powerAction
+}
+
+// pressATXButton holds a button for the given time and always releases it, returns the context error if it ended early
+func pressATXButton(ctx context.Context, name string, press func() error, release func() error, hold time.Duration) error {
+	releaseButton := func() error {
+		var err error
+		for attempt := 0; attempt <= atxReleaseRetries; attempt++ {
+			if err = release(); err == nil {
+				return nil
+			}
+			if attempt < atxReleaseRetries {
+				time.Sleep(powerLEDPollInterval)
+			}
+		}
+		log.Printf("Failed to release the %s button: %v", name, err)
+		return fmt.Errorf("failed to release %s button: %v", name, err)
+	}
+
+	if err := press(); err != nil {
+		releaseButton()
+		return fmt.Errorf("failed to press %s button: %v", name, err)
+	}
+	select {
+	case <-ctx.Done():
+	case <-time.After(hold):
+	}
+	if err := releaseButton(); err != nil {
+		return err
+	}
+	return ctx.Err()
+}
+
+// powerLED returns the PWR LED state, nil if the board does not report it
+func (i *UsbKvmDeviceInstance) powerLED() *bool {
+	status := i.auxMCUController.GetStatus()
+	if !status.Available {
+		return nil
+	}
+	on := status.PowerLED
+	return &on
+}
+
+// waitPowerLED waits until the PWR LED is in the wanted state or the timeout passes,
+// it returns the last state, nil if the board does not report it
+func (i *UsbKvmDeviceInstance) waitPowerLED(ctx context.Context, want bool, timeout time.Duration) *bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		led := i.powerLED()
+		if led == nil || *led == want || time.Now().After(deadline) {
+			return led
+		}
+		select {
+		case <-ctx.Done():
+			return i.powerLED()
+		case <-time.After(powerLEDPollInterval):
+		}
+	}
+}
+
+// RunPowerAction runs an ATX power action and waits for it to finish
+func (i *UsbKvmDeviceInstance) RunPowerAction(action string, opts PowerActionOptions) (*PowerActionResult, error) {
+	defaultHold := DefaultPowerShortHold
+	switch action {
+	case PowerActionShort, PowerActionCycle:
+	case PowerActionLong:
+		defaultHold = DefaultPowerLongHold
+	case PowerActionReset:
+		defaultHold = DefaultResetHold
+	default:
+		return nil, fmt.Errorf("unknown power action: %s", action)
+	}
+	hold, err := parseDurationMs(opts.Hold, defaultHold, MaxPowerHold)
+	if err != nil {
+		return nil, fmt.Errorf("invalid hold time: %v", err)
+	}
+	offHold, err := parseDurationMs(opts.OffHold, DefaultPowerLongHold, MaxPowerHold)
+	if err != nil {
+		return nil, fmt.Errorf("invalid off hold time: %v", err)
+	}
+	offDelay, err := parseDurationMs(opts.OffDelay, DefaultPowerCycleOffDelay, MaxPowerCycleOffDelay)
+	if err != nil {
+		return nil, fmt.Errorf("invalid off delay: %v", err)
+	}
+	verifyTimeout, err := parseDurationMs(opts.VerifyTimeout, DefaultPowerVerifyTimeout, MaxPowerVerifyTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("invalid verify timeout: %v", err)
+	}
+
+	// Not bound to the request, a client going away must not cut a forced off short
+	ctx, end, err := i.beginPowerAction(context.Background(), action)
+	if err != nil {
+		return nil, err
+	}
+	defer end()
+
+	aux := i.auxMCUController
+	pressPower := func(hold time.Duration) error {
+		return pressATXButton(ctx, "power", aux.PressPowerButton, aux.ReleasePowerButton, hold)
+	}
+	result := &PowerActionResult{
+		Action:         action,
+		PowerLEDBefore: i.powerLED(),
+		StartedAt:      time.Now().UnixMilli(),
+	}
+	wasOn := result.PowerLEDBefore != nil && *result.PowerLEDBefore
+	wasOff := result.PowerLEDBefore != nil && !*result.PowerLEDBefore
+
+	// expect is the PWR LED state the action should end in, nil if it cannot be told
+	var expect *bool
+	switch action {
+	case PowerActionShort:
+		err = pressPower(hold)
+		if wasOff {
+			// Shutting down from a short press is up to the OS and may take any time
+			expect = boolPtr(true)
+		}
+	case PowerActionLong:
+		err = pressPower(hold)
+		expect = boolPtr(false)
+	case PowerActionReset:
+		err = pressATXButton(ctx, "reset", aux.PressResetButton, aux.ReleaseResetButton, hold)
+		if wasOn {
+			expect = boolPtr(true)
+		}
+	case PowerActionCycle:
+		if !wasOff {
+			err = pressPower(offHold)
+			if err == nil && result.PowerLEDBefore != nil {
+				if led := i.waitPowerLED(ctx, false, verifyTimeout); led != nil && *led {
+					err = errors.New("target did not power off")
+				}
+			}
+			if err == nil {
+				select {
+				case <-ctx.Done():
+					err = ctx.Err()
+				case <-time.After(offDelay):
+				}
+			}
+		}
+		if err == nil {
+			err = pressPower(hold)
+		}
+		expect = boolPtr(true)
+	}
+
+	if err == nil && expect != nil {
+		result.PowerLEDAfter = i.waitPowerLED(ctx, *expect, verifyTimeout)
+	} else {
+		result.PowerLEDAfter = i.powerLED()
+	}
+	if err == nil && expect != nil && result.PowerLEDAfter != nil {
+		result.Verified = boolPtr(*result.PowerLEDAfter == *expect)
+	}
+	result.FinishedAt = time.Now().UnixMilli()
+	if err != nil {
+		result.Error = err.Error()
+	}
+	log.Printf("Power action %s on instance %s finished, verified: %s", action, i.uuid, formatVerified(result.Verified))
+	return result, err
+}
+
+func boolPtr(b bool) *bool {
+	return &b
+}
+
+func formatVerified(verified *bool) string {
+	if verified == nil {
+		return "unknown"
+	}
+	return fmt.Sprintf("%t", *verified)
+}
+
+// HandlePowerAction runs the power action on the given instance and returns the PowerActionResult.
+// Accept a JSON body with the PowerActionOptions fields, all optional.
+func (d *DezukVM) HandlePowerAction(w http.ResponseWriter, r *http.Request, instanceUuid string, action string) {
+	targetInstance, err := d.GetInstanceByUUID(instanceUuid)
+	if err != nil {
+		http.Error(w, "Instance with specified UUID not found", http.StatusNotFound)
+		return
+	}
+	var opts PowerActionOptions
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&opts); err != nil {
+			http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+			return
+		}
+	}
+	d.auditAction(targetInstance.UUID(), r, "power_"+action)
+	result, err := targetInstance.RunPowerAction(action, opts)
+	if result == nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, ErrPowerActionBusy) {
+			status = http.StatusConflict
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	json.NewEncoder(w).Encode(result)
+}
+
+// HandlePowerStatus returns the running power action and the ATX status of the given instance
+func (d *DezukVM) HandlePowerStatus(w http.ResponseWriter, r *http.Request, instanceUuid string) {
+	targetInstance, err := d.GetInstanceByUUID(instanceUuid)
+	if err != nil {
+		http.Error(w, "Instance with specified UUID not found", http.StatusNotFound)
+		return
+	}
+	if targetInstance.auxMCUController == nil {
+		http.Error(w, "Auxiliary MCU controller not initialized or missing", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"running_action": targetInstance.RunningPowerAction(),
+		"aux_status":     targetInstance.auxMCUController.GetStatus(),
+	})
+}
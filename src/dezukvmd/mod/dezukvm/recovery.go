@@ -0,0 +1,259 @@
+package dezukvm
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"imuslab.com/dezukvm/dezukvmd/mod/usbcapture"
+)
+
+/*
+	recovery.go
+
+	Video capture recovery. The MS2109 capture card sometimes hangs and
+	stops sending frames until it is replugged. Recovery stops the capture,
+	cuts the USB power of the card through the AuxMCU, waits for the V4L2
+	node to come back and starts the capture again. Power control needs a
+	v7 PCB or later and is enabled with aux_mcu_capture_power_control, as
+	older firmware silently ignores the commands. Without it only the
+	capture is restarted.
+
+	A watchdog runs recovery when a client is streaming but no frame
+	arrived for the stall timeout, backing off after each automatic attempt
+	so a card that is gone for good is not power cycled in a loop.
+*/
+
+const (
+	DefaultCaptureStallTimeout  = 10 * time.Second
+	captureWatchdogInterval     = 2 * time.Second // Also the time the watchdog waits for a frame
+	captureRecoveryPowerOffTime = 2 * time.Second // Time the capture card stays unpowered
+	captureRecoveryNodeTimeout  = 20 * time.Second
+	captureRecoveryPollInterval = 250 * time.Millisecond
+	captureRecoveryMinBackoff   = time.Minute      // Time before the watchdog may recover again
+	captureRecoveryMaxBackoff   = 30 * time.Minute // Longest backoff after repeated automatic recoveries
+)
+
+// ErrCaptureRecoveryBusy is returned when a capture recovery is already running on the instance
+var ErrCaptureRecoveryBusy = errors.New("capture recovery is already running on this instance")
+
+// CaptureRecoveryStatus is the state of the capture recovery of an instance
+type CaptureRecoveryStatus struct {
+	Running        bool   `json:"running"`
+	Recoveries     int    `json:"recoveries"`                 // Recoveries run since the instance was started
+	PowerCycled    bool   `json:"power_cycled"`               // The last recovery cut the power of the capture card, false if only the capture was restarted
+	LastReason     string `json:"last_reason,omitempty"`      // What triggered the last recovery, e.g. api or no_frames
+	LastStartedAt  int64  `json:"last_started_at,omitempty"`  // Unix time in milliseconds
+	LastFinishedAt int64  `json:"last_finished_at,omitempty"` // Unix time in milliseconds
+	LastError      string `json:"last_error,omitempty"`
+}
+
+// Capture recovery triggers
+const (
+	CaptureRecoveryReasonAPI      = "api"
+	CaptureRecoveryReasonNoFrames = "no_frames"
+)
+
+// GetCaptureRecoveryStatus returns the state of the capture recovery
+func (i *UsbKvmDeviceInstance) GetCaptureRecoveryStatus() CaptureRecoveryStatus {
+	i.captureRecoveryMu.Lock()
+	defer i.captureRecoveryMu.Unlock()
+	return i.captureRecovery
+}
+
+// RecoverCapture power cycles the capture card if supported and restarts the video capture, it returns once capture runs again
+func (i *UsbKvmDeviceInstance) RecoverCapture(reason string) error {
+	i.captureRecoveryMu.Lock()
+	if i.captureRecovery.Running {
+		i.captureRecoveryMu.Unlock()
+		return ErrCaptureRecoveryBusy
+	}
+	if i.usbCaptureDevice == nil {
+		i.captureRecoveryMu.Unlock()
+		return errors.New("video capture device not initialized")
+	}
+	i.captureRecovery.Running = true
+	i.captureRecovery.Recoveries++
+	i.captureRecovery.LastReason = reason
+	i.captureRecovery.LastStartedAt = time.Now().UnixMilli()
+	i.captureRecovery.LastFinishedAt = 0
+	i.captureRecovery.LastError = ""
+	i.captureRecoveryDone = make(chan struct{})
+	stop := i.captureStop
+	i.captureRecoveryMu.Unlock()
+
+	log.Printf("Recovering video capture of instance %s (%s)", i.uuid, reason)
+	powerCycled, err := i.runCaptureRecovery(stop)
+
+	i.captureRecoveryMu.Lock()
+	i.captureRecovery.Running = false
+	i.captureRecovery.PowerCycled = powerCycled
+	i.captureRecovery.LastFinishedAt = time.Now().UnixMilli()
+	if err != nil {
+		i.captureRecovery.LastError = err.Error()
+	}
+	close(i.captureRecoveryDone)
+	i.captureRecoveryMu.Unlock()
+
+	if err != nil {
+		log.Printf("Video capture recovery of instance %s failed: %v", i.uuid, err)
+		return err
+	}
+	if powerCycled {
+		log.Printf("Video capture of instance %s recovered by power cycling the capture card", i.uuid)
+	} else {
+		log.Printf("Video capture of instance %s recovered, only the capture was restarted", i.uuid)
+	}
+	return nil
+}
+
+// runCaptureRecovery stops the capture, power cycles the card if the board supports it and restarts the capture
+func (i *UsbKvmDeviceInstance) runCaptureRecovery(stop chan struct{}) (bool, error) {
+	capture := i.usbCaptureDevice
+	capture.StopCapture()
+
+	powerCycled := false
+	if i.auxMCUController != nil && i.Config.AuxMCUCapturePowerControl {
+		if err := i.auxMCUController.CaptureCardPowerOff(); err != nil {
+			log.Printf("Failed to power off the capture card of instance %s: %v", i.uuid, err)
+		} else {
+			powerCycled = true
+			if !sleepUnlessStopped(stop, captureRecoveryPowerOffTime) {
+				// Never leave the card unpowered
+				i.auxMCUController.CaptureCardPowerOn()
+				return powerCycled, errors.New("instance stopped")
+			}
+		}
+		if err := i.auxMCUController.CaptureCardPowerOn(); err != nil {
+			return powerCycled, fmt.Errorf("failed to power on the capture card: %v", err)
+		}
+	}
+
+	// The V4L2 node disappears while the card is unpowered, wait for it to come back and open it
+	devicePath := capture.Config.VideoDeviceName
+	deadline := time.Now().Add(captureRecoveryNodeTimeout)
+	for {
+		var err error
+		if _, err = os.Stat(devicePath); err == nil {
+			err = capture.StartVideoCapture(i.videoResoltuionConfig)
+			if err == nil {
+				return powerCycled, nil
+			}
+		}
+		if time.Now().After(deadline) {
+			return powerCycled, fmt.Errorf("video device %s did not come back: %v", devicePath, err)
+		}
+		if !sleepUnlessStopped(stop, captureRecoveryPollInterval) {
+			return powerCycled, errors.New("instance stopped")
+		}
+	}
+}
+
+// sleepUnlessStopped waits for d, returns false if stop is closed first
+func sleepUnlessStopped(stop chan struct{}, d time.Duration) bool {
+	select {
+	case <-stop:
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
+
+// waitCaptureRecovery waits for a running capture recovery to finish
+func (i *UsbKvmDeviceInstance) waitCaptureRecovery() {
+	i.captureRecoveryMu.Lock()
+	running, done := i.captureRecovery.Running, i.captureRecoveryDone
+	i.captureRecoveryMu.Unlock()
+	if running {
+		<-done
+	}
+}
+
+// runCaptureWatchdog recovers the capture when no frame arrived for the stall timeout, until stop is closed
+func (i *UsbKvmDeviceInstance) runCaptureWatchdog(stop chan struct{}, stallTimeout time.Duration) {
+	ticker := time.NewTicker(captureWatchdogInterval)
+	defer ticker.Stop()
+	lastFrame := time.Now()
+	backoff := captureRecoveryMinBackoff
+	var nextRecovery time.Time
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		capture := i.usbCaptureDevice
+		if capture == nil || i.GetCaptureRecoveryStatus().Running {
+			lastFrame = time.Now()
+			continue
+		}
+		_, err := capture.CaptureFrame(captureWatchdogInterval)
+		if errors.Is(err, usbcapture.ErrNoVideoStream) {
+			// Frames are only seen while a client streams, a stall cannot be told apart
+			lastFrame = time.Now()
+			continue
+		}
+		if err == nil {
+			lastFrame = time.Now()
+			if time.Now().After(nextRecovery) {
+				// Frames kept coming since the last recovery, start over with the shortest backoff
+				backoff = captureRecoveryMinBackoff
+			}
+			continue
+		}
+		if time.Since(lastFrame) < stallTimeout || time.Now().Before(nextRecovery) {
+			continue
+		}
+
+		log.Printf("No video frame from instance %s for %v", i.uuid, time.Since(lastFrame).Round(time.Second))
+		i.RecoverCapture(CaptureRecoveryReasonNoFrames)
+		lastFrame = time.Now()
+		nextRecovery = time.Now().Add(backoff)
+		backoff *= 2
+		if backoff > captureRecoveryMaxBackoff {
+			backoff = captureRecoveryMaxBackoff
+		}
+	}
+}
+
+// captureStallTimeout returns the configured stall timeout, 0 if the watchdog is disabled
+func (i *UsbKvmDeviceInstance) captureStallTimeout() time.Duration {
+	switch {
+	case i.Config.CaptureStallTimeout < 0:
+		return 0
+	case i.Config.CaptureStallTimeout == 0:
+		return DefaultCaptureStallTimeout
+	default:
+		return time.Duration(i.Config.CaptureStallTimeout) * time.Second
+	}
+}
+
+// HandleCaptureRecovery runs the capture recovery on POST and returns its status, GET returns the status only
+func (d *DezukVM) HandleCaptureRecovery(w http.ResponseWriter, r *http.Request, instanceUuid string) {
+	targetInstance, err := d.GetInstanceByUUID(instanceUuid)
+	if err != nil {
+		http.Error(w, "Instance with specified UUID not found", http.StatusNotFound)
+		return
+	}
+	if r.Method == http.MethodPost {
+		d.auditAction(targetInstance.UUID(), r, "capture_recovery")
+		err := targetInstance.RecoverCapture(CaptureRecoveryReasonAPI)
+		if errors.Is(err, ErrCaptureRecoveryBusy) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(targetInstance.GetCaptureRecoveryStatus())
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(targetInstance.GetCaptureRecoveryStatus())
+}
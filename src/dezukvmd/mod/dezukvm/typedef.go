@@ -1,8 +1,14 @@
 package dezukvm
 
 import (
+	"context"
+	"sync"
+
+	"github.com/boltdb/bolt"
 	"imuslab.com/dezukvm/dezukvmd/mod/kvmaux"
 	"imuslab.com/dezukvm/dezukvmd/mod/kvmhid"
+	"imuslab.com/dezukvm/dezukvmd/mod/kvmmacro"
+	"imuslab.com/dezukvm/dezukvmd/mod/kvmscript"
 	"imuslab.com/dezukvm/dezukvmd/mod/usbcapture"
 )
 
@@ -23,8 +29,15 @@ type UsbKvmDeviceOption struct {
 	CaptureAudioFrameSize         int `json:"capture_audio_frame_size"`        // Size of each audio frame in bytes, e.g., 1920
 
 	/* Communication Settings */
-	USBKVMBaudrate int `json:"usb_kvm_baudrate"` // Baudrate for USB KVM HID communication, e.g., 115200
-	AuxMCUBaudrate int `json:"aux_mcu_baudrate"` // Baudrate for auxiliary MCU communication, e.g., 115200
+	USBKVMBaudrate        int    `json:"usb_kvm_baudrate"`                    // Baudrate for USB KVM HID communication, e.g., 115200
+	AuxMCUBaudrate        int    `json:"aux_mcu_baudrate"`                    // Baudrate for auxiliary MCU communication, e.g., 115200
+	USBKVMMouseReportRate int    `json:"usb_kvm_mouse_report_rate,omitempty"` // Maximum mouse reports per second, 0 for the default of 125
+	USBKVMBackend         string `json:"usb_kvm_backend,omitempty"`           // HID firmware protocol, ch9329 (default if empty), remdeshid for v1/v2 PCBs, hidg for a USB gadget or auto to detect
+	USBKVMGadgetMousePath string `json:"usb_kvm_gadget_mouse_path,omitempty"` // Mouse device of the hidg backend, default /dev/hidg1. usb_kvm_device_path is its keyboard.
+
+	/* Recovery Settings */
+	CaptureStallTimeout       int  `json:"capture_stall_timeout,omitempty"`         // Seconds without a video frame before the capture is recovered, 0 for the default of 10, negative to disable
+	AuxMCUCapturePowerControl bool `json:"aux_mcu_capture_power_control,omitempty"` // The AuxMCU can cut the capture card power (v7 PCB and later), older firmware ignores the commands
 }
 
 type UsbKvmDeviceInstance struct {
@@ -35,20 +48,39 @@ type UsbKvmDeviceInstance struct {
 	videoResoltuionConfig *usbcapture.CaptureResolution
 
 	/* Internals */
-	uuid             string // Session UUID obtained from AuxMCU
-	usbKVMController *kvmhid.Controller
-	auxMCUController *kvmaux.AuxMcu
-	usbCaptureDevice *usbcapture.Instance
-	parent           *DezukVM
+	uuid                string // Session UUID obtained from AuxMCU
+	usbKVMController    *kvmhid.Controller
+	auxMCUController    *kvmaux.AuxMcu
+	usbCaptureDevice    *usbcapture.Instance
+	parent              *DezukVM
+	calibrationStop     chan struct{} // Stops the picture area detection of auto pointer calibration
+	bootKeyJob          *bootKeyJob   // Last boot key helper run, nil if none
+	bootKeyMu           sync.Mutex
+	powerAction         string             // ATX power action pressing a button, empty if none
+	powerCancel         context.CancelFunc // Cancels the running power action
+	powerDone           chan struct{}      // Closed when the running power action has released its button
+	powerMu             sync.Mutex
+	auditListeners      []int         // HID listener IDs of the input audit log
+	captureStop         chan struct{} // Stops the capture watchdog and aborts a running capture recovery
+	captureRecovery     CaptureRecoveryStatus
+	captureRecoveryDone chan struct{} // Closed when the running capture recovery has finished
+	captureRecoveryMu   sync.Mutex
 }
 
 type RuntimeOptions struct {
-	EnableLog bool `json:"enable_log"` // Enable or disable logging
+	EnableLog    bool              `json:"enable_log"` // Enable or disable logging
+	MacroManager *kvmmacro.Manager `json:"-"`          // HID macro storage and playback, optional
+	Database     *bolt.DB          `json:"-"`          // System database for per-instance settings and the input audit log, optional
+
+	AuditMaxEntries    int `json:"audit_max_entries"`    // Input audit entries to keep, 0 for the default of 100000
+	AuditRetentionDays int `json:"audit_retention_days"` // Days to keep input audit entries, 0 for the default of 90
 }
 type DezukVM struct {
 	UsbKvmInstance []*UsbKvmDeviceInstance
 
 	/* Internals */
-	occupiedUUIDs map[string]bool // Track occupied UUIDs to prevent duplicate connections
-	option        *RuntimeOptions // Runtime options
+	occupiedUUIDs map[string]bool   // Track occupied UUIDs to prevent duplicate connections
+	option        *RuntimeOptions   // Runtime options
+	scriptRunner  *kvmscript.Runner // DuckyScript payload runner
+	audit         *inputAudit       // Input audit log, nil if no database is configured
 }
@@ -24,9 +24,12 @@ func (i *UsbKvmDeviceInstance) Start() error {
 
 	/* --------- Start HID Controller --------- */
 	usbKVM := kvmhid.NewHIDController(&kvmhid.Config{
-		PortName:          i.Config.USBKVMDevicePath,
-		BaudRate:          i.Config.USBKVMBaudrate,
-		ScrollSensitivity: 0x01, // Set mouse scroll sensitivity
+		PortName:           i.Config.USBKVMDevicePath,
+		BaudRate:           i.Config.USBKVMBaudrate,
+		ScrollSensitivity:  0x01, // Set mouse scroll sensitivity
+		MaxMouseReportRate: i.Config.USBKVMMouseReportRate,
+		Backend:            i.Config.USBKVMBackend, // Empty for CH9329, existing configs predate the other backends
+		GadgetMouseDevice:  i.Config.USBKVMGadgetMousePath,
 	})
 
 	//Start the HID controller
@@ -80,11 +83,50 @@ func (i *UsbKvmDeviceInstance) Start() error {
 	}
 
 	i.usbCaptureDevice = usbCaptureDevice
+
+	/* --------- Restore Pointer Calibration --------- */
+	i.loadPointerCalibration()
+	i.calibrationStop = make(chan struct{})
+	go i.runAutoCalibration(i.calibrationStop)
+
+	/* --------- Start Capture Watchdog --------- */
+	i.captureStop = make(chan struct{})
+	if stallTimeout := i.captureStallTimeout(); stallTimeout > 0 {
+		go i.runCaptureWatchdog(i.captureStop, stallTimeout)
+	}
+
+	/* --------- Start Input Audit --------- */
+	if i.parent != nil && i.parent.audit != nil {
+		i.auditListeners = i.parent.audit.attach(i.uuid, i.usbKVMController)
+	}
 	return nil
 }
 
 func (i *UsbKvmDeviceInstance) Stop() error {
+	if i.calibrationStop != nil {
+		close(i.calibrationStop)
+		i.calibrationStop = nil
+	}
+	i.bootKeyMu.Lock()
+	if i.bootKeyJob != nil {
+		// The job uses the controllers closed below
+		i.bootKeyJob.cancel()
+		<-i.bootKeyJob.done
+	}
+	i.bootKeyMu.Unlock()
+	// Release any ATX button before the AuxMCU goes away
+	i.cancelPowerAction()
+	if i.captureStop != nil {
+		// A running recovery aborts and powers the capture card back on
+		close(i.captureStop)
+		i.waitCaptureRecovery()
+		i.captureStop = nil
+	}
 	if i.usbKVMController != nil {
+		if i.parent != nil && i.parent.audit != nil {
+			i.parent.audit.detach(i.uuid, i.usbKVMController, i.auditListeners)
+			i.auditListeners = nil
+		}
 		i.usbKVMController.Close()
 		i.usbKVMController = nil
 	}
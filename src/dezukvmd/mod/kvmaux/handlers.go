@@ -4,8 +4,22 @@ import (
 	"encoding/json"
 	"log"
 	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
 )
 
+const statusWriteTimeout = 5 * time.Second // Clients not taking a status push for this long are dropped
+
+// upgrader is used to upgrade HTTP connections to WebSocket connections
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	CheckOrigin: func(r *http.Request) bool {
+		return true
+	},
+}
+
 // Handler for switching USB to KVM side
 func (c *AuxMcu) HandleSwitchUSBToKVM(w http.ResponseWriter, r *http.Request) {
 	if err := c.SwitchUSBToKVM(); err != nil {
@@ -79,3 +93,71 @@ func (c *AuxMcu) HandleGetUSBMassStorageSide(w http.ResponseWriter, r *http.Requ
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{"usb_mass_storage_side": side})
 }
+
+// Handler for getting the ATX and USB mass storage status
+func (c *AuxMcu) HandleGetStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(c.GetStatus())
+}
+
+// HandleStatusWebSocket pushes {"aux_status": AuxStatus} once on connect and on every status change
+func (c *AuxMcu) HandleStatusWebSocket(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Println("Failed to upgrade to websocket:", err)
+		return
+	}
+	defer conn.Close()
+
+	// Listeners run on the aux reader goroutine, so they only queue the status
+	// for the writer below and a slow client never holds up the serial port.
+	// Only the latest status matters, a stale queued one is replaced.
+	updates := make(chan AuxStatus, 1)
+	push := func(status AuxStatus) {
+		for {
+			select {
+			case updates <- status:
+				return
+			default:
+			}
+			select {
+			case <-updates:
+			default:
+			}
+		}
+	}
+	closed := make(chan struct{})
+	writerDone := make(chan struct{})
+	go func() {
+		defer close(writerDone)
+		for {
+			select {
+			case status := <-updates:
+				conn.SetWriteDeadline(time.Now().Add(statusWriteTimeout))
+				if err := conn.WriteJSON(map[string]AuxStatus{"aux_status": status}); err != nil {
+					// Drop the client, which also ends the read loop below
+					log.Println("Error writing message:", err)
+					conn.Close()
+					return
+				}
+			case <-closed:
+				return
+			}
+		}
+	}()
+	defer func() {
+		close(closed)
+		<-writerDone
+	}()
+
+	push(c.GetStatus())
+	listenerID := c.AddStatusListener(push)
+	defer c.RemoveStatusListener(listenerID)
+
+	// Nothing is expected from the client, read until it goes away
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			return
+		}
+	}
+}
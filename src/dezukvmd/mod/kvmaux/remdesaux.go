@@ -5,10 +5,16 @@ package kvmaux
 
 	This module provides functions to interact with the auxiliary MCU (CH552G)
 	used in RemdeskVM for managing USB switching and power/reset button simulation.
+
+	A background reader owns the serial port. Firmware built with ATX control
+	prints a status digit every 100 ms (see status.go), command replies such
+	as the UUID are full lines and are handed to the waiting request.
 */
 
 import (
-	"bufio"
+	"errors"
+	"io"
+	"log"
 	"strings"
 	"sync"
 	"time"
@@ -16,6 +22,12 @@ import (
 	"github.com/tarm/serial"
 )
 
+const (
+	auxReplyTimeout  = 2 * time.Second // Time to wait for a command reply line
+	uuidLength       = 36              // Length of a UUID reply, e.g. df75279d-c691-4be5-9001-c18e37593ffc
+	auxMaxLineLength = 64              // Longer lines are handled as they are, so a missing line end cannot hide the status reports
+)
+
 type USB_mass_storage_side int
 
 const (
@@ -26,8 +38,29 @@ const (
 type AuxMcu struct {
 	usb_mass_storage_side USB_mass_storage_side
 	port                  *serial.Port
-	reader                *bufio.Reader
 	mu                    sync.Mutex
+
+	/* Background reader */
+	line      []byte        // Reply line being received, nil between lines
+	pending   *auxRequest   // Request waiting for a reply line
+	dropLine  bool          // A request gave up waiting, the reader drops its partial line
+	pendingMu sync.Mutex    // Guards pending and dropLine
+	requestMu sync.Mutex    // Held while a request waits for its reply
+	stop      chan struct{} // Closed to stop the reader
+	done      chan struct{} // Closed when the reader has stopped
+
+	/* Status stream */
+	status          AuxStatus
+	statusMu        sync.Mutex
+	statusListeners map[int]StatusListener
+	nextListenerID  int
+	listenersMu     sync.Mutex
+}
+
+// auxRequest waits for the reply line of a command
+type auxRequest struct {
+	replyLen int // Expected reply length, 0 for any
+	reply    chan string
 }
 
 // NewAuxOutbandController initializes a new AuxMcu instance
@@ -35,45 +68,189 @@ func NewAuxOutbandController(portName string, baudRate int) (*AuxMcu, error) {
 	c := &serial.Config{
 		Name:        portName,
 		Baud:        baudRate,
-		ReadTimeout: time.Second * 2,
+		ReadTimeout: time.Millisecond * 500,
 	}
 	port, err := serial.OpenPort(c)
 	if err != nil {
 		return nil, err
 	}
-	return &AuxMcu{
+	mcu := &AuxMcu{
 		usb_mass_storage_side: USB_MASS_STORAGE_KVM, //Default to KVM side, defined in MCU firmware
 		port:                  port,
-		reader:                bufio.NewReader(port),
-	}, nil
+		stop:                  make(chan struct{}),
+		done:                  make(chan struct{}),
+		statusListeners:       make(map[int]StatusListener),
+	}
+	mcu.status.USBMassStorageSide = USB_MASS_STORAGE_KVM
+	go mcu.readLoop(port)
+	return mcu, nil
 }
 
 func (c *AuxMcu) Close() error {
 	c.mu.Lock()
-	defer c.mu.Unlock()
-	if c.port != nil {
-		return c.port.Close()
+	port := c.port
+	c.port = nil
+	c.mu.Unlock()
+	if port == nil {
+		return nil
+	}
+	close(c.stop)
+	err := port.Close()
+	<-c.done
+	return err
+}
+
+// readLoop reads the serial port until the MCU is closed
+func (c *AuxMcu) readLoop(port *serial.Port) {
+	defer close(c.done)
+	buf := make([]byte, 256)
+	for {
+		select {
+		case <-c.stop:
+			return
+		default:
+		}
+		n, err := port.Read(buf)
+		if n > 0 {
+			c.handleIncomingData(buf[:n])
+		}
+		c.checkStatusTimeout()
+		if err != nil && err != io.EOF {
+			select {
+			case <-c.stop:
+			default:
+				log.Println("Aux MCU read failed: " + err.Error())
+			}
+			return
+		}
+	}
+}
+
+// handleIncomingData splits the received bytes into status reports and reply lines
+func (c *AuxMcu) handleIncomingData(data []byte) {
+	c.pendingMu.Lock()
+	if c.dropLine {
+		c.line = nil
+		c.dropLine = false
+	}
+	c.pendingMu.Unlock()
+
+	for _, b := range data {
+		switch {
+		case c.line != nil:
+			if b == '\n' {
+				c.handleLine(strings.TrimSpace(string(c.line)))
+				c.line = nil
+			} else {
+				c.line = append(c.line, b)
+				if len(c.line) >= auxMaxLineLength {
+					c.handleLine(strings.TrimSpace(string(c.line)))
+					c.line = nil
+				}
+			}
+		case b == '\r' || b == '\n':
+			// Line ending without a line
+		case isStatusReport(b) && !c.waitingForReply():
+			c.updateStatus(b)
+		default:
+			// A reply line starts, status digits in front of it are split off in handleLine
+			c.line = []byte{b}
+		}
+	}
+}
+
+func (c *AuxMcu) waitingForReply() bool {
+	c.pendingMu.Lock()
+	defer c.pendingMu.Unlock()
+	return c.pending != nil
+}
+
+// handleLine hands a reply line to the waiting request
+func (c *AuxMcu) handleLine(line string) {
+	if debug := strings.TrimLeft(line, auxStatusChars); strings.HasPrefix(debug, "[") {
+		// Debug output of the firmware, status reports in front of it are still applied
+		if prefix := line[:len(line)-len(debug)]; prefix != "" {
+			c.updateStatus(prefix[len(prefix)-1])
+		}
+		log.Println("Aux MCU: " + debug)
+		return
+	}
+
+	c.pendingMu.Lock()
+	req := c.pending
+	c.pending = nil
+	c.pendingMu.Unlock()
+	if req == nil {
+		log.Println("Aux MCU sent unexpected line: " + line)
+		return
+	}
+
+	// Status reports sent just before the command was executed end up in front of the reply
+	if req.replyLen > 0 && len(line) > req.replyLen {
+		prefix := line[:len(line)-req.replyLen]
+		if strings.Trim(prefix, auxStatusChars) == "" {
+			c.updateStatus(prefix[len(prefix)-1])
+			line = line[len(prefix):]
+		}
+	}
+	req.reply <- line
+}
+
+// request sends a command and waits for its reply line
+func (c *AuxMcu) request(cmd byte, replyLen int) (string, error) {
+	c.requestMu.Lock()
+	defer c.requestMu.Unlock()
+
+	req := &auxRequest{replyLen: replyLen, reply: make(chan string, 1)}
+	c.pendingMu.Lock()
+	c.pending = req
+	c.pendingMu.Unlock()
+	if err := c.sendCommand(cmd); err != nil {
+		c.clearPending(req)
+		return "", err
+	}
+
+	select {
+	case line := <-req.reply:
+		return line, nil
+	case <-c.done:
+		return "", errors.New("aux MCU closed")
+	case <-time.After(auxReplyTimeout):
+		c.clearPending(req)
+		return "", errors.New("timeout waiting for aux MCU reply")
+	}
+}
+
+// clearPending stops waiting for the reply of req, a partial reply line is dropped
+func (c *AuxMcu) clearPending(req *auxRequest) {
+	c.pendingMu.Lock()
+	defer c.pendingMu.Unlock()
+	if c.pending == req {
+		c.pending = nil
+		c.dropLine = true
 	}
-	return nil
 }
 
 // sendCommand writes a single byte command to the serial port
 func (c *AuxMcu) sendCommand(cmd byte) error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	if c.port == nil {
+		return errors.New("aux MCU closed")
+	}
 	_, err := c.port.Write([]byte{cmd})
 	return err
 }
 
 // SwitchUSBToKVM switches USB mass storage to KVM side
 func (c *AuxMcu) SwitchUSBToKVM() error {
-	c.usb_mass_storage_side = USB_MASS_STORAGE_KVM
+	c.setUSBMassStorageSide(USB_MASS_STORAGE_KVM)
 	return c.sendCommand('m')
 }
 
 // SwitchUSBToRemote switches USB mass storage to remote computer
 func (c *AuxMcu) SwitchUSBToRemote() error {
-	c.usb_mass_storage_side = USB_MASS_STORAGE_REMOTE
+	c.setUSBMassStorageSide(USB_MASS_STORAGE_REMOTE)
 	return c.sendCommand('n')
 }
 
@@ -97,18 +274,24 @@ func (c *AuxMcu) ReleaseResetButton() error {
 	return c.sendCommand('d')
 }
 
+// PowerCycleCaptureCard cuts the USB power of the HDMI capture card for one second, v7 PCB and later
+func (c *AuxMcu) PowerCycleCaptureCard() error {
+	return c.sendCommand('k')
+}
+
+// CaptureCardPowerOff cuts the USB power of the HDMI capture card, v7 PCB and later
+func (c *AuxMcu) CaptureCardPowerOff() error {
+	return c.sendCommand('l')
+}
+
+// CaptureCardPowerOn restores the USB power of the HDMI capture card, v7 PCB and later
+func (c *AuxMcu) CaptureCardPowerOn() error {
+	return c.sendCommand('j')
+}
+
 // GetUUID requests the device UUID and returns it as a string
 func (c *AuxMcu) GetUUID() (string, error) {
-	if err := c.sendCommand('u'); err != nil {
-		return "", err
-	}
-	line, err := c.reader.ReadString('\n')
-	if err != nil {
-		return "", err
-	}
-
-	line = strings.TrimSpace(line)
-	return line, nil
+	return c.request('u', uuidLength)
 }
 
 func (c *AuxMcu) GetUSBMassStorageSide() USB_mass_storage_side {
@@ -116,3 +299,9 @@ func (c *AuxMcu) GetUSBMassStorageSide() USB_mass_storage_side {
 	defer c.mu.Unlock()
 	return c.usb_mass_storage_side
 }
+
+func (c *AuxMcu) setUSBMassStorageSide(side USB_mass_storage_side) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.usb_mass_storage_side = side
+}
@@ -0,0 +1,79 @@
+package kvmaux
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestHandleIncomingData(t *testing.T) {
+	const uuid = "df75279d-c691-4be5-9001-c18e37593ffc"
+	const digitUUID = "0f75279d-c691-4be5-9001-c18e37593ffc" // Starts like a status digit
+
+	tests := []struct {
+		name      string
+		waiting   bool     // A UUID request waits for its reply
+		chunks    []string // Data as returned by the serial reads
+		timeoutAt int      // Number of chunks after which the request times out, 0 for never
+		wantReply string   // Empty if no reply is expected
+		wantLast  int      // Last status report applied, -1 if none
+	}{
+		{"status digits", false, []string{"1", "3"}, 0, "", 3},
+		{"raw status bytes", false, []string{"\x01\x05"}, 0, "", 5},
+		{"line endings only", false, []string{"\r\n"}, 0, "", -1},
+		{"digits before reply", true, []string{"1", "5" + uuid + "\r\n"}, 0, uuid, 5},
+		{"raw bytes before reply", true, []string{"\x01\x04" + uuid + "\r\n"}, 0, uuid, 4},
+		{"reply starting with a digit", true, []string{"3" + digitUUID + "\r\n"}, 0, digitUUID, 3},
+		{"reply without status", true, []string{digitUUID + "\r\n"}, 0, digitUUID, -1},
+		{"reply split across reads", true, []string{uuid[:10], uuid[10:30], uuid[30:] + "\r", "\n"}, 0, uuid, -1},
+		{"debug line", false, []string{"[ATX] power pressed\r\n", "2"}, 0, "", 2},
+		{"debug line before reply", true, []string{"\x03[USB] switched\r\n", uuid + "\r\n"}, 0, uuid, 3},
+		{"status after reply", true, []string{uuid + "\r\n", "6"}, 0, uuid, 6},
+		{"stray byte without line end", false, []string{"x", strings.Repeat("3", 70)}, 0, "", 3},
+		{"reply cut off", true, []string{uuid[:10], "5"}, 1, "", 5},
+	}
+	for _, tt := range tests {
+		c := &AuxMcu{statusListeners: make(map[int]StatusListener)}
+		var req *auxRequest
+		if tt.waiting {
+			req = &auxRequest{replyLen: uuidLength, reply: make(chan string, 1)}
+			c.pending = req
+		}
+		for n, chunk := range tt.chunks {
+			if tt.timeoutAt > 0 && n == tt.timeoutAt {
+				c.clearPending(req)
+			}
+			c.handleIncomingData([]byte(chunk))
+		}
+
+		if req != nil && tt.wantReply == "" {
+			select {
+			case reply := <-req.reply:
+				t.Errorf("%s: got reply %q, want none", tt.name, reply)
+			default:
+			}
+		} else if req != nil {
+			select {
+			case reply := <-req.reply:
+				if reply != tt.wantReply {
+					t.Errorf("%s: got reply %q, want %q", tt.name, reply, tt.wantReply)
+				}
+			default:
+				t.Errorf("%s: no reply, want %q", tt.name, tt.wantReply)
+			}
+		}
+
+		status := c.GetStatus()
+		if tt.wantLast < 0 {
+			if status.Available {
+				t.Errorf("%s: unexpected status %+v", tt.name, status)
+			}
+			continue
+		}
+		want := byte(tt.wantLast)
+		if !status.Available || status.PowerLED != (want&auxStatusPowerLED != 0) ||
+			status.HDDLED != (want&auxStatusHDDLED != 0) ||
+			(status.USBMassStorageSide == USB_MASS_STORAGE_REMOTE) != (want&auxStatusUSBMSSide != 0) {
+			t.Errorf("%s: got status %+v, want report %d", tt.name, status, want)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package kvmaux
+
+import "time"
+
+/*
+	status.go
+
+	Firmware built with ENABLE_ATX_CTRL reports its status every 100 ms
+	as one digit, '0' to '7':
+
+	Bit 0: ATX PWR LED
+	Bit 1: ATX HDD LED
+	Bit 2: USB mass storage side, 0 = KVM host, 1 = remote computer
+
+	Raw status bytes 0x00 to 0x07 are accepted as well. The HDD LED
+	blinks with disk activity, so the time it was last seen on is kept
+	next to its current state.
+*/
+
+const auxStatusTimeout = time.Second // Status is unavailable if no report arrived for this long
+
+// Status bits of the firmware report_status
+const (
+	auxStatusPowerLED   = 0x01
+	auxStatusHDDLED     = 0x02
+	auxStatusUSBMSSide  = 0x04
+	auxStatusReportMask = 0x07
+)
+
+// AuxStatus is the live ATX and USB mass storage state reported by the aux MCU
+type AuxStatus struct {
+	Available          bool                  `json:"available"`                    // Status reports are received, needs ATX control in the firmware
+	PowerLED           bool                  `json:"power_led"`                    // ATX power LED is on, the target is running
+	HDDLED             bool                  `json:"hdd_led"`                      // ATX HDD LED is on
+	LastDiskActivity   int64                 `json:"last_disk_activity,omitempty"` // Unix time in milliseconds the HDD LED was last on
+	USBMassStorageSide USB_mass_storage_side `json:"usb_mass_storage_side"`
+	UpdatedAt          int64                 `json:"updated_at"` // Unix time in milliseconds of the last report
+}
+
+// StatusListener is called when the aux MCU status changes
+type StatusListener func(status AuxStatus)
+
+// auxStatusChars are the status digits and raw status bytes, which can end up in front of a line
+const auxStatusChars = "01234567\x00\x01\x02\x03\x04\x05\x06\x07"
+
+// isStatusReport returns true if b is a status digit or a raw status byte
+func isStatusReport(b byte) bool {
+	return b <= auxStatusReportMask || (b >= '0' && b <= '7')
+}
+
+// GetStatus returns the last reported status
+func (c *AuxMcu) GetStatus() AuxStatus {
+	c.statusMu.Lock()
+	defer c.statusMu.Unlock()
+	return c.status
+}
+
+// AddStatusListener registers a listener for status changes and returns its id
+func (c *AuxMcu) AddStatusListener(l StatusListener) int {
+	c.listenersMu.Lock()
+	defer c.listenersMu.Unlock()
+	c.nextListenerID++
+	c.statusListeners[c.nextListenerID] = l
+	return c.nextListenerID
+}
+
+// RemoveStatusListener removes a status listener by its id
+func (c *AuxMcu) RemoveStatusListener(id int) {
+	c.listenersMu.Lock()
+	defer c.listenersMu.Unlock()
+	delete(c.statusListeners, id)
+}
+
+// updateStatus applies a status report and notifies the listeners if anything but the time changed
+func (c *AuxMcu) updateStatus(report byte) {
+	if report >= '0' {
+		report -= '0'
+	}
+	now := time.Now().UnixMilli()
+	side := USB_MASS_STORAGE_KVM
+	if report&auxStatusUSBMSSide != 0 {
+		side = USB_MASS_STORAGE_REMOTE
+	}
+
+	c.statusMu.Lock()
+	previous := c.status
+	c.status.Available = true
+	c.status.PowerLED = report&auxStatusPowerLED != 0
+	c.status.HDDLED = report&auxStatusHDDLED != 0
+	if c.status.HDDLED {
+		c.status.LastDiskActivity = now
+	}
+	c.status.USBMassStorageSide = side
+	c.status.UpdatedAt = now
+	status := c.status
+	c.statusMu.Unlock()
+
+	// The firmware knows the side for sure, e.g. after it was switched by another client
+	c.setUSBMassStorageSide(side)
+
+	if previous.Available != status.Available || previous.PowerLED != status.PowerLED ||
+		previous.HDDLED != status.HDDLED || previous.USBMassStorageSide != status.USBMassStorageSide {
+		c.notifyStatus(status)
+	}
+}
+
+// checkStatusTimeout marks the status unavailable once the reports stop, e.g. on firmware without ATX control
+func (c *AuxMcu) checkStatusTimeout() {
+	c.statusMu.Lock()
+	if !c.status.Available || time.Since(time.UnixMilli(c.status.UpdatedAt)) < auxStatusTimeout {
+		c.statusMu.Unlock()
+		return
+	}
+	c.status.Available = false
+	status := c.status
+	c.statusMu.Unlock()
+	c.notifyStatus(status)
+}
+
+func (c *AuxMcu) notifyStatus(status AuxStatus) {
+	c.listenersMu.Lock()
+	listeners := make([]StatusListener, 0, len(c.statusListeners))
+	for _, l := range c.statusListeners {
+		listeners = append(listeners, l)
+	}
+	c.listenersMu.Unlock()
+	for _, l := range listeners {
+		l(status)
+	}
+}
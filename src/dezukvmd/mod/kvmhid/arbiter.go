@@ -0,0 +1,289 @@
+package kvmhid
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+/*
+	arbiter.go
+
+	Input arbitration between the HID websocket sessions of a controller.
+	Only one session holds input control at a time, all others are view-only
+	and have their input events rejected. Control can be requested (granted
+	right away if nobody holds it, otherwise the holder is asked), handed over
+	by the holder, released, or forcibly taken. When the holder disconnects,
+	control passes to the session connected longest. Every change is
+	broadcast to all sessions as {"control": ControlState}.
+
+	REST input (typed text, key chords, media keys, macros, scripts and
+	boot keys, and cancelling them) carries the control token of its session
+	in the X-HID-Control-Token header or the control_token query parameter.
+	Session IDs are public, the token is a separate secret only sent to the
+	session's own client in its hello message. REST input is only accepted
+	with the token of the holder, or from anyone while nobody holds control.
+	Running text typing is cancelled when control changes hands.
+
+	Background input jobs (REST text typing, macros, scripts and the boot
+	key helper) take the input job lock of the controller, so only one of
+	them types on the target at a time.
+*/
+
+// HIDControlTokenHeader carries the control token of the HID session a REST input request is sent from
+const HIDControlTokenHeader = "X-HID-Control-Token"
+
+// ErrNoInputControl is returned for input from a session that does not hold input control
+var ErrNoInputControl = errors.New("session does not hold input control")
+
+// ErrInputJobBusy is returned when another background input job runs on the controller
+var ErrInputJobBusy = errors.New("another input job is running on this controller")
+
+// ControlState is the input ownership state of a controller
+type ControlState struct {
+	Owner    string        `json:"owner"`    // Session ID holding input control, empty if nobody
+	Sessions []SessionInfo `json:"sessions"` // All connected sessions
+}
+
+// SessionInfo describes a connected HID session
+type SessionInfo struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	RemoteAddr  string `json:"remote_addr,omitempty"`
+	HasControl  bool   `json:"has_control"`
+	ConnectedAt int64  `json:"connected_at"`
+}
+
+// IsControlEvent checks if the event manages input ownership rather than sending input
+func IsControlEvent(event EventType) bool {
+	switch event {
+	case EventTypeRequestControl, EventTypeGrantControl, EventTypeDenyControl,
+		EventTypeTakeControl, EventTypeReleaseControl:
+		return true
+	}
+	return false
+}
+
+// requiresControl checks if the event changes the target and is only allowed from the control holder
+func requiresControl(event EventType) bool {
+	return event != EventTypeSetMouseMode && !IsControlEvent(event)
+}
+
+// GetControlState returns the current input ownership state
+func (c *Controller) GetControlState() ControlState {
+	c.controlMu.Lock()
+	defer c.controlMu.Unlock()
+	return c.controlStateLocked()
+}
+
+// hasControl checks if the session currently holds input control
+func (c *Controller) hasControl(sessionID string) bool {
+	c.controlMu.Lock()
+	defer c.controlMu.Unlock()
+	return c.controlOwner == sessionID
+}
+
+// CheckControl returns ErrNoInputControl unless the control token belongs to the session
+// holding input control, or nobody holds it. Use an empty token for input that does not
+// come from a HID session.
+func (c *Controller) CheckControl(controlToken string) error {
+	c.controlMu.Lock()
+	defer c.controlMu.Unlock()
+	if c.controlOwner == "" {
+		return nil
+	}
+	owner, ok := c.sessions[c.controlOwner]
+	if !ok || controlToken == "" || subtle.ConstantTimeCompare([]byte(owner.controlToken), []byte(controlToken)) != 1 {
+		return ErrNoInputControl
+	}
+	return nil
+}
+
+// RequestControlToken returns the control token a REST request is sent with, empty if none
+func RequestControlToken(r *http.Request) string {
+	if token := r.Header.Get(HIDControlTokenHeader); token != "" {
+		return token
+	}
+	return r.URL.Query().Get("control_token")
+}
+
+// registerSession adds a session to the arbiter, it gets control if nobody holds it
+func (c *Controller) registerSession(s *hidSession) {
+	c.controlMu.Lock()
+	c.sessions[s.id] = s
+	gotControl := c.controlOwner == ""
+	if gotControl {
+		c.controlOwner = s.id
+	}
+	c.controlMu.Unlock()
+	if gotControl {
+		// Text typed through the REST API while nobody held control stops here
+		c.CancelTypeText()
+	}
+	c.broadcastControlState()
+	c.notifySessionListeners(s.info(false), true)
+}
+
+// unregisterSession removes a session from the arbiter, handing control to the
+// session connected longest if it held it
+func (c *Controller) unregisterSession(s *hidSession) {
+	c.controlMu.Lock()
+	delete(c.sessions, s.id)
+	lostControl := c.controlOwner == s.id
+	if lostControl {
+		c.controlOwner = c.oldestSessionLocked()
+	}
+	newOwner := c.controlOwner
+	c.controlMu.Unlock()
+	if lostControl {
+		c.CancelTypeText()
+		log.Printf("HID input control passed from disconnected session %q to %q", s.id, newOwner)
+	}
+	c.broadcastControlState()
+	c.notifySessionListeners(s.info(false), false)
+}
+
+// oldestSessionLocked returns the ID of the session connected longest, empty if there is none.
+// Must be called with controlMu held.
+func (c *Controller) oldestSessionLocked() string {
+	var oldest *hidSession
+	for _, s := range c.sessions {
+		if oldest == nil || s.connectedAt < oldest.connectedAt ||
+			(s.connectedAt == oldest.connectedAt && s.seq < oldest.seq) {
+			oldest = s
+		}
+	}
+	if oldest == nil {
+		return ""
+	}
+	return oldest.id
+}
+
+// handleControlCommand handles an input ownership event from a session
+func (c *Controller) handleControlCommand(s *hidSession, cmd *HIDCommand) error {
+	c.controlMu.Lock()
+	owner := c.controlOwner
+	switch cmd.Event {
+	case EventTypeRequestControl:
+		if owner == s.id {
+			c.controlMu.Unlock()
+			return nil
+		}
+		if owner != "" {
+			// Ask the holder, it can grant or deny the request
+			holder := c.sessions[owner]
+			c.controlMu.Unlock()
+			holder.send(map[string]SessionInfo{"control_request": s.info(false)})
+			return nil
+		}
+		c.controlOwner = s.id
+	case EventTypeGrantControl:
+		if owner != s.id {
+			c.controlMu.Unlock()
+			return errors.New("only the session holding control can grant it")
+		}
+		if _, ok := c.sessions[cmd.TargetSession]; !ok {
+			c.controlMu.Unlock()
+			return errors.New("target session not found")
+		}
+		c.controlOwner = cmd.TargetSession
+	case EventTypeDenyControl:
+		target, ok := c.sessions[cmd.TargetSession]
+		c.controlMu.Unlock()
+		if owner != s.id {
+			return errors.New("only the session holding control can deny requests")
+		}
+		if !ok {
+			return errors.New("target session not found")
+		}
+		target.send(map[string]SessionInfo{"control_denied": s.info(true)})
+		return nil
+	case EventTypeTakeControl:
+		c.controlOwner = s.id
+	case EventTypeReleaseControl:
+		if owner != s.id {
+			c.controlMu.Unlock()
+			return errors.New("session does not hold control")
+		}
+		c.controlOwner = ""
+	}
+	newOwner := c.controlOwner
+	previous := c.sessions[owner]
+	c.controlMu.Unlock()
+
+	if newOwner != owner {
+		c.CancelTypeText()
+		if previous != nil {
+			// Whatever the previous holder was pressing must not stay held
+			previous.releasePressed(c)
+		}
+		log.Printf("HID input control changed from session %q to %q", owner, newOwner)
+		c.broadcastControlState()
+	}
+	return nil
+}
+
+// broadcastControlState sends the current ownership state to all sessions
+func (c *Controller) broadcastControlState() {
+	c.broadcast(map[string]ControlState{"control": c.GetControlState()})
+}
+
+// broadcast sends a message to all sessions
+func (c *Controller) broadcast(msg interface{}) {
+	c.controlMu.Lock()
+	sessions := make([]*hidSession, 0, len(c.sessions))
+	for _, s := range c.sessions {
+		sessions = append(sessions, s)
+	}
+	c.controlMu.Unlock()
+
+	for _, s := range sessions {
+		s.send(msg)
+	}
+}
+
+// controlStateLocked builds the ownership state, must be called with controlMu held
+func (c *Controller) controlStateLocked() ControlState {
+	state := ControlState{
+		Owner:    c.controlOwner,
+		Sessions: []SessionInfo{},
+	}
+	for _, s := range c.sessions {
+		state.Sessions = append(state.Sessions, s.info(s.id == c.controlOwner))
+	}
+	sort.Slice(state.Sessions, func(i, j int) bool {
+		return state.Sessions[i].ConnectedAt < state.Sessions[j].ConnectedAt
+	})
+	return state
+}
+
+// BeginInputJob reserves the controller for a background input job, e.g. "macro Login".
+// end must be called once the job stopped pressing keys.
+func (c *Controller) BeginInputJob(name string) (end func(), err error) {
+	c.inputJobMu.Lock()
+	defer c.inputJobMu.Unlock()
+	if c.inputJob != "" {
+		return nil, fmt.Errorf("%w: %s", ErrInputJobBusy, c.inputJob)
+	}
+	c.inputJob = name
+	var once sync.Once
+	end = func() {
+		once.Do(func() {
+			c.inputJobMu.Lock()
+			c.inputJob = ""
+			c.inputJobMu.Unlock()
+		})
+	}
+	return end, nil
+}
+
+// RunningInputJob returns the name of the background input job running on the controller, empty if none
+func (c *Controller) RunningInputJob() string {
+	c.inputJobMu.Lock()
+	defer c.inputJobMu.Unlock()
+	return c.inputJob
+}
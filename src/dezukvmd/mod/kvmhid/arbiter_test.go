@@ -0,0 +1,215 @@
+package kvmhid
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// recordingSession creates a registered session that keeps all messages pushed to it
+func recordingSession(c *Controller, name string) (*hidSession, func() []interface{}) {
+	var mu sync.Mutex
+	messages := []interface{}{}
+	s := newHIDSession()
+	s.name = name
+	s.push = func(msg interface{}) {
+		mu.Lock()
+		defer mu.Unlock()
+		messages = append(messages, msg)
+	}
+	c.registerSession(s)
+	return s, func() []interface{} {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]interface{}{}, messages...)
+	}
+}
+
+func TestControlArbitration(t *testing.T) {
+	c, emu := newEmulatedController(t)
+	alice, aliceMessages := recordingSession(c, "alice")
+	bob, bobMessages := recordingSession(c, "bob")
+
+	if owner := c.GetControlState().Owner; owner != alice.id {
+		t.Fatalf("first session should get control, owner is %q", owner)
+	}
+	keyA := HIDCommand{Event: EventTypeKeyCodePress, Code: "KeyA"}
+	if _, err := alice.handleCommand(c, &keyA); err != nil {
+		t.Fatal(err)
+	}
+	keyB := HIDCommand{Event: EventTypeKeyCodePress, Code: "KeyB"}
+	if _, err := bob.handleCommand(c, &keyB); err == nil {
+		t.Fatal("input from a view-only session should be rejected")
+	}
+
+	// Mouse mode is a per session setting and allowed without control
+	if _, err := bob.handleCommand(c, &HIDCommand{Event: EventTypeSetMouseMode, MouseMode: MouseModeRelative}); err != nil {
+		t.Errorf("setting mouse mode without control failed: %v", err)
+	}
+
+	// Request goes to the holder, control does not change yet
+	if err := c.handleControlCommand(bob, &HIDCommand{Event: EventTypeRequestControl}); err != nil {
+		t.Fatal(err)
+	}
+	msgs := aliceMessages()
+	request, ok := msgs[len(msgs)-1].(map[string]SessionInfo)
+	if !ok || request["control_request"].ID != bob.id || request["control_request"].Name != "bob" {
+		t.Fatalf("holder did not get the control request: %+v", msgs[len(msgs)-1])
+	}
+	if c.GetControlState().Owner != alice.id {
+		t.Fatal("control should not change before it is granted")
+	}
+
+	if err := c.handleControlCommand(bob, &HIDCommand{Event: EventTypeGrantControl, TargetSession: bob.id}); err == nil {
+		t.Error("only the holder should be able to grant control")
+	}
+	if err := c.handleControlCommand(alice, &HIDCommand{Event: EventTypeGrantControl, TargetSession: bob.id}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Keys held by the previous holder are released on hand over
+	if got := lastKeyboardReport(t, emu); !bytes.Equal(got, make([]byte, 8)) {
+		t.Errorf("keys of previous holder not released: %X", got)
+	}
+	msgs = bobMessages()
+	state, ok := msgs[len(msgs)-1].(map[string]ControlState)
+	if !ok || state["control"].Owner != bob.id || len(state["control"].Sessions) != 2 {
+		t.Fatalf("ownership change not broadcast: %+v", msgs[len(msgs)-1])
+	}
+	if _, err := alice.handleCommand(c, &keyA); err == nil {
+		t.Error("previous holder should be view-only")
+	}
+	if _, err := bob.handleCommand(c, &keyB); err != nil {
+		t.Errorf("new holder input rejected: %v", err)
+	}
+
+	// Forcibly taking control works without the holder agreeing
+	if err := c.handleControlCommand(alice, &HIDCommand{Event: EventTypeTakeControl}); err != nil {
+		t.Fatal(err)
+	}
+	if c.GetControlState().Owner != alice.id {
+		t.Error("take control did not change the owner")
+	}
+
+	// Released control is free, and the next request gets it right away
+	if err := c.handleControlCommand(alice, &HIDCommand{Event: EventTypeReleaseControl}); err != nil {
+		t.Fatal(err)
+	}
+	if c.GetControlState().Owner != "" {
+		t.Error("control should be free after the holder released it")
+	}
+	if err := c.handleControlCommand(bob, &HIDCommand{Event: EventTypeRequestControl}); err != nil {
+		t.Fatal(err)
+	}
+	if c.GetControlState().Owner != bob.id {
+		t.Error("request for free control should be granted")
+	}
+}
+
+func TestControlPassesToOldestSession(t *testing.T) {
+	c, _ := newEmulatedController(t)
+	alice, _ := recordingSession(c, "alice")
+	bob, _ := recordingSession(c, "bob")
+	carol, _ := recordingSession(c, "carol")
+	if err := c.handleControlCommand(carol, &HIDCommand{Event: EventTypeTakeControl}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The other tabs must not be left view-only with nobody in control
+	c.unregisterSession(carol)
+	if owner := c.GetControlState().Owner; owner != alice.id {
+		t.Fatalf("control passed to %q, want the oldest session %q", owner, alice.id)
+	}
+	c.unregisterSession(alice)
+	if owner := c.GetControlState().Owner; owner != bob.id {
+		t.Fatalf("control passed to %q, want %q", owner, bob.id)
+	}
+	c.unregisterSession(bob)
+	if owner := c.GetControlState().Owner; owner != "" {
+		t.Errorf("control held by %q without any session", owner)
+	}
+}
+
+func TestRESTInputRequiresControl(t *testing.T) {
+	c, _ := newEmulatedController(t)
+	send := func(controlToken string) int {
+		req := httptest.NewRequest(http.MethodPost, "/keys", strings.NewReader(`{"chords":["Enter"]}`))
+		if controlToken != "" {
+			req.Header.Set(HIDControlTokenHeader, controlToken)
+		}
+		rec := httptest.NewRecorder()
+		c.HandleSendKeys(rec, req)
+		return rec.Code
+	}
+
+	// Without any session, REST input is allowed
+	if code := send(""); code != http.StatusOK {
+		t.Fatalf("got status %d without sessions, want 200", code)
+	}
+
+	alice, _ := recordingSession(c, "alice")
+	bob, _ := recordingSession(c, "bob")
+	if code := send(""); code != http.StatusConflict {
+		t.Errorf("got status %d without a token while alice holds control, want 409", code)
+	}
+	if code := send(bob.controlToken); code != http.StatusConflict {
+		t.Errorf("got status %d from view-only bob, want 409", code)
+	}
+	// The session ID of the holder is public and must not authorize input
+	if code := send(c.GetControlState().Owner); code != http.StatusConflict {
+		t.Errorf("got status %d with the session ID of the holder, want 409", code)
+	}
+	if code := send(alice.controlToken); code != http.StatusOK {
+		t.Errorf("got status %d from the holder, want 200", code)
+	}
+
+	// A view-only session cannot cancel the jobs of the holder either
+	req := httptest.NewRequest(http.MethodPost, "/type/cancel", nil)
+	req.Header.Set(HIDControlTokenHeader, bob.controlToken)
+	rec := httptest.NewRecorder()
+	c.HandleCancelTypeText(rec, req)
+	if rec.Code != http.StatusConflict {
+		t.Errorf("got status %d cancelling typing from view-only bob, want 409", rec.Code)
+	}
+}
+
+func TestInputJobLock(t *testing.T) {
+	c, _ := newEmulatedController(t)
+	end, err := c.BeginInputJob("macro Login")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.BeginInputJob("script"); !errors.Is(err, ErrInputJobBusy) {
+		t.Errorf("second job: got %v, want %v", err, ErrInputJobBusy)
+	}
+	if _, err := c.StartTypeText("a", "", 0); !errors.Is(err, ErrInputJobBusy) {
+		t.Errorf("text typing: got %v, want %v", err, ErrInputJobBusy)
+	}
+	form := url.Values{"text": {"a"}}
+	req := httptest.NewRequest(http.MethodPost, "/type", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	c.HandleTypeText(rec, req)
+	if rec.Code != http.StatusConflict {
+		t.Errorf("REST typing: got status %d, want %d", rec.Code, http.StatusConflict)
+	}
+
+	end()
+	endScript, err := c.BeginInputJob("script")
+	if err != nil {
+		t.Fatalf("controller not free after the job ended: %v", err)
+	}
+	end() // Ending twice must not free the job started in between
+	if job := c.RunningInputJob(); job != "script" {
+		t.Errorf("got running job %q, want script", job)
+	}
+	endScript()
+	if job := c.RunningInputJob(); job != "" {
+		t.Errorf("input job %q still running", job)
+	}
+}
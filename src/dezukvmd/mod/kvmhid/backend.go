@@ -0,0 +1,160 @@
+package kvmhid
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+/*
+	backend.go
+
+	HID backends translate keyboard, mouse and media key reports into the
+	protocol of the USB KVM firmware. The controller owns the HIDState and
+	hands complete reports to the backend, so key tracking, session
+	arbitration, the mouse scheduler and everything above stay the same
+	for all boards.
+
+	ch9329:    CH9329 serial frames, used by v3 and later PCBs
+	remdeshid: Opcode protocol of the CH552G firmware on v1 and v2 PCBs
+	hidg:      Linux USB gadget HID functions, for hosts with USB OTG
+	auto:      Probe the firmware when the transport is first opened,
+	           or use hidg if the port is a /dev/hidgN device
+*/
+
+// HID backends selectable in Config.Backend
+const (
+	BackendCH9329    = "ch9329"
+	BackendRemdesHID = "remdeshid"
+	BackendHIDGadget = "hidg"
+	BackendAuto      = "auto"
+)
+
+const backendProbeTimeout = 300 * time.Millisecond // Time to wait for the firmware to answer a probe
+
+// Backend sends HID reports to the USB KVM over the controller transport
+type Backend interface {
+	// Name returns the backend name as used in Config.Backend
+	Name() string
+	// Reset clears the device input queue and releases everything, called after (re)connecting
+	Reset() error
+	// HandleIncomingData processes bytes read from the transport
+	HandleIncomingData(data []byte)
+
+	SendKeyboardReport(modkey uint8, keys [6]uint8) ([]byte, error)
+	// SendMouseRelative sends a relative move, dx, dy and wheel are int8 values. If wait is
+	// false the backend returns without waiting for the device to confirm the report.
+	SendMouseRelative(buttons uint8, dx, dy, wheel uint8, wait bool) ([]byte, error)
+	// SendMouseAbsolute moves the pointer to x, y in the range 0 - 4095
+	SendMouseAbsolute(buttons uint8, x, y uint16, wait bool) ([]byte, error)
+	SendMultimediaReport(keys [3]uint8) ([]byte, error)
+	SendSystemKeyReport(keys uint8) ([]byte, error)
+
+	// GetStatus queries the device status and the keyboard LED state of the target
+	GetStatus() (*ChipStatus, error)
+}
+
+// ErrUnsupportedByBackend is returned for input the selected backend cannot send
+var ErrUnsupportedByBackend = errors.New("not supported by the HID backend")
+
+// ListBackends returns the names of all HID backends
+func ListBackends() []string {
+	return []string{BackendCH9329, BackendRemdesHID, BackendHIDGadget}
+}
+
+// newBackend creates the backend with the given name, CH9329 if none is set
+func newBackend(c *Controller, name string) Backend {
+	switch name {
+	case "", BackendCH9329:
+		return &ch9329Backend{c: c}
+	case BackendRemdesHID:
+		return newRemdesHIDBackend(c)
+	case BackendHIDGadget:
+		return &hidgBackend{c: c}
+	case BackendAuto:
+		return &invalidBackend{name: name, err: errors.New("HID backend is not detected yet")}
+	default:
+		return &invalidBackend{name: name, err: fmt.Errorf("unknown HID backend: %s", name)}
+	}
+}
+
+// DetectBackend probes the firmware behind the transport and returns the name of its backend.
+// A CH9329 answers GET_INFO with a frame, the remdeshid firmware answers every byte of a ping.
+func DetectBackend(port Transport) (string, error) {
+	getInfo := []byte{0x57, 0xAB, 0x00, 0x01, 0x00, 0x00}
+	getInfo[5] = calcChecksum(getInfo[:5])
+	if _, err := port.Write(getInfo); err != nil {
+		return "", err
+	}
+	parser := &frameParser{}
+	err := readProbe(port, func(data []byte) bool {
+		for _, f := range parser.Feed(data) {
+			if f.cmd == 0x81 {
+				return true
+			}
+		}
+		return false
+	})
+	if err == nil {
+		return BackendCH9329, nil
+	}
+
+	// Reset the remdeshid operation queue, which may hold the bytes above, then ping
+	if _, err := port.Write([]byte{remdesOprDataReset, remdesOprPing, 0x00, 0x00}); err != nil {
+		return "", err
+	}
+	received := []byte{}
+	err = readProbe(port, func(data []byte) bool {
+		received = append(received, data...)
+		return len(received) >= 4 && bytes.Equal(received[len(received)-4:], []byte{0x00, 0x00, 0x00, 0x00})
+	})
+	if err == nil {
+		return BackendRemdesHID, nil
+	}
+	return "", errors.New("no supported HID firmware detected")
+}
+
+// readProbe reads from the transport until done returns true or the probe times out
+func readProbe(port Transport, done func(data []byte) bool) error {
+	buf := make([]byte, 256)
+	deadline := time.Now().Add(backendProbeTimeout)
+	for time.Now().Before(deadline) {
+		n, err := port.Read(buf)
+		if n > 0 && done(buf[:n]) {
+			return nil
+		}
+		if err != nil && err != io.EOF {
+			return err
+		}
+	}
+	return errors.New("timeout waiting for probe reply")
+}
+
+// BackendName returns the name of the HID backend used by the controller
+func (c *Controller) BackendName() string {
+	return c.backend.Name()
+}
+
+// invalidBackend stands in for an unknown or undetected backend, all input fails with its error
+type invalidBackend struct {
+	name string
+	err  error
+}
+
+func (b *invalidBackend) Name() string                   { return b.name }
+func (b *invalidBackend) Reset() error                   { return b.err }
+func (b *invalidBackend) HandleIncomingData(data []byte) {}
+func (b *invalidBackend) SendKeyboardReport(modkey uint8, keys [6]uint8) ([]byte, error) {
+	return nil, b.err
+}
+func (b *invalidBackend) SendMouseRelative(buttons uint8, dx, dy, wheel uint8, wait bool) ([]byte, error) {
+	return nil, b.err
+}
+func (b *invalidBackend) SendMouseAbsolute(buttons uint8, x, y uint16, wait bool) ([]byte, error) {
+	return nil, b.err
+}
+func (b *invalidBackend) SendMultimediaReport(keys [3]uint8) ([]byte, error) { return nil, b.err }
+func (b *invalidBackend) SendSystemKeyReport(keys uint8) ([]byte, error)     { return nil, b.err }
+func (b *invalidBackend) GetStatus() (*ChipStatus, error)                    { return nil, b.err }
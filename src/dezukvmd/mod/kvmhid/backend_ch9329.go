@@ -0,0 +1,148 @@
+package kvmhid
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+/*
+	backend_ch9329.go
+
+	CH9329 backend. Every report is a frame that the chip acknowledges,
+	see frame.go for the framing and reply matching.
+*/
+
+type ch9329Backend struct {
+	c *Controller
+}
+
+func (b *ch9329Backend) Name() string {
+	return BackendCH9329
+}
+
+// Reset clears the chip command queue
+func (b *ch9329Backend) Reset() error {
+	return b.c.Send([]byte{0xFF})
+}
+
+func (b *ch9329Backend) HandleIncomingData(data []byte) {
+	b.c.handleIncomingData(data)
+}
+
+func (b *ch9329Backend) send(packet []byte, wait bool) ([]byte, error) {
+	if !wait {
+		return nil, b.c.sendPipelined(packet)
+	}
+	return b.c.sendAndWait(packet)
+}
+
+func (b *ch9329Backend) SendKeyboardReport(modkey uint8, keys [6]uint8) ([]byte, error) {
+	// Prepare the packet
+	packet := []uint8{
+		0x57, 0xAB, 0x00, 0x02, 0x08,
+		modkey, 0x00,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x00,
+	}
+
+	// Populate the HID keycodes
+	for i := 0; i < len(keys); i++ {
+		packet[7+i] = keys[i]
+	}
+
+	// Calculate checksum
+	packet[13] = calcChecksum(packet[:13])
+	return b.send(packet, true)
+}
+
+func (b *ch9329Backend) SendMouseRelative(buttons uint8, dx, dy, wheel uint8, wait bool) ([]byte, error) {
+	// Ensure 0x80 is not used
+	if dx == 0x80 {
+		dx = 0x81
+	}
+	if dy == 0x80 {
+		dy = 0x81
+	}
+
+	packet := []uint8{
+		0x57, 0xAB, 0x00, 0x05, 0x05, 0x01,
+		buttons,
+		dx,    // Delta X
+		dy,    // Delta Y
+		wheel, // Scroll wheel
+		0x00,  // Checksum placeholder
+	}
+
+	packet[10] = calcChecksum(packet[:10])
+	return b.send(packet, wait)
+}
+
+func (b *ch9329Backend) SendMouseAbsolute(buttons uint8, x, y uint16, wait bool) ([]byte, error) {
+	packet := []uint8{
+		0x57, 0xAB, 0x00, 0x04, 0x07, 0x02,
+		buttons,
+		byte(x & 0xFF),        // X LSB
+		byte((x >> 8) & 0xFF), // X MSB
+		byte(y & 0xFF),        // Y LSB
+		byte((y >> 8) & 0xFF), // Y MSB
+		0x00,                  // Scroll
+		0x00,                  // Checksum placeholder
+	}
+
+	packet[12] = calcChecksum(packet[:12])
+	return b.send(packet, wait)
+}
+
+func (b *ch9329Backend) SendMultimediaReport(keys [3]uint8) ([]byte, error) {
+	packet := []uint8{
+		0x57, 0xAB, 0x00, 0x03, 0x04,
+		mediaReportIDMultimedia,
+		keys[0], keys[1], keys[2],
+		0x00, // Checksum placeholder
+	}
+	packet[9] = calcChecksum(packet[:9])
+	return b.send(packet, true)
+}
+
+func (b *ch9329Backend) SendSystemKeyReport(keys uint8) ([]byte, error) {
+	packet := []uint8{
+		0x57, 0xAB, 0x00, 0x03, 0x02,
+		mediaReportIDACPI,
+		keys,
+		0x00, // Checksum placeholder
+	}
+	packet[7] = calcChecksum(packet[:7])
+	return b.send(packet, true)
+}
+
+// GetStatus sends the GET_INFO command (0x01)
+func (b *ch9329Backend) GetStatus() (*ChipStatus, error) {
+	cmd := []byte{0x57, 0xAB,
+		0x00, 0x01, 0x00,
+		0x00, //placeholder for checksum
+	}
+	cmd[5] = calcChecksum(cmd[:5])
+
+	resp, err := b.c.sendAndWait(cmd)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp) < 3 {
+		return nil, errors.New("invalid response length")
+	}
+
+	// resp[0]: version, 0x30 is V1.0
+	// resp[1]: 0x01 if the target has enumerated the USB device
+	// resp[2]: keyboard LED bits
+	leds := resp[2]
+	return &ChipStatus{
+		Online:          true,
+		Version:         fmt.Sprintf("V%d.%d", (resp[0]>>4)-2, resp[0]&0x0F),
+		TargetConnected: resp[1] == 0x01,
+		NumLock:         leds&LED_NUM_LOCK != 0,
+		CapsLock:        leds&LED_CAPS_LOCK != 0,
+		ScrollLock:      leds&LED_SCROLL_LOCK != 0,
+		UpdatedAt:       time.Now().UnixMilli(),
+	}, nil
+}
@@ -0,0 +1,275 @@
+package kvmhid
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+/*
+	backend_hidg.go
+
+	Backend for the Linux USB gadget HID functions, for SBCs with a USB OTG
+	port that is plugged into the target directly. The keyboard function
+	takes 8 byte boot keyboard reports and sends the LED output reports of
+	the target back, the mouse function takes absolute reports of the form
+
+	<buttons> <x LSB> <x MSB> <y LSB> <y MSB> <wheel>
+
+	with x and y in the range 0 - 4095, see gadget.go for the report
+	descriptors and the configfs setup.
+
+	Both devices are wrapped in a GadgetTransport, so the controller
+	supervises and reopens them like a serial port. Every write to the
+	transport starts with the index of the function it is for.
+
+	The gadget has no relative mouse, multimedia or system key function.
+*/
+
+// Functions of the gadget, the first byte of every write to a GadgetTransport
+const (
+	gadgetKeyboard = 0x00
+	gadgetMouse    = 0x01
+)
+
+const (
+	DefaultGadgetKeyboardDevice = "/dev/hidg0"
+	DefaultGadgetMouseDevice    = "/dev/hidg1"
+)
+
+const gadgetReadTimeout = 500 * time.Millisecond // Read returns nothing after this long without an LED report
+
+// udcClassDir lists the USB device controllers and their state
+const udcClassDir = "/sys/class/udc"
+
+// GadgetTransport writes reports to the keyboard and mouse gadget devices and
+// reads the keyboard LED reports of the target
+type GadgetTransport struct {
+	keyboard  *os.File
+	mouse     *os.File
+	leds      chan byte
+	readErr   chan error
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// OpenGadget opens the keyboard and mouse gadget devices, e.g. /dev/hidg0 and /dev/hidg1
+func OpenGadget(keyboardDevice, mouseDevice string) (*GadgetTransport, error) {
+	keyboard, err := os.OpenFile(keyboardDevice, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	mouse, err := os.OpenFile(mouseDevice, os.O_WRONLY, 0)
+	if err != nil {
+		keyboard.Close()
+		return nil, err
+	}
+	t := &GadgetTransport{
+		keyboard: keyboard,
+		mouse:    mouse,
+		leds:     make(chan byte, 16),
+		readErr:  make(chan error, 1),
+		closed:   make(chan struct{}),
+	}
+	go t.readLEDs()
+	return t, nil
+}
+
+// readLEDs reads the LED output reports from the keyboard device until it is closed
+func (t *GadgetTransport) readLEDs() {
+	buf := make([]byte, 8)
+	for {
+		n, err := t.keyboard.Read(buf)
+		if n > 0 {
+			select {
+			case t.leds <- buf[0]:
+			case <-t.closed:
+				return
+			}
+		}
+		if err == io.EOF {
+			// A plain file instead of a gadget device, there are no LED reports
+			return
+		}
+		if err != nil {
+			t.readErr <- err
+			return
+		}
+	}
+}
+
+// Read returns the LED report bytes received so far, or nothing after a short timeout
+func (t *GadgetTransport) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	select {
+	case led := <-t.leds:
+		p[0] = led
+		return 1, nil
+	case err := <-t.readErr:
+		return 0, err
+	case <-t.closed:
+		return 0, errors.New("gadget closed")
+	case <-time.After(gadgetReadTimeout):
+		return 0, nil
+	}
+}
+
+// Write sends a report to the function given in its first byte
+func (t *GadgetTransport) Write(p []byte) (int, error) {
+	if len(p) < 2 {
+		return 0, errors.New("invalid gadget report")
+	}
+	var device *os.File
+	switch p[0] {
+	case gadgetKeyboard:
+		device = t.keyboard
+	case gadgetMouse:
+		device = t.mouse
+	default:
+		return 0, fmt.Errorf("unknown gadget function: %d", p[0])
+	}
+	if _, err := device.Write(p[1:]); err != nil {
+		if errors.Is(err, syscall.ESHUTDOWN) {
+			// The target has not enumerated the gadget, the report is dropped like on a CH9329
+			return len(p), nil
+		}
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (t *GadgetTransport) Close() error {
+	var err error
+	t.closeOnce.Do(func() {
+		close(t.closed)
+		err = errors.Join(t.keyboard.Close(), t.mouse.Close())
+	})
+	return err
+}
+
+// isGadgetDevice returns true if the port is a USB gadget HID device
+func isGadgetDevice(portName string) bool {
+	return strings.HasPrefix(filepath.Base(portName), "hidg")
+}
+
+// gadgetMouseDevice returns the mouse device of the hidg backend
+func (c *Controller) gadgetMouseDevice() string {
+	if c.Config.GadgetMouseDevice == "" {
+		return DefaultGadgetMouseDevice
+	}
+	return c.Config.GadgetMouseDevice
+}
+
+type hidgBackend struct {
+	c *Controller
+
+	mu   sync.Mutex
+	x, y uint16 // Last absolute position, reports without one stay there
+	leds uint8  // Last LED report of the target
+}
+
+func (b *hidgBackend) Name() string {
+	return BackendHIDGadget
+}
+
+func (b *hidgBackend) send(function byte, report []byte) error {
+	return b.c.Send(append([]byte{function}, report...))
+}
+
+// Reset releases all keys and mouse buttons
+func (b *hidgBackend) Reset() error {
+	_, kbErr := b.SendKeyboardReport(0x00, [6]uint8{})
+	_, mouseErr := b.SendMouseRelative(0x00, 0, 0, 0, false)
+	return errors.Join(kbErr, mouseErr)
+}
+
+// HandleIncomingData records the LED reports of the target
+func (b *hidgBackend) HandleIncomingData(data []byte) {
+	if len(data) == 0 {
+		return
+	}
+	b.mu.Lock()
+	b.leds = data[len(data)-1]
+	b.mu.Unlock()
+}
+
+func (b *hidgBackend) SendKeyboardReport(modkey uint8, keys [6]uint8) ([]byte, error) {
+	report := []byte{modkey, 0x00, keys[0], keys[1], keys[2], keys[3], keys[4], keys[5]}
+	return nil, b.send(gadgetKeyboard, report)
+}
+
+// SendMouseRelative can only change the buttons and the wheel, the pointer stays at the last absolute position
+func (b *hidgBackend) SendMouseRelative(buttons uint8, dx, dy, wheel uint8, wait bool) ([]byte, error) {
+	if dx != 0 || dy != 0 {
+		return nil, fmt.Errorf("relative mouse is %w, use absolute mouse mode", ErrUnsupportedByBackend)
+	}
+	b.mu.Lock()
+	x, y := b.x, b.y
+	b.mu.Unlock()
+	return nil, b.send(gadgetMouse, gadgetMouseReport(buttons, x, y, wheel))
+}
+
+func (b *hidgBackend) SendMouseAbsolute(buttons uint8, x, y uint16, wait bool) ([]byte, error) {
+	b.mu.Lock()
+	b.x, b.y = x, y
+	b.mu.Unlock()
+	return nil, b.send(gadgetMouse, gadgetMouseReport(buttons, x, y, 0x00))
+}
+
+func gadgetMouseReport(buttons uint8, x, y uint16, wheel uint8) []byte {
+	return []byte{buttons, byte(x & 0xFF), byte(x >> 8), byte(y & 0xFF), byte(y >> 8), wheel}
+}
+
+func (b *hidgBackend) SendMultimediaReport(keys [3]uint8) ([]byte, error) {
+	if keys == [3]uint8{} {
+		// Nothing can be held, so releasing always succeeds
+		return nil, nil
+	}
+	return nil, fmt.Errorf("multimedia keys are %w", ErrUnsupportedByBackend)
+}
+
+func (b *hidgBackend) SendSystemKeyReport(keys uint8) ([]byte, error) {
+	if keys == 0x00 {
+		return nil, nil
+	}
+	return nil, fmt.Errorf("system keys are %w", ErrUnsupportedByBackend)
+}
+
+// GetStatus returns the last LED report, the target is connected once a USB device controller is configured
+func (b *hidgBackend) GetStatus() (*ChipStatus, error) {
+	if !b.c.serialRunning.Load() {
+		return nil, errors.New("gadget devices are not open")
+	}
+	b.mu.Lock()
+	leds := b.leds
+	b.mu.Unlock()
+	return &ChipStatus{
+		Online:          true,
+		Version:         BackendHIDGadget,
+		TargetConnected: udcConfigured(),
+		NumLock:         leds&LED_NUM_LOCK != 0,
+		CapsLock:        leds&LED_CAPS_LOCK != 0,
+		ScrollLock:      leds&LED_SCROLL_LOCK != 0,
+		UpdatedAt:       time.Now().UnixMilli(),
+	}, nil
+}
+
+// udcConfigured returns true if any USB device controller was configured by its host
+func udcConfigured() bool {
+	states, _ := filepath.Glob(filepath.Join(udcClassDir, "*", "state"))
+	for _, state := range states {
+		content, err := os.ReadFile(state)
+		if err == nil && strings.TrimSpace(string(content)) == "configured" {
+			return true
+		}
+	}
+	return false
+}
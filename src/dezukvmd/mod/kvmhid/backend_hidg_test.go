@@ -0,0 +1,183 @@
+package kvmhid
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newGadgetController creates a hidg controller writing its reports to plain files
+func newGadgetController(t *testing.T) (*Controller, string, string) {
+	t.Helper()
+	dir := t.TempDir()
+	keyboard := filepath.Join(dir, "hidg0")
+	mouse := filepath.Join(dir, "hidg1")
+	for _, path := range []string{keyboard, mouse} {
+		if err := os.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c := NewHIDController(&Config{
+		PortName:           keyboard,
+		ScrollSensitivity:  0x01,
+		StatusPollInterval: time.Hour,
+		Backend:            BackendAuto,
+		GadgetMouseDevice:  mouse,
+	})
+	if err := c.Connect(); err != nil {
+		t.Fatalf("failed to open gadget files: %v", err)
+	}
+	t.Cleanup(c.Close)
+	return c, keyboard, mouse
+}
+
+// readReports waits until the file holds n reports of the given size and returns them
+func readReports(t *testing.T, path string, size int, n int) [][]byte {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(data) >= size*n || time.Now().After(deadline) {
+			if len(data)%size != 0 {
+				t.Fatalf("%s holds %d bytes, not a multiple of the %d byte report", path, len(data), size)
+			}
+			reports := [][]byte{}
+			for i := 0; i < len(data); i += size {
+				reports = append(reports, data[i:i+size])
+			}
+			return reports
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func checkReports(t *testing.T, name string, got [][]byte, want [][]byte) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("%s: got reports %X, want %X", name, got, want)
+	}
+	for i := range want {
+		if !bytes.Equal(got[i], want[i]) {
+			t.Errorf("%s: report %d is %X, want %X", name, i, got[i], want[i])
+		}
+	}
+}
+
+func TestGadgetKeyboardReports(t *testing.T) {
+	c, keyboard, _ := newGadgetController(t)
+	if name := c.BackendName(); name != BackendHIDGadget {
+		t.Fatalf("%s detected as %q", keyboard, name)
+	}
+
+	if _, err := c.PressHIDUsage(0xE1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.PressHIDUsage(0x04); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.ReleaseAll(); err != nil {
+		t.Fatal(err)
+	}
+	checkReports(t, "keyboard", readReports(t, keyboard, 8, 4), [][]byte{
+		{0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}, // Reset on connect
+		{0x02, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00},
+		{0x02, 0x00, 0x04, 0x00, 0x00, 0x00, 0x00, 0x00},
+		{0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00},
+	})
+
+	if _, err := c.PressMediaKey("volume_up"); !errors.Is(err, ErrUnsupportedByBackend) {
+		t.Errorf("got %v for a media key, want %v", err, ErrUnsupportedByBackend)
+	}
+}
+
+func TestGadgetMouseReports(t *testing.T) {
+	c, _, mouse := newGadgetController(t)
+
+	if _, err := c.MouseMoveAbsolute(0x00, 0x08, 0x34, 0x02); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.MouseButtonPress(0x01); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.MouseScroll(-1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.MouseButtonRelease(0x01); err != nil {
+		t.Fatal(err)
+	}
+	checkReports(t, "mouse", readReports(t, mouse, 6, 5), [][]byte{
+		{0x00, 0x00, 0x00, 0x00, 0x00, 0x00}, // Reset on connect
+		{0x00, 0x00, 0x08, 0x34, 0x02, 0x00},
+		{0x01, 0x00, 0x08, 0x34, 0x02, 0x00},
+		{0x01, 0x00, 0x08, 0x34, 0x02, 0x01},
+		{0x00, 0x00, 0x08, 0x34, 0x02, 0x00},
+	})
+
+	if _, err := c.MouseMoveRelativeDelta(10, 0); !errors.Is(err, ErrUnsupportedByBackend) {
+		t.Errorf("got %v for a relative move, want %v", err, ErrUnsupportedByBackend)
+	}
+}
+
+func TestGadgetKeyboardReportDescKeyRange(t *testing.T) {
+	// Walk the short items of the descriptor up to the key array input
+	var logicalMax, usageMin, usageMax uint32
+	found := false
+	desc := gadgetKeyboardReportDesc
+	for i := 0; i < len(desc); {
+		prefix := desc[i]
+		size := int(prefix & 0x03)
+		if size == 3 {
+			size = 4
+		}
+		if i+1+size > len(desc) {
+			t.Fatalf("item at offset %d runs past the descriptor", i)
+		}
+		var value uint32
+		for j := 0; j < size; j++ {
+			value |= uint32(desc[i+1+j]) << (8 * j)
+		}
+		i += 1 + size
+
+		switch prefix & 0xFC {
+		case 0x24: // Logical Maximum
+			logicalMax = value
+		case 0x18: // Usage Minimum
+			usageMin = value
+		case 0x28: // Usage Maximum
+			usageMax = value
+		case 0x80: // Input
+			if value&0x02 == 0 {
+				found = true
+			}
+		}
+		if found {
+			break
+		}
+	}
+	if !found {
+		t.Fatal("no key array input in the keyboard report descriptor")
+	}
+
+	usages := map[string][]uint8{
+		"F13 - F24":        {0x68, 0x69, 0x6A, 0x6B, 0x6C, 0x6D, 0x6E, 0x6F, 0x70, 0x71, 0x72, 0x73},
+		"International1":   {0x87},
+		"International3":   {0x89},
+		"LANG1 - LANG5":    {0x90, 0x91, 0x92, 0x93, 0x94},
+		"Keyboard a and A": {0x04},
+	}
+	for name, codes := range usages {
+		for _, code := range codes {
+			if uint32(code) < usageMin || uint32(code) > usageMax || uint32(code) > logicalMax {
+				t.Errorf("%s usage 0x%02X outside the key array range 0x%02X - 0x%02X, logical max 0x%02X",
+					name, code, usageMin, usageMax, logicalMax)
+			}
+		}
+	}
+}
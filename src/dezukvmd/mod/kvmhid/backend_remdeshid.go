@@ -0,0 +1,439 @@
+package kvmhid
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+/*
+	backend_remdeshid.go
+
+	Backend for the CH552G firmware of the v1 and v2 PCBs (remdeshid, see
+	firmware/For v1 and 2 PCB). The firmware takes operations of the form
+
+	<opr_type> <opr_subtype> <payload>
+
+	e.g. 0x01 0x02 'a' to press the A key, and answers every byte it
+	receives with one response byte, the last one of an operation being
+	its result. Keys and buttons are sent as press and release events,
+	so each report is compared with the previous one and only the keys
+	that changed are sent.
+
+	The firmware only emulates a relative mouse, has no multimedia or
+	system keys and cannot report the target keyboard LEDs.
+*/
+
+// Operation types of the remdeshid firmware
+const (
+	remdesOprPing          = 0x00
+	remdesOprKeyboardWrite = 0x01
+	remdesOprMouseWrite    = 0x02
+	remdesOprMouseMove     = 0x03
+	remdesOprMouseScroll   = 0x04
+	remdesOprDataReset     = 0xFF
+)
+
+// Keyboard sub-types, release is always press + 1
+const (
+	remdesKeyboardASCIIPress    = 0x02
+	remdesKeyboardModifierPress = 0x04
+	remdesKeyboardFuncKeyPress  = 0x06
+	remdesKeyboardOtherKeyPress = 0x08
+	remdesKeyboardNumpadPress   = 0x0A
+	remdesKeyboardPause         = 0xF9
+	remdesKeyboardPrintScreen   = 0xFA
+	remdesKeyboardScrollLock    = 0xFB
+	remdesKeyboardReset         = 0xFE
+)
+
+// Mouse sub-types and buttons
+const (
+	remdesMousePress   = 0x02
+	remdesMouseRelease = 0x03
+	remdesMouseReset   = 0x05
+
+	remdesMouseButtonLeft   = 0x01
+	remdesMouseButtonRight  = 0x02
+	remdesMouseButtonMiddle = 0x03
+)
+
+// remdesMaxMouseStep is the largest move the firmware accepts per operation
+const remdesMaxMouseStep = 0x7E
+
+// remdesResponses are the response codes of the firmware
+var remdesResponses = map[byte]string{
+	0x01: "unknown operation",
+	0x02: "invalid operation type",
+	0x03: "invalid key value",
+	0x04: "not implemented",
+}
+
+// remdesKey is how a HID usage is sent to the firmware
+type remdesKey struct {
+	subtype uint8 // Sub-type to press the key
+	payload uint8
+	tap     bool // The firmware presses and releases the key itself, nothing is sent on release
+}
+
+// remdesKeys maps HID usage codes to firmware keys
+var remdesKeys = map[uint8]remdesKey{}
+
+func init() {
+	ascii := func(usage uint8, char byte) {
+		remdesKeys[usage] = remdesKey{subtype: remdesKeyboardASCIIPress, payload: char}
+	}
+	for usage := uint8(0x04); usage <= 0x1D; usage++ {
+		ascii(usage, 'a'+usage-0x04)
+	}
+	for usage := uint8(0x1E); usage <= 0x26; usage++ {
+		ascii(usage, '1'+usage-0x1E)
+	}
+	ascii(0x27, '0')
+	for usage, char := range map[uint8]byte{
+		0x2C: ' ', 0x2D: '-', 0x2E: '=', 0x2F: '[', 0x30: ']', 0x31: '\\',
+		0x33: ';', 0x34: '\'', 0x35: '`', 0x36: ',', 0x37: '.', 0x38: '/',
+	} {
+		ascii(usage, char)
+	}
+
+	// Function and other keys use the Arduino key codes, which are the HID usage + 136
+	funcKeys := []uint8{}
+	for usage := uint8(0x3A); usage <= 0x45; usage++ {
+		funcKeys = append(funcKeys, usage) // F1 - F12
+	}
+	for usage := uint8(0x68); usage <= 0x73; usage++ {
+		funcKeys = append(funcKeys, usage) // F13 - F24
+	}
+	for _, usage := range funcKeys {
+		remdesKeys[usage] = remdesKey{subtype: remdesKeyboardFuncKeyPress, payload: usage + 136}
+	}
+	otherKeys := []uint8{0x28, 0x29, 0x2A, 0x2B, 0x39} // Enter, Escape, Backspace, Tab, Caps Lock
+	for usage := uint8(0x49); usage <= 0x52; usage++ {
+		otherKeys = append(otherKeys, usage) // Insert, Home, Page Up, Delete, End, Page Down, arrows
+	}
+	for _, usage := range otherKeys {
+		remdesKeys[usage] = remdesKey{subtype: remdesKeyboardOtherKeyPress, payload: usage + 136}
+	}
+
+	// Numpad keys have their own IDs
+	numpad := map[uint8]uint8{
+		0x62: 0x00, 0x63: 0x0A, 0x55: 0x0B, 0x54: 0x0C, 0x57: 0x0D, 0x56: 0x0E, 0x58: 0x0F, 0x53: 0x10,
+	}
+	for usage := uint8(0x59); usage <= 0x61; usage++ {
+		numpad[usage] = usage - 0x58 // Keypad 1 - 9
+	}
+	for usage, id := range numpad {
+		remdesKeys[usage] = remdesKey{subtype: remdesKeyboardNumpadPress, payload: id}
+	}
+
+	remdesKeys[0x46] = remdesKey{subtype: remdesKeyboardPrintScreen, tap: true}
+	remdesKeys[0x47] = remdesKey{subtype: remdesKeyboardScrollLock, tap: true}
+	remdesKeys[0x48] = remdesKey{subtype: remdesKeyboardPause, tap: true}
+}
+
+type remdesHIDBackend struct {
+	c *Controller
+
+	// Last state sent to the firmware
+	modkey  uint8
+	keys    [6]uint8
+	buttons uint8
+	stateMu sync.Mutex
+
+	// Every byte sent is answered by one response byte, counted to find the result of an operation
+	sent     uint64
+	received uint64
+	waiters  []*remdesWaiter
+	ackMu    sync.Mutex
+}
+
+// remdesWaiter waits for the response to the byte at position until
+type remdesWaiter struct {
+	until uint64
+	done  chan error
+}
+
+func newRemdesHIDBackend(c *Controller) *remdesHIDBackend {
+	return &remdesHIDBackend{c: c}
+}
+
+func (b *remdesHIDBackend) Name() string {
+	return BackendRemdesHID
+}
+
+// Reset clears the firmware operation queue and releases all keys and mouse buttons
+func (b *remdesHIDBackend) Reset() error {
+	b.stateMu.Lock()
+	defer b.stateMu.Unlock()
+	b.modkey = 0x00
+	b.keys = [6]uint8{}
+	b.buttons = 0x00
+
+	b.ackMu.Lock()
+	b.sent, b.received = 0, 0
+	waiters := b.waiters
+	b.waiters = nil
+	b.ackMu.Unlock()
+	for _, w := range waiters {
+		w.done <- errors.New("device was reset")
+	}
+
+	return b.send([]byte{remdesOprDataReset,
+		remdesOprKeyboardWrite, remdesKeyboardReset, 0x00,
+		remdesOprMouseWrite, remdesMouseReset, 0x00,
+	}, false)
+}
+
+// HandleIncomingData matches response bytes to the operations waiting for them
+func (b *remdesHIDBackend) HandleIncomingData(data []byte) {
+	b.ackMu.Lock()
+	defer b.ackMu.Unlock()
+	for _, code := range data {
+		b.received++
+		answered := false
+		for len(b.waiters) > 0 && b.waiters[0].until <= b.received {
+			w := b.waiters[0]
+			b.waiters = b.waiters[1:]
+			if w.until == b.received {
+				w.done <- remdesResponseError(code)
+				answered = true
+			}
+		}
+		if !answered && code != 0x00 {
+			log.Printf("remdeshid operation failed: %v", remdesResponseError(code))
+		}
+	}
+}
+
+func remdesResponseError(code byte) error {
+	if code == 0x00 {
+		return nil
+	}
+	if reason, ok := remdesResponses[code]; ok {
+		return errors.New("device returned error: " + reason)
+	}
+	return fmt.Errorf("device returned error 0x%02X", code)
+}
+
+// send writes an operation and, if wait is set, waits for its result
+func (b *remdesHIDBackend) send(op []byte, wait bool) error {
+	b.ackMu.Lock()
+	if err := b.c.Send(op); err != nil {
+		b.ackMu.Unlock()
+		return err
+	}
+	b.sent += uint64(len(op))
+	var w *remdesWaiter
+	if wait {
+		w = &remdesWaiter{until: b.sent, done: make(chan error, 1)}
+		b.waiters = append(b.waiters, w)
+	}
+	b.ackMu.Unlock()
+	if w == nil {
+		return nil
+	}
+
+	select {
+	case err := <-w.done:
+		return err
+	case <-time.After(CommandReplyTimeout):
+		b.ackMu.Lock()
+		for i, pending := range b.waiters {
+			if pending == w {
+				b.waiters = append(b.waiters[:i], b.waiters[i+1:]...)
+				break
+			}
+		}
+		b.ackMu.Unlock()
+		return errors.New("timeout waiting for reply")
+	}
+}
+
+// sendAll sends the operations one by one and returns the first error
+func (b *remdesHIDBackend) sendAll(ops [][]byte, wait bool) error {
+	var firstErr error
+	for _, op := range ops {
+		if err := b.send(op, wait); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// keyOp returns the operation pressing or releasing a key, nil if nothing is to be sent
+func remdesKeyOp(usage uint8, press bool) ([]byte, error) {
+	key, ok := remdesKeys[usage]
+	if !ok {
+		return nil, fmt.Errorf("key 0x%02X is %w", usage, ErrUnsupportedByBackend)
+	}
+	if key.tap {
+		if !press {
+			return nil, nil
+		}
+		return []byte{remdesOprKeyboardWrite, key.subtype, 0x00}, nil
+	}
+	subtype := key.subtype
+	if !press {
+		subtype++
+	}
+	return []byte{remdesOprKeyboardWrite, subtype, key.payload}, nil
+}
+
+// SendKeyboardReport sends press and release events for the keys that changed since the last report
+func (b *remdesHIDBackend) SendKeyboardReport(modkey uint8, keys [6]uint8) ([]byte, error) {
+	b.stateMu.Lock()
+	defer b.stateMu.Unlock()
+
+	ops := [][]byte{}
+	var keyErr error
+	// Releases first, so a key moving between slots is not released after being pressed
+	for _, usage := range b.keys {
+		if usage != 0x00 && !containsUsage(keys, usage) {
+			op, err := remdesKeyOp(usage, false)
+			if err != nil {
+				keyErr = err
+			} else if op != nil {
+				ops = append(ops, op)
+			}
+		}
+	}
+	// Modifier IDs of the firmware follow the HID modifier bits
+	for bit := uint8(0); bit < 8; bit++ {
+		mask := uint8(1) << bit
+		if modkey&mask == b.modkey&mask {
+			continue
+		}
+		subtype := uint8(remdesKeyboardModifierPress)
+		if modkey&mask == 0 {
+			subtype++
+		}
+		ops = append(ops, []byte{remdesOprKeyboardWrite, subtype, bit})
+	}
+	for _, usage := range keys {
+		if usage != 0x00 && !containsUsage(b.keys, usage) {
+			op, err := remdesKeyOp(usage, true)
+			if err != nil {
+				keyErr = err
+			} else if op != nil {
+				ops = append(ops, op)
+			}
+		}
+	}
+	b.modkey = modkey
+	b.keys = keys
+
+	if err := b.sendAll(ops, true); err != nil {
+		return nil, err
+	}
+	return nil, keyErr
+}
+
+func containsUsage(keys [6]uint8, usage uint8) bool {
+	for _, key := range keys {
+		if key == usage {
+			return true
+		}
+	}
+	return false
+}
+
+// SendMouseRelative sends the button changes, the move and the scroll as separate operations
+func (b *remdesHIDBackend) SendMouseRelative(buttons uint8, dx, dy, wheel uint8, wait bool) ([]byte, error) {
+	b.stateMu.Lock()
+	defer b.stateMu.Unlock()
+
+	ops := [][]byte{}
+	for _, button := range []struct {
+		mask uint8
+		id   uint8
+	}{
+		{0x01, remdesMouseButtonLeft},
+		{0x02, remdesMouseButtonRight},
+		{0x04, remdesMouseButtonMiddle},
+	} {
+		if buttons&button.mask == b.buttons&button.mask {
+			continue
+		}
+		subtype := uint8(remdesMousePress)
+		if buttons&button.mask == 0 {
+			subtype = remdesMouseRelease
+		}
+		ops = append(ops, []byte{remdesOprMouseWrite, subtype, button.id})
+	}
+	b.buttons = buttons
+
+	x, y := int(int8(dx)), int(int8(dy))
+	for x != 0 || y != 0 {
+		stepX := clampRemdesStep(x)
+		stepY := clampRemdesStep(y)
+		ops = append(ops, remdesMouseMoveOp(stepX, stepY))
+		x -= stepX
+		y -= stepY
+	}
+
+	if tilt := int(int8(wheel)); tilt != 0 {
+		direction := uint8(0x00) // Up
+		if tilt < 0 {
+			direction = 0x01 // Down
+			tilt = -tilt
+		}
+		ops = append(ops, []byte{remdesOprMouseScroll, direction, uint8(clampRemdesStep(tilt))})
+	}
+	return nil, b.sendAll(ops, wait)
+}
+
+func clampRemdesStep(delta int) int {
+	if delta > remdesMaxMouseStep {
+		return remdesMaxMouseStep
+	}
+	if delta < -remdesMaxMouseStep {
+		return -remdesMaxMouseStep
+	}
+	return delta
+}
+
+// remdesMouseMoveOp encodes a move as magnitudes followed by sign bytes
+func remdesMouseMoveOp(dx, dy int) []byte {
+	signX, signY := uint8(0x00), uint8(0x00)
+	if dx < 0 {
+		dx, signX = -dx, 0x01
+	}
+	if dy < 0 {
+		dy, signY = -dy, 0x01
+	}
+	return []byte{remdesOprMouseMove, uint8(dx), uint8(dy), signX, signY}
+}
+
+func (b *remdesHIDBackend) SendMouseAbsolute(buttons uint8, x, y uint16, wait bool) ([]byte, error) {
+	return nil, fmt.Errorf("absolute mouse is %w, use relative mouse mode", ErrUnsupportedByBackend)
+}
+
+func (b *remdesHIDBackend) SendMultimediaReport(keys [3]uint8) ([]byte, error) {
+	if keys == [3]uint8{} {
+		// Nothing can be held, so releasing always succeeds
+		return nil, nil
+	}
+	return nil, fmt.Errorf("multimedia keys are %w", ErrUnsupportedByBackend)
+}
+
+func (b *remdesHIDBackend) SendSystemKeyReport(keys uint8) ([]byte, error) {
+	if keys == 0x00 {
+		return nil, nil
+	}
+	return nil, fmt.Errorf("system keys are %w", ErrUnsupportedByBackend)
+}
+
+// GetStatus pings the firmware, it cannot tell if the target enumerated the device or which LEDs are on
+func (b *remdesHIDBackend) GetStatus() (*ChipStatus, error) {
+	if err := b.send([]byte{remdesOprPing, 0x00, 0x00}, true); err != nil {
+		return nil, err
+	}
+	return &ChipStatus{
+		Online:    true,
+		Version:   BackendRemdesHID,
+		UpdatedAt: time.Now().UnixMilli(),
+	}, nil
+}
@@ -0,0 +1,204 @@
+package kvmhid
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// remdesFirmware is a minimal remdeshid firmware, it splits the received bytes into
+// operations and answers every byte with resp_ok. Pings are not recorded as the
+// status poll sends them at any time.
+type remdesFirmware struct {
+	pending   []byte
+	ops       [][]byte
+	outbuf    []byte
+	dataReady chan struct{}
+	closed    bool
+	mu        sync.Mutex
+}
+
+func newRemdesFirmware() *remdesFirmware {
+	return &remdesFirmware{dataReady: make(chan struct{}, 1)}
+}
+
+func (f *remdesFirmware) Read(p []byte) (int, error) {
+	deadline := time.After(emulatorReadTimeout)
+	for {
+		f.mu.Lock()
+		if f.closed {
+			f.mu.Unlock()
+			return 0, errors.New("firmware closed")
+		}
+		if len(f.outbuf) > 0 {
+			n := copy(p, f.outbuf)
+			f.outbuf = f.outbuf[n:]
+			f.mu.Unlock()
+			return n, nil
+		}
+		f.mu.Unlock()
+
+		select {
+		case <-f.dataReady:
+		case <-deadline:
+			return 0, nil
+		}
+	}
+}
+
+func (f *remdesFirmware) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, b := range p {
+		if b == remdesOprDataReset {
+			f.pending = nil
+			f.ops = append(f.ops, []byte{b})
+		} else {
+			f.pending = append(f.pending, b)
+			length := 3
+			if f.pending[0] == remdesOprMouseMove {
+				length = 5
+			}
+			if len(f.pending) == length {
+				if f.pending[0] != remdesOprPing {
+					f.ops = append(f.ops, f.pending)
+				}
+				f.pending = nil
+			}
+		}
+		f.outbuf = append(f.outbuf, 0x00)
+	}
+	select {
+	case f.dataReady <- struct{}{}:
+	default:
+	}
+	return len(p), nil
+}
+
+func (f *remdesFirmware) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closed = true
+	return nil
+}
+
+// takeOps waits for at least n operations, then returns and clears all received so far
+func (f *remdesFirmware) takeOps(n int) [][]byte {
+	deadline := time.Now().Add(time.Second)
+	for {
+		f.mu.Lock()
+		if len(f.ops) >= n || time.Now().After(deadline) {
+			ops := f.ops
+			f.ops = nil
+			f.mu.Unlock()
+			return ops
+		}
+		f.mu.Unlock()
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func newRemdesController(t *testing.T, backend string) (*Controller, *remdesFirmware) {
+	t.Helper()
+	fw := newRemdesFirmware()
+	c := NewHIDController(&Config{
+		PortName:           "remdeshid",
+		BaudRate:           115200,
+		ScrollSensitivity:  0x01,
+		StatusPollInterval: time.Hour,
+		Backend:            backend,
+	})
+	if err := c.ConnectTransport(fw); err != nil {
+		t.Fatalf("failed to connect to firmware: %v", err)
+	}
+	t.Cleanup(c.Close)
+	return c, fw
+}
+
+func checkOps(t *testing.T, name string, got [][]byte, want [][]byte) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("%s: got ops %X, want %X", name, got, want)
+	}
+	for i := range want {
+		if !bytes.Equal(got[i], want[i]) {
+			t.Errorf("%s: op %d is %X, want %X", name, i, got[i], want[i])
+		}
+	}
+}
+
+func TestRemdesHIDKeyboard(t *testing.T) {
+	c, fw := newRemdesController(t, BackendRemdesHID)
+	checkOps(t, "connect", fw.takeOps(3), [][]byte{{0xFF}, {0x01, 0xFE, 0x00}, {0x02, 0x05, 0x00}})
+
+	steps := []struct {
+		name   string
+		action func() ([]byte, error)
+		want   [][]byte
+	}{
+		{"press left shift", func() ([]byte, error) { return c.PressHIDUsage(0xE1) }, [][]byte{{0x01, 0x04, 0x01}}},
+		{"press a", func() ([]byte, error) { return c.PressHIDUsage(0x04) }, [][]byte{{0x01, 0x02, 'a'}}},
+		{"press F1", func() ([]byte, error) { return c.PressHIDUsage(0x3A) }, [][]byte{{0x01, 0x06, 0xC2}}},
+		{"press enter", func() ([]byte, error) { return c.PressHIDUsage(0x28) }, [][]byte{{0x01, 0x08, 0xB0}}},
+		{"press keypad 1", func() ([]byte, error) { return c.PressHIDUsage(0x59) }, [][]byte{{0x01, 0x0A, 0x01}}},
+		{"release all", func() ([]byte, error) { return nil, c.ReleaseAll() }, [][]byte{
+			{0x01, 0x03, 'a'}, {0x01, 0x07, 0xC2}, {0x01, 0x09, 0xB0}, {0x01, 0x0B, 0x01}, {0x01, 0x05, 0x01},
+		}},
+	}
+	for _, step := range steps {
+		if _, err := step.action(); err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		checkOps(t, step.name, fw.takeOps(len(step.want)), step.want)
+	}
+
+	if _, err := c.PressHIDUsage(0x32); !errors.Is(err, ErrUnsupportedByBackend) {
+		t.Errorf("got %v for a key without firmware code, want %v", err, ErrUnsupportedByBackend)
+	}
+}
+
+func TestRemdesHIDMouse(t *testing.T) {
+	c, fw := newRemdesController(t, BackendRemdesHID)
+	fw.takeOps(3)
+
+	if _, err := c.MouseButtonPress(0x01); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.MouseMoveRelativeDelta(200, -5); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.MouseScroll(-1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.MouseButtonRelease(0x01); err != nil {
+		t.Fatal(err)
+	}
+	checkOps(t, "mouse", fw.takeOps(6), [][]byte{
+		{0x02, 0x02, 0x01},
+		{0x03, 0x7E, 0x05, 0x00, 0x01}, {0x03, 0x01, 0x00, 0x00, 0x00}, {0x03, 0x49, 0x00, 0x00, 0x00},
+		{0x04, 0x00, 0x01}, // a negative tilt scrolls up
+		{0x02, 0x03, 0x01},
+	})
+
+	if _, err := c.MouseMoveAbsolute(0x00, 0x08, 0x00, 0x08); !errors.Is(err, ErrUnsupportedByBackend) {
+		t.Errorf("got %v for an absolute move, want %v", err, ErrUnsupportedByBackend)
+	}
+	if _, err := c.GetChipConfig(); err == nil {
+		t.Error("CH9329 configuration was sent to the remdeshid firmware")
+	}
+}
+
+func TestDetectBackend(t *testing.T) {
+	if name, err := DetectBackend(NewEmulator()); err != nil || name != BackendCH9329 {
+		t.Errorf("emulator detected as %q, %v", name, err)
+	}
+	c, _ := newRemdesController(t, BackendAuto)
+	if name := c.BackendName(); name != BackendRemdesHID {
+		t.Errorf("remdeshid firmware detected as %q", name)
+	}
+	if status, err := c.GetChipInfo(); err != nil || !status.Online {
+		t.Errorf("ping failed: %+v, %v", status, err)
+	}
+}
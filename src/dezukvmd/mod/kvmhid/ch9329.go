@@ -8,85 +8,48 @@ import (
 
 func (c *Controller) ConfigureChipTo115200() error {
 	// Send the command to get chip configuration and info
-	currentConfig, err := c.GetChipCurrentConfiguration()
+	currentConfig, err := c.GetChipConfig()
 	if err != nil {
 		fmt.Printf("Error getting current configuration: %v\n", err)
 		return errors.New("failed to get current configuration")
 	}
 
-	// Modify baudrate bytes in the response
-	currentConfig[3] = 0x00 // Baudrate byte 1
-	currentConfig[4] = 0x01 // Baudrate byte 2
-	currentConfig[5] = 0xC2 // Baudrate byte 3
-	currentConfig[6] = 0x00 // Baudrate byte 4
-
+	currentConfig.BaudRate = 115200
 	time.Sleep(1 * time.Second) // Wait for a second before sending the command
-	// Prepare the command to set the new configuration
-	setCmd := append([]byte{0x57, 0xAB, 0x00, 0x09, 0x32}, currentConfig[:50]...)
-	setCmd = append(setCmd, calcChecksum(setCmd[:len(setCmd)-1]))
-
-	err = c.Send(setCmd)
-	if err != nil {
-		fmt.Printf("Error sending configuration command: %v\n", err)
-		return errors.New("failed to send configuration command")
-	}
-
-	// Wait for the reply
-	resp, err := c.WaitForReply(0x09)
+	err = c.SetChipConfig(currentConfig)
 	if err != nil {
 		fmt.Printf("Error waiting for reply: %v\n", err)
 		return errors.New("failed to get reply")
 	}
 
-	fmt.Println()
-	fmt.Print("Reply: ")
-	for _, b := range resp {
-		fmt.Printf("0x%02X ", b)
-	}
-	fmt.Println()
 	fmt.Println("Baudrate updated to 115200 successfully")
 	return nil
 }
 
-func (c *Controller) WriteChipProperties() ([]byte, error) {
-	manufacturerString := []byte{
-		0x57, 0xAB, 0x00, 0x0B,
-		0x09, // Length of payload
-		0x00, // Set manufacturer string
-		0x07, // Length of the USB manufacturer string
-		'i', 'm', 'u', 's', 'l', 'a', 'b',
-		0x00, // Checksum placeholder
-	}
-
-	manufacturerString[14] = calcChecksum(manufacturerString[:14])
-	// Send set manufacturer string
-	err := c.Send(manufacturerString)
-	if err != nil {
-		return nil, fmt.Errorf("failed to send manufacturer string: %v", err)
-	}
-	_, err = c.WaitForReply(0x0B)
+// WriteChipProperties sets the USB manufacturer and product strings reported to the target
+// and enables them in the chip configuration
+func (c *Controller) WriteChipProperties(manufacturer string, product string) ([]byte, error) {
+	err := c.SetUSBString(USBStringManufacturer, manufacturer)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get manufacturer string response: %v", err)
+		return nil, fmt.Errorf("failed to set manufacturer string: %v", err)
 	}
 
-	productString := []byte{
-		0x57, 0xAB, 0x00, 0x0B,
-		0x0B, // Length of the payload
-		0x01, // Set product string
-		0x09, // Length of the USB product string
-		'R', 'e', 'm', 'd', 'e', 's', 'K', 'V', 'M',
-		0x00, // Checksum placeholder
-	}
-
-	productString[16] = calcChecksum(productString[:16])
-	// Send set product string
-	err = c.Send(productString)
+	err = c.SetUSBString(USBStringProduct, product)
 	if err != nil {
-		return nil, fmt.Errorf("failed to send product string: %v", err)
+		return nil, fmt.Errorf("failed to set product string: %v", err)
 	}
-	_, err = c.WaitForReply(0x0B)
+
+	cfg, err := c.GetChipConfig()
 	if err != nil {
-		return nil, fmt.Errorf("failed to get product string response: %v", err)
+		return nil, fmt.Errorf("failed to get chip configuration: %v", err)
+	}
+	if !cfg.CustomStringsEnabled || !cfg.ManufacturerStringEnabled || !cfg.ProductStringEnabled {
+		cfg.CustomStringsEnabled = true
+		cfg.ManufacturerStringEnabled = true
+		cfg.ProductStringEnabled = true
+		if err := c.SetChipConfig(cfg); err != nil {
+			return nil, err
+		}
 	}
 
 	return []byte("OK"), nil
@@ -103,13 +66,7 @@ func (c *Controller) GetChipCurrentConfiguration() ([]byte, error) {
 	}
 
 	cmd[5] = calcChecksum(cmd[:5])
-	err := c.Send(cmd)
-	if err != nil {
-		fmt.Printf("Error sending command: %v\n", err)
-		return nil, errors.New("failed to send command")
-	}
-
-	resp, err := c.WaitForReply(0x08)
+	resp, err := c.sendAndWait(cmd)
 	if err != nil {
 		fmt.Printf("Error waiting for reply: %v\n", err)
 		return nil, errors.New("failed to get reply")
@@ -132,27 +89,38 @@ func (c *Controller) GetChipCurrentConfiguration() ([]byte, error) {
 func (c *Controller) ChipSoftReset() error {
 	//Send the command to get chip configuration and info
 	cmd := []byte{0x57, 0xAB,
-		0x00, 0x0F,
+		0x00, 0x0F, 0x00,
 		0x00, //placeholder for checksum
 	}
 
-	cmd[4] = calcChecksum(cmd[:4])
-	err := c.Send(cmd)
-	if err != nil {
-		fmt.Printf("Error sending command: %v\n", err)
-		return errors.New("failed to send command")
-	}
-
-	_, err = c.WaitForReply(0x0F)
+	cmd[5] = calcChecksum(cmd[:5])
+	_, err := c.sendAndWait(cmd)
 	if err != nil {
 		fmt.Printf("Error waiting for reply: %v\n", err)
 		return errors.New("failed to get reply")
 	}
 
 	fmt.Println("Chip soft reset successfully")
+	c.broadcastChipReset()
 	return nil
 }
 
+// ReleaseAll releases all keyboard keys, modifiers, media keys and mouse buttons on the target
+func (c *Controller) ReleaseAll() error {
+	_, err := c.execute(OpReleaseAll, func() ([]byte, error) {
+		c.hidState.Modkey = 0x00
+		c.hidState.KeyboardButtons = [6]uint8{}
+		if _, err := keyboardSendKeyCombinations(c); err != nil {
+			return nil, err
+		}
+		if err := c.releaseMediaKeys(); err != nil {
+			return nil, err
+		}
+		return c.releaseMouseButtons(0xFF)
+	})
+	return err
+}
+
 func (c *Controller) IsModifierKeys(keycode int) bool {
 	// Modifier keycodes for JavaScript
 	modifierKeys := []int{16, 17, 18, 91} // Shift, Ctrl, Alt, Meta (Windows/Command key)
@@ -185,39 +153,41 @@ func (c *Controller) ConstructAndSendCmd(HIDCommand *HIDCommand) ([]byte, error)
 			return c.SendKeyboardRelease(uint8(146))
 		}
 		return c.SendKeyboardRelease(uint8(HIDCommand.Keycode))
-	case EventTypeMouseMove:
-		//Map mouse button state to HID state
-		leftPressed := (HIDCommand.MouseMoveButtonState & 0x01) != 0
-		middlePressed := (HIDCommand.MouseMoveButtonState & 0x02) != 0
-		rightPressed := (HIDCommand.MouseMoveButtonState & 0x04) != 0
-		if leftPressed {
-			c.hidState.MouseButtons |= 0x01
-		} else {
-			c.hidState.MouseButtons &^= 0x01
+	case EventTypeKeyCodePress:
+		usage, err := KeyboardCodeToHIDUsage(HIDCommand.Code)
+		if err != nil {
+			return nil, err
 		}
-
-		if middlePressed {
-			c.hidState.MouseButtons |= 0x04
-		} else {
-			c.hidState.MouseButtons &^= 0x04
+		return c.PressHIDUsage(usage)
+	case EventTypeKeyCodeRelease:
+		usage, err := KeyboardCodeToHIDUsage(HIDCommand.Code)
+		if err != nil {
+			return nil, err
 		}
-
-		if rightPressed {
-			c.hidState.MouseButtons |= 0x02
-		} else {
-			c.hidState.MouseButtons &^= 0x02
+		return c.ReleaseHIDUsage(usage)
+	case EventTypeMouseMove:
+		//Map mouse button state to HID state, moves without a state keep the held buttons
+		if HIDCommand.MouseMoveButtonState != nil {
+			state := *HIDCommand.MouseMoveButtonState
+			buttons := uint8(0x00)
+			if state&0x01 != 0 {
+				buttons |= 0x01 // Left
+			}
+			if state&0x02 != 0 {
+				buttons |= 0x04 // Middle
+			}
+			if state&0x04 != 0 {
+				buttons |= 0x02 // Right
+			}
+			c.setMouseButtons(buttons)
 		}
 
-		// Update mouse position
-		c.lastCursorEventTime = time.Now().UnixMilli()
+		// Moves are coalesced by the mouse scheduler, only the latest position is sent
 		if HIDCommand.MouseAbsX != 0 || HIDCommand.MouseAbsY != 0 {
-			xLSB := byte(HIDCommand.MouseAbsX & 0xFF)        // Extract LSB of X
-			xMSB := byte((HIDCommand.MouseAbsX >> 8) & 0xFF) // Extract MSB of X
-			yLSB := byte(HIDCommand.MouseAbsY & 0xFF)        // Extract LSB of Y
-			yMSB := byte((HIDCommand.MouseAbsY >> 8) & 0xFF) // Extract MSB of Y
-			return c.MouseMoveAbsolute(xLSB, xMSB, yLSB, yMSB)
+			// Clients send positions on the video, map them onto the target picture
+			c.QueueMouseMoveAbsolute(c.mapAbsolutePosition(HIDCommand.MouseAbsX, HIDCommand.MouseAbsY))
 		} else if HIDCommand.MouseRelX != 0 || HIDCommand.MouseRelY != 0 {
-			//Todo
+			c.QueueMouseMoveRelative(HIDCommand.MouseRelX, HIDCommand.MouseRelY)
 		}
 		return []byte{}, nil
 	case EventTypeMousePress:
@@ -233,12 +203,20 @@ func (c *Controller) ConstructAndSendCmd(HIDCommand *HIDCommand) ([]byte, error)
 		button := uint8(HIDCommand.MouseButton)
 		return c.MouseButtonRelease(button)
 	case EventTypeMouseScroll:
-		if time.Now().UnixMilli()-c.lastCursorEventTime < MinCusorEventInterval {
-			// Ignore mouse move events that are too close together
-			return []byte{}, nil
-		}
-		c.lastCursorEventTime = time.Now().UnixMilli()
-		return c.MouseScroll(HIDCommand.MouseScroll)
+		c.QueueMouseScroll(HIDCommand.MouseScroll)
+		return []byte{}, nil
+	case EventTypeMediaKeyPress:
+		return c.PressMediaKey(HIDCommand.MediaKey)
+	case EventTypeMediaKeyRelease:
+		return c.ReleaseMediaKey(HIDCommand.MediaKey)
+	case EventTypeReleaseAll:
+		return []byte{}, c.ReleaseAll()
+	case EventTypeTypeText:
+		_, err := c.StartTypeText(HIDCommand.Text, HIDCommand.Layout, time.Duration(HIDCommand.KeyInterval)*time.Millisecond)
+		return []byte{}, err
+	case EventTypeTypeTextCancel:
+		c.CancelTypeText()
+		return []byte{}, nil
 	case EventTypeHIDReset:
 		return []byte{}, c.ChipSoftReset()
 	default:
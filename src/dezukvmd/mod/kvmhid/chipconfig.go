@@ -0,0 +1,246 @@
+package kvmhid
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+/*
+	chipconfig.go
+
+	Typed access to the CH9329 parameter configuration
+	(CMD_GET_PARA_CFG 0x08 / CMD_SET_PARA_CFG 0x09) and the
+	custom USB strings (CMD_GET_USB_STRING 0x0A / CMD_SET_USB_STRING 0x0B).
+
+	Parameter configuration layout (50 bytes):
+	0       work mode
+	1       serial communication mode
+	2       serial address
+	3-6     baud rate (big endian)
+	7-8     reserved
+	9-10    serial packet interval in ms (big endian)
+	11-12   USB VID (little endian)
+	13-14   USB PID (little endian)
+	15-16   ASCII mode keyboard upload interval in ms (big endian)
+	17-18   ASCII mode keyboard release delay in ms (big endian)
+	19      ASCII mode auto enter flag
+	20-27   ASCII mode carriage return characters
+	28-43   ASCII mode filter start and end strings
+	44      USB string enable flags
+	45      ASCII mode keyboard fast upload flag
+	46-49   reserved
+
+	Changes to the parameter configuration take effect after the chip is reset.
+*/
+
+const (
+	chipConfigLength   = 50
+	MaxUSBStringLength = 23 // Longest custom USB string the chip accepts
+)
+
+// USB string enable flags, byte 44 of the parameter configuration
+const (
+	usbStringEnableCustom       = 0x80
+	usbStringEnableManufacturer = 0x04
+	usbStringEnableProduct      = 0x02
+	usbStringEnableSerial       = 0x01
+)
+
+type USBStringType uint8
+
+const (
+	USBStringManufacturer USBStringType = 0x00
+	USBStringProduct      USBStringType = 0x01
+	USBStringSerial       USBStringType = 0x02
+)
+
+// supportedBaudRates are the serial baud rates the CH9329 can be configured to
+var supportedBaudRates = []uint32{1200, 2400, 4800, 9600, 14400, 19200, 38400, 57600, 115200}
+
+// ChipConfig is the parameter configuration of the CH9329
+type ChipConfig struct {
+	WorkMode                  uint8  `json:"work_mode"`                    // 0x00 keyboard + mouse + custom HID, 0x01 keyboard only, 0x02 mouse only, 0x03 custom HID only. 0x80 - 0x83 for the same modes set by hardware pins
+	SerialMode                uint8  `json:"serial_mode"`                  // 0x00 protocol mode, 0x01 ASCII mode, 0x02 transparent mode
+	Address                   uint8  `json:"address"`                      // Serial address, 0x00 - 0xFE
+	BaudRate                  uint32 `json:"baud_rate"`                    // Serial baud rate
+	PacketInterval            uint16 `json:"packet_interval"`              // Serial packet interval in milliseconds
+	VID                       uint16 `json:"vid"`                          // USB vendor ID
+	PID                       uint16 `json:"pid"`                          // USB product ID
+	KeyboardUploadInterval    uint16 `json:"keyboard_upload_interval"`     // ASCII mode keyboard upload interval in milliseconds
+	KeyboardReleaseDelay      uint16 `json:"keyboard_release_delay"`       // ASCII mode keyboard release delay in milliseconds
+	AutoEnter                 bool   `json:"auto_enter"`                   // ASCII mode sends enter after each packet
+	KeyboardFastUpload        bool   `json:"keyboard_fast_upload"`         // ASCII mode keyboard fast upload
+	CustomStringsEnabled      bool   `json:"custom_strings_enabled"`       // Use the custom USB strings below instead of the chip defaults
+	ManufacturerStringEnabled bool   `json:"manufacturer_string_enabled"`  // Custom manufacturer string is enabled
+	ProductStringEnabled      bool   `json:"product_string_enabled"`       // Custom product string is enabled
+	SerialNumberStringEnabled bool   `json:"serial_number_string_enabled"` // Custom serial number string is enabled
+
+	raw [chipConfigLength]byte // Original bytes, keeps the fields not exposed above
+}
+
+// ChipStrings are the custom USB strings of the CH9329
+type ChipStrings struct {
+	Manufacturer string `json:"manufacturer"`
+	Product      string `json:"product"`
+	SerialNumber string `json:"serial_number"`
+}
+
+// ParseChipConfig parses the 50 bytes parameter configuration returned by the chip
+func ParseChipConfig(data []byte) (*ChipConfig, error) {
+	if len(data) < chipConfigLength {
+		return nil, errors.New("invalid configuration length")
+	}
+	cfg := &ChipConfig{
+		WorkMode:                  data[0],
+		SerialMode:                data[1],
+		Address:                   data[2],
+		BaudRate:                  binary.BigEndian.Uint32(data[3:7]),
+		PacketInterval:            binary.BigEndian.Uint16(data[9:11]),
+		VID:                       binary.LittleEndian.Uint16(data[11:13]),
+		PID:                       binary.LittleEndian.Uint16(data[13:15]),
+		KeyboardUploadInterval:    binary.BigEndian.Uint16(data[15:17]),
+		KeyboardReleaseDelay:      binary.BigEndian.Uint16(data[17:19]),
+		AutoEnter:                 data[19] != 0x00,
+		CustomStringsEnabled:      data[44]&usbStringEnableCustom != 0,
+		ManufacturerStringEnabled: data[44]&usbStringEnableManufacturer != 0,
+		ProductStringEnabled:      data[44]&usbStringEnableProduct != 0,
+		SerialNumberStringEnabled: data[44]&usbStringEnableSerial != 0,
+		KeyboardFastUpload:        data[45] != 0x00,
+	}
+	copy(cfg.raw[:], data[:chipConfigLength])
+	return cfg, nil
+}
+
+// Bytes serializes the configuration into the 50 bytes layout accepted by the chip
+func (cfg *ChipConfig) Bytes() []byte {
+	data := make([]byte, chipConfigLength)
+	copy(data, cfg.raw[:])
+	data[0] = cfg.WorkMode
+	data[1] = cfg.SerialMode
+	data[2] = cfg.Address
+	binary.BigEndian.PutUint32(data[3:7], cfg.BaudRate)
+	binary.BigEndian.PutUint16(data[9:11], cfg.PacketInterval)
+	binary.LittleEndian.PutUint16(data[11:13], cfg.VID)
+	binary.LittleEndian.PutUint16(data[13:15], cfg.PID)
+	binary.BigEndian.PutUint16(data[15:17], cfg.KeyboardUploadInterval)
+	binary.BigEndian.PutUint16(data[17:19], cfg.KeyboardReleaseDelay)
+	data[19] = boolToByte(cfg.AutoEnter)
+
+	flags := data[44] &^ (usbStringEnableCustom | usbStringEnableManufacturer | usbStringEnableProduct | usbStringEnableSerial)
+	if cfg.CustomStringsEnabled {
+		flags |= usbStringEnableCustom
+	}
+	if cfg.ManufacturerStringEnabled {
+		flags |= usbStringEnableManufacturer
+	}
+	if cfg.ProductStringEnabled {
+		flags |= usbStringEnableProduct
+	}
+	if cfg.SerialNumberStringEnabled {
+		flags |= usbStringEnableSerial
+	}
+	data[44] = flags
+	data[45] = boolToByte(cfg.KeyboardFastUpload)
+	return data
+}
+
+// Validate checks if the configuration values are accepted by the chip
+func (cfg *ChipConfig) Validate() error {
+	if cfg.WorkMode&0x7F > 0x03 {
+		return fmt.Errorf("invalid work mode: 0x%02X", cfg.WorkMode)
+	}
+	if cfg.SerialMode&0x7F > 0x02 {
+		return fmt.Errorf("invalid serial mode: 0x%02X", cfg.SerialMode)
+	}
+	if cfg.Address == 0xFF {
+		return errors.New("invalid serial address: 0xFF is reserved for broadcast")
+	}
+	for _, rate := range supportedBaudRates {
+		if rate == cfg.BaudRate {
+			return nil
+		}
+	}
+	return fmt.Errorf("unsupported baud rate: %d", cfg.BaudRate)
+}
+
+// GetChipConfig reads the parameter configuration from the chip
+func (c *Controller) GetChipConfig() (*ChipConfig, error) {
+	data, err := c.GetChipCurrentConfiguration()
+	if err != nil {
+		return nil, err
+	}
+	return ParseChipConfig(data)
+}
+
+// SetChipConfig writes the parameter configuration to the chip.
+// The new configuration takes effect after the chip is reset.
+func (c *Controller) SetChipConfig(cfg *ChipConfig) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	cmd := append([]byte{0x57, 0xAB, 0x00, 0x09, chipConfigLength}, cfg.Bytes()...)
+	cmd = append(cmd, calcChecksum(cmd))
+	if _, err := c.sendAndWait(cmd); err != nil {
+		return errors.New("failed to set chip configuration: " + err.Error())
+	}
+	return nil
+}
+
+// GetUSBString reads one of the custom USB strings from the chip
+func (c *Controller) GetUSBString(stringType USBStringType) (string, error) {
+	cmd := []byte{0x57, 0xAB, 0x00, 0x0A, 0x01, byte(stringType), 0x00}
+	cmd[6] = calcChecksum(cmd[:6])
+	resp, err := c.sendAndWait(cmd)
+	if err != nil {
+		return "", fmt.Errorf("failed to get USB string: %v", err)
+	}
+	// resp[0]: string type, resp[1]: string length, followed by the string
+	if len(resp) < 2 || len(resp) < 2+int(resp[1]) {
+		return "", errors.New("invalid USB string response")
+	}
+	return string(resp[2 : 2+int(resp[1])]), nil
+}
+
+// SetUSBString writes one of the custom USB strings to the chip.
+// Custom strings are only used if enabled in the chip configuration.
+func (c *Controller) SetUSBString(stringType USBStringType, value string) error {
+	if len(value) > MaxUSBStringLength {
+		return fmt.Errorf("USB string is too long, at most %d characters are allowed", MaxUSBStringLength)
+	}
+	for _, r := range value {
+		if r < 0x20 || r > 0x7E {
+			return errors.New("USB string must only contain printable ASCII characters")
+		}
+	}
+	cmd := []byte{0x57, 0xAB, 0x00, 0x0B, byte(2 + len(value)), byte(stringType), byte(len(value))}
+	cmd = append(cmd, []byte(value)...)
+	cmd = append(cmd, calcChecksum(cmd))
+	if _, err := c.sendAndWait(cmd); err != nil {
+		return fmt.Errorf("failed to set USB string: %v", err)
+	}
+	return nil
+}
+
+// GetUSBStrings reads all custom USB strings from the chip
+func (c *Controller) GetUSBStrings() (*ChipStrings, error) {
+	strs := &ChipStrings{}
+	var err error
+	if strs.Manufacturer, err = c.GetUSBString(USBStringManufacturer); err != nil {
+		return nil, err
+	}
+	if strs.Product, err = c.GetUSBString(USBStringProduct); err != nil {
+		return nil, err
+	}
+	if strs.SerialNumber, err = c.GetUSBString(USBStringSerial); err != nil {
+		return nil, err
+	}
+	return strs, nil
+}
+
+func boolToByte(b bool) byte {
+	if b {
+		return 0x01
+	}
+	return 0x00
+}
@@ -0,0 +1,234 @@
+package kvmhid
+
+import (
+	"errors"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+/*
+	connection.go
+
+	Supervised serial I/O. A reader and a writer goroutine run on the open
+	transport until either of them hits an I/O error, e.g. when the USB KVM
+	is unplugged. The transport is then closed, queued writes and pending
+	commands fail, and the port is reopened with exponential backoff.
+	After reconnecting the chip queue is reset with 0xFF and the current
+	HIDState is sent again, so the target sees the same keys and buttons
+	held as the controller believes are held.
+
+	Connection state changes are pushed to all HID sessions as
+	{"connection": ConnectionStatus}.
+*/
+
+const (
+	ReconnectMinBackoff = 250 * time.Millisecond // First delay before reopening a lost transport
+	ReconnectMaxBackoff = 10 * time.Second       // Longest delay between reopen attempts
+)
+
+// Connection states of a controller
+const (
+	ConnectionStateConnected    = "connected"    // Transport is open and working
+	ConnectionStateReconnecting = "reconnecting" // Transport was lost, trying to reopen it
+	ConnectionStateDisconnected = "disconnected" // Transport was lost and cannot be reopened, or the controller was closed
+)
+
+// TransportOpener opens the transport to the HID chip, called again to reconnect
+type TransportOpener func() (Transport, error)
+
+// ConnectionStatus is the state of the transport to the HID chip
+type ConnectionStatus struct {
+	State      string `json:"state"`
+	Since      int64  `json:"since"`      // Unix time in milliseconds of the last state change
+	Reconnects int    `json:"reconnects"` // Successful reconnects since the controller was started
+	LastError  string `json:"last_error,omitempty"`
+}
+
+// ConnectTransportFunc opens the transport with open and starts the controller on it.
+// If the transport fails later, open is called again until it succeeds or the controller is closed.
+func (c *Controller) ConnectTransportFunc(open TransportOpener) error {
+	port, err := open()
+	if err != nil {
+		return err
+	}
+	return c.startTransport(port, open)
+}
+
+// GetConnectionStatus returns the state of the transport to the HID chip
+func (c *Controller) GetConnectionStatus() ConnectionStatus {
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+	return c.connStatus
+}
+
+// setConnectionState updates the connection state and tells all sessions about it
+func (c *Controller) setConnectionState(state string, cause error) {
+	c.connMu.Lock()
+	if state == ConnectionStateConnected && c.connStatus.State == ConnectionStateReconnecting {
+		c.connStatus.Reconnects++
+	}
+	c.connStatus.State = state
+	c.connStatus.Since = time.Now().UnixMilli()
+	if cause != nil {
+		c.connStatus.LastError = cause.Error()
+	}
+	status := c.connStatus
+	c.connMu.Unlock()
+	c.broadcast(map[string]ConnectionStatus{"connection": status})
+}
+
+// superviseTransport runs the serial I/O and reopens the transport when it fails, until stop is closed.
+// onStart is run once the serial I/O is first up.
+func (c *Controller) superviseTransport(port Transport, open TransportOpener, stop chan struct{}, done chan struct{}, onStart func()) {
+	defer close(done)
+	for {
+		err := c.runTransport(port, stop, onStart)
+		c.drainWriteQueue()
+		if err == nil {
+			// Stopped by Close
+			c.failPendingCommands(errors.New("serial port closed"))
+			c.setConnectionState(ConnectionStateDisconnected, nil)
+			return
+		}
+
+		log.Println("HID serial connection lost: " + err.Error())
+		c.failPendingCommands(err)
+		if open == nil {
+			c.setConnectionState(ConnectionStateDisconnected, err)
+			return
+		}
+		c.setConnectionState(ConnectionStateReconnecting, err)
+		port = c.reopenTransport(open, stop)
+		if port == nil {
+			c.setConnectionState(ConnectionStateDisconnected, nil)
+			return
+		}
+		log.Println("HID serial connection restored")
+		onStart = c.resyncHIDState
+	}
+}
+
+// runTransport reads and writes the transport until an I/O error occurs (returned) or stop is closed (nil).
+// onStart, if not nil, is run once the reader and writer are up.
+func (c *Controller) runTransport(port Transport, stop chan struct{}, onStart func()) error {
+	quit := make(chan struct{})
+	failed := make(chan error, 2)
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	// Reader, a read returning nothing (or io.EOF from a serial port) is just a timeout
+	go func() {
+		defer wg.Done()
+		buf := make([]byte, 1024)
+		for {
+			select {
+			case <-quit:
+				return
+			default:
+			}
+			n, err := port.Read(buf)
+			if n > 0 {
+				c.backend.HandleIncomingData(buf[:n])
+			}
+			if err != nil && err != io.EOF {
+				failed <- err
+				return
+			}
+		}
+	}()
+
+	// Writer
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-quit:
+				return
+			case data := <-c.writeQueue:
+				if _, err := port.Write(data); err != nil {
+					failed <- err
+					return
+				}
+			}
+		}
+	}()
+
+	c.serialRunning.Store(true)
+	c.setConnectionState(ConnectionStateConnected, nil)
+	if onStart != nil {
+		go onStart()
+	}
+
+	var err error
+	select {
+	case err = <-failed:
+	case <-stop:
+	}
+	c.serialRunning.Store(false)
+	close(quit)
+	// Unblock a reader or writer stuck on the transport before waiting for them
+	port.Close()
+	wg.Wait()
+	// The frame parser is only used by the reader, start the next one from a clean buffer
+	c.frameParser = frameParser{}
+	return err
+}
+
+// reopenTransport calls open with exponential backoff until it succeeds, returns nil if stop is closed first
+func (c *Controller) reopenTransport(open TransportOpener, stop chan struct{}) Transport {
+	backoff := ReconnectMinBackoff
+	for {
+		select {
+		case <-stop:
+			return nil
+		case <-time.After(backoff):
+		}
+		port, err := open()
+		if err == nil {
+			return port
+		}
+		backoff *= 2
+		if backoff > ReconnectMaxBackoff {
+			backoff = ReconnectMaxBackoff
+		}
+	}
+}
+
+// drainWriteQueue drops writes queued for a transport that is gone
+func (c *Controller) drainWriteQueue() {
+	for {
+		select {
+		case <-c.writeQueue:
+		default:
+			return
+		}
+	}
+}
+
+// resyncHIDState resets the device and sends the current keyboard, media and mouse
+// button state again, as the chip may have lost it while disconnected
+func (c *Controller) resyncHIDState() {
+	_, err := c.execute(OpResync, func() ([]byte, error) {
+		if err := c.backend.Reset(); err != nil {
+			return nil, errors.New("failed to reset HID device: " + err.Error())
+		}
+		if _, err := keyboardSendKeyCombinations(c); err != nil {
+			log.Println("Failed to resync keyboard state: " + err.Error())
+		}
+		if _, err := c.sendMultimediaReport(c.hidState.MediaKeys); err != nil {
+			log.Println("Failed to resync media key state: " + err.Error())
+		}
+		if _, err := c.sendSystemKeyReport(c.hidState.SystemKeys); err != nil {
+			log.Println("Failed to resync system key state: " + err.Error())
+		}
+		return c.mouseMoveRelative(0, 0, 0)
+	})
+	if err != nil {
+		log.Println("Failed to resync HID state: " + err.Error())
+		return
+	}
+	// Reads the LEDs through the executor, so not part of the operation above
+	c.updateChipStatus()
+}
@@ -0,0 +1,89 @@
+package kvmhid
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// waitForConnectionState polls the controller until it reaches the connection state
+func waitForConnectionState(t *testing.T, c *Controller, state string) ConnectionStatus {
+	t.Helper()
+	deadline := time.Now().Add(3 * time.Second)
+	for time.Now().Before(deadline) {
+		if status := c.GetConnectionStatus(); status.State == state {
+			return status
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("controller did not reach state %s, got %+v", state, c.GetConnectionStatus())
+	return ConnectionStatus{}
+}
+
+func TestReconnectResyncsHIDState(t *testing.T) {
+	var mu sync.Mutex
+	emu := NewEmulator()
+	unplugged := false
+	c := NewHIDController(&Config{
+		PortName:           "emulator",
+		BaudRate:           115200,
+		StatusPollInterval: time.Hour,
+	})
+	err := c.ConnectTransportFunc(func() (Transport, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if unplugged {
+			return nil, errors.New("no such device")
+		}
+		return emu, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(c.Close)
+	if _, err := c.PressHIDUsage(0x04); err != nil {
+		t.Fatal(err)
+	}
+
+	// Unplug, input fails right away instead of filling the write queue
+	mu.Lock()
+	unplugged = true
+	emu.Close()
+	mu.Unlock()
+	status := waitForConnectionState(t, c, ConnectionStateReconnecting)
+	if status.LastError == "" {
+		t.Error("lost connection should record the error")
+	}
+	if _, err := c.GetChipInfo(); err == nil {
+		t.Error("commands should fail while reconnecting")
+	}
+
+	// Replug, the held key is sent to the new chip
+	mu.Lock()
+	emu = NewEmulator()
+	unplugged = false
+	replugged := emu
+	mu.Unlock()
+	if status := waitForConnectionState(t, c, ConnectionStateConnected); status.Reconnects != 1 {
+		t.Errorf("got %d reconnects, want 1", status.Reconnects)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, r := range replugged.Reports() {
+			if r.Cmd == 0x02 && bytes.Equal(r.Data, []byte{0, 0, 0x04, 0, 0, 0, 0, 0}) {
+				return
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("keyboard state not resynced after reconnect: %+v", replugged.Reports())
+}
+
+func TestConnectTransportDisconnectsWithoutOpener(t *testing.T) {
+	c, emu := newEmulatedController(t)
+	waitForConnectionState(t, c, ConnectionStateConnected)
+	emu.Close()
+	waitForConnectionState(t, c, ConnectionStateDisconnected)
+}
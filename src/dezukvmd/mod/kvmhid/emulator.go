@@ -0,0 +1,246 @@
+package kvmhid
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+/*
+	emulator.go
+
+	In-process CH9329 emulator implementing Transport. It answers commands
+	with the same ACK, error and checksum frames as the real chip, keeps the
+	parameter configuration and USB strings, and records every HID report it
+	receives so keyboard and mouse logic can be tested without a board.
+*/
+
+const emulatorReadTimeout = 50 * time.Millisecond
+
+// EmulatorReport is a HID report received by the emulator
+type EmulatorReport struct {
+	Cmd  byte   // Command byte, e.g. 0x02 for keyboard or 0x04 for absolute mouse
+	Data []byte // Report data as sent by the host
+}
+
+// Emulator is a software CH9329 connected through an in-process byte stream
+type Emulator struct {
+	inbuf           []byte
+	outbuf          []byte
+	dataReady       chan struct{}
+	reports         []EmulatorReport
+	config          [chipConfigLength]byte
+	usbStrings      map[USBStringType]string
+	leds            uint8
+	targetConnected bool
+	failCommands    map[byte]byte // Command byte to error code to reply with
+	closed          bool
+	mu              sync.Mutex
+}
+
+// NewEmulator creates an emulator with the factory default chip configuration
+func NewEmulator() *Emulator {
+	e := &Emulator{
+		dataReady:       make(chan struct{}, 1),
+		reports:         []EmulatorReport{},
+		usbStrings:      make(map[USBStringType]string),
+		targetConnected: true,
+		failCommands:    make(map[byte]byte),
+	}
+	// Protocol mode, address 0, 9600 baud, VID 0x1A86, PID 0xE129
+	copy(e.config[:], []byte{
+		0x00, 0x00, 0x00,
+		0x00, 0x00, 0x25, 0x80,
+		0x08, 0x00,
+		0x00, 0x03,
+		0x86, 0x1A,
+		0x29, 0xE1,
+	})
+	return e
+}
+
+// Read returns bytes sent by the emulated chip, or nothing after a short timeout
+func (e *Emulator) Read(p []byte) (int, error) {
+	deadline := time.After(emulatorReadTimeout)
+	for {
+		e.mu.Lock()
+		if e.closed {
+			e.mu.Unlock()
+			return 0, errors.New("emulator closed")
+		}
+		if len(e.outbuf) > 0 {
+			n := copy(p, e.outbuf)
+			e.outbuf = e.outbuf[n:]
+			e.mu.Unlock()
+			return n, nil
+		}
+		e.mu.Unlock()
+
+		select {
+		case <-e.dataReady:
+		case <-deadline:
+			return 0, nil
+		}
+	}
+}
+
+// Write feeds bytes sent by the host to the emulated chip
+func (e *Emulator) Write(p []byte) (int, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.closed {
+		return 0, errors.New("emulator closed")
+	}
+	e.inbuf = append(e.inbuf, p...)
+	e.processInput()
+	return len(p), nil
+}
+
+// Close closes the emulated connection
+func (e *Emulator) Close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.closed = true
+	return nil
+}
+
+// Reports returns a copy of all HID reports received so far
+func (e *Emulator) Reports() []EmulatorReport {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]EmulatorReport{}, e.reports...)
+}
+
+// ClearReports drops all recorded HID reports
+func (e *Emulator) ClearReports() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.reports = []EmulatorReport{}
+}
+
+// SetLEDs sets the keyboard LED state reported by GET_INFO
+func (e *Emulator) SetLEDs(leds uint8) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.leds = leds
+}
+
+// SetTargetConnected sets whether the target has enumerated the emulated USB device
+func (e *Emulator) SetTargetConnected(connected bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.targetConnected = connected
+}
+
+// FailCommand makes the emulator reply to the command with the given error code, 0 to stop failing
+func (e *Emulator) FailCommand(cmd byte, errorCode byte) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if errorCode == 0 {
+		delete(e.failCommands, cmd)
+		return
+	}
+	e.failCommands[cmd] = errorCode
+}
+
+// processInput handles all complete frames in the input buffer, must be called with mu held
+func (e *Emulator) processInput() {
+	for {
+		// Skip anything before the header, e.g. the 0xFF queue reset byte
+		start := -1
+		for i := 0; i+1 < len(e.inbuf); i++ {
+			if e.inbuf[i] == frameHeader[0] && e.inbuf[i+1] == frameHeader[1] {
+				start = i
+				break
+			}
+		}
+		if start < 0 {
+			if len(e.inbuf) > 0 && e.inbuf[len(e.inbuf)-1] == frameHeader[0] {
+				e.inbuf = e.inbuf[len(e.inbuf)-1:]
+			} else {
+				e.inbuf = e.inbuf[:0]
+			}
+			return
+		}
+		e.inbuf = e.inbuf[start:]
+		if len(e.inbuf) < 5 {
+			return
+		}
+		total := 5 + int(e.inbuf[4]) + 1
+		if len(e.inbuf) < total {
+			return
+		}
+		packet := e.inbuf[:total]
+		e.inbuf = e.inbuf[total:]
+
+		cmd := packet[3]
+		if calcChecksum(packet[:total-1]) != packet[total-1] {
+			e.reply(cmd|0xC0, []byte{0xE4})
+			continue
+		}
+		e.handleCommand(cmd, append([]byte{}, packet[5:total-1]...))
+	}
+}
+
+// handleCommand answers a single command frame, must be called with mu held
+func (e *Emulator) handleCommand(cmd byte, data []byte) {
+	if code, ok := e.failCommands[cmd]; ok {
+		e.reply(cmd|0xC0, []byte{code})
+		return
+	}
+
+	switch cmd {
+	case 0x01: // GET_INFO
+		connected := byte(0x00)
+		if e.targetConnected {
+			connected = 0x01
+		}
+		e.reply(cmd|0x80, []byte{0x30, connected, e.leds, 0x00, 0x00, 0x00, 0x00, 0x00})
+	case 0x02, 0x03, 0x04, 0x05, 0x06: // Keyboard, media, absolute mouse, relative mouse, custom HID
+		expectedLength := map[byte]int{0x02: 8, 0x04: 7, 0x05: 5}
+		if n, ok := expectedLength[cmd]; ok && len(data) != n {
+			e.reply(cmd|0xC0, []byte{0xE5})
+			return
+		}
+		e.reports = append(e.reports, EmulatorReport{Cmd: cmd, Data: data})
+		e.reply(cmd|0x80, []byte{0x00})
+	case 0x08: // GET_PARA_CFG
+		e.reply(cmd|0x80, e.config[:])
+	case 0x09: // SET_PARA_CFG
+		if len(data) != chipConfigLength {
+			e.reply(cmd|0xC0, []byte{0xE5})
+			return
+		}
+		copy(e.config[:], data)
+		e.reply(cmd|0x80, []byte{0x00})
+	case 0x0A: // GET_USB_STRING
+		if len(data) != 1 || data[0] > byte(USBStringSerial) {
+			e.reply(cmd|0xC0, []byte{0xE5})
+			return
+		}
+		value := e.usbStrings[USBStringType(data[0])]
+		e.reply(cmd|0x80, append([]byte{data[0], byte(len(value))}, value...))
+	case 0x0B: // SET_USB_STRING
+		if len(data) < 2 || data[0] > byte(USBStringSerial) || int(data[1]) != len(data)-2 || int(data[1]) > MaxUSBStringLength {
+			e.reply(cmd|0xC0, []byte{0xE5})
+			return
+		}
+		e.usbStrings[USBStringType(data[0])] = string(data[2:])
+		e.reply(cmd|0x80, []byte{0x00})
+	case 0x0C, 0x0F: // SET_DEFAULT_CFG, RESET
+		e.reply(cmd|0x80, []byte{0x00})
+	default:
+		e.reply(cmd|0xC0, []byte{0xE3})
+	}
+}
+
+// reply queues a frame to be read by the host, must be called with mu held
+func (e *Emulator) reply(cmd byte, data []byte) {
+	frame := append([]byte{0x57, 0xAB, 0x00, cmd, byte(len(data))}, data...)
+	frame = append(frame, calcChecksum(frame))
+	e.outbuf = append(e.outbuf, frame...)
+	select {
+	case e.dataReady <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,151 @@
+package kvmhid
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newEmulatedController creates a controller connected to a CH9329 emulator
+func newEmulatedController(t *testing.T) (*Controller, *Emulator) {
+	t.Helper()
+	emu := NewEmulator()
+	c := NewHIDController(&Config{
+		PortName:           "emulator",
+		BaudRate:           115200,
+		ScrollSensitivity:  0x01,
+		StatusPollInterval: time.Hour,
+	})
+	if err := c.ConnectTransport(emu); err != nil {
+		t.Fatalf("failed to connect to emulator: %v", err)
+	}
+	t.Cleanup(c.Close)
+	return c, emu
+}
+
+// readFrame reads the next reply frame from the emulator
+func readFrame(t *testing.T, emu *Emulator) *frame {
+	t.Helper()
+	parser := &frameParser{}
+	buf := make([]byte, 128)
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		n, err := emu.Read(buf)
+		if err != nil {
+			t.Fatalf("read failed: %v", err)
+		}
+		if frames := parser.Feed(buf[:n]); len(frames) > 0 {
+			return frames[0]
+		}
+	}
+	t.Fatal("timeout waiting for reply frame")
+	return nil
+}
+
+func TestEmulatorRepliesWithChecksumError(t *testing.T) {
+	emu := NewEmulator()
+	emu.Write([]byte{0x57, 0xAB, 0x00, 0x02, 0x08, 0, 0, 0x04, 0, 0, 0, 0, 0, 0x00})
+	f := readFrame(t, emu)
+	if f.cmd != 0xC2 || !bytes.Equal(f.data, []byte{0xE4}) {
+		t.Errorf("got cmd 0x%02X data %X, want checksum error reply", f.cmd, f.data)
+	}
+	if len(emu.Reports()) != 0 {
+		t.Error("report with invalid checksum should not be recorded")
+	}
+}
+
+func TestEmulatorRejectsUnknownCommand(t *testing.T) {
+	emu := NewEmulator()
+	packet := []byte{0x57, 0xAB, 0x00, 0x3E, 0x00, 0x00}
+	packet[5] = calcChecksum(packet[:5])
+	emu.Write(packet)
+	f := readFrame(t, emu)
+	if f.cmd != 0xFE || !bytes.Equal(f.data, []byte{0xE3}) {
+		t.Errorf("got cmd 0x%02X data %X, want invalid command reply", f.cmd, f.data)
+	}
+}
+
+func TestCommandErrorReply(t *testing.T) {
+	c, emu := newEmulatedController(t)
+	emu.FailCommand(0x02, 0xE6)
+	_, err := c.PressHIDUsage(0x04)
+	if err == nil || !strings.Contains(err.Error(), "operation failed") {
+		t.Fatalf("expected operation failed error, got %v", err)
+	}
+
+	emu.FailCommand(0x02, 0)
+	if _, err := c.PressHIDUsage(0x05); err != nil {
+		t.Fatalf("unexpected error after clearing failure: %v", err)
+	}
+}
+
+func TestGetChipInfo(t *testing.T) {
+	c, emu := newEmulatedController(t)
+	emu.SetLEDs(LED_CAPS_LOCK | LED_SCROLL_LOCK)
+	emu.SetTargetConnected(false)
+
+	status, err := c.GetChipInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Version != "V1.0" || status.TargetConnected || status.NumLock || !status.CapsLock || !status.ScrollLock {
+		t.Errorf("unexpected chip status: %+v", status)
+	}
+}
+
+func TestChipConfigRoundTrip(t *testing.T) {
+	c, _ := newEmulatedController(t)
+	cfg, err := c.GetChipConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.BaudRate != 9600 || cfg.VID != 0x1A86 || cfg.PID != 0xE129 {
+		t.Fatalf("unexpected default config: %+v", cfg)
+	}
+
+	cfg.BaudRate = 115200
+	cfg.VID = 0x1234
+	cfg.CustomStringsEnabled = true
+	cfg.ProductStringEnabled = true
+	if err := c.SetChipConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	updated, err := c.GetChipConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(updated.Bytes(), cfg.Bytes()) {
+		t.Errorf("config changed after round trip:\n got %X\nwant %X", updated.Bytes(), cfg.Bytes())
+	}
+	if updated.BaudRate != 115200 || updated.VID != 0x1234 || !updated.ProductStringEnabled || updated.ManufacturerStringEnabled {
+		t.Errorf("unexpected updated config: %+v", updated)
+	}
+
+	cfg.BaudRate = 12345
+	if err := c.SetChipConfig(cfg); err == nil {
+		t.Error("expected unsupported baud rate to be rejected")
+	}
+}
+
+func TestUSBStrings(t *testing.T) {
+	c, _ := newEmulatedController(t)
+	if _, err := c.WriteChipProperties("imuslab", "DezuKVM"); err != nil {
+		t.Fatal(err)
+	}
+	strs, err := c.GetUSBStrings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strs.Manufacturer != "imuslab" || strs.Product != "DezuKVM" || strs.SerialNumber != "" {
+		t.Errorf("unexpected USB strings: %+v", strs)
+	}
+	cfg, _ := c.GetChipConfig()
+	if !cfg.CustomStringsEnabled || !cfg.ManufacturerStringEnabled || !cfg.ProductStringEnabled {
+		t.Errorf("custom strings not enabled: %+v", cfg)
+	}
+
+	if err := c.SetUSBString(USBStringSerial, strings.Repeat("x", MaxUSBStringLength+1)); err == nil {
+		t.Error("expected too long USB string to be rejected")
+	}
+}
@@ -0,0 +1,190 @@
+package kvmhid
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+/*
+	executor.go
+
+	Command executor. A single goroutine owns the HIDState: every public
+	input method (keyboard, mouse, media keys, release all, reconnect
+	resync) submits a typed operation and waits for its result, so input
+	from websocket sessions, the mouse scheduler, text typing, macros and
+	scripts never changes the state concurrently.
+
+	Operations must only call the unexported helpers, never the public
+	methods, or they would wait on themselves.
+
+	Latency (from submitting to finishing, including time spent queued)
+	and errors are recorded per operation type.
+*/
+
+const executorQueueSize = 64
+
+// ErrControllerClosed is returned for input submitted after the controller was closed
+var ErrControllerClosed = errors.New("HID controller is closed")
+
+// Operation types recorded in the command metrics
+const (
+	OpKeyboard      = "keyboard"
+	OpKeyCombo      = "key_combo"
+	OpMediaKey      = "media_key"
+	OpMouseMove     = "mouse_move"
+	OpMouseButton   = "mouse_button"
+	OpMouseScroll   = "mouse_scroll"
+	OpMouseFlush    = "mouse_flush"
+	OpReleaseAll    = "release_all"
+	OpResync        = "resync"
+	opInternalState = "" // State reads and bookkeeping, not recorded
+)
+
+// hidOp is an operation run by the executor goroutine
+type hidOp struct {
+	name   string
+	fn     func() ([]byte, error)
+	queued time.Time
+	done   chan hidOpResult
+}
+
+type hidOpResult struct {
+	data []byte
+	err  error
+}
+
+// CommandMetrics are the latency and error statistics of one operation type
+type CommandMetrics struct {
+	Count        int64   `json:"count"`
+	Errors       int64   `json:"errors"`
+	AvgLatencyMs float64 `json:"avg_latency_ms"`
+	MaxLatencyMs float64 `json:"max_latency_ms"`
+	LastError    string  `json:"last_error,omitempty"`
+	LastErrorAt  int64   `json:"last_error_at,omitempty"` // Unix time in milliseconds
+
+	totalLatency time.Duration
+	maxLatency   time.Duration
+}
+
+// commandExecutor holds the operation queue and the metrics
+type commandExecutor struct {
+	queue   chan *hidOp
+	stop    chan struct{}
+	done    chan struct{}
+	metrics map[string]*CommandMetrics
+	mu      sync.Mutex // Protects metrics
+}
+
+func newCommandExecutor() *commandExecutor {
+	return &commandExecutor{
+		queue:   make(chan *hidOp, executorQueueSize),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+		metrics: make(map[string]*CommandMetrics),
+	}
+}
+
+// run processes operations in order until stop is closed
+func (e *commandExecutor) run() {
+	defer close(e.done)
+	for {
+		select {
+		case <-e.stop:
+			return
+		case op := <-e.queue:
+			data, err := op.fn()
+			e.record(op.name, time.Since(op.queued), err)
+			op.done <- hidOpResult{data, err}
+		}
+	}
+}
+
+func (e *commandExecutor) close() {
+	select {
+	case <-e.stop:
+	default:
+		close(e.stop)
+	}
+	<-e.done
+}
+
+// record adds the result of an operation to the metrics
+func (e *commandExecutor) record(name string, latency time.Duration, err error) {
+	if name == opInternalState {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	m, ok := e.metrics[name]
+	if !ok {
+		m = &CommandMetrics{}
+		e.metrics[name] = m
+	}
+	m.Count++
+	m.totalLatency += latency
+	if latency > m.maxLatency {
+		m.maxLatency = latency
+	}
+	if err != nil {
+		m.Errors++
+		m.LastError = err.Error()
+		m.LastErrorAt = time.Now().UnixMilli()
+	}
+}
+
+// execute runs fn on the executor goroutine and returns its result
+func (c *Controller) execute(name string, fn func() ([]byte, error)) ([]byte, error) {
+	e := c.executor
+	op := &hidOp{
+		name:   name,
+		fn:     fn,
+		queued: time.Now(),
+		done:   make(chan hidOpResult, 1),
+	}
+	select {
+	case e.queue <- op:
+	case <-e.done:
+		return nil, ErrControllerClosed
+	}
+	select {
+	case r := <-op.done:
+		return r.data, r.err
+	case <-e.done:
+		return nil, ErrControllerClosed
+	}
+}
+
+// executeState runs fn on the executor goroutine without recording metrics,
+// used to read or change the HID state without sending anything
+func (c *Controller) executeState(fn func()) {
+	c.execute(opInternalState, func() ([]byte, error) {
+		fn()
+		return nil, nil
+	})
+}
+
+// GetCommandMetrics returns the latency and error statistics of each operation type
+func (c *Controller) GetCommandMetrics() map[string]CommandMetrics {
+	e := c.executor
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	metrics := make(map[string]CommandMetrics, len(e.metrics))
+	for name, m := range e.metrics {
+		snapshot := *m
+		if m.Count > 0 {
+			snapshot.AvgLatencyMs = float64(m.totalLatency) / float64(m.Count) / float64(time.Millisecond)
+		}
+		snapshot.MaxLatencyMs = float64(m.maxLatency) / float64(time.Millisecond)
+		metrics[name] = snapshot
+	}
+	return metrics
+}
+
+// ResetCommandMetrics clears the statistics of all operation types
+func (c *Controller) ResetCommandMetrics() {
+	e := c.executor
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.metrics = make(map[string]*CommandMetrics)
+}
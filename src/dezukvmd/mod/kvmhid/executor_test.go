@@ -0,0 +1,86 @@
+package kvmhid
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+	"testing"
+)
+
+func TestExecutorSerializesConcurrentKeys(t *testing.T) {
+	c, emu := newEmulatedController(t)
+	usages := []uint8{0x04, 0x05, 0x06, 0x07, 0x08, 0x09}
+
+	var wg sync.WaitGroup
+	for _, usage := range usages {
+		wg.Add(1)
+		go func(usage uint8) {
+			defer wg.Done()
+			if _, err := c.PressHIDUsage(usage); err != nil {
+				t.Errorf("press 0x%02X: %v", usage, err)
+			}
+		}(usage)
+	}
+	wg.Wait()
+
+	// Every key got its own slot, none was lost to a concurrent update
+	got := lastKeyboardReport(t, emu)
+	held := map[uint8]bool{}
+	for _, key := range got[2:] {
+		held[key] = true
+	}
+	for _, usage := range usages {
+		if !held[usage] {
+			t.Errorf("key 0x%02X missing from report %X", usage, got)
+		}
+	}
+
+	for _, usage := range usages {
+		wg.Add(1)
+		go func(usage uint8) {
+			defer wg.Done()
+			if _, err := c.ReleaseHIDUsage(usage); err != nil {
+				t.Errorf("release 0x%02X: %v", usage, err)
+			}
+		}(usage)
+	}
+	wg.Wait()
+	if got := lastKeyboardReport(t, emu); !bytes.Equal(got, make([]byte, 8)) {
+		t.Errorf("got report %X after releasing all keys, want all zero", got)
+	}
+
+	metrics := c.GetCommandMetrics()
+	if m := metrics[OpKeyboard]; m.Count != int64(2*len(usages)) || m.Errors != 0 {
+		t.Errorf("keyboard metrics %+v, want %d commands without errors", m, 2*len(usages))
+	}
+}
+
+func TestExecutorRecordsErrors(t *testing.T) {
+	c, _ := newEmulatedController(t)
+	failure := errors.New("write failed")
+	c.execute(OpMouseMove, func() ([]byte, error) { return nil, nil })
+	c.execute(OpMouseMove, func() ([]byte, error) { return nil, failure })
+	c.executeState(func() {})
+
+	metrics := c.GetCommandMetrics()
+	m := metrics[OpMouseMove]
+	if m.Count != 2 || m.Errors != 1 || m.LastError != failure.Error() {
+		t.Errorf("mouse move metrics %+v, want 2 commands with 1 error", m)
+	}
+	if _, ok := metrics[opInternalState]; ok {
+		t.Error("state access was recorded in the metrics")
+	}
+
+	c.ResetCommandMetrics()
+	if metrics := c.GetCommandMetrics(); len(metrics) != 0 {
+		t.Errorf("got %d metrics after reset, want none", len(metrics))
+	}
+}
+
+func TestExecutorRejectsInputAfterClose(t *testing.T) {
+	c, _ := newEmulatedController(t)
+	c.Close()
+	if _, err := c.PressHIDUsage(0x04); err != ErrControllerClosed {
+		t.Errorf("got %v after close, want %v", err, ErrControllerClosed)
+	}
+}
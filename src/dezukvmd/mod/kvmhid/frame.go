@@ -0,0 +1,237 @@
+package kvmhid
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"time"
+)
+
+/*
+	frame.go
+
+	Streaming parser for CH9329 frames and matching of replies to the
+	commands waiting for them. Frames have the format
+
+	0x57 0xAB <address> <command> <length> <data...> <checksum>
+
+	where the checksum is the sum of all preceding bytes. Replies use the
+	command byte | 0x80 on success and | 0xC0 on error. The chip answers
+	commands in order, so replies are matched to the oldest outstanding
+	command of the same type. This lets callers pipeline commands instead
+	of waiting for each round trip.
+*/
+
+const (
+	CommandReplyTimeout = 500 * time.Millisecond // Time to wait for the chip to reply to a command
+	maxFrameDataLength  = 64                     // Longest data section of a CH9329 frame
+)
+
+var frameHeader = []byte{0x57, 0xAB}
+
+// frame is a single decoded CH9329 frame
+type frame struct {
+	addr byte
+	cmd  byte
+	data []byte
+}
+
+// frameParser decodes frames from a stream of bytes that may be split or
+// corrupted arbitrarily. Garbage is skipped by searching for the next header.
+type frameParser struct {
+	buf []byte
+}
+
+// pendingCommand is a command sent to the chip that is waiting for its reply
+type pendingCommand struct {
+	cmd      byte
+	callback func(data []byte, err error)
+	timer    *time.Timer
+}
+
+// chipErrorCodes are the error codes carried in error replies
+var chipErrorCodes = map[byte]string{
+	0xE1: "receive timeout",
+	0xE2: "invalid frame header",
+	0xE3: "invalid command",
+	0xE4: "checksum mismatch",
+	0xE5: "invalid parameter",
+	0xE6: "operation failed",
+}
+
+// Feed appends the received bytes and returns all complete frames with a valid checksum
+func (p *frameParser) Feed(data []byte) []*frame {
+	p.buf = append(p.buf, data...)
+	frames := []*frame{}
+	for {
+		idx := bytes.Index(p.buf, frameHeader)
+		if idx < 0 {
+			// Keep a trailing 0x57 as it might be the start of the next header
+			if len(p.buf) > 0 && p.buf[len(p.buf)-1] == frameHeader[0] {
+				p.buf = append(p.buf[:0], frameHeader[0])
+			} else {
+				p.buf = p.buf[:0]
+			}
+			return frames
+		}
+		p.buf = p.buf[idx:]
+		if len(p.buf) < 5 {
+			return frames
+		}
+
+		length := int(p.buf[4])
+		if length > maxFrameDataLength {
+			// Not a real header, resync after it
+			p.buf = p.buf[1:]
+			continue
+		}
+		total := 5 + length + 1
+		if len(p.buf) < total {
+			return frames
+		}
+		if calcChecksum(p.buf[:total-1]) != p.buf[total-1] {
+			// Corrupted frame or a header found inside other data, resync after it
+			p.buf = p.buf[1:]
+			continue
+		}
+
+		frames = append(frames, &frame{
+			addr: p.buf[2],
+			cmd:  p.buf[3],
+			data: append([]byte{}, p.buf[5:5+length]...),
+		})
+		p.buf = p.buf[total:]
+	}
+}
+
+// SendCommandAsync queues a command packet and returns without waiting for the reply.
+// The callback, if not nil, is called with the reply data or an error once the reply
+// arrives or times out. It must not block as it runs on the serial reader.
+func (c *Controller) SendCommandAsync(packet []byte, callback func(data []byte, err error)) error {
+	if len(packet) < 5 {
+		return fmt.Errorf("invalid command packet")
+	}
+	if name := c.backend.Name(); name != BackendCH9329 {
+		return fmt.Errorf("CH9329 commands are not supported by the %s backend", name)
+	}
+	pc := &pendingCommand{
+		cmd:      packet[3],
+		callback: callback,
+	}
+
+	// Register before sending so a fast reply cannot arrive before we are waiting for it
+	c.pendingMu.Lock()
+	c.pendingCommands = append(c.pendingCommands, pc)
+	pc.timer = time.AfterFunc(CommandReplyTimeout, func() {
+		if c.removePendingCommand(pc) {
+			pc.resolve(nil, fmt.Errorf("timeout waiting for reply"))
+		}
+	})
+	c.pendingMu.Unlock()
+
+	if err := c.Send(packet); err != nil {
+		pc.timer.Stop()
+		c.removePendingCommand(pc)
+		return err
+	}
+	return nil
+}
+
+// sendAndWait sends a command packet and waits for the chip to reply to it
+func (c *Controller) sendAndWait(packet []byte) ([]byte, error) {
+	type result struct {
+		data []byte
+		err  error
+	}
+	done := make(chan result, 1)
+	err := c.SendCommandAsync(packet, func(data []byte, err error) {
+		done <- result{data, err}
+	})
+	if err != nil {
+		return nil, err
+	}
+	r := <-done
+	return r.data, r.err
+}
+
+// sendPipelined sends a command packet without waiting for the reply, errors are only logged
+func (c *Controller) sendPipelined(packet []byte) error {
+	return c.SendCommandAsync(packet, func(data []byte, err error) {
+		if err != nil {
+			log.Printf("HID command 0x%02X failed: %v", packet[3], err)
+		}
+	})
+}
+
+// handleIncomingData decodes received bytes and resolves the commands they reply to
+func (c *Controller) handleIncomingData(data []byte) {
+	for _, f := range c.frameParser.Feed(data) {
+		cmd := f.cmd & 0x3F
+		var replyErr error
+		switch f.cmd & 0xC0 {
+		case 0x80:
+		case 0xC0:
+			replyErr = fmt.Errorf("device returned error reply")
+			if len(f.data) > 0 {
+				if reason, ok := chipErrorCodes[f.data[0]]; ok {
+					replyErr = fmt.Errorf("device returned error reply: %s", reason)
+				}
+			}
+		default:
+			// Not a reply, e.g. an echo of our own frame
+			continue
+		}
+
+		pc := c.takePendingCommand(cmd)
+		if pc == nil {
+			log.Printf("Discarding unexpected reply to HID command 0x%02X", cmd)
+			continue
+		}
+		pc.timer.Stop()
+		pc.resolve(f.data, replyErr)
+	}
+}
+
+// takePendingCommand removes and returns the oldest outstanding command of the given type
+func (c *Controller) takePendingCommand(cmd byte) *pendingCommand {
+	c.pendingMu.Lock()
+	defer c.pendingMu.Unlock()
+	for i, pc := range c.pendingCommands {
+		if pc.cmd == cmd {
+			c.pendingCommands = append(c.pendingCommands[:i], c.pendingCommands[i+1:]...)
+			return pc
+		}
+	}
+	return nil
+}
+
+// removePendingCommand removes the command from the outstanding list, returns false if it was already resolved
+func (c *Controller) removePendingCommand(target *pendingCommand) bool {
+	c.pendingMu.Lock()
+	defer c.pendingMu.Unlock()
+	for i, pc := range c.pendingCommands {
+		if pc == target {
+			c.pendingCommands = append(c.pendingCommands[:i], c.pendingCommands[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// failPendingCommands resolves all outstanding commands with the given error
+func (c *Controller) failPendingCommands(err error) {
+	c.pendingMu.Lock()
+	pending := c.pendingCommands
+	c.pendingCommands = nil
+	c.pendingMu.Unlock()
+	for _, pc := range pending {
+		pc.timer.Stop()
+		pc.resolve(nil, err)
+	}
+}
+
+func (pc *pendingCommand) resolve(data []byte, err error) {
+	if pc.callback != nil {
+		pc.callback(data, err)
+	}
+}
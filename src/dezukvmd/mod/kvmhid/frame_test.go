@@ -0,0 +1,70 @@
+package kvmhid
+
+import (
+	"bytes"
+	"testing"
+)
+
+func buildFrame(cmd byte, data ...byte) []byte {
+	f := append([]byte{0x57, 0xAB, 0x00, cmd, byte(len(data))}, data...)
+	return append(f, calcChecksum(f))
+}
+
+func TestFrameParserSplitFrames(t *testing.T) {
+	p := &frameParser{}
+	stream := append(buildFrame(0x82, 0x00), buildFrame(0x88, 0x01, 0x02, 0x03)...)
+	var frames []*frame
+	for _, b := range stream {
+		frames = append(frames, p.Feed([]byte{b})...)
+	}
+	if len(frames) != 2 {
+		t.Fatalf("got %d frames, want 2", len(frames))
+	}
+	if frames[0].cmd != 0x82 || frames[1].cmd != 0x88 || !bytes.Equal(frames[1].data, []byte{0x01, 0x02, 0x03}) {
+		t.Errorf("unexpected frames: %+v %+v", frames[0], frames[1])
+	}
+}
+
+func TestFrameParserResync(t *testing.T) {
+	p := &frameParser{}
+	corrupted := buildFrame(0x84, 0x00)
+	corrupted[len(corrupted)-1]++
+
+	stream := []byte{0x00, 0x57, 0x12}        // Garbage with a stray header byte
+	stream = append(stream, corrupted...)     // Frame with bad checksum
+	stream = append(stream, 0x57, 0xAB, 0xFF) // Header followed by an impossible length
+	stream = append(stream, buildFrame(0x85, 0x00)...)
+
+	frames := p.Feed(stream)
+	if len(frames) != 1 || frames[0].cmd != 0x85 {
+		t.Fatalf("expected only the valid frame, got %+v", frames)
+	}
+}
+
+func TestPipelinedRepliesMatchCommands(t *testing.T) {
+	c, emu := newEmulatedController(t)
+	results := make(chan []byte, 2)
+	if err := c.SendCommandAsync(buildFrame(0x01), func(data []byte, err error) {
+		if err != nil {
+			t.Errorf("GET_INFO failed: %v", err)
+		}
+		results <- data
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.MouseMoveAbsoluteAsync(0x10, 0x00, 0x20, 0x00); err != nil {
+		t.Fatal(err)
+	}
+	info := <-results
+	if len(info) != 8 || info[0] != 0x30 {
+		t.Errorf("GET_INFO reply matched to wrong command: %X", info)
+	}
+
+	// A blocking command after the pipelined ones still gets its own reply
+	if _, err := c.MouseButtonPress(0x01); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(emu.Reports()); n != 2 {
+		t.Errorf("got %d reports, want 2", n)
+	}
+}
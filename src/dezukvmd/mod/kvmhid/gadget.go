@@ -0,0 +1,258 @@
+package kvmhid
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+/*
+	gadget.go
+
+	Set up a USB gadget with a boot keyboard and an absolute mouse HID
+	function through configfs, for the hidg backend. Needs root, the
+	libcomposite module and a USB device controller, e.g. the OTG port
+	of a Raspberry Pi with dtoverlay=dwc2.
+
+	The gadget is bound to the device controller once set up, the target
+	then sees both devices and the functions show up as /dev/hidgN.
+*/
+
+const DefaultConfigfsGadgetDir = "/sys/kernel/config/usb_gadget"
+
+// Configfs names of the HID functions and the gadget configuration
+const (
+	gadgetKeyboardFunction = "hid.keyboard"
+	gadgetMouseFunction    = "hid.mouse"
+	gadgetConfigName       = "c.1"
+	gadgetLanguage         = "0x409" // English (US)
+)
+
+// gadgetKeyboardReportDesc is the boot keyboard report descriptor, with modifiers,
+// a reserved byte, 6 keys and the 5 LED output bits
+var gadgetKeyboardReportDesc = []byte{
+	0x05, 0x01, // Usage Page (Generic Desktop)
+	0x09, 0x06, // Usage (Keyboard)
+	0xA1, 0x01, // Collection (Application)
+	0x05, 0x07, //   Usage Page (Keyboard)
+	0x19, 0xE0, //   Usage Minimum (Left Control)
+	0x29, 0xE7, //   Usage Maximum (Right GUI)
+	0x15, 0x00, //   Logical Minimum (0)
+	0x25, 0x01, //   Logical Maximum (1)
+	0x75, 0x01, //   Report Size (1)
+	0x95, 0x08, //   Report Count (8)
+	0x81, 0x02, //   Input (Data, Variable, Absolute), modifiers
+	0x95, 0x01, //   Report Count (1)
+	0x75, 0x08, //   Report Size (8)
+	0x81, 0x03, //   Input (Constant), reserved byte
+	0x95, 0x05, //   Report Count (5)
+	0x75, 0x01, //   Report Size (1)
+	0x05, 0x08, //   Usage Page (LEDs)
+	0x19, 0x01, //   Usage Minimum (Num Lock)
+	0x29, 0x05, //   Usage Maximum (Kana)
+	0x91, 0x02, //   Output (Data, Variable, Absolute), LEDs
+	0x95, 0x01, //   Report Count (1)
+	0x75, 0x03, //   Report Size (3)
+	0x91, 0x03, //   Output (Constant), LED padding
+	0x95, 0x06, //   Report Count (6)
+	0x75, 0x08, //   Report Size (8)
+	0x15, 0x00, //   Logical Minimum (0)
+	0x26, 0xFF, 0x00, //   Logical Maximum (255), covers F13 - F24, International and LANG keys
+	0x05, 0x07, //   Usage Page (Keyboard)
+	0x19, 0x00, //   Usage Minimum (0)
+	0x2A, 0xFF, 0x00, //   Usage Maximum (255)
+	0x81, 0x00, //   Input (Data, Array), keys
+	0xC0, // End Collection
+}
+
+// gadgetMouseReportDesc is the absolute mouse report descriptor, with 5 buttons,
+// x and y in the range 0 - 4095 and a relative wheel
+var gadgetMouseReportDesc = []byte{
+	0x05, 0x01, // Usage Page (Generic Desktop)
+	0x09, 0x02, // Usage (Mouse)
+	0xA1, 0x01, // Collection (Application)
+	0x09, 0x01, //   Usage (Pointer)
+	0xA1, 0x00, //   Collection (Physical)
+	0x05, 0x09, //     Usage Page (Button)
+	0x19, 0x01, //     Usage Minimum (1)
+	0x29, 0x05, //     Usage Maximum (5)
+	0x15, 0x00, //     Logical Minimum (0)
+	0x25, 0x01, //     Logical Maximum (1)
+	0x95, 0x05, //     Report Count (5)
+	0x75, 0x01, //     Report Size (1)
+	0x81, 0x02, //     Input (Data, Variable, Absolute), buttons
+	0x95, 0x01, //     Report Count (1)
+	0x75, 0x03, //     Report Size (3)
+	0x81, 0x03, //     Input (Constant), button padding
+	0x05, 0x01, //     Usage Page (Generic Desktop)
+	0x09, 0x30, //     Usage (X)
+	0x09, 0x31, //     Usage (Y)
+	0x15, 0x00, //     Logical Minimum (0)
+	0x26, 0xFF, 0x0F, //     Logical Maximum (4095)
+	0x75, 0x10, //     Report Size (16)
+	0x95, 0x02, //     Report Count (2)
+	0x81, 0x02, //     Input (Data, Variable, Absolute), x and y
+	0x09, 0x38, //     Usage (Wheel)
+	0x15, 0x81, //     Logical Minimum (-127)
+	0x25, 0x7F, //     Logical Maximum (127)
+	0x75, 0x08, //     Report Size (8)
+	0x95, 0x01, //     Report Count (1)
+	0x81, 0x06, //     Input (Data, Variable, Relative), wheel
+	0xC0, //   End Collection
+	0xC0, // End Collection
+}
+
+// GadgetConfig describes the USB gadget created by SetupGadget
+type GadgetConfig struct {
+	Name         string // Directory of the gadget in configfs, e.g. dezukvm
+	ConfigfsDir  string // Gadget directory of configfs, default DefaultConfigfsGadgetDir
+	UDC          string // USB device controller to bind to, default the first one in /sys/class/udc
+	VendorID     uint16 // Default 0x1D6B (Linux Foundation)
+	ProductID    uint16 // Default 0x0104 (Multifunction Composite Gadget)
+	Manufacturer string
+	Product      string
+	SerialNumber string
+}
+
+func (cfg *GadgetConfig) gadgetDir() string {
+	dir := cfg.ConfigfsDir
+	if dir == "" {
+		dir = DefaultConfigfsGadgetDir
+	}
+	return filepath.Join(dir, cfg.Name)
+}
+
+// SetupGadget creates the keyboard and mouse HID functions and binds the gadget to
+// the USB device controller. A gadget that is already bound is left as it is.
+func SetupGadget(cfg GadgetConfig) error {
+	if cfg.Name == "" {
+		return errors.New("gadget name is empty")
+	}
+	if cfg.VendorID == 0 {
+		cfg.VendorID = 0x1D6B
+	}
+	if cfg.ProductID == 0 {
+		cfg.ProductID = 0x0104
+	}
+	if cfg.Manufacturer == "" {
+		cfg.Manufacturer = "imuslab"
+	}
+	if cfg.Product == "" {
+		cfg.Product = "DezuKVM HID"
+	}
+
+	gadget := cfg.gadgetDir()
+	if udc, err := os.ReadFile(filepath.Join(gadget, "UDC")); err == nil && strings.TrimSpace(string(udc)) != "" {
+		return nil
+	}
+
+	config := filepath.Join(gadget, "configs", gadgetConfigName)
+	attributes := []struct {
+		path  string
+		value []byte
+	}{
+		{"idVendor", []byte(fmt.Sprintf("0x%04x", cfg.VendorID))},
+		{"idProduct", []byte(fmt.Sprintf("0x%04x", cfg.ProductID))},
+		{"bcdDevice", []byte("0x0100")},
+		{"bcdUSB", []byte("0x0200")},
+		{filepath.Join("strings", gadgetLanguage, "manufacturer"), []byte(cfg.Manufacturer)},
+		{filepath.Join("strings", gadgetLanguage, "product"), []byte(cfg.Product)},
+		{filepath.Join("strings", gadgetLanguage, "serialnumber"), []byte(cfg.SerialNumber)},
+		{filepath.Join("configs", gadgetConfigName, "MaxPower"), []byte("250")},
+		{filepath.Join("configs", gadgetConfigName, "strings", gadgetLanguage, "configuration"), []byte("Keyboard and mouse")},
+
+		// Boot keyboard
+		{filepath.Join("functions", gadgetKeyboardFunction, "protocol"), []byte("1")},
+		{filepath.Join("functions", gadgetKeyboardFunction, "subclass"), []byte("1")},
+		{filepath.Join("functions", gadgetKeyboardFunction, "report_length"), []byte("8")},
+		{filepath.Join("functions", gadgetKeyboardFunction, "report_desc"), gadgetKeyboardReportDesc},
+
+		// Absolute mouse, not a boot device
+		{filepath.Join("functions", gadgetMouseFunction, "protocol"), []byte("0")},
+		{filepath.Join("functions", gadgetMouseFunction, "subclass"), []byte("0")},
+		{filepath.Join("functions", gadgetMouseFunction, "report_length"), []byte("6")},
+		{filepath.Join("functions", gadgetMouseFunction, "report_desc"), gadgetMouseReportDesc},
+	}
+	for _, attr := range attributes {
+		path := filepath.Join(gadget, attr.path)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(path, attr.value, 0644); err != nil {
+			return fmt.Errorf("failed to write %s: %w", path, err)
+		}
+	}
+
+	for _, function := range []string{gadgetKeyboardFunction, gadgetMouseFunction} {
+		link := filepath.Join(config, function)
+		if _, err := os.Lstat(link); err == nil {
+			continue
+		}
+		if err := os.Symlink(filepath.Join(gadget, "functions", function), link); err != nil {
+			return err
+		}
+	}
+
+	udc := cfg.UDC
+	if udc == "" {
+		controllers, err := os.ReadDir(udcClassDir)
+		if err != nil || len(controllers) == 0 {
+			return errors.New("no USB device controller found, is the OTG port in peripheral mode?")
+		}
+		udc = controllers[0].Name()
+	}
+	return os.WriteFile(filepath.Join(gadget, "UDC"), []byte(udc), 0644)
+}
+
+// RemoveGadget unbinds the gadget and removes it from configfs
+func RemoveGadget(cfg GadgetConfig) error {
+	if cfg.Name == "" {
+		return errors.New("gadget name is empty")
+	}
+	gadget := cfg.gadgetDir()
+	if _, err := os.Stat(gadget); err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(gadget, "UDC"), []byte("\n"), 0644); err != nil {
+		return err
+	}
+
+	// configfs only allows removing the directories, children first
+	config := filepath.Join(gadget, "configs", gadgetConfigName)
+	paths := []string{
+		filepath.Join(config, gadgetKeyboardFunction),
+		filepath.Join(config, gadgetMouseFunction),
+		filepath.Join(config, "strings", gadgetLanguage),
+		config,
+		filepath.Join(gadget, "functions", gadgetKeyboardFunction),
+		filepath.Join(gadget, "functions", gadgetMouseFunction),
+		filepath.Join(gadget, "strings", gadgetLanguage),
+		gadget,
+	}
+	for _, path := range paths {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// GadgetDevices returns the /dev/hidgN devices of the keyboard and mouse functions
+func GadgetDevices(cfg GadgetConfig) (string, string, error) {
+	devices := []string{}
+	for _, function := range []string{gadgetKeyboardFunction, gadgetMouseFunction} {
+		// dev holds major:minor, the minor number is the N of /dev/hidgN
+		dev, err := os.ReadFile(filepath.Join(cfg.gadgetDir(), "functions", function, "dev"))
+		if err != nil {
+			return "", "", err
+		}
+		_, minor, found := strings.Cut(strings.TrimSpace(string(dev)), ":")
+		if !found {
+			return "", "", fmt.Errorf("invalid device number of %s: %s", function, dev)
+		}
+		devices = append(devices, "/dev/hidg"+minor)
+	}
+	return devices[0], devices[1], nil
+}
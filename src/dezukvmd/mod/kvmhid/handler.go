@@ -2,10 +2,15 @@ package kvmhid
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
 )
@@ -14,12 +19,15 @@ import (
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
+	Subprotocols:    []string{HIDProtocolV2},
 	CheckOrigin: func(r *http.Request) bool {
 		return true
 	},
 }
 
-// HIDWebSocketHandler handles incoming WebSocket connections for HID commands
+// HIDWebSocketHandler handles incoming WebSocket connections for HID commands.
+// Clients asking for the dezukvm.hid.v2 subprotocol get the binary protocol
+// described in protocol.go, all others the JSON protocol.
 func (c *Controller) HIDWebSocketHandler(w http.ResponseWriter, r *http.Request) {
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
@@ -27,12 +35,93 @@ func (c *Controller) HIDWebSocketHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 	defer conn.Close()
+	isV2 := conn.Subprotocol() == HIDProtocolV2
+
+	// Each connection has its own session settings, e.g. mouse mode
+	session := newHIDSession()
+	session.name = r.URL.Query().Get("name")
+	session.remoteAddr = r.RemoteAddr
+	// The control token is only ever sent here, to this client
+	var hello interface{} = map[string]string{"session_id": session.id, "control_token": session.controlToken}
+	if isV2 {
+		hello = &HIDEvent{Type: HIDEventHello, SessionID: session.id, ControlToken: session.controlToken, Protocol: 2}
+	}
+	if err := conn.WriteJSON(hello); err != nil {
+		log.Println("Error writing message:", err)
+		return
+	}
+
+	// Chip status and input control changes are pushed from other goroutines,
+	// so all writes to the connection are serialized with writeMu.
+	var writeMu sync.Mutex
+	push := func(msg interface{}) {
+		if isV2 {
+			msg = toHIDEvent(msg)
+		}
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		if err := conn.WriteJSON(msg); err != nil {
+			log.Println("Error writing message:", err)
+		}
+	}
+
+	// Push chip status (target connection and keyboard LEDs) to the client when it changes
+	var lastLEDs *LEDState
+	pushStatus := func(status ChipStatus) {
+		push(map[string]ChipStatus{"chip_status": status})
+		if leds := ledState(status); isV2 && (lastLEDs == nil || *lastLEDs != leds) {
+			lastLEDs = &leds
+			push(&HIDEvent{Type: HIDEventLEDs, LEDs: &leds})
+		}
+	}
+	push(map[string]ConnectionStatus{"connection": c.GetConnectionStatus()})
+	pushStatus(c.GetChipStatus())
+	statusListenerID := c.AddStatusListener(pushStatus)
+	defer c.RemoveStatusListener(statusListenerID)
+
+	// Only one session holds input control, the others are view-only
+	session.push = push
+	c.registerSession(session)
+	defer c.unregisterSession(session)
+
+	// Never leave keys held on the target when the client goes away,
+	// whether the socket is closed cleanly, errors or just goes quiet
+	defer session.releasePressed(c)
+	idleTimeout := c.Config.SessionIdleTimeout
+	if idleTimeout <= 0 {
+		idleTimeout = DefaultSessionIdleTimeout
+	}
+	idleTimer := time.AfterFunc(idleTimeout, func() {
+		session.releasePressed(c)
+	})
+	defer idleTimer.Stop()
+
 	for {
-		_, message, err := conn.ReadMessage()
+		messageType, message, err := conn.ReadMessage()
 		if err != nil {
 			log.Println("Error reading message:", err)
 			break
 		}
+		idleTimer.Reset(idleTimeout)
+
+		if isV2 {
+			var seq uint16
+			var hidCmd *HIDCommand
+			if messageType == websocket.BinaryMessage {
+				seq, hidCmd, err = DecodeHIDFrame(message)
+			} else {
+				seq, hidCmd, err = decodeHIDTextFrame(message)
+			}
+			if err == nil {
+				err = c.handleSessionCommand(session, hidCmd)
+			}
+			if err != nil {
+				push(&HIDEvent{Type: HIDEventError, Seq: seq, Error: err.Error()})
+			} else if seq != 0 {
+				push(&HIDEvent{Type: HIDEventAck, Seq: seq})
+			}
+			continue
+		}
 
 		//Try parsing the message as a HIDCommand
 		var hidCmd HIDCommand
@@ -41,16 +130,26 @@ func (c *Controller) HIDWebSocketHandler(w http.ResponseWriter, r *http.Request)
 			continue
 		}
 
-		bytes, err := c.ConstructAndSendCmd(&hidCmd)
+		if IsControlEvent(hidCmd.Event) {
+			if err := c.handleControlCommand(session, &hidCmd); err != nil {
+				push(map[string]string{"error": err.Error()})
+			}
+			continue
+		}
+
+		bytes, err := session.handleCommand(c, &hidCmd)
 		if err != nil {
 			errmsg := map[string]string{"error": err.Error()}
-			if err := conn.WriteJSON(errmsg); err != nil {
+			writeMu.Lock()
+			writeErr := conn.WriteJSON(errmsg)
+			writeMu.Unlock()
+			if writeErr != nil {
 				// Check for broken pipe error to handle closed websocket
-				if err != nil && strings.Contains(err.Error(), "broken pipe") {
+				if strings.Contains(writeErr.Error(), "broken pipe") {
 					log.Println("WebSocket connection closed (broken pipe), cleaning up")
 					break
 				}
-				log.Println("Error writing message:", err)
+				log.Println("Error writing message:", writeErr)
 				continue
 			}
 			log.Println("Error sending command:", err)
@@ -61,7 +160,10 @@ func (c *Controller) HIDWebSocketHandler(w http.ResponseWriter, r *http.Request)
 		for _, b := range bytes {
 			prettyBytes += fmt.Sprintf("0x%02X ", b)
 		}
-		if err := conn.WriteMessage(websocket.TextMessage, []byte(prettyBytes)); err != nil {
+		writeMu.Lock()
+		err = conn.WriteMessage(websocket.TextMessage, []byte(prettyBytes))
+		writeMu.Unlock()
+		if err != nil {
 			if err != nil && strings.Contains(err.Error(), "broken pipe") {
 				log.Println("WebSocket connection closed (broken pipe), cleaning up")
 				break
@@ -72,3 +174,311 @@ func (c *Controller) HIDWebSocketHandler(w http.ResponseWriter, r *http.Request)
 
 	}
 }
+
+// handleSessionCommand handles a command from a session, either an input
+// ownership event or an input event
+func (c *Controller) handleSessionCommand(s *hidSession, cmd *HIDCommand) error {
+	if IsControlEvent(cmd.Event) {
+		return c.handleControlCommand(s, cmd)
+	}
+	_, err := s.handleCommand(c, cmd)
+	return err
+}
+
+// HandleTypeText starts typing the posted text on the target
+// Accept POST parameters: text, layout (optional, default us) and interval (optional, in ms).
+// Like all REST input, only accepted from the session holding input control, see arbiter.go.
+func (c *Controller) HandleTypeText(w http.ResponseWriter, r *http.Request) {
+	if err := c.CheckControl(RequestControlToken(r)); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Invalid form data", http.StatusBadRequest)
+		return
+	}
+	text := r.Form.Get("text")
+	if text == "" {
+		http.Error(w, "Missing or invalid text parameter", http.StatusBadRequest)
+		return
+	}
+	interval := 0
+	if intervalStr := r.Form.Get("interval"); intervalStr != "" {
+		var err error
+		interval, err = strconv.Atoi(intervalStr)
+		if err != nil || interval < 0 {
+			http.Error(w, "Invalid interval parameter", http.StatusBadRequest)
+			return
+		}
+	}
+
+	job, err := c.StartTypeText(text, r.Form.Get("layout"), time.Duration(interval)*time.Millisecond)
+	if errors.Is(err, ErrTypeTextBusy) || errors.Is(err, ErrInputJobBusy) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(job.Status())
+}
+
+// HandleTypeTextStatus returns the progress of the current or last typing job
+func (c *Controller) HandleTypeTextStatus(w http.ResponseWriter, r *http.Request) {
+	job := c.GetTypeTextJob()
+	if job == nil {
+		http.Error(w, "No text typing job found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(job.Status())
+}
+
+// HandleCancelTypeText cancels the running typing job, only from the session holding input control
+func (c *Controller) HandleCancelTypeText(w http.ResponseWriter, r *http.Request) {
+	if err := c.CheckControl(RequestControlToken(r)); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	job := c.GetTypeTextJob()
+	if job == nil {
+		http.Error(w, "No text typing job found", http.StatusNotFound)
+		return
+	}
+	job.Cancel()
+	job.Wait()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(job.Status())
+}
+
+// HandleMediaKey presses and releases a multimedia or ACPI system key on the target
+// Accept POST parameters: key (e.g. volume_up, mute, power, sleep, wake) and hold (optional, in ms)
+func (c *Controller) HandleMediaKey(w http.ResponseWriter, r *http.Request) {
+	if err := c.CheckControl(RequestControlToken(r)); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Invalid form data", http.StatusBadRequest)
+		return
+	}
+	key := r.Form.Get("key")
+	if key == "" {
+		http.Error(w, "Missing or invalid key parameter", http.StatusBadRequest)
+		return
+	}
+	hold := 0
+	if holdStr := r.Form.Get("hold"); holdStr != "" {
+		var err error
+		hold, err = strconv.Atoi(holdStr)
+		if err != nil || hold < 0 {
+			http.Error(w, "Invalid hold parameter", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if err := c.TapMediaKey(r.Context(), key, time.Duration(hold)*time.Millisecond); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("OK"))
+}
+
+// HandleSendKeys presses and releases a sequence of key chords on the target
+// Accept a JSON body with chords, a list of chord objects or strings like "Ctrl+Alt+Delete",
+// or sysrq, a Linux Magic SysRq command sequence like "reisub" with an optional sysrq_delay in ms
+func (c *Controller) HandleSendKeys(w http.ResponseWriter, r *http.Request) {
+	if err := c.CheckControl(RequestControlToken(r)); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	var req struct {
+		Chords     []KeyChord `json:"chords"`
+		SysRq      string     `json:"sysrq"`
+		SysRqDelay int        `json:"sysrq_delay"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+
+	chords := req.Chords
+	if req.SysRq != "" {
+		if len(chords) > 0 {
+			http.Error(w, "Send either chords or sysrq, not both", http.StatusBadRequest)
+			return
+		}
+		var err error
+		chords, err = SysRqChords(req.SysRq, time.Duration(req.SysRqDelay)*time.Millisecond)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if err := ValidateKeyChords(chords); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := c.SendKeyChords(r.Context(), chords); err != nil {
+		if err == ErrKeyChordsBusy {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		http.Error(w, "Failed to send keys: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("OK"))
+}
+
+// HandleListMediaKeys returns the names of the supported multimedia and system keys
+func (c *Controller) HandleListMediaKeys(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ListMediaKeys())
+}
+
+// HandleGetChipConfig returns the parameter configuration and custom USB strings of the chip
+func (c *Controller) HandleGetChipConfig(w http.ResponseWriter, r *http.Request) {
+	cfg, err := c.GetChipConfig()
+	if err != nil {
+		http.Error(w, "Failed to read chip configuration: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	strs, err := c.GetUSBStrings()
+	if err != nil {
+		http.Error(w, "Failed to read chip USB strings: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"config":  cfg,
+		"strings": strs,
+	})
+}
+
+// HandleSetChipConfig updates the parameter configuration and custom USB strings of the chip.
+// Accept a JSON body in the same format as HandleGetChipConfig, fields not given are left unchanged.
+// Set "reset" to true to soft reset the chip so the new configuration takes effect. Changing the
+// baud rate requires "force" as the daemon has to be reconfigured to talk to the chip afterwards.
+func (c *Controller) HandleSetChipConfig(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Config  json.RawMessage `json:"config"`
+		Strings json.RawMessage `json:"strings"`
+		Reset   bool            `json:"reset"`
+		Force   bool            `json:"force"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+
+	if len(req.Config) > 0 {
+		cfg, err := c.GetChipConfig()
+		if err != nil {
+			http.Error(w, "Failed to read chip configuration: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		currentBaudRate := cfg.BaudRate
+		if err := json.Unmarshal(req.Config, cfg); err != nil {
+			http.Error(w, "Invalid config: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if cfg.BaudRate != currentBaudRate && !req.Force {
+			http.Error(w, "Changing the baud rate requires force to be set", http.StatusBadRequest)
+			return
+		}
+		if err := cfg.Validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := c.SetChipConfig(cfg); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if len(req.Strings) > 0 {
+		strs, err := c.GetUSBStrings()
+		if err != nil {
+			http.Error(w, "Failed to read chip USB strings: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		current := *strs
+		if err := json.Unmarshal(req.Strings, strs); err != nil {
+			http.Error(w, "Invalid strings: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		updates := []struct {
+			stringType USBStringType
+			old, new   string
+		}{
+			{USBStringManufacturer, current.Manufacturer, strs.Manufacturer},
+			{USBStringProduct, current.Product, strs.Product},
+			{USBStringSerial, current.SerialNumber, strs.SerialNumber},
+		}
+		for _, u := range updates {
+			if u.old == u.new {
+				continue
+			}
+			if err := c.SetUSBString(u.stringType, u.new); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+	}
+
+	if req.Reset {
+		if err := c.ChipSoftReset(); err != nil {
+			http.Error(w, "Failed to reset chip: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("OK"))
+}
+
+// HandleReleaseAll releases all keys, modifiers, media keys and mouse buttons on the target
+func (c *Controller) HandleReleaseAll(w http.ResponseWriter, r *http.Request) {
+	if err := c.CheckControl(RequestControlToken(r)); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err := c.ReleaseAll(); err != nil {
+		http.Error(w, "Failed to release inputs: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("OK"))
+}
+
+// HandleControlState returns which HID session holds input control and all connected sessions
+func (c *Controller) HandleControlState(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(c.GetControlState())
+}
+
+// HandleCommandMetrics returns the command metrics of the controller, or clears them with DELETE
+func (c *Controller) HandleCommandMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodDelete {
+		c.ResetCommandMetrics()
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("OK"))
+		return
+	}
+	metrics := c.GetCommandMetrics()
+	names := make([]string, 0, len(metrics))
+	for name := range metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"operations":  names,
+		"metrics":     metrics,
+		"queue_depth": len(c.executor.queue),
+	})
+}
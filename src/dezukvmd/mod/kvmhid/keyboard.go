@@ -1,6 +1,11 @@
 package kvmhid
 
-import "errors"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
 
 const (
 	MOD_LCTRL  = 0x01
@@ -63,9 +68,10 @@ func (c *Controller) SetModifierKey(keycode uint8, isRight bool) ([]byte, error)
 		return nil, errors.ErrUnsupported
 	}
 
-	c.hidState.Modkey |= modifierBit
-
-	return keyboardSendKeyCombinations(c)
+	return c.execute(OpKeyboard, func() ([]byte, error) {
+		c.hidState.Modkey |= modifierBit
+		return keyboardSendKeyCombinations(c)
+	})
 }
 
 func (c *Controller) UnsetModifierKey(keycode uint8, isRight bool) ([]byte, error) {
@@ -101,22 +107,58 @@ func (c *Controller) UnsetModifierKey(keycode uint8, isRight bool) ([]byte, erro
 		return nil, errors.ErrUnsupported
 	}
 
-	c.hidState.Modkey &^= modifierBit
-	return keyboardSendKeyCombinations(c)
+	return c.execute(OpKeyboard, func() ([]byte, error) {
+		c.hidState.Modkey &^= modifierBit
+		return keyboardSendKeyCombinations(c)
+	})
 }
 
 // SendKeyboardPress sends a keyboard press by JavaScript keycode
 func (c *Controller) SendKeyboardPress(keycode uint8) ([]byte, error) {
 	// Convert JavaScript keycode to HID
-	keycode = javaScriptKeycodeToHIDOpcode(keycode)
-	if keycode == 0x00 {
+	usage := javaScriptKeycodeToHIDOpcode(keycode)
+	if usage == 0x00 {
+		// Not supported
+		return nil, fmt.Errorf("unsupported keycode: %d", keycode)
+	}
+	return c.PressHIDUsage(usage)
+}
+
+// SendKeyboardRelease sends a keyboard release by JavaScript keycode
+func (c *Controller) SendKeyboardRelease(keycode uint8) ([]byte, error) {
+	// Convert JavaScript keycode to HID
+	usage := javaScriptKeycodeToHIDOpcode(keycode)
+	if usage == 0x00 {
 		// Not supported
-		return nil, errors.New("Unsupported keycode: " + string(keycode))
+		return nil, fmt.Errorf("unsupported keycode: %d", keycode)
+	}
+	return c.ReleaseHIDUsage(usage)
+}
+
+// PressHIDUsage presses a key by its HID usage code. Modifier usages (0xE0 - 0xE7)
+// are set in the modifier byte instead of taking one of the 6 key slots.
+func (c *Controller) PressHIDUsage(usage uint8) ([]byte, error) {
+	return c.execute(OpKeyboard, func() ([]byte, error) {
+		return c.pressHIDUsage(usage)
+	})
+}
+
+// ReleaseHIDUsage releases a key by its HID usage code
+func (c *Controller) ReleaseHIDUsage(usage uint8) ([]byte, error) {
+	return c.execute(OpKeyboard, func() ([]byte, error) {
+		return c.releaseHIDUsage(usage)
+	})
+}
+
+func (c *Controller) pressHIDUsage(usage uint8) ([]byte, error) {
+	if isModifierUsage(usage) {
+		c.hidState.Modkey |= modifierUsageToBit(usage)
+		return keyboardSendKeyCombinations(c)
 	}
 
 	// Already pressed? Skip
 	for i := 0; i < 6; i++ {
-		if c.hidState.KeyboardButtons[i] == keycode {
+		if c.hidState.KeyboardButtons[i] == usage {
 			return nil, nil
 		}
 	}
@@ -124,27 +166,24 @@ func (c *Controller) SendKeyboardPress(keycode uint8) ([]byte, error) {
 	// Get the empty slot in the current HID list
 	for i := 0; i < 6; i++ {
 		if c.hidState.KeyboardButtons[i] == 0x00 {
-			c.hidState.KeyboardButtons[i] = keycode
+			c.hidState.KeyboardButtons[i] = usage
 			return keyboardSendKeyCombinations(c)
 		}
 	}
 
 	// No space left
-	return nil, errors.New("No space left in keyboard state to press key: " + string(keycode))
+	return nil, fmt.Errorf("no space left in keyboard state to press key: 0x%02X", usage)
 }
 
-// SendKeyboardRelease sends a keyboard release by JavaScript keycode
-func (c *Controller) SendKeyboardRelease(keycode uint8) ([]byte, error) {
-	// Convert JavaScript keycode to HID
-	keycode = javaScriptKeycodeToHIDOpcode(keycode)
-	if keycode == 0x00 {
-		// Not supported
-		return nil, errors.New("Unsupported keycode: " + string(keycode))
+func (c *Controller) releaseHIDUsage(usage uint8) ([]byte, error) {
+	if isModifierUsage(usage) {
+		c.hidState.Modkey &^= modifierUsageToBit(usage)
+		return keyboardSendKeyCombinations(c)
 	}
 
 	// Find the position where the key is pressed
 	for i := 0; i < 6; i++ {
-		if c.hidState.KeyboardButtons[i] == keycode {
+		if c.hidState.KeyboardButtons[i] == usage {
 			c.hidState.KeyboardButtons[i] = 0x00
 			return keyboardSendKeyCombinations(c)
 		}
@@ -154,31 +193,65 @@ func (c *Controller) SendKeyboardRelease(keycode uint8) ([]byte, error) {
 	return nil, nil
 }
 
-// keyboardSendKeyCombinations simulates sending the current key combinations
-func keyboardSendKeyCombinations(c *Controller) ([]byte, error) {
-	// Prepare the packet
-	packet := []uint8{
-		0x57, 0xAB, 0x00, 0x02, 0x08,
-		c.hidState.Modkey, 0x00,
-		0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
-		0x00,
+// SendKeyCombo presses the modifiers and keys (HID usage codes) together, holds them
+// for the given duration and releases them. The keys are always released, even if the
+// context is cancelled while holding. Keys held by other sessions are restored afterwards.
+func (c *Controller) SendKeyCombo(ctx context.Context, modifiers uint8, keys []uint8, hold time.Duration) error {
+	var report [6]uint8
+	slot := 0
+	for _, usage := range keys {
+		if isModifierUsage(usage) {
+			modifiers |= modifierUsageToBit(usage)
+			continue
+		}
+		if slot >= len(report) {
+			return errors.New("too many keys in key combination, at most 6 non-modifier keys are allowed")
+		}
+		report[slot] = usage
+		slot++
 	}
 
-	// Populate the HID keycodes
-	for i := 0; i < len(c.hidState.KeyboardButtons); i++ {
-		packet[7+i] = c.hidState.KeyboardButtons[i]
+	_, err := c.execute(OpKeyCombo, func() ([]byte, error) {
+		resp, err := c.sendKeyboardReport(modifiers, report)
+		if err != nil {
+			keyboardSendKeyCombinations(c)
+		}
+		return resp, err
+	})
+	if err != nil {
+		return err
+	}
+	holdErr := sleepContext(ctx, hold)
+	if _, err := c.execute(OpKeyCombo, func() ([]byte, error) {
+		return keyboardSendKeyCombinations(c)
+	}); err != nil {
+		return err
 	}
+	return holdErr
+}
+
+// RestoreKeyboard sends the keys held in the HID state to the target again. Key combinations
+// and text typing never change the HID state, so this releases whatever they left pressed
+// while keys held by sessions stay down.
+func (c *Controller) RestoreKeyboard() error {
+	_, err := c.execute(OpKeyboard, func() ([]byte, error) {
+		return keyboardSendKeyCombinations(c)
+	})
+	return err
+}
 
-	// Calculate checksum
-	packet[13] = calcChecksum(packet[:13])
+// keyboardSendKeyCombinations simulates sending the current key combinations, must run on the executor
+func keyboardSendKeyCombinations(c *Controller) ([]byte, error) {
+	return c.sendKeyboardReport(c.hidState.Modkey, c.hidState.KeyboardButtons)
+}
 
-	err := c.Send(packet)
+// sendKeyboardReport sends a raw keyboard report with the given modifier and HID usage codes
+func (c *Controller) sendKeyboardReport(modkey uint8, keys [6]uint8) ([]byte, error) {
+	resp, err := c.backend.SendKeyboardReport(modkey, keys)
 	if err != nil {
-		return nil, errors.New("failed to send mouse move command: " + err.Error())
+		return nil, fmt.Errorf("failed to send keyboard command: %w", err)
 	}
-
-	// Wait for a reply from the device
-	return c.WaitForReply(0x02)
+	return resp, nil
 }
 
 // JavaScriptKeycodeToHIDOpcode converts JavaScript keycode into HID keycode
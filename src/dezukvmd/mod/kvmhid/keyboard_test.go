@@ -0,0 +1,114 @@
+package kvmhid
+
+import (
+	"bytes"
+	"context"
+	"testing"
+)
+
+// lastKeyboardReport returns the data of the last keyboard report received by the emulator
+func lastKeyboardReport(t *testing.T, emu *Emulator) []byte {
+	t.Helper()
+	reports := emu.Reports()
+	for i := len(reports) - 1; i >= 0; i-- {
+		if reports[i].Cmd == 0x02 {
+			return reports[i].Data
+		}
+	}
+	t.Fatal("no keyboard report received")
+	return nil
+}
+
+func TestModifierHandling(t *testing.T) {
+	c, emu := newEmulatedController(t)
+	steps := []struct {
+		name   string
+		action func() ([]byte, error)
+		want   []byte
+	}{
+		{"press left shift", func() ([]byte, error) { return c.PressHIDUsage(0xE1) }, []byte{0x02, 0, 0, 0, 0, 0, 0, 0}},
+		{"press a", func() ([]byte, error) { return c.PressHIDUsage(0x04) }, []byte{0x02, 0, 0x04, 0, 0, 0, 0, 0}},
+		{"press right ctrl", func() ([]byte, error) { return c.SetModifierKey(17, true) }, []byte{0x12, 0, 0x04, 0, 0, 0, 0, 0}},
+		{"release left shift", func() ([]byte, error) { return c.ReleaseHIDUsage(0xE1) }, []byte{0x10, 0, 0x04, 0, 0, 0, 0, 0}},
+		{"release right ctrl", func() ([]byte, error) { return c.UnsetModifierKey(17, true) }, []byte{0x00, 0, 0x04, 0, 0, 0, 0, 0}},
+		{"release a", func() ([]byte, error) { return c.ReleaseHIDUsage(0x04) }, []byte{0, 0, 0, 0, 0, 0, 0, 0}},
+	}
+	for _, step := range steps {
+		if _, err := step.action(); err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		if got := lastKeyboardReport(t, emu); !bytes.Equal(got, step.want) {
+			t.Errorf("%s: got report %X, want %X", step.name, got, step.want)
+		}
+	}
+}
+
+func TestKeySlots(t *testing.T) {
+	c, emu := newEmulatedController(t)
+	for usage := uint8(0x04); usage < 0x0A; usage++ {
+		if _, err := c.PressHIDUsage(usage); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := c.PressHIDUsage(0x0A); err == nil {
+		t.Error("expected error when pressing a 7th key")
+	}
+
+	// Releasing a key frees its slot for the next one
+	c.ReleaseHIDUsage(0x05)
+	c.PressHIDUsage(0x0A)
+	want := []byte{0x00, 0, 0x04, 0x0A, 0x06, 0x07, 0x08, 0x09}
+	if got := lastKeyboardReport(t, emu); !bytes.Equal(got, want) {
+		t.Errorf("got report %X, want %X", got, want)
+	}
+
+	// Pressing an already pressed key sends nothing
+	emu.ClearReports()
+	c.PressHIDUsage(0x04)
+	if len(emu.Reports()) != 0 {
+		t.Error("pressing a held key should not send a report")
+	}
+}
+
+func TestKeyComboRestoresHeldKeys(t *testing.T) {
+	c, emu := newEmulatedController(t)
+	c.PressHIDUsage(0xE1) // Held by the user
+	emu.ClearReports()
+
+	if err := c.SendKeyCombo(context.Background(), MOD_LCTRL|MOD_LALT, []uint8{0x4C}, 0); err != nil {
+		t.Fatal(err)
+	}
+	reports := emu.Reports()
+	if len(reports) != 2 {
+		t.Fatalf("got %d reports, want 2", len(reports))
+	}
+	if want := []byte{0x05, 0, 0x4C, 0, 0, 0, 0, 0}; !bytes.Equal(reports[0].Data, want) {
+		t.Errorf("combo report %X, want %X", reports[0].Data, want)
+	}
+	if want := []byte{0x02, 0, 0, 0, 0, 0, 0, 0}; !bytes.Equal(reports[1].Data, want) {
+		t.Errorf("restore report %X, want %X", reports[1].Data, want)
+	}
+}
+
+func TestReleaseAll(t *testing.T) {
+	c, emu := newEmulatedController(t)
+	c.PressHIDUsage(0xE0)
+	c.PressHIDUsage(0x04)
+	c.MouseButtonPress(0x01)
+	c.PressMediaKey("volume_up")
+
+	if err := c.ReleaseAll(); err != nil {
+		t.Fatal(err)
+	}
+	if got := lastKeyboardReport(t, emu); !bytes.Equal(got, make([]byte, 8)) {
+		t.Errorf("keyboard not released: %X", got)
+	}
+	reports := emu.Reports()
+	last := reports[len(reports)-1]
+	if last.Cmd != 0x05 || last.Data[1] != 0x00 {
+		t.Errorf("mouse buttons not released: %+v", last)
+	}
+	if c.hidState.MediaKeys != [3]uint8{} {
+		t.Errorf("media keys not released: %X", c.hidState.MediaKeys)
+	}
+}
@@ -0,0 +1,176 @@
+package kvmhid
+
+import (
+	"fmt"
+	"strings"
+)
+
+/*
+	keycode.go
+
+	Mapping from KeyboardEvent.code to HID usage codes (Keyboard/Keypad page 0x07).
+
+	Unlike the deprecated KeyboardEvent.keyCode, the code value identifies the
+	physical key, so left / right modifiers, numpad keys and ISO / JIS only keys
+	can be told apart without guessing.
+*/
+
+var keyboardCodeToHIDUsage = map[string]uint8{
+	/* Letters */
+	"KeyA": 0x04, "KeyB": 0x05, "KeyC": 0x06, "KeyD": 0x07, "KeyE": 0x08,
+	"KeyF": 0x09, "KeyG": 0x0A, "KeyH": 0x0B, "KeyI": 0x0C, "KeyJ": 0x0D,
+	"KeyK": 0x0E, "KeyL": 0x0F, "KeyM": 0x10, "KeyN": 0x11, "KeyO": 0x12,
+	"KeyP": 0x13, "KeyQ": 0x14, "KeyR": 0x15, "KeyS": 0x16, "KeyT": 0x17,
+	"KeyU": 0x18, "KeyV": 0x19, "KeyW": 0x1A, "KeyX": 0x1B, "KeyY": 0x1C,
+	"KeyZ": 0x1D,
+
+	/* Digits (top row) */
+	"Digit1": 0x1E, "Digit2": 0x1F, "Digit3": 0x20, "Digit4": 0x21, "Digit5": 0x22,
+	"Digit6": 0x23, "Digit7": 0x24, "Digit8": 0x25, "Digit9": 0x26, "Digit0": 0x27,
+
+	/* Control and punctuation */
+	"Enter":         0x28,
+	"Escape":        0x29,
+	"Backspace":     0x2A,
+	"Tab":           0x2B,
+	"Space":         0x2C,
+	"Minus":         0x2D,
+	"Equal":         0x2E,
+	"BracketLeft":   0x2F,
+	"BracketRight":  0x30,
+	"Backslash":     0x31,
+	"Semicolon":     0x33,
+	"Quote":         0x34,
+	"Backquote":     0x35,
+	"Comma":         0x36,
+	"Period":        0x37,
+	"Slash":         0x38,
+	"CapsLock":      0x39,
+	"IntlBackslash": 0x64, // ISO key between left shift and Z
+	"ContextMenu":   0x65,
+	"Power":         0x66,
+
+	/* Function keys */
+	"F1": 0x3A, "F2": 0x3B, "F3": 0x3C, "F4": 0x3D, "F5": 0x3E, "F6": 0x3F,
+	"F7": 0x40, "F8": 0x41, "F9": 0x42, "F10": 0x43, "F11": 0x44, "F12": 0x45,
+	"F13": 0x68, "F14": 0x69, "F15": 0x6A, "F16": 0x6B, "F17": 0x6C, "F18": 0x6D,
+	"F19": 0x6E, "F20": 0x6F, "F21": 0x70, "F22": 0x71, "F23": 0x72, "F24": 0x73,
+
+	/* Navigation */
+	"PrintScreen": 0x46,
+	"ScrollLock":  0x47,
+	"Pause":       0x48,
+	"Insert":      0x49,
+	"Home":        0x4A,
+	"PageUp":      0x4B,
+	"Delete":      0x4C,
+	"End":         0x4D,
+	"PageDown":    0x4E,
+	"ArrowRight":  0x4F,
+	"ArrowLeft":   0x50,
+	"ArrowDown":   0x51,
+	"ArrowUp":     0x52,
+
+	/* Numpad */
+	"NumLock":          0x53,
+	"NumpadDivide":     0x54,
+	"NumpadMultiply":   0x55,
+	"NumpadSubtract":   0x56,
+	"NumpadAdd":        0x57,
+	"NumpadEnter":      0x58,
+	"Numpad1":          0x59,
+	"Numpad2":          0x5A,
+	"Numpad3":          0x5B,
+	"Numpad4":          0x5C,
+	"Numpad5":          0x5D,
+	"Numpad6":          0x5E,
+	"Numpad7":          0x5F,
+	"Numpad8":          0x60,
+	"Numpad9":          0x61,
+	"Numpad0":          0x62,
+	"NumpadDecimal":    0x63,
+	"NumpadEqual":      0x67,
+	"NumpadComma":      0x85,
+	"NumpadParenLeft":  0xB6,
+	"NumpadParenRight": 0xB7,
+	"NumpadBackspace":  0xBB,
+
+	/* Editing and system keys found on some keyboards */
+	"Open":            0x74,
+	"Help":            0x75,
+	"Select":          0x77,
+	"Again":           0x79,
+	"Undo":            0x7A,
+	"Cut":             0x7B,
+	"Copy":            0x7C,
+	"Paste":           0x7D,
+	"Find":            0x7E,
+	"AudioVolumeMute": 0x7F,
+	"AudioVolumeUp":   0x80,
+	"AudioVolumeDown": 0x81,
+
+	/* International (JIS / Korean) */
+	"IntlRo":     0x87, // International1, JIS \ _ key
+	"KanaMode":   0x88, // International2, Katakana / Hiragana
+	"IntlYen":    0x89, // International3, JIS Yen key
+	"Convert":    0x8A, // International4, Henkan
+	"NonConvert": 0x8B, // International5, Muhenkan
+	"Lang1":      0x90, // Hangul / English, or Kana on Mac
+	"Lang2":      0x91, // Hanja, or Eisu on Mac
+	"Lang3":      0x92, // Katakana
+	"Lang4":      0x93, // Hiragana
+	"Lang5":      0x94, // Zenkaku / Hankaku
+
+	/* Modifiers */
+	"ControlLeft":  0xE0,
+	"ShiftLeft":    0xE1,
+	"AltLeft":      0xE2,
+	"MetaLeft":     0xE3,
+	"OSLeft":       0xE3, // Older Firefox name of MetaLeft
+	"ControlRight": 0xE4,
+	"ShiftRight":   0xE5,
+	"AltRight":     0xE6,
+	"MetaRight":    0xE7,
+	"OSRight":      0xE7, // Older Firefox name of MetaRight
+}
+
+// KeyboardCodeToHIDUsage converts a KeyboardEvent.code value into a HID usage code
+func KeyboardCodeToHIDUsage(code string) (uint8, error) {
+	usage, ok := keyboardCodeToHIDUsage[code]
+	if !ok {
+		return 0x00, fmt.Errorf("unsupported key code: %s", code)
+	}
+	return usage, nil
+}
+
+// isModifierUsage checks if the HID usage code is one of the 8 modifier keys
+func isModifierUsage(usage uint8) bool {
+	return usage >= 0xE0 && usage <= 0xE7
+}
+
+// modifierUsageToBit converts a modifier HID usage (0xE0 - 0xE7) into its modifier byte bit
+func modifierUsageToBit(usage uint8) uint8 {
+	return 1 << (usage - 0xE0)
+}
+
+// hidUsageToKeyboardCode is the reverse of keyboardCodeToHIDUsage
+var hidUsageToKeyboardCode = map[uint8]string{}
+
+func init() {
+	for code, usage := range keyboardCodeToHIDUsage {
+		// Prefer the current names over the older aliases, e.g. MetaLeft over OSLeft
+		if existing, ok := hidUsageToKeyboardCode[usage]; ok && !strings.HasPrefix(existing, "OS") {
+			continue
+		}
+		hidUsageToKeyboardCode[usage] = code
+	}
+}
+
+// HIDUsageToKeyboardCode converts a HID usage code back into its KeyboardEvent.code value,
+// or a hex string like "0x8C" if the usage has no code
+func HIDUsageToKeyboardCode(usage uint8) string {
+	if code, ok := hidUsageToKeyboardCode[usage]; ok {
+		return code
+	}
+	return fmt.Sprintf("0x%02X", usage)
+}
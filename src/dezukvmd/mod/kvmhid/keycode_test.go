@@ -0,0 +1,103 @@
+package kvmhid
+
+import "testing"
+
+func TestKeyboardCodeToHIDUsage(t *testing.T) {
+	tests := map[string]uint8{
+		"KeyA":          0x04,
+		"KeyZ":          0x1D,
+		"Digit1":        0x1E,
+		"Digit0":        0x27,
+		"Enter":         0x28,
+		"Escape":        0x29,
+		"Space":         0x2C,
+		"F1":            0x3A,
+		"F12":           0x45,
+		"ArrowUp":       0x52,
+		"NumpadEnter":   0x58,
+		"IntlBackslash": 0x64,
+		"ControlLeft":   0xE0,
+		"ShiftLeft":     0xE1,
+		"AltRight":      0xE6,
+		"MetaRight":     0xE7,
+	}
+	for code, want := range tests {
+		got, err := KeyboardCodeToHIDUsage(code)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", code, err)
+			continue
+		}
+		if got != want {
+			t.Errorf("%s: got 0x%02X, want 0x%02X", code, got, want)
+		}
+	}
+
+	if _, err := KeyboardCodeToHIDUsage("NotAKey"); err == nil {
+		t.Error("expected error for unknown code")
+	}
+}
+
+func TestJavaScriptKeycodeToHIDOpcode(t *testing.T) {
+	tests := map[uint8]uint8{
+		65:  0x04, // A
+		90:  0x1D, // Z
+		49:  0x1E, // 1
+		13:  0x28, // Enter
+		8:   0x2A, // Backspace
+		112: 0x3A, // F1
+		16:  0xE1, // Shift
+	}
+	for keycode, want := range tests {
+		if got := javaScriptKeycodeToHIDOpcode(keycode); got != want {
+			t.Errorf("keycode %d: got 0x%02X, want 0x%02X", keycode, got, want)
+		}
+	}
+}
+
+func TestModifierUsageToBit(t *testing.T) {
+	for usage := uint8(0xE0); usage <= 0xE7; usage++ {
+		if !isModifierUsage(usage) {
+			t.Errorf("0x%02X should be a modifier usage", usage)
+		}
+		if want := uint8(1) << (usage - 0xE0); modifierUsageToBit(usage) != want {
+			t.Errorf("0x%02X: got bit 0x%02X, want 0x%02X", usage, modifierUsageToBit(usage), want)
+		}
+	}
+	if isModifierUsage(0x04) {
+		t.Error("0x04 should not be a modifier usage")
+	}
+}
+
+func TestHIDUsageToKeyboardCode(t *testing.T) {
+	tests := map[uint8]string{
+		0x04: "KeyA",
+		0x4C: "Delete",
+		0xE3: "MetaLeft",
+		0xE7: "MetaRight",
+		0xFF: "0xFF",
+	}
+	for usage, want := range tests {
+		if got := HIDUsageToKeyboardCode(usage); got != want {
+			t.Errorf("0x%02X: got %s, want %s", usage, got, want)
+		}
+	}
+
+	de, _ := GetKeyboardLayout("de")
+	if r, ok := de.Character(0x1C, MOD_RSHIFT); !ok || r != 'Z' {
+		t.Errorf("got %q, want Z on the German layout", r)
+	}
+	if _, ok := de.Character(0x35, 0); ok {
+		t.Error("dead keys should not produce a character")
+	}
+
+	// AltGr dead keys of AZERTY, needed for shell text
+	fr, _ := GetKeyboardLayout("fr")
+	for r, want := range map[rune]KeyStroke{
+		'~': {Usage: 0x1F, Modifier: MOD_RALT, Dead: true},
+		'`': {Usage: 0x24, Modifier: MOD_RALT, Dead: true},
+	} {
+		if got, ok := fr.keys[r]; !ok || got != want {
+			t.Errorf("%q on the French layout: got %+v, want %+v", r, got, want)
+		}
+	}
+}
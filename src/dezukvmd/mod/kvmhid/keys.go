@@ -0,0 +1,286 @@
+package kvmhid
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+/*
+	keys.go
+
+	One-shot key chords for automation, e.g. Ctrl+Alt+Delete, Win+R or the
+	Linux Magic SysRq sequence Alt+SysRq+REISUB. Keys go through the same
+	HID state as websocket input and every key pressed by a chord sequence
+	is released when it ends, whether it finished, failed or was cancelled.
+*/
+
+const (
+	DefaultKeyChordHold  = 100 * time.Millisecond // Time keys of a chord are held down if not given
+	DefaultKeyChordPress = 20 * time.Millisecond  // Time between pressing the keys of a chord if not given
+	DefaultSysRqDelay    = 2 * time.Second        // Time between SysRq commands, gives the kernel time to finish each one
+	MaxKeyChordDuration  = 10 * time.Second       // Longest press, hold or delay time of a single chord
+	MaxKeyChords         = 64                     // Most chords in one sequence
+	MaxKeysPerChord      = 8                      // 6 keys plus modifiers, modifiers do not take key slots
+	sysRqChordHoldTime   = 200 * time.Millisecond
+)
+
+// ErrKeyChordsBusy is returned if another chord sequence is running on the controller
+var ErrKeyChordsBusy = errors.New("another key chord sequence is running")
+
+// keyNameAliases maps common key names (lower case) to KeyboardEvent.code values
+var keyNameAliases = map[string]string{
+	"ctrl":        "ControlLeft",
+	"control":     "ControlLeft",
+	"lctrl":       "ControlLeft",
+	"rctrl":       "ControlRight",
+	"shift":       "ShiftLeft",
+	"lshift":      "ShiftLeft",
+	"rshift":      "ShiftRight",
+	"alt":         "AltLeft",
+	"lalt":        "AltLeft",
+	"ralt":        "AltRight",
+	"altgr":       "AltRight",
+	"win":         "MetaLeft",
+	"windows":     "MetaLeft",
+	"gui":         "MetaLeft",
+	"meta":        "MetaLeft",
+	"super":       "MetaLeft",
+	"cmd":         "MetaLeft",
+	"command":     "MetaLeft",
+	"del":         "Delete",
+	"ins":         "Insert",
+	"esc":         "Escape",
+	"return":      "Enter",
+	"bksp":        "Backspace",
+	"pgup":        "PageUp",
+	"pgdn":        "PageDown",
+	"up":          "ArrowUp",
+	"down":        "ArrowDown",
+	"left":        "ArrowLeft",
+	"right":       "ArrowRight",
+	"sysrq":       "PrintScreen",
+	"prtsc":       "PrintScreen",
+	"printscreen": "PrintScreen",
+	"break":       "Pause",
+	"menu":        "ContextMenu",
+}
+
+// KeyChord is a set of keys pressed together, held and released.
+// In JSON a chord is either an object or a string like "Ctrl+Alt+Delete".
+type KeyChord struct {
+	Keys  []string `json:"keys"`            // KeyboardEvent.code values or aliases, e.g. ControlLeft, Ctrl, Delete, R
+	Press int      `json:"press,omitempty"` // Milliseconds between pressing each key, default 20
+	Hold  int      `json:"hold,omitempty"`  // Milliseconds to hold all keys down, default 100
+	Delay int      `json:"delay,omitempty"` // Milliseconds to wait after releasing before the next chord
+}
+
+// UnmarshalJSON accepts a chord object or a "+" separated key string
+func (k *KeyChord) UnmarshalJSON(data []byte) error {
+	var combo string
+	if err := json.Unmarshal(data, &combo); err == nil {
+		*k = KeyChord{Keys: strings.Split(combo, "+")}
+		return nil
+	}
+	type plainKeyChord KeyChord
+	return json.Unmarshal(data, (*plainKeyChord)(k))
+}
+
+// resolvedKeyChord is a validated chord with HID usage codes
+type resolvedKeyChord struct {
+	usages []uint8
+	press  time.Duration
+	hold   time.Duration
+	delay  time.Duration
+}
+
+// ParseKeyName converts a KeyboardEvent.code value or a common key name
+// (case insensitive, e.g. ctrl, win, del, sysrq, f2, r, 1) into a HID usage code
+func ParseKeyName(name string) (uint8, error) {
+	name = strings.TrimSpace(name)
+	if usage, err := KeyboardCodeToHIDUsage(name); err == nil {
+		return usage, nil
+	}
+	lower := strings.ToLower(name)
+	if code, ok := keyNameAliases[lower]; ok {
+		return KeyboardCodeToHIDUsage(code)
+	}
+	if len(lower) == 1 {
+		if lower[0] >= 'a' && lower[0] <= 'z' {
+			return KeyboardCodeToHIDUsage("Key" + strings.ToUpper(lower))
+		}
+		if lower[0] >= '0' && lower[0] <= '9' {
+			return KeyboardCodeToHIDUsage("Digit" + lower)
+		}
+	}
+	for code, usage := range keyboardCodeToHIDUsage {
+		if strings.EqualFold(code, name) {
+			return usage, nil
+		}
+	}
+	return 0x00, fmt.Errorf("unknown key: %q", name)
+}
+
+// SysRqChords builds the chords for a Linux Magic SysRq command sequence, e.g. "reisub".
+// Each command is sent as Alt+SysRq+<command> followed by the given delay.
+func SysRqChords(commands string, delay time.Duration) ([]KeyChord, error) {
+	if commands == "" {
+		return nil, errors.New("no SysRq commands given")
+	}
+	if delay <= 0 {
+		delay = DefaultSysRqDelay
+	}
+	chords := []KeyChord{}
+	for _, r := range strings.ToLower(commands) {
+		if (r < 'a' || r > 'z') && (r < '0' || r > '9') {
+			return nil, fmt.Errorf("invalid SysRq command: %q", r)
+		}
+		chords = append(chords, KeyChord{
+			Keys:  []string{"AltLeft", "PrintScreen", string(r)},
+			Hold:  int(sysRqChordHoldTime / time.Millisecond),
+			Delay: int(delay / time.Millisecond),
+		})
+	}
+	return chords, nil
+}
+
+// resolveKeyChords validates the chords and converts their key names
+func resolveKeyChords(chords []KeyChord) ([]resolvedKeyChord, error) {
+	if len(chords) == 0 {
+		return nil, errors.New("no key chords given")
+	}
+	if len(chords) > MaxKeyChords {
+		return nil, fmt.Errorf("too many key chords, at most %d are allowed", MaxKeyChords)
+	}
+	toDuration := func(ms int, def time.Duration) (time.Duration, error) {
+		if ms < 0 {
+			return 0, errors.New("durations must not be negative")
+		}
+		d := time.Duration(ms) * time.Millisecond
+		if d > MaxKeyChordDuration {
+			return 0, fmt.Errorf("durations must not be longer than %v", MaxKeyChordDuration)
+		}
+		if ms == 0 {
+			return def, nil
+		}
+		return d, nil
+	}
+
+	resolved := make([]resolvedKeyChord, 0, len(chords))
+	for i, chord := range chords {
+		if len(chord.Keys) == 0 || len(chord.Keys) > MaxKeysPerChord {
+			return nil, fmt.Errorf("chord %d: a chord needs 1 to %d keys", i+1, MaxKeysPerChord)
+		}
+		rc := resolvedKeyChord{}
+		keySlots := 0
+		for _, name := range chord.Keys {
+			usage, err := ParseKeyName(name)
+			if err != nil {
+				return nil, fmt.Errorf("chord %d: %v", i+1, err)
+			}
+			if !isModifierUsage(usage) {
+				keySlots++
+			}
+			rc.usages = append(rc.usages, usage)
+		}
+		if keySlots > 6 {
+			return nil, fmt.Errorf("chord %d: at most 6 non-modifier keys are allowed", i+1)
+		}
+		var err error
+		if rc.press, err = toDuration(chord.Press, DefaultKeyChordPress); err != nil {
+			return nil, fmt.Errorf("chord %d: %v", i+1, err)
+		}
+		if rc.hold, err = toDuration(chord.Hold, DefaultKeyChordHold); err != nil {
+			return nil, fmt.Errorf("chord %d: %v", i+1, err)
+		}
+		if rc.delay, err = toDuration(chord.Delay, 0); err != nil {
+			return nil, fmt.Errorf("chord %d: %v", i+1, err)
+		}
+		resolved = append(resolved, rc)
+	}
+	return resolved, nil
+}
+
+// ValidateKeyChords checks the chords without sending them
+func ValidateKeyChords(chords []KeyChord) error {
+	_, err := resolveKeyChords(chords)
+	return err
+}
+
+// SendKeyChords presses, holds and releases each chord in order. All chords are
+// validated before any key is pressed. Keys pressed by the sequence are always
+// released, even if sending fails or the context is cancelled. Only one chord
+// sequence runs at a time per controller.
+func (c *Controller) SendKeyChords(ctx context.Context, chords []KeyChord) error {
+	resolved, err := resolveKeyChords(chords)
+	if err != nil {
+		return err
+	}
+	if !c.keyChordMu.TryLock() {
+		return ErrKeyChordsBusy
+	}
+	defer c.keyChordMu.Unlock()
+
+	for _, chord := range resolved {
+		if err := c.sendKeyChord(ctx, chord); err != nil {
+			return err
+		}
+		if err := sleepContext(ctx, chord.delay); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sendKeyChord presses the keys of a chord in order and releases them in reverse order
+func (c *Controller) sendKeyChord(ctx context.Context, chord resolvedKeyChord) (err error) {
+	pressed := []uint8{}
+	defer func() {
+		for i := len(pressed) - 1; i >= 0; i-- {
+			if _, releaseErr := c.ReleaseHIDUsage(pressed[i]); releaseErr != nil {
+				log.Printf("Failed to release key 0x%02X: %v", pressed[i], releaseErr)
+				if err == nil {
+					err = releaseErr
+				}
+			}
+		}
+	}()
+
+	for i, usage := range chord.usages {
+		if i > 0 {
+			if err := sleepContext(ctx, chord.press); err != nil {
+				return err
+			}
+		}
+		_, err := c.execute(OpKeyboard, func() ([]byte, error) {
+			if c.isHIDUsagePressed(usage) {
+				// Held by someone else, e.g. a websocket session, leave it to them
+				return nil, nil
+			}
+			// Remember the key before sending, a failed send may still have reached the target
+			pressed = append(pressed, usage)
+			return c.pressHIDUsage(usage)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return sleepContext(ctx, chord.hold)
+}
+
+// isHIDUsagePressed checks if a key is currently down in the HID state, must run on the executor
+func (c *Controller) isHIDUsagePressed(usage uint8) bool {
+	if isModifierUsage(usage) {
+		return c.hidState.Modkey&modifierUsageToBit(usage) != 0
+	}
+	for _, key := range c.hidState.KeyboardButtons {
+		if key == usage {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,121 @@
+package kvmhid
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestParseKeyName(t *testing.T) {
+	tests := map[string]uint8{
+		"ControlLeft": 0xE0,
+		"ctrl":        0xE0,
+		"Alt":         0xE2,
+		"Win":         0xE3,
+		"Del":         0x4C,
+		"delete":      0x4C,
+		"SysRq":       0x46,
+		"F2":          0x3B,
+		"f12":         0x45,
+		"r":           0x15,
+		"R":           0x15,
+		"1":           0x1E,
+	}
+	for name, want := range tests {
+		got, err := ParseKeyName(name)
+		if err != nil || got != want {
+			t.Errorf("ParseKeyName(%q) = 0x%02X, %v, want 0x%02X", name, got, err, want)
+		}
+	}
+	if _, err := ParseKeyName("Hyper"); err == nil {
+		t.Error("unknown key should be rejected")
+	}
+}
+
+func TestKeyChordJSON(t *testing.T) {
+	var chords []KeyChord
+	err := json.Unmarshal([]byte(`["Ctrl+Alt+Delete", {"keys": ["Win", "R"], "hold": 50, "delay": 500}]`), &chords)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chords) != 2 || len(chords[0].Keys) != 3 || chords[0].Keys[2] != "Delete" {
+		t.Fatalf("unexpected string chord: %+v", chords)
+	}
+	if chords[1].Hold != 50 || chords[1].Delay != 500 || chords[1].Keys[1] != "R" {
+		t.Errorf("unexpected object chord: %+v", chords[1])
+	}
+}
+
+func TestSendKeyChords(t *testing.T) {
+	c, emu := newEmulatedController(t)
+	emu.ClearReports()
+
+	chords := []KeyChord{{Keys: []string{"Ctrl", "Alt", "Delete"}, Press: 1, Hold: 1}}
+	if err := c.SendKeyChords(context.Background(), chords); err != nil {
+		t.Fatal(err)
+	}
+	want := [][]byte{
+		{0x01, 0, 0, 0, 0, 0, 0, 0},
+		{0x05, 0, 0, 0, 0, 0, 0, 0},
+		{0x05, 0, 0x4C, 0, 0, 0, 0, 0},
+		{0x05, 0, 0, 0, 0, 0, 0, 0},
+		{0x01, 0, 0, 0, 0, 0, 0, 0},
+		{0x00, 0, 0, 0, 0, 0, 0, 0},
+	}
+	reports := emu.Reports()
+	if len(reports) != len(want) {
+		t.Fatalf("got %d reports, want %d", len(reports), len(want))
+	}
+	for i, r := range reports {
+		if !bytes.Equal(r.Data, want[i]) {
+			t.Errorf("report %d: got %X, want %X", i, r.Data, want[i])
+		}
+	}
+}
+
+func TestSendKeyChordsReleasesOnCancel(t *testing.T) {
+	c, emu := newEmulatedController(t)
+	// A key held by a websocket session must stay held
+	c.PressHIDUsage(0x04)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- c.SendKeyChords(ctx, []KeyChord{{Keys: []string{"Alt", "SysRq", "A", "B"}, Hold: 5000}})
+	}()
+	time.Sleep(200 * time.Millisecond)
+
+	// Only one sequence runs at a time
+	if err := c.SendKeyChords(context.Background(), []KeyChord{{Keys: []string{"Esc"}}}); err != ErrKeyChordsBusy {
+		t.Errorf("got %v while another sequence is running, want ErrKeyChordsBusy", err)
+	}
+
+	cancel()
+	if err := <-done; err == nil {
+		t.Error("cancelled sequence should return an error")
+	}
+	if got := lastKeyboardReport(t, emu); !bytes.Equal(got, []byte{0, 0, 0x04, 0, 0, 0, 0, 0}) {
+		t.Errorf("keys not released after cancel: %X", got)
+	}
+}
+
+func TestSysRqChords(t *testing.T) {
+	chords, err := SysRqChords("REISUB", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chords) != 6 || chords[0].Keys[2] != "r" || chords[5].Keys[2] != "b" {
+		t.Fatalf("unexpected chords: %+v", chords)
+	}
+	if chords[0].Delay != int(DefaultSysRqDelay/time.Millisecond) {
+		t.Errorf("got delay %d, want the default", chords[0].Delay)
+	}
+	if err := ValidateKeyChords(chords); err != nil {
+		t.Errorf("SysRq chords should be valid: %v", err)
+	}
+	if _, err := SysRqChords("re!sub", 0); err == nil {
+		t.Error("invalid SysRq command should be rejected")
+	}
+}
@@ -19,18 +19,38 @@ func NewHIDController(config *Config) *Controller {
 		MouseY:          0,
 	}
 
-	return &Controller{
-		Config:            config,
-		serialRunning:     false,
-		hidState:          defaultHidState,
-		writeQueue:        make(chan []byte, 32),
-		incomingDataQueue: make(chan []byte, 1024),
-		readCloseChan:     make(chan bool),
+	executor := newCommandExecutor()
+	go executor.run()
+
+	c := &Controller{
+		Config:           config,
+		hidState:         defaultHidState,
+		writeQueue:       make(chan []byte, 32),
+		commandListeners: make(map[int]CommandListener),
+		sessionListeners: make(map[int]SessionListener),
+		statusListeners:  make(map[int]StatusListener),
+		sessions:         make(map[string]*hidSession),
+		mouseScheduler:   newMouseScheduler(),
+		executor:         executor,
+
+		pointerCalibration: DefaultPointerCalibration(),
 	}
+	c.backend = newBackend(c, config.Backend)
+	return c
 }
 
-// Connect opens the serial port and starts reading from it
+// Connect opens the serial port, or the gadget devices for the hidg backend, and starts reading from it.
+// The port is reopened automatically if it fails, e.g. after the USB KVM was replugged.
 func (c *Controller) Connect() error {
+	if c.backend.Name() == BackendAuto && isGadgetDevice(c.Config.PortName) {
+		c.backend = newBackend(c, BackendHIDGadget)
+	}
+	if c.backend.Name() == BackendHIDGadget {
+		return c.ConnectTransportFunc(func() (Transport, error) {
+			return OpenGadget(c.Config.PortName, c.gadgetMouseDevice())
+		})
+	}
+
 	// Open the serial port
 	config := &serial.Config{
 		Name:        c.Config.PortName,
@@ -39,56 +59,57 @@ func (c *Controller) Connect() error {
 		Parity:      serial.ParityNone,
 		ReadTimeout: time.Millisecond * 500,
 	}
+	return c.ConnectTransportFunc(func() (Transport, error) {
+		return serial.OpenPort(config)
+	})
+}
 
-	port, err := serial.OpenPort(config)
-	if err != nil {
-		return err
-	}
-
-	c.serialPort = port
-	// Start reading from the serial port
-	go func() {
-		buf := make([]byte, 1024)
-		for {
-			select {
-			case <-c.readCloseChan:
-				return
-			default:
-				n, err := port.Read(buf)
-				if err != nil {
-					continue
-				}
-				if n > 0 {
-					c.incomingDataQueue <- buf[:n]
-				}
-			}
-		}
-	}()
+// ConnectTransport starts the controller on an already opened transport,
+// e.g. a serial port or the CH9329 emulator. The transport cannot be
+// reopened, use ConnectTransportFunc to reconnect after failures.
+func (c *Controller) ConnectTransport(port Transport) error {
+	return c.startTransport(port, nil)
+}
 
-	//Create a loop to write to the serial port
-	c.serialRunning = true
-	go func() {
-		for {
-			data := <-c.writeQueue
-			_, err := port.Write(data)
-			if err != nil {
-				log.Println(err.Error())
-				return
-			}
+// startTransport starts the supervised serial I/O and the background workers
+func (c *Controller) startTransport(port Transport, open TransportOpener) error {
+	if c.backend.Name() == BackendAuto {
+		name, err := DetectBackend(port)
+		if err != nil {
+			port.Close()
+			return err
 		}
-	}()
+		log.Println("Detected HID backend: " + name)
+		c.backend = newBackend(c, name)
+	}
+	if b, ok := c.backend.(*invalidBackend); ok {
+		port.Close()
+		return b.err
+	}
+	c.transportStop = make(chan struct{})
+	c.transportDone = make(chan struct{})
+	started := make(chan struct{})
+	go c.superviseTransport(port, open, c.transportStop, c.transportDone, func() { close(started) })
+	<-started
 
 	//Send over an opr queue reset signal
-	err = c.Send([]byte{0xFF})
+	err := c.backend.Reset()
 	if err != nil {
 		return err
 	}
 
+	// Keep the chip status and keyboard LEDs in sync with the target
+	c.statusPollStop = make(chan struct{})
+	go c.pollChipStatus(c.statusPollStop)
+
+	// Send queued mouse input at the report rate the serial link can carry
+	c.mouseSchedulerStop = make(chan struct{})
+	go c.runMouseScheduler(c.mouseSchedulerStop)
 	return nil
 }
 
 func (c *Controller) Send(data []byte) error {
-	if !c.serialRunning {
+	if !c.serialRunning.Load() {
 		return fmt.Errorf("serial port is not running")
 	}
 	select {
@@ -99,93 +120,24 @@ func (c *Controller) Send(data []byte) error {
 	}
 }
 
-func (c *Controller) ClearReadQueue() {
-	// Clear the incoming data queue
-	for len(c.incomingDataQueue) > 0 {
-		<-c.incomingDataQueue
+func (c *Controller) Close() {
+	if c.statusPollStop != nil {
+		close(c.statusPollStop)
+		c.statusPollStop = nil
 	}
-}
-
-func (c *Controller) WaitForReply(cmdByte byte) ([]byte, error) {
-	// Wait for a reply from the device
-	succReplyByte := cmdByte | 0x80
-	errorReplyByte := cmdByte | 0xC0
-	timeout := make(chan bool, 1)
-	go func() {
-		// Timeout after 500ms
-		time.Sleep(500 * time.Millisecond)
-		timeout <- true
-	}()
-
-	var reply []byte
-	for {
-		select {
-		case data := <-c.incomingDataQueue:
-			reply = append(reply, data...)
-			// Check if we have received enough bytes for a complete packet
-			if len(reply) >= 7 {
-				// Validate header
-				if reply[0] == 0x57 && reply[1] == 0xAB {
-					// Extract fields
-					//address := reply[2]
-					replyByte := reply[3]
-					dataLength := reply[4]
-					expectedLength := 5 + int(dataLength) + 1 // Header + address + replyByte + dataLength + data + checksum
-
-					// Check if the full packet is received
-					if len(reply) >= expectedLength {
-						data := reply[5 : 5+dataLength]
-						checksum := reply[5+dataLength]
-
-						// Calculate checksum
-						sum := byte(0)
-						for _, b := range reply[:5+dataLength] {
-							sum += b
-						}
-
-						// Validate checksum
-						if sum == checksum {
-							// Check reply byte for success or error
-							switch replyByte {
-							case succReplyByte:
-								return data, nil
-							case errorReplyByte:
-								fmt.Print("Reply: ")
-								for _, b := range reply {
-									fmt.Printf("0x%02X ", b)
-								}
-								return nil, fmt.Errorf("device returned error reply")
-							}
-						} else {
-							return nil, fmt.Errorf("checksum validation failed")
-						}
-					}
-				} else {
-					// Invalid header, discard data
-					reply = nil
-				}
-			}
-		case <-timeout:
-			return nil, fmt.Errorf("timeout waiting for reply")
-		}
+	if c.mouseSchedulerStop != nil {
+		close(c.mouseSchedulerStop)
+		c.mouseSchedulerStop = nil
 	}
-}
-
-func (c *Controller) Close() {
-	c.serialRunning = false
-	c.readCloseChan <- true
-	if c.serialPort != nil {
-		done := make(chan struct{})
-		go func() {
-			c.serialPort.Close()
-			close(done)
-		}()
+	if c.transportStop != nil {
+		close(c.transportStop)
+		c.transportStop = nil
 		select {
-		case <-done:
+		case <-c.transportDone:
 			// Closed successfully
 		case <-time.After(3 * time.Second):
 			log.Println("serial port close timeout")
 		}
 	}
-
+	c.executor.close()
 }
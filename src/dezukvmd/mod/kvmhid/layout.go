@@ -0,0 +1,312 @@
+package kvmhid
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+/*
+	layout.go
+
+	Keyboard layouts used to convert text into HID key strokes.
+	The CH9329 sends HID usage codes, which map to physical key positions.
+	The character produced by a key position depends on the keyboard layout
+	configured on the target OS, so the same text needs different key strokes
+	for different target layouts.
+*/
+
+// KeyStroke is a single HID key press needed to produce a character
+type KeyStroke struct {
+	Usage    uint8 // HID usage code of the key
+	Modifier uint8 // Modifier bits to hold while pressing the key
+	Dead     bool  // Dead key, a space has to follow to produce the character itself
+}
+
+// KeyboardLayout maps characters to the key strokes that produce them on a target layout
+type KeyboardLayout struct {
+	Name  string
+	keys  map[rune]KeyStroke
+	chars map[KeyStroke]rune // Reverse lookup of keys, without dead keys
+}
+
+// layoutKey describes the characters produced by one key position.
+// Use 0 for combinations that do not produce a character.
+type layoutKey struct {
+	usage   uint8
+	normal  rune
+	shifted rune
+	altgr   rune
+}
+
+const (
+	hidUsageEnter = 0x28
+	hidUsageTab   = 0x2B
+	hidUsageSpace = 0x2C
+)
+
+var keyboardLayouts = map[string]*KeyboardLayout{}
+
+func init() {
+	registerLayout("us", usLayoutKeys(), "")
+	registerLayout("uk", ukLayoutKeys(), "")
+	registerLayout("de", deLayoutKeys(), "^´`")
+	registerLayout("fr", frLayoutKeys(), "^¨~`")
+	registerLayout("jp", jpLayoutKeys(), "")
+}
+
+// registerLayout builds the character lookup table of a layout.
+// Later keys override earlier ones, so layouts can start from the QWERTY
+// letters and move the letters that are in other positions.
+func registerLayout(name string, keys []layoutKey, deadKeys string) {
+	layout := &KeyboardLayout{
+		Name: name,
+		keys: map[rune]KeyStroke{
+			'\n': {Usage: hidUsageEnter},
+			'\t': {Usage: hidUsageTab},
+			' ':  {Usage: hidUsageSpace},
+		},
+		chars: map[KeyStroke]rune{
+			{Usage: hidUsageSpace}: ' ',
+		},
+	}
+
+	for _, k := range keys {
+		if k.normal != 0 {
+			layout.keys[k.normal] = KeyStroke{Usage: k.usage}
+			layout.chars[KeyStroke{Usage: k.usage}] = k.normal
+		}
+		if k.shifted != 0 {
+			layout.keys[k.shifted] = KeyStroke{Usage: k.usage, Modifier: MOD_LSHIFT}
+			layout.chars[KeyStroke{Usage: k.usage, Modifier: MOD_LSHIFT}] = k.shifted
+		}
+		if k.altgr != 0 {
+			layout.keys[k.altgr] = KeyStroke{Usage: k.usage, Modifier: MOD_RALT}
+			layout.chars[KeyStroke{Usage: k.usage, Modifier: MOD_RALT}] = k.altgr
+		}
+	}
+
+	for _, r := range deadKeys {
+		if stroke, ok := layout.keys[r]; ok {
+			delete(layout.chars, stroke)
+			stroke.Dead = true
+			layout.keys[r] = stroke
+		}
+	}
+	keyboardLayouts[name] = layout
+}
+
+// GetKeyboardLayout returns the keyboard layout with the given name, e.g. "us" or "de"
+func GetKeyboardLayout(name string) (*KeyboardLayout, error) {
+	if name == "" {
+		name = "us"
+	}
+	layout, ok := keyboardLayouts[strings.ToLower(name)]
+	if !ok {
+		return nil, fmt.Errorf("unsupported keyboard layout: %s", name)
+	}
+	return layout, nil
+}
+
+// ListKeyboardLayouts returns the names of all supported keyboard layouts
+func ListKeyboardLayouts() []string {
+	names := []string{}
+	for name := range keyboardLayouts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Lookup returns the key stroke that produces the given character
+func (l *KeyboardLayout) Lookup(r rune) (KeyStroke, bool) {
+	stroke, ok := l.keys[r]
+	return stroke, ok
+}
+
+// Character returns the character produced by pressing the key with the given
+// modifier bits held, left and right shift are treated the same
+func (l *KeyboardLayout) Character(usage uint8, modifier uint8) (rune, bool) {
+	stroke := KeyStroke{Usage: usage}
+	if modifier&(MOD_LSHIFT|MOD_RSHIFT) != 0 {
+		stroke.Modifier |= MOD_LSHIFT
+	}
+	if modifier&MOD_RALT != 0 {
+		stroke.Modifier |= MOD_RALT
+	}
+	r, ok := l.chars[stroke]
+	return r, ok
+}
+
+// Convert turns a string into a list of key strokes. Carriage returns are dropped
+// so both \n and \r\n line endings produce a single Enter.
+func (l *KeyboardLayout) Convert(text string) ([]KeyStroke, error) {
+	strokes := []KeyStroke{}
+	for i, r := range []rune(text) {
+		if r == '\r' {
+			continue
+		}
+		stroke, ok := l.keys[r]
+		if !ok {
+			return nil, fmt.Errorf("character %q at position %d cannot be typed with layout %s", r, i, l.Name)
+		}
+		strokes = append(strokes, stroke)
+	}
+	return strokes, nil
+}
+
+// qwertyLetterKeys returns the letter keys a-z in QWERTY positions
+func qwertyLetterKeys() []layoutKey {
+	keys := []layoutKey{}
+	for i := 0; i < 26; i++ {
+		keys = append(keys, layoutKey{uint8(0x04 + i), rune('a' + i), rune('A' + i), 0})
+	}
+	return keys
+}
+
+func usLayoutKeys() []layoutKey {
+	return append(qwertyLetterKeys(), []layoutKey{
+		{0x1E, '1', '!', 0},
+		{0x1F, '2', '@', 0},
+		{0x20, '3', '#', 0},
+		{0x21, '4', '$', 0},
+		{0x22, '5', '%', 0},
+		{0x23, '6', '^', 0},
+		{0x24, '7', '&', 0},
+		{0x25, '8', '*', 0},
+		{0x26, '9', '(', 0},
+		{0x27, '0', ')', 0},
+		{0x2D, '-', '_', 0},
+		{0x2E, '=', '+', 0},
+		{0x2F, '[', '{', 0},
+		{0x30, ']', '}', 0},
+		{0x31, '\\', '|', 0},
+		{0x33, ';', ':', 0},
+		{0x34, '\'', '"', 0},
+		{0x35, '`', '~', 0},
+		{0x36, ',', '<', 0},
+		{0x37, '.', '>', 0},
+		{0x38, '/', '?', 0},
+	}...)
+}
+
+func ukLayoutKeys() []layoutKey {
+	return append(qwertyLetterKeys(), []layoutKey{
+		{0x1E, '1', '!', 0},
+		{0x1F, '2', '"', 0},
+		{0x20, '3', '£', 0},
+		{0x21, '4', '$', '€'},
+		{0x22, '5', '%', 0},
+		{0x23, '6', '^', 0},
+		{0x24, '7', '&', 0},
+		{0x25, '8', '*', 0},
+		{0x26, '9', '(', 0},
+		{0x27, '0', ')', 0},
+		{0x2D, '-', '_', 0},
+		{0x2E, '=', '+', 0},
+		{0x2F, '[', '{', 0},
+		{0x30, ']', '}', 0},
+		{0x32, '#', '~', 0},
+		{0x33, ';', ':', 0},
+		{0x34, '\'', '@', 0},
+		{0x35, '`', '¬', '¦'},
+		{0x36, ',', '<', 0},
+		{0x37, '.', '>', 0},
+		{0x38, '/', '?', 0},
+		{0x64, '\\', '|', 0},
+	}...)
+}
+
+func deLayoutKeys() []layoutKey {
+	return append(qwertyLetterKeys(), []layoutKey{
+		// QWERTZ, Y and Z are swapped
+		{0x1C, 'z', 'Z', 0},
+		{0x1D, 'y', 'Y', 0},
+		{0x14, 'q', 'Q', '@'},
+		{0x08, 'e', 'E', '€'},
+		{0x10, 'm', 'M', 'µ'},
+		{0x1E, '1', '!', 0},
+		{0x1F, '2', '"', '²'},
+		{0x20, '3', '§', '³'},
+		{0x21, '4', '$', 0},
+		{0x22, '5', '%', 0},
+		{0x23, '6', '&', 0},
+		{0x24, '7', '/', '{'},
+		{0x25, '8', '(', '['},
+		{0x26, '9', ')', ']'},
+		{0x27, '0', '=', '}'},
+		{0x2D, 'ß', '?', '\\'},
+		{0x2E, '´', '`', 0},
+		{0x2F, 'ü', 'Ü', 0},
+		{0x30, '+', '*', '~'},
+		{0x32, '#', '\'', 0},
+		{0x33, 'ö', 'Ö', 0},
+		{0x34, 'ä', 'Ä', 0},
+		{0x35, '^', '°', 0},
+		{0x36, ',', ';', 0},
+		{0x37, '.', ':', 0},
+		{0x38, '-', '_', 0},
+		{0x64, '<', '>', '|'},
+	}...)
+}
+
+func frLayoutKeys() []layoutKey {
+	return append(qwertyLetterKeys(), []layoutKey{
+		// AZERTY, A/Q and Z/W are swapped and M moves next to L
+		{0x04, 'q', 'Q', 0},
+		{0x14, 'a', 'A', 0},
+		{0x1A, 'z', 'Z', 0},
+		{0x1D, 'w', 'W', 0},
+		{0x08, 'e', 'E', '€'},
+		{0x33, 'm', 'M', 0},
+		{0x10, ',', '?', 0},
+		{0x1E, '&', '1', 0},
+		{0x1F, 'é', '2', '~'},
+		{0x20, '"', '3', '#'},
+		{0x21, '\'', '4', '{'},
+		{0x22, '(', '5', '['},
+		{0x23, '-', '6', '|'},
+		{0x24, 'è', '7', '`'},
+		{0x25, '_', '8', '\\'},
+		{0x26, 'ç', '9', 0},
+		{0x27, 'à', '0', '@'},
+		{0x2D, ')', '°', ']'},
+		{0x2E, '=', '+', '}'},
+		{0x2F, '^', '¨', 0},
+		{0x30, '$', '£', '¤'},
+		{0x32, '*', 'µ', 0},
+		{0x34, 'ù', '%', 0},
+		{0x35, '²', 0, 0},
+		{0x36, ';', '.', 0},
+		{0x37, ':', '/', 0},
+		{0x38, '!', '§', 0},
+		{0x64, '<', '>', 0},
+	}...)
+}
+
+func jpLayoutKeys() []layoutKey {
+	return append(qwertyLetterKeys(), []layoutKey{
+		{0x1E, '1', '!', 0},
+		{0x1F, '2', '"', 0},
+		{0x20, '3', '#', 0},
+		{0x21, '4', '$', 0},
+		{0x22, '5', '%', 0},
+		{0x23, '6', '&', 0},
+		{0x24, '7', '\'', 0},
+		{0x25, '8', '(', 0},
+		{0x26, '9', ')', 0},
+		{0x27, '0', 0, 0},
+		{0x2D, '-', '=', 0},
+		{0x2E, '^', '~', 0},
+		{0x2F, '@', '`', 0},
+		{0x30, '[', '{', 0},
+		{0x32, ']', '}', 0},
+		{0x33, ';', '+', 0},
+		{0x34, ':', '*', 0},
+		{0x36, ',', '<', 0},
+		{0x37, '.', '>', 0},
+		{0x38, '/', '?', 0},
+		{0x87, '\\', '_', 0}, // International1 (Ro)
+		{0x89, '¥', '|', 0},  // International3 (Yen)
+	}...)
+}
@@ -0,0 +1,163 @@
+package kvmhid
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+/*
+	media.go
+
+	Multimedia (consumer) keys and ACPI system keys, sent with
+	the CH9329 CMD_SEND_KB_MEDIA_DATA command (0x03).
+
+	ACPI report:       0x01, 1 byte bitmap (power, sleep, wake)
+	Multimedia report: 0x02, 3 bytes bitmap
+*/
+
+const (
+	mediaReportIDACPI       = 0x01
+	mediaReportIDMultimedia = 0x02
+
+	DefaultMediaKeyHoldTime = 100 * time.Millisecond // Key press duration when no hold time is given
+	MaxMediaKeyHoldTime     = 10 * time.Second       // Longest allowed key press duration
+)
+
+// systemKeys maps ACPI system key names to their bit in the ACPI report
+var systemKeys = map[string]uint8{
+	"power": 0x01,
+	"sleep": 0x02,
+	"wake":  0x04,
+}
+
+// mediaKeys maps multimedia key names to their byte index and bit in the multimedia report
+var mediaKeys = map[string][2]uint8{
+	"volume_up":         {0, 0x01},
+	"volume_down":       {0, 0x02},
+	"mute":              {0, 0x04},
+	"play_pause":        {0, 0x08},
+	"next_track":        {0, 0x10},
+	"prev_track":        {0, 0x20},
+	"stop":              {0, 0x40},
+	"eject":             {0, 0x80},
+	"email":             {1, 0x01},
+	"browser_search":    {1, 0x02},
+	"browser_favorites": {1, 0x04},
+	"browser_home":      {1, 0x08},
+	"browser_back":      {1, 0x10},
+	"browser_forward":   {1, 0x20},
+	"browser_stop":      {1, 0x40},
+	"browser_refresh":   {1, 0x80},
+	"media":             {2, 0x01},
+	"explorer":          {2, 0x02},
+	"calculator":        {2, 0x04},
+	"screen_save":       {2, 0x08},
+	"my_computer":       {2, 0x10},
+	"minimize":          {2, 0x20},
+	"record":            {2, 0x40},
+	"rewind":            {2, 0x80},
+}
+
+// ListMediaKeys returns the names of all supported multimedia and system keys
+func ListMediaKeys() []string {
+	names := []string{}
+	for name := range mediaKeys {
+		names = append(names, name)
+	}
+	for name := range systemKeys {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// PressMediaKey presses a multimedia or ACPI system key and keeps it held
+func (c *Controller) PressMediaKey(name string) ([]byte, error) {
+	if bit, ok := systemKeys[name]; ok {
+		return c.execute(OpMediaKey, func() ([]byte, error) {
+			c.hidState.SystemKeys |= bit
+			return c.sendSystemKeyReport(c.hidState.SystemKeys)
+		})
+	}
+	key, ok := mediaKeys[name]
+	if !ok {
+		return nil, errors.New("unknown media key: " + name)
+	}
+	return c.execute(OpMediaKey, func() ([]byte, error) {
+		c.hidState.MediaKeys[key[0]] |= key[1]
+		return c.sendMultimediaReport(c.hidState.MediaKeys)
+	})
+}
+
+// ReleaseMediaKey releases a multimedia or ACPI system key
+func (c *Controller) ReleaseMediaKey(name string) ([]byte, error) {
+	if bit, ok := systemKeys[name]; ok {
+		return c.execute(OpMediaKey, func() ([]byte, error) {
+			c.hidState.SystemKeys &^= bit
+			return c.sendSystemKeyReport(c.hidState.SystemKeys)
+		})
+	}
+	key, ok := mediaKeys[name]
+	if !ok {
+		return nil, errors.New("unknown media key: " + name)
+	}
+	return c.execute(OpMediaKey, func() ([]byte, error) {
+		c.hidState.MediaKeys[key[0]] &^= key[1]
+		return c.sendMultimediaReport(c.hidState.MediaKeys)
+	})
+}
+
+// TapMediaKey presses a multimedia or system key, holds it for the given duration and
+// releases it. The key is released even if the context is cancelled while holding.
+func (c *Controller) TapMediaKey(ctx context.Context, name string, hold time.Duration) error {
+	if hold <= 0 {
+		hold = DefaultMediaKeyHoldTime
+	}
+	if hold > MaxMediaKeyHoldTime {
+		return errors.New("hold time is too long")
+	}
+	if _, err := c.PressMediaKey(name); err != nil {
+		return err
+	}
+	holdErr := sleepContext(ctx, hold)
+	if _, err := c.ReleaseMediaKey(name); err != nil {
+		return err
+	}
+	return holdErr
+}
+
+// releaseMediaKeys releases all multimedia and system keys if any is held, must run on the executor
+func (c *Controller) releaseMediaKeys() error {
+	if c.hidState.MediaKeys != [3]uint8{} {
+		c.hidState.MediaKeys = [3]uint8{}
+		if _, err := c.sendMultimediaReport(c.hidState.MediaKeys); err != nil {
+			return err
+		}
+	}
+	if c.hidState.SystemKeys != 0x00 {
+		c.hidState.SystemKeys = 0x00
+		if _, err := c.sendSystemKeyReport(c.hidState.SystemKeys); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Controller) sendSystemKeyReport(keys uint8) ([]byte, error) {
+	resp, err := c.backend.SendSystemKeyReport(keys)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send system key command: %w", err)
+	}
+	return resp, nil
+}
+
+func (c *Controller) sendMultimediaReport(keys [3]uint8) ([]byte, error) {
+	resp, err := c.backend.SendMultimediaReport(keys)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send multimedia key command: %w", err)
+	}
+	return resp, nil
+}
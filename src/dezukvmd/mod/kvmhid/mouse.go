@@ -1,11 +1,14 @@
 package kvmhid
 
 import (
-	"bytes"
-	"encoding/binary"
 	"errors"
+	"fmt"
+	"math"
 )
 
+// maxRelativeStep is the largest delta a single CH9329 relative mouse report can carry
+const maxRelativeStep = 127
+
 // calcChecksum calculates the checksum for a given data slice.
 func calcChecksum(data []uint8) uint8 {
 	var sum uint8 = 0
@@ -16,100 +19,196 @@ func calcChecksum(data []uint8) uint8 {
 }
 
 func (c *Controller) MouseMoveAbsolute(xLSB, xMSB, yLSB, yMSB uint8) ([]byte, error) {
-	packet := []uint8{
-		0x57, 0xAB, 0x00, 0x04, 0x07, 0x02,
-		c.hidState.MouseButtons,
-		xLSB, // X LSB
-		xMSB, // X MSB
-		yLSB, // Y LSB
-		yMSB, // Y MSB
-		0x00, // Scroll
-		0x00, // Checksum placeholder
-	}
+	return c.execute(OpMouseMove, func() ([]byte, error) {
+		resp, err := c.mouseMoveAbsolute(uint16(xMSB)<<8|uint16(xLSB), uint16(yMSB)<<8|uint16(yLSB), true)
+		if err != nil {
+			return nil, fmt.Errorf("failed to send mouse move command: %w", err)
+		}
+		return resp, nil
+	})
+}
 
-	packet[12] = calcChecksum(packet[:12])
+// MouseMoveAbsoluteAsync moves the mouse to an absolute position without waiting for the chip to reply
+func (c *Controller) MouseMoveAbsoluteAsync(xLSB, xMSB, yLSB, yMSB uint8) error {
+	_, err := c.execute(OpMouseMove, func() ([]byte, error) {
+		return c.mouseMoveAbsolute(uint16(xMSB)<<8|uint16(xLSB), uint16(yMSB)<<8|uint16(yLSB), false)
+	})
+	return err
+}
 
-	buf := new(bytes.Buffer)
-	if err := binary.Write(buf, binary.LittleEndian, packet); err != nil {
-		return nil, errors.New("failed to write packet to buffer")
-	}
+// mouseMoveAbsolute sends an absolute mouse report with the current buttons, must run on the executor
+func (c *Controller) mouseMoveAbsolute(x, y uint16, wait bool) ([]byte, error) {
+	return c.backend.SendMouseAbsolute(c.hidState.MouseButtons, x, y, wait)
+}
+
+func (c *Controller) MouseMoveRelative(dx, dy, wheel uint8) ([]byte, error) {
+	return c.execute(OpMouseMove, func() ([]byte, error) {
+		return c.mouseMoveRelative(dx, dy, wheel)
+	})
+}
 
-	err := c.Send(buf.Bytes())
+// mouseMoveRelative sends a relative mouse report with the current buttons, must run on the executor
+func (c *Controller) mouseMoveRelative(dx, dy, wheel uint8) ([]byte, error) {
+	resp, err := c.backend.SendMouseRelative(c.hidState.MouseButtons, dx, dy, wheel, true)
 	if err != nil {
-		return nil, errors.New("failed to send mouse move command: " + err.Error())
+		return nil, fmt.Errorf("failed to send mouse move relative command: %w", err)
 	}
+	return resp, nil
+}
 
-	// Wait for a reply from the device
-	return c.WaitForReply(0x04)
+// MouseMoveRelativeDelta moves the mouse by an arbitrary signed delta. Deltas larger than
+// what fits in a single int8 report are split into multiple CH9329 relative mouse packets.
+func (c *Controller) MouseMoveRelativeDelta(dx, dy int) ([]byte, error) {
+	return c.execute(OpMouseMove, func() ([]byte, error) {
+		var resp []byte
+		for dx != 0 || dy != 0 {
+			stepX := clampRelativeStep(dx)
+			stepY := clampRelativeStep(dy)
+			r, err := c.mouseMoveRelative(uint8(int8(stepX)), uint8(int8(stepY)), 0)
+			if err != nil {
+				return nil, err
+			}
+			resp = append(resp, r...)
+			dx -= stepX
+			dy -= stepY
+		}
+		return resp, nil
+	})
 }
 
-func (c *Controller) MouseMoveRelative(dx, dy, wheel uint8) ([]byte, error) {
-	// Ensure 0x80 is not used
-	if dx == 0x80 {
-		dx = 0x81
-	}
-	if dy == 0x80 {
-		dy = 0x81
+// MouseMoveRelativeDeltaAsync is like MouseMoveRelativeDelta but queues all packets
+// without waiting for the chip to reply
+func (c *Controller) MouseMoveRelativeDeltaAsync(dx, dy int) error {
+	_, err := c.execute(OpMouseMove, func() ([]byte, error) {
+		return nil, c.mouseMoveRelativeDeltaAsync(dx, dy)
+	})
+	return err
+}
+
+func (c *Controller) mouseMoveRelativeDeltaAsync(dx, dy int) error {
+	for dx != 0 || dy != 0 {
+		stepX := clampRelativeStep(dx)
+		stepY := clampRelativeStep(dy)
+		if _, err := c.backend.SendMouseRelative(c.hidState.MouseButtons, uint8(int8(stepX)), uint8(int8(stepY)), 0, false); err != nil {
+			return err
+		}
+		dx -= stepX
+		dy -= stepY
 	}
+	return nil
+}
 
-	packet := []uint8{
-		0x57, 0xAB, 0x00, 0x05, 0x05, 0x01,
-		c.hidState.MouseButtons,
-		dx,    // Delta X
-		dy,    // Delta Y
-		wheel, // Scroll wheel
-		0x00,  // Checksum placeholder
+// clampRelativeStep limits a delta to the range of a single relative mouse report
+func clampRelativeStep(delta int) int {
+	if delta > maxRelativeStep {
+		return maxRelativeStep
+	}
+	if delta < -maxRelativeStep {
+		return -maxRelativeStep
 	}
+	return delta
+}
 
-	packet[10] = calcChecksum(packet[:10])
+// RelativeMouse converts raw client deltas into the deltas sent to the target,
+// applying sensitivity and acceleration while keeping track of sub-pixel motion
+// so slow movements are not lost to rounding.
+type RelativeMouse struct {
+	Sensitivity  float64 // Multiplier applied to every movement, 1.0 means unchanged
+	Acceleration float64 // Extra gain per pixel of movement speed, 0 disables acceleration
 
-	buf := new(bytes.Buffer)
-	if err := binary.Write(buf, binary.LittleEndian, packet); err != nil {
-		return nil, errors.New("failed to write packet to buffer")
+	remainderX float64
+	remainderY float64
+}
+
+// NewRelativeMouse creates a relative mouse filter with the given sensitivity and acceleration
+func NewRelativeMouse(sensitivity float64, acceleration float64) *RelativeMouse {
+	if sensitivity <= 0 {
+		sensitivity = 1.0
+	}
+	if acceleration < 0 {
+		acceleration = 0
+	}
+	return &RelativeMouse{
+		Sensitivity:  sensitivity,
+		Acceleration: acceleration,
 	}
+}
 
-	err := c.Send(buf.Bytes())
-	if err != nil {
-		return nil, errors.New("failed to send mouse move relative command: " + err.Error())
+// Apply scales the given delta and returns the whole pixel movement to send.
+// Any fractional part is carried over to the next call.
+func (m *RelativeMouse) Apply(dx, dy int) (int, int) {
+	gain := m.Sensitivity
+	if m.Acceleration > 0 {
+		speed := math.Hypot(float64(dx), float64(dy))
+		gain *= 1 + m.Acceleration*speed
 	}
 
-	return c.WaitForReply(0x05)
+	fx := float64(dx)*gain + m.remainderX
+	fy := float64(dy)*gain + m.remainderY
+	outX := math.Trunc(fx)
+	outY := math.Trunc(fy)
+	m.remainderX = fx - outX
+	m.remainderY = fy - outY
+	return int(outX), int(outY)
+}
+
+// Reset clears the accumulated sub-pixel motion
+func (m *RelativeMouse) Reset() {
+	m.remainderX = 0
+	m.remainderY = 0
 }
 
 // Handle mouse button press events
 func (c *Controller) MouseButtonPress(button uint8) ([]byte, error) {
+	var bit uint8
 	switch button {
 	case 0x01: // Left
-		c.hidState.MouseButtons |= 0x01
+		bit = 0x01
 	case 0x02: // Right
-		c.hidState.MouseButtons |= 0x02
+		bit = 0x02
 	case 0x03: // Middle
-		c.hidState.MouseButtons |= 0x04
+		bit = 0x04
 	default:
 		return nil, errors.New("invalid opcode for mouse button press")
 	}
 
-	// Send updated button state with no movement
-	return c.MouseMoveRelative(0, 0, 0)
+	return c.execute(OpMouseButton, func() ([]byte, error) {
+		// Queued moves must reach the target before the button goes down
+		c.applyMouseButtons(c.hidState.MouseButtons | bit)
+
+		// Send updated button state with no movement
+		return c.mouseMoveRelative(0, 0, 0)
+	})
 }
 
 // Handle mouse button release events
 func (c *Controller) MouseButtonRelease(button uint8) ([]byte, error) {
+	var bits uint8
 	switch button {
 	case 0x00: // Release all
-		c.hidState.MouseButtons = 0x00
+		bits = 0xFF
 	case 0x01: // Left
-		c.hidState.MouseButtons &^= 0x01
+		bits = 0x01
 	case 0x02: // Right
-		c.hidState.MouseButtons &^= 0x02
+		bits = 0x02
 	case 0x03: // Middle
-		c.hidState.MouseButtons &^= 0x04
+		bits = 0x04
 	default:
 		return nil, errors.New("invalid opcode for mouse button release")
 	}
 
+	return c.execute(OpMouseButton, func() ([]byte, error) {
+		return c.releaseMouseButtons(bits)
+	})
+}
+
+// releaseMouseButtons releases the given button bits, must run on the executor
+func (c *Controller) releaseMouseButtons(bits uint8) ([]byte, error) {
+	// Queued moves must reach the target before the button goes up
+	c.applyMouseButtons(c.hidState.MouseButtons &^ bits)
+
 	// Send updated button state with no movement
-	return c.MouseMoveRelative(0, 0, 0)
+	return c.mouseMoveRelative(0, 0, 0)
 }
 
 func (c *Controller) MouseScroll(tilt int) ([]byte, error) {
@@ -118,13 +217,16 @@ func (c *Controller) MouseScroll(tilt int) ([]byte, error) {
 		return nil, nil
 	}
 
-	var wheel uint8
+	//fmt.Println(tilt, "-->", wheel)
+	return c.execute(OpMouseScroll, func() ([]byte, error) {
+		return c.mouseMoveRelative(0, 0, c.scrollWheelValue(tilt))
+	})
+}
+
+// scrollWheelValue converts a scroll direction into the wheel byte of a relative mouse report
+func (c *Controller) scrollWheelValue(tilt int) uint8 {
 	if tilt < 0 {
-		wheel = uint8(c.Config.ScrollSensitivity)
-	} else {
-		wheel = uint8(0xFF - c.Config.ScrollSensitivity)
+		return uint8(c.Config.ScrollSensitivity)
 	}
-
-	//fmt.Println(tilt, "-->", wheel)
-	return c.MouseMoveRelative(0, 0, wheel)
+	return uint8(0xFF - c.Config.ScrollSensitivity)
 }
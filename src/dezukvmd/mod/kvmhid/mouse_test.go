@@ -0,0 +1,107 @@
+package kvmhid
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestMouseMoveAbsolutePacket(t *testing.T) {
+	c, emu := newEmulatedController(t)
+	c.MouseButtonPress(0x02)
+	emu.ClearReports()
+
+	if _, err := c.MouseMoveAbsolute(0x34, 0x02, 0xFF, 0x0F); err != nil {
+		t.Fatal(err)
+	}
+	reports := emu.Reports()
+	if len(reports) != 1 || reports[0].Cmd != 0x04 {
+		t.Fatalf("unexpected reports: %+v", reports)
+	}
+	want := []byte{0x02, 0x02, 0x34, 0x02, 0xFF, 0x0F, 0x00}
+	if !bytes.Equal(reports[0].Data, want) {
+		t.Errorf("got %X, want %X", reports[0].Data, want)
+	}
+}
+
+func TestMouseMoveRelativeDeltaSplit(t *testing.T) {
+	c, emu := newEmulatedController(t)
+	emu.ClearReports()
+
+	if _, err := c.MouseMoveRelativeDelta(300, -10); err != nil {
+		t.Fatal(err)
+	}
+	want := [][]byte{
+		{0x01, 0x00, 0x7F, 0xF6, 0x00},
+		{0x01, 0x00, 0x7F, 0x00, 0x00},
+		{0x01, 0x00, 0x2E, 0x00, 0x00},
+	}
+	reports := emu.Reports()
+	if len(reports) != len(want) {
+		t.Fatalf("got %d reports, want %d", len(reports), len(want))
+	}
+	for i, r := range reports {
+		if r.Cmd != 0x05 || !bytes.Equal(r.Data, want[i]) {
+			t.Errorf("report %d: got cmd 0x%02X data %X, want %X", i, r.Cmd, r.Data, want[i])
+		}
+	}
+}
+
+func TestMouseButtons(t *testing.T) {
+	c, emu := newEmulatedController(t)
+	steps := []struct {
+		press  bool
+		button uint8
+		want   byte
+	}{
+		{true, 0x01, 0x01},
+		{true, 0x03, 0x05}, // Middle is bit 2
+		{true, 0x02, 0x07},
+		{false, 0x01, 0x06},
+		{false, 0x00, 0x00}, // Release all
+	}
+	for _, step := range steps {
+		var err error
+		if step.press {
+			_, err = c.MouseButtonPress(step.button)
+		} else {
+			_, err = c.MouseButtonRelease(step.button)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		reports := emu.Reports()
+		if got := reports[len(reports)-1].Data[1]; got != step.want {
+			t.Errorf("button 0x%02X press=%v: got state 0x%02X, want 0x%02X", step.button, step.press, got, step.want)
+		}
+	}
+
+	if _, err := c.MouseButtonPress(0x04); err == nil {
+		t.Error("expected error for invalid button")
+	}
+}
+
+func TestMouseScroll(t *testing.T) {
+	c, emu := newEmulatedController(t)
+	emu.ClearReports()
+	c.MouseScroll(-1)
+	c.MouseScroll(1)
+	reports := emu.Reports()
+	if len(reports) != 2 || reports[0].Data[4] != 0x01 || reports[1].Data[4] != 0xFE {
+		t.Errorf("unexpected scroll reports: %+v", reports)
+	}
+}
+
+func TestRelativeMouseCarriesRemainder(t *testing.T) {
+	m := NewRelativeMouse(0.5, 0)
+	if dx, dy := m.Apply(1, -1); dx != 0 || dy != 0 {
+		t.Errorf("first half step should not move, got %d,%d", dx, dy)
+	}
+	if dx, dy := m.Apply(1, -1); dx != 1 || dy != -1 {
+		t.Errorf("second half step should move one pixel, got %d,%d", dx, dy)
+	}
+
+	accel := NewRelativeMouse(1.0, 0.1)
+	if dx, _ := accel.Apply(10, 0); dx != 20 {
+		t.Errorf("accelerated move got %d, want 20", dx)
+	}
+}
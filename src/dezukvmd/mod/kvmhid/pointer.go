@@ -0,0 +1,163 @@
+package kvmhid
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+/*
+	pointer.go
+
+	Absolute pointer calibration. Clients send absolute positions relative to
+	the captured video (0 - 4096 on both axes). If the target picture does not
+	fill the whole video frame, e.g. a 4:3 target letterboxed by the capture
+	card, those positions are mapped onto the active picture area before they
+	are sent to the CH9329 (0 - 4095 on both axes).
+*/
+
+const (
+	AbsolutePositionRange  = 4096 // Range of absolute positions sent by clients
+	maxAbsolutePosition    = 4095 // Largest absolute position the CH9329 accepts
+	minPointerAreaFraction = 0.1  // Smallest active area accepted, as a fraction of the frame
+)
+
+// Pointer calibration modes
+const (
+	PointerCalibrationNone       = "none"       // The picture fills the whole video frame
+	PointerCalibrationManual     = "manual"     // Active area set by the user
+	PointerCalibrationResolution = "resolution" // Active area computed from the target resolution
+	PointerCalibrationAuto       = "auto"       // Active area detected from captured frames
+)
+
+// PointerCalibration is the active picture area within the captured video frame.
+// The area is given in fractions of the frame size, so it does not depend on
+// the capture resolution.
+type PointerCalibration struct {
+	Mode         string  `json:"mode"`
+	Left         float64 `json:"left"`
+	Top          float64 `json:"top"`
+	Width        float64 `json:"width"`
+	Height       float64 `json:"height"`
+	TargetWidth  int     `json:"target_width,omitempty"`  // Target screen resolution, used in resolution mode
+	TargetHeight int     `json:"target_height,omitempty"` // Target screen resolution, used in resolution mode
+	UpdatedAt    int64   `json:"updated_at"`              // Unix time in milliseconds
+}
+
+// DefaultPointerCalibration returns a calibration where the picture fills the whole frame
+func DefaultPointerCalibration() PointerCalibration {
+	return PointerCalibration{
+		Mode:   PointerCalibrationNone,
+		Width:  1,
+		Height: 1,
+	}
+}
+
+// NewResolutionCalibration computes the active area of a target resolution scaled
+// to fit into the capture frame with its aspect ratio kept, centered on both axes
+func NewResolutionCalibration(frameWidth, frameHeight, targetWidth, targetHeight int) (PointerCalibration, error) {
+	if frameWidth <= 0 || frameHeight <= 0 {
+		return PointerCalibration{}, errors.New("invalid capture resolution")
+	}
+	if targetWidth <= 0 || targetHeight <= 0 {
+		return PointerCalibration{}, errors.New("invalid target resolution")
+	}
+	scale := math.Min(float64(frameWidth)/float64(targetWidth), float64(frameHeight)/float64(targetHeight))
+	width := float64(targetWidth) * scale / float64(frameWidth)
+	height := float64(targetHeight) * scale / float64(frameHeight)
+	return PointerCalibration{
+		Mode:         PointerCalibrationResolution,
+		Left:         (1 - width) / 2,
+		Top:          (1 - height) / 2,
+		Width:        width,
+		Height:       height,
+		TargetWidth:  targetWidth,
+		TargetHeight: targetHeight,
+		UpdatedAt:    time.Now().UnixMilli(),
+	}, nil
+}
+
+// NewAreaCalibration creates a calibration from an active area in frame pixels
+func NewAreaCalibration(mode string, frameWidth, frameHeight, left, top, width, height int) (PointerCalibration, error) {
+	if frameWidth <= 0 || frameHeight <= 0 {
+		return PointerCalibration{}, errors.New("invalid capture resolution")
+	}
+	cal := PointerCalibration{
+		Mode:      mode,
+		Left:      float64(left) / float64(frameWidth),
+		Top:       float64(top) / float64(frameHeight),
+		Width:     float64(width) / float64(frameWidth),
+		Height:    float64(height) / float64(frameHeight),
+		UpdatedAt: time.Now().UnixMilli(),
+	}
+	return cal, cal.Validate()
+}
+
+// Validate checks if the active area lies within the frame
+func (p PointerCalibration) Validate() error {
+	switch p.Mode {
+	case PointerCalibrationNone, PointerCalibrationManual, PointerCalibrationResolution, PointerCalibrationAuto:
+	default:
+		return fmt.Errorf("invalid pointer calibration mode: %s", p.Mode)
+	}
+	if p.Mode == PointerCalibrationNone {
+		return nil
+	}
+	const epsilon = 1e-6
+	if p.Left < 0 || p.Top < 0 || p.Left+p.Width > 1+epsilon || p.Top+p.Height > 1+epsilon {
+		return errors.New("active area must lie within the video frame")
+	}
+	if p.Width < minPointerAreaFraction || p.Height < minPointerAreaFraction {
+		return errors.New("active area is too small")
+	}
+	return nil
+}
+
+// Map converts an absolute position on the video into a CH9329 absolute position.
+// Positions on the black bars are clamped to the nearest edge of the picture.
+func (p PointerCalibration) Map(x, y int) (int, int) {
+	if p.Mode == PointerCalibrationNone || p.Width <= 0 || p.Height <= 0 {
+		return clampAbsolutePosition(x), clampAbsolutePosition(y)
+	}
+	fx := (float64(x)/AbsolutePositionRange - p.Left) / p.Width
+	fy := (float64(y)/AbsolutePositionRange - p.Top) / p.Height
+	return clampAbsolutePosition(int(math.Round(fx * AbsolutePositionRange))),
+		clampAbsolutePosition(int(math.Round(fy * AbsolutePositionRange)))
+}
+
+func clampAbsolutePosition(v int) int {
+	if v < 0 {
+		return 0
+	}
+	if v > maxAbsolutePosition {
+		return maxAbsolutePosition
+	}
+	return v
+}
+
+// GetPointerCalibration returns the absolute pointer calibration in use
+func (c *Controller) GetPointerCalibration() PointerCalibration {
+	c.pointerMu.Lock()
+	defer c.pointerMu.Unlock()
+	return c.pointerCalibration
+}
+
+// SetPointerCalibration changes the absolute pointer calibration
+func (c *Controller) SetPointerCalibration(cal PointerCalibration) error {
+	if err := cal.Validate(); err != nil {
+		return err
+	}
+	if cal.Mode == PointerCalibrationNone {
+		cal = DefaultPointerCalibration()
+	}
+	c.pointerMu.Lock()
+	c.pointerCalibration = cal
+	c.pointerMu.Unlock()
+	return nil
+}
+
+// mapAbsolutePosition converts a client position on the video into a target position
+func (c *Controller) mapAbsolutePosition(x, y int) (int, int) {
+	return c.GetPointerCalibration().Map(x, y)
+}
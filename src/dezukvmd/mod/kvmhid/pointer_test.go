@@ -0,0 +1,72 @@
+package kvmhid
+
+import (
+	"bytes"
+	"math"
+	"testing"
+)
+
+func TestResolutionCalibrationPillarbox(t *testing.T) {
+	// A 1024x768 target captured at 1920x1080 is scaled to 1440x1080 with 240px bars left and right
+	cal, err := NewResolutionCalibration(1920, 1080, 1024, 768)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if math.Abs(cal.Left-0.125) > 1e-9 || cal.Top != 0 || math.Abs(cal.Width-0.75) > 1e-9 || cal.Height != 1 {
+		t.Fatalf("unexpected area: %+v", cal)
+	}
+
+	tests := []struct {
+		x, y   int
+		wx, wy int
+	}{
+		{2048, 2048, 2048, 2048}, // Center stays in the center
+		{512, 0, 0, 0},           // Left edge of the picture
+		{3584, 4096, 4095, 4095}, // Right edge of the picture is clamped to the chip range
+		{100, 1024, 0, 1024},     // Clicks on the bar stick to the picture edge
+		{4000, 1024, 4095, 1024},
+	}
+	for _, tt := range tests {
+		x, y := cal.Map(tt.x, tt.y)
+		if x != tt.wx || y != tt.wy {
+			t.Errorf("Map(%d, %d) = (%d, %d), want (%d, %d)", tt.x, tt.y, x, y, tt.wx, tt.wy)
+		}
+	}
+}
+
+func TestAreaCalibrationValidation(t *testing.T) {
+	if _, err := NewAreaCalibration(PointerCalibrationManual, 1920, 1080, 0, 60, 1920, 960); err != nil {
+		t.Errorf("valid letterbox area rejected: %v", err)
+	}
+	if _, err := NewAreaCalibration(PointerCalibrationManual, 1920, 1080, 100, 0, 1920, 1080); err == nil {
+		t.Error("area outside the frame should be rejected")
+	}
+	if _, err := NewAreaCalibration(PointerCalibrationManual, 1920, 1080, 0, 0, 10, 10); err == nil {
+		t.Error("tiny area should be rejected")
+	}
+	if err := (PointerCalibration{Mode: "bogus", Width: 1, Height: 1}).Validate(); err == nil {
+		t.Error("unknown mode should be rejected")
+	}
+}
+
+func TestMouseMoveUsesPointerCalibration(t *testing.T) {
+	c, emu := newEmulatedController(t)
+	cal, err := NewAreaCalibration(PointerCalibrationManual, 1920, 1080, 0, 135, 1920, 810)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SetPointerCalibration(cal); err != nil {
+		t.Fatal(err)
+	}
+	emu.ClearReports()
+
+	// 1/8 of the frame height is the top edge of the picture
+	c.ConstructAndSendCmd(&HIDCommand{Event: EventTypeMouseMove, MouseAbsX: 1024, MouseAbsY: 512})
+	c.FlushMouse()
+
+	reports := waitForReports(t, emu, 1)
+	want := []byte{0x02, 0x00, 0x00, 0x04, 0x00, 0x00, 0x00}
+	if !bytes.Equal(reports[len(reports)-1].Data, want) {
+		t.Errorf("got %X, want %X", reports[len(reports)-1].Data, want)
+	}
+}
@@ -0,0 +1,222 @@
+package kvmhid
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+/*
+	protocol.go
+
+	HID websocket protocol v2, selected by the client with the
+	"dezukvm.hid.v2" websocket subprotocol. Clients that do not ask for it
+	keep using the JSON protocol (v1).
+
+	Uplink input events are binary frames, all integers little-endian:
+
+		byte 0     frame version, 0x02
+		byte 1     event type, same values as EventType
+		byte 2-3   sequence number, 0 if no ack is wanted
+		byte 4-    payload
+
+	Payloads by event type:
+
+		KeyPress / KeyRelease              keycode u8, flags u8 (bit 0: right modifier)
+		MouseMove                          flags u8 (bit 0: relative), buttons u8, x i16, y i16
+		MousePress / MouseRelease          button u8
+		MouseScroll                        tilt i8
+		KeyCodePress / KeyCodeRelease      length u8, KeyboardEvent.code in ASCII
+		MediaKeyPress / MediaKeyRelease    length u8, media key name in ASCII
+		ReleaseAll, TypeTextCancel,
+		RequestControl, TakeControl,
+		ReleaseControl, HIDReset           no payload
+
+	Events with text or float arguments (SetMouseMode, TypeText, GrantControl,
+	DenyControl) are sent as JSON text frames, a HIDCommand with an extra
+	"seq" field.
+
+	Downlink messages are JSON objects with a "type" field, see HIDEvent.
+*/
+
+const (
+	HIDProtocolV2   = "dezukvm.hid.v2" // Websocket subprotocol of the v2 protocol
+	hidFrameVersion = 0x02
+	hidFrameHeader  = 4
+)
+
+// HID v2 downlink event types
+const (
+	HIDEventHello          = "hello"           // Sent once after connecting
+	HIDEventAck            = "ack"             // Input event with the sequence number was sent to the target
+	HIDEventError          = "error"           // Input event with the sequence number failed
+	HIDEventLEDs           = "leds"            // Keyboard LEDs of the target changed
+	HIDEventChipStatus     = "chip_status"     // HID chip status changed
+	HIDEventControl        = "control"         // Input ownership changed
+	HIDEventControlRequest = "control_request" // Another session asks for input control
+	HIDEventControlDenied  = "control_denied"  // The control holder denied our request
+	HIDEventChipReset      = "chip_reset"      // The HID chip was reset, all keys were released
+	HIDEventConnection     = "connection"      // Serial connection to the HID chip changed, e.g. lost and reconnecting
+)
+
+// HIDEvent is a downlink message of the v2 protocol
+type HIDEvent struct {
+	Type         string            `json:"type"`
+	Seq          uint16            `json:"seq,omitempty"`
+	Error        string            `json:"error,omitempty"`
+	SessionID    string            `json:"session_id,omitempty"`
+	ControlToken string            `json:"control_token,omitempty"` // Only in the hello of the session itself
+	Protocol     int               `json:"protocol,omitempty"`
+	LEDs         *LEDState         `json:"leds,omitempty"`
+	Status       *ChipStatus       `json:"status,omitempty"`
+	Control      *ControlState     `json:"control,omitempty"`
+	Session      *SessionInfo      `json:"session,omitempty"`
+	Connection   *ConnectionStatus `json:"connection,omitempty"`
+	Time         int64             `json:"time,omitempty"` // Unix time in milliseconds
+}
+
+// LEDState is the keyboard LED state of the target
+type LEDState struct {
+	NumLock    bool `json:"num_lock"`
+	CapsLock   bool `json:"caps_lock"`
+	ScrollLock bool `json:"scroll_lock"`
+}
+
+// hidTextRequest is a JSON text frame of the v2 protocol
+type hidTextRequest struct {
+	HIDCommand
+	Seq uint16 `json:"seq"`
+}
+
+// DecodeHIDFrame decodes a v2 binary input frame and returns its sequence number
+func DecodeHIDFrame(frame []byte) (uint16, *HIDCommand, error) {
+	if len(frame) < hidFrameHeader {
+		return 0, nil, errors.New("frame too short")
+	}
+	seq := binary.LittleEndian.Uint16(frame[2:4])
+	if frame[0] != hidFrameVersion {
+		return seq, nil, fmt.Errorf("unsupported frame version: %d", frame[0])
+	}
+	cmd := &HIDCommand{Event: EventType(frame[1])}
+	payload := frame[hidFrameHeader:]
+
+	need := func(n int) error {
+		if len(payload) < n {
+			return fmt.Errorf("payload too short for event %d", cmd.Event)
+		}
+		return nil
+	}
+	readString := func() (string, error) {
+		if err := need(1); err != nil {
+			return "", err
+		}
+		n := int(payload[0])
+		if err := need(1 + n); err != nil {
+			return "", err
+		}
+		return string(payload[1 : 1+n]), nil
+	}
+
+	var err error
+	switch cmd.Event {
+	case EventTypeKeyPress, EventTypeKeyRelease:
+		if err = need(2); err == nil {
+			cmd.Keycode = int(payload[0])
+			cmd.IsRightModKey = payload[1]&0x01 != 0
+		}
+	case EventTypeMouseMove:
+		if err = need(6); err == nil {
+			x := int(int16(binary.LittleEndian.Uint16(payload[2:4])))
+			y := int(int16(binary.LittleEndian.Uint16(payload[4:6])))
+			if payload[0]&0x01 != 0 {
+				cmd.MouseRelX, cmd.MouseRelY = x, y
+			} else {
+				cmd.MouseAbsX, cmd.MouseAbsY = x, y
+			}
+			// Binary moves always carry the button state
+			state := int(payload[1])
+			cmd.MouseMoveButtonState = &state
+		}
+	case EventTypeMousePress, EventTypeMouseRelease:
+		if err = need(1); err == nil {
+			cmd.MouseButton = int(payload[0])
+		}
+	case EventTypeMouseScroll:
+		if err = need(1); err == nil {
+			cmd.MouseScroll = int(int8(payload[0]))
+		}
+	case EventTypeKeyCodePress, EventTypeKeyCodeRelease:
+		cmd.Code, err = readString()
+	case EventTypeMediaKeyPress, EventTypeMediaKeyRelease:
+		cmd.MediaKey, err = readString()
+	case EventTypeReleaseAll, EventTypeTypeTextCancel, EventTypeRequestControl,
+		EventTypeTakeControl, EventTypeReleaseControl, EventTypeHIDReset:
+		// No payload
+	default:
+		err = fmt.Errorf("event %d is not supported in binary frames", cmd.Event)
+	}
+	if err != nil {
+		return seq, nil, err
+	}
+	return seq, cmd, nil
+}
+
+// decodeHIDTextFrame decodes a v2 JSON text frame and returns its sequence number
+func decodeHIDTextFrame(message []byte) (uint16, *HIDCommand, error) {
+	var req hidTextRequest
+	if err := json.Unmarshal(message, &req); err != nil {
+		return 0, nil, err
+	}
+	return req.Seq, &req.HIDCommand, nil
+}
+
+// toHIDEvent converts a message pushed to a session into a v2 downlink event
+func toHIDEvent(msg interface{}) interface{} {
+	switch m := msg.(type) {
+	case *HIDEvent:
+		return m
+	case map[string]ControlState:
+		if state, ok := m["control"]; ok {
+			return &HIDEvent{Type: HIDEventControl, Control: &state}
+		}
+	case map[string]SessionInfo:
+		for _, t := range []string{HIDEventControlRequest, HIDEventControlDenied} {
+			if info, ok := m[t]; ok {
+				return &HIDEvent{Type: t, Session: &info}
+			}
+		}
+	case map[string]ChipStatus:
+		if status, ok := m["chip_status"]; ok {
+			return &HIDEvent{Type: HIDEventChipStatus, Status: &status}
+		}
+	case map[string]ConnectionStatus:
+		if status, ok := m["connection"]; ok {
+			return &HIDEvent{Type: HIDEventConnection, Connection: &status}
+		}
+	case map[string]int64:
+		if t, ok := m["chip_reset"]; ok {
+			return &HIDEvent{Type: HIDEventChipReset, Time: t}
+		}
+	case map[string]string:
+		if e, ok := m["error"]; ok {
+			return &HIDEvent{Type: HIDEventError, Error: e}
+		}
+	}
+	return msg
+}
+
+// ledState returns the keyboard LED part of a chip status
+func ledState(status ChipStatus) LEDState {
+	return LEDState{
+		NumLock:    status.NumLock,
+		CapsLock:   status.CapsLock,
+		ScrollLock: status.ScrollLock,
+	}
+}
+
+// broadcastChipReset tells all sessions that the HID chip was reset
+func (c *Controller) broadcastChipReset() {
+	c.broadcast(map[string]int64{"chip_reset": time.Now().UnixMilli()})
+}
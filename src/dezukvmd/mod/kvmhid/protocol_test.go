@@ -0,0 +1,167 @@
+package kvmhid
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// dialHIDWebSocket connects to the HID websocket handler of the controller with the given subprotocols
+func dialHIDWebSocket(t *testing.T, c *Controller, subprotocols ...string) *websocket.Conn {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(c.HIDWebSocketHandler))
+	t.Cleanup(server.Close)
+	dialer := websocket.Dialer{Subprotocols: subprotocols}
+	conn, _, err := dialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// readHIDEvent reads downlink events until one of the given type arrives
+func readHIDEvent(t *testing.T, conn *websocket.Conn, eventType string) HIDEvent {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		var evt HIDEvent
+		if err := conn.ReadJSON(&evt); err != nil {
+			t.Fatalf("waiting for %s event: %v", eventType, err)
+		}
+		if evt.Type == eventType {
+			return evt
+		}
+	}
+}
+
+func TestDecodeHIDFrame(t *testing.T) {
+	tests := []struct {
+		name  string
+		frame []byte
+		seq   uint16
+		want  HIDCommand
+	}{
+		{"absolute move", []byte{0x02, 0x02, 0x01, 0x00, 0x00, 0x01, 0x00, 0x08, 0xFF, 0x0F}, 1,
+			HIDCommand{Event: EventTypeMouseMove, MouseAbsX: 2048, MouseAbsY: 4095, MouseMoveButtonState: buttonState(1)}},
+		{"relative move", []byte{0x02, 0x02, 0x02, 0x00, 0x01, 0x00, 0xFB, 0xFF, 0x0A, 0x00}, 2,
+			HIDCommand{Event: EventTypeMouseMove, MouseRelX: -5, MouseRelY: 10, MouseMoveButtonState: buttonState(0)}},
+		{"scroll down", []byte{0x02, 0x05, 0x00, 0x01, 0xFF}, 256,
+			HIDCommand{Event: EventTypeMouseScroll, MouseScroll: -1}},
+		{"right ctrl", []byte{0x02, 0x00, 0x03, 0x00, 17, 0x01}, 3,
+			HIDCommand{Event: EventTypeKeyPress, Keycode: 17, IsRightModKey: true}},
+		{"key code", []byte{0x02, 0x0A, 0x04, 0x00, 4, 'K', 'e', 'y', 'A'}, 4,
+			HIDCommand{Event: EventTypeKeyCodePress, Code: "KeyA"}},
+		{"release all", []byte{0x02, 0x0E, 0x00, 0x00}, 0,
+			HIDCommand{Event: EventTypeReleaseAll}},
+	}
+	for _, tt := range tests {
+		seq, cmd, err := DecodeHIDFrame(tt.frame)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if seq != tt.seq || !reflect.DeepEqual(*cmd, tt.want) {
+			t.Errorf("%s: got seq %d %+v, want seq %d %+v", tt.name, seq, *cmd, tt.seq, tt.want)
+		}
+	}
+
+	bad := [][]byte{
+		{0x02, 0x02},                         // Missing header
+		{0x01, 0x0E, 0x00, 0x00},             // Unknown version
+		{0x02, 0x02, 0x00, 0x00, 0x00},       // Short mouse move
+		{0x02, 0x0A, 0x00, 0x00, 5, 'K'},     // Code longer than the frame
+		{0x02, 0x07, 0x00, 0x00, 0x01, 0x00}, // Mouse mode must be sent as JSON
+	}
+	for _, frame := range bad {
+		if _, _, err := DecodeHIDFrame(frame); err == nil {
+			t.Errorf("frame %X should be rejected", frame)
+		}
+	}
+}
+
+func TestHIDWebSocketV2(t *testing.T) {
+	c, emu := newEmulatedController(t)
+	conn := dialHIDWebSocket(t, c, HIDProtocolV2)
+	if conn.Subprotocol() != HIDProtocolV2 {
+		t.Fatalf("subprotocol not negotiated: %q", conn.Subprotocol())
+	}
+	hello := readHIDEvent(t, conn, HIDEventHello)
+	if hello.SessionID == "" || hello.ControlToken == "" || hello.ControlToken == hello.SessionID || hello.Protocol != 2 {
+		t.Fatalf("unexpected hello: %+v", hello)
+	}
+	// The control token is a secret of this client, never part of the broadcast state
+	control := readHIDEvent(t, conn, HIDEventControl)
+	if data, _ := json.Marshal(control); strings.Contains(string(data), hello.ControlToken) {
+		t.Errorf("control token leaked in %s", data)
+	}
+	emu.ClearReports()
+
+	// Left button press with sequence number 7
+	if err := conn.WriteMessage(websocket.BinaryMessage, []byte{0x02, 0x03, 0x07, 0x00, 0x01}); err != nil {
+		t.Fatal(err)
+	}
+	if ack := readHIDEvent(t, conn, HIDEventAck); ack.Seq != 7 {
+		t.Errorf("got ack for seq %d, want 7", ack.Seq)
+	}
+	if reports := emu.Reports(); len(reports) != 1 || reports[0].Data[1] != 0x01 {
+		t.Errorf("button press not sent: %+v", reports)
+	}
+
+	// Invalid button number is reported with its sequence number
+	conn.WriteMessage(websocket.BinaryMessage, []byte{0x02, 0x03, 0x08, 0x00, 0x09})
+	if e := readHIDEvent(t, conn, HIDEventError); e.Seq != 8 || e.Error == "" {
+		t.Errorf("unexpected error event: %+v", e)
+	}
+
+	// JSON text frames carry the events without a binary encoding
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"event":7,"mouse_mode":1,"seq":9}`))
+	if ack := readHIDEvent(t, conn, HIDEventAck); ack.Seq != 9 {
+		t.Errorf("got ack for seq %d, want 9", ack.Seq)
+	}
+
+	emu.SetLEDs(LED_CAPS_LOCK)
+	c.updateChipStatus()
+	if leds := readHIDEvent(t, conn, HIDEventLEDs); leds.LEDs == nil || !leds.LEDs.CapsLock || leds.LEDs.NumLock {
+		t.Errorf("unexpected LED event: %+v", leds)
+	}
+
+	conn.WriteMessage(websocket.BinaryMessage, []byte{0x02, 0xFF, 0x0A, 0x00})
+	readHIDEvent(t, conn, HIDEventChipReset)
+}
+
+func TestHIDWebSocketV1StillJSON(t *testing.T) {
+	c, _ := newEmulatedController(t)
+	conn := dialHIDWebSocket(t, c)
+	if conn.Subprotocol() != "" {
+		t.Fatalf("unexpected subprotocol %q", conn.Subprotocol())
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var hello map[string]string
+	if err := conn.ReadJSON(&hello); err != nil || hello["session_id"] == "" || hello["control_token"] == "" {
+		t.Fatalf("unexpected v1 hello: %v %v", hello, err)
+	}
+
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"event":3,"mouse_button":1}`))
+	for {
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var obj map[string]json.RawMessage
+		if json.Unmarshal(msg, &obj) == nil {
+			// Status and control pushes
+			continue
+		}
+		if !strings.HasPrefix(string(msg), "0x") {
+			t.Errorf("unexpected v1 reply %q", msg)
+		}
+		return
+	}
+}
@@ -0,0 +1,162 @@
+package kvmhid
+
+import (
+	"sync"
+	"time"
+)
+
+/*
+	scheduler.go
+
+	Mouse input scheduler. Browsers send mouse moves much faster than the
+	serial link can carry them, so moves are queued and only the latest
+	absolute position (or the sum of relative deltas and scroll steps) is
+	sent, at most once per report interval. The interval is the configured
+	maximum report rate, or slower if the baud rate cannot keep up.
+
+	Button changes are never merged away: pending moves are flushed with the
+	old button state before the new state is applied, so a click always lands
+	where the cursor was when it happened.
+*/
+
+const (
+	DefaultMaxMouseReportRate = 125 // Mouse reports per second, matches a full speed USB mouse
+	mouseReportWireBytes      = 20  // Bytes on the wire for an absolute mouse report and its reply
+)
+
+// mouseScheduler holds the mouse input waiting to be sent
+type mouseScheduler struct {
+	hasAbsolute bool
+	absX        int
+	absY        int
+	relX        int
+	relY        int
+	scroll      int
+	wake        chan struct{}
+	mu          sync.Mutex
+}
+
+func newMouseScheduler() *mouseScheduler {
+	return &mouseScheduler{
+		wake: make(chan struct{}, 1),
+	}
+}
+
+// MouseReportInterval returns the minimum time between two mouse reports
+func (c *Controller) MouseReportInterval() time.Duration {
+	rate := c.Config.MaxMouseReportRate
+	if rate <= 0 {
+		rate = DefaultMaxMouseReportRate
+	}
+	interval := time.Second / time.Duration(rate)
+	if c.Config.BaudRate > 0 {
+		// 10 bits per byte on the wire with 8N1
+		wireTime := time.Duration(mouseReportWireBytes * 10 * int64(time.Second) / int64(c.Config.BaudRate))
+		if wireTime > interval {
+			interval = wireTime
+		}
+	}
+	return interval
+}
+
+// QueueMouseMoveAbsolute queues a move to an absolute position, replacing any queued position
+func (c *Controller) QueueMouseMoveAbsolute(x, y int) {
+	s := c.mouseScheduler
+	s.mu.Lock()
+	s.hasAbsolute = true
+	s.absX, s.absY = x, y
+	s.mu.Unlock()
+	s.notify()
+}
+
+// QueueMouseMoveRelative queues a relative move, adding to any queued movement
+func (c *Controller) QueueMouseMoveRelative(dx, dy int) {
+	s := c.mouseScheduler
+	s.mu.Lock()
+	s.relX += dx
+	s.relY += dy
+	s.mu.Unlock()
+	s.notify()
+}
+
+// QueueMouseScroll queues a scroll step, positive for scroll up and negative for scroll down
+func (c *Controller) QueueMouseScroll(tilt int) {
+	s := c.mouseScheduler
+	s.mu.Lock()
+	s.scroll += tilt
+	s.mu.Unlock()
+	s.notify()
+}
+
+// setMouseButtons flushes queued moves with the current button state and applies the new one
+func (c *Controller) setMouseButtons(buttons uint8) {
+	c.execute(OpMouseButton, func() ([]byte, error) {
+		c.applyMouseButtons(buttons)
+		return nil, nil
+	})
+}
+
+// applyMouseButtons is setMouseButtons on the executor
+func (c *Controller) applyMouseButtons(buttons uint8) {
+	if c.hidState.MouseButtons == buttons {
+		return
+	}
+	c.flushMouse()
+	c.hidState.MouseButtons = buttons
+}
+
+// FlushMouse sends all queued mouse input right away
+func (c *Controller) FlushMouse() {
+	c.execute(OpMouseFlush, func() ([]byte, error) {
+		c.flushMouse()
+		return nil, nil
+	})
+}
+
+// flushMouse sends the queued mouse input, must run on the executor
+func (c *Controller) flushMouse() {
+	s := c.mouseScheduler
+	s.mu.Lock()
+	hasAbsolute, absX, absY := s.hasAbsolute, s.absX, s.absY
+	relX, relY, scroll := s.relX, s.relY, s.scroll
+	s.hasAbsolute = false
+	s.relX, s.relY, s.scroll = 0, 0, 0
+	s.mu.Unlock()
+
+	if hasAbsolute {
+		c.mouseMoveAbsolute(uint16(absX), uint16(absY), false)
+	}
+	if relX != 0 || relY != 0 {
+		c.mouseMoveRelativeDeltaAsync(relX, relY)
+	}
+	if scroll != 0 {
+		// One scroll step per report, extra steps within the interval are dropped
+		c.backend.SendMouseRelative(c.hidState.MouseButtons, 0, 0, c.scrollWheelValue(scroll), false)
+	}
+}
+
+// runMouseScheduler sends queued mouse input at most once per report interval until stop is closed
+func (c *Controller) runMouseScheduler(stop chan struct{}) {
+	s := c.mouseScheduler
+	interval := c.MouseReportInterval()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-s.wake:
+		}
+		c.FlushMouse()
+		select {
+		case <-stop:
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+func (s *mouseScheduler) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
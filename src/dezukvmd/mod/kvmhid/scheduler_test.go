@@ -0,0 +1,136 @@
+package kvmhid
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// waitForReports waits until the emulator recorded at least n reports
+func waitForReports(t *testing.T, emu *Emulator, n int) []EmulatorReport {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if reports := emu.Reports(); len(reports) >= n {
+			return reports
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("timeout waiting for %d reports, got %d", n, len(emu.Reports()))
+	return nil
+}
+
+// newRateLimitedController creates a controller connected to a CH9329 emulator with the given mouse report rate
+func newRateLimitedController(t *testing.T, rate int) (*Controller, *Emulator) {
+	t.Helper()
+	emu := NewEmulator()
+	c := NewHIDController(&Config{
+		PortName:           "emulator",
+		BaudRate:           115200,
+		ScrollSensitivity:  0x01,
+		StatusPollInterval: time.Hour,
+		MaxMouseReportRate: rate,
+	})
+	if err := c.ConnectTransport(emu); err != nil {
+		t.Fatalf("failed to connect to emulator: %v", err)
+	}
+	t.Cleanup(c.Close)
+	return c, emu
+}
+
+func TestMouseReportInterval(t *testing.T) {
+	c := NewHIDController(&Config{BaudRate: 115200})
+	if got := c.MouseReportInterval(); got != time.Second/DefaultMaxMouseReportRate {
+		t.Errorf("got %v at 115200 baud, want the default report rate", got)
+	}
+
+	c.Config.MaxMouseReportRate = 10
+	if got := c.MouseReportInterval(); got != 100*time.Millisecond {
+		t.Errorf("got %v with a 10 Hz report rate, want 100ms", got)
+	}
+
+	// 20 bytes of 10 bits at 9600 baud take longer than 8ms
+	c = NewHIDController(&Config{BaudRate: 9600})
+	if got := c.MouseReportInterval(); got <= time.Second/DefaultMaxMouseReportRate {
+		t.Errorf("got %v at 9600 baud, want the interval limited by the baud rate", got)
+	}
+}
+
+func TestSchedulerCollapsesAbsoluteMoves(t *testing.T) {
+	c, emu := newRateLimitedController(t, 20)
+	emu.ClearReports()
+
+	for i := 1; i <= 100; i++ {
+		c.QueueMouseMoveAbsolute(i*10, i*20)
+	}
+	time.Sleep(100 * time.Millisecond)
+	c.FlushMouse()
+
+	reports := waitForReports(t, emu, 1)
+	if len(reports) > 3 {
+		t.Errorf("got %d reports for 100 queued moves, want them collapsed", len(reports))
+	}
+	last := reports[len(reports)-1]
+	want := []byte{0x02, 0x00, 0xE8, 0x03, 0xD0, 0x07, 0x00}
+	if last.Cmd != 0x04 || !bytes.Equal(last.Data, want) {
+		t.Errorf("last report cmd 0x%02X data %X, want %X", last.Cmd, last.Data, want)
+	}
+}
+
+func TestSchedulerSumsRelativeMovesAndScroll(t *testing.T) {
+	c, emu := newRateLimitedController(t, 1)
+	emu.ClearReports()
+
+	// Queue and flush on the executor so the scheduler cannot send in between
+	c.executeState(func() {
+		c.QueueMouseMoveRelative(10, -5)
+		c.QueueMouseMoveRelative(20, -5)
+		c.QueueMouseScroll(-1)
+		c.QueueMouseScroll(-1)
+		c.flushMouse()
+	})
+
+	reports := waitForReports(t, emu, 2)
+	want := [][]byte{
+		{0x01, 0x00, 0x1E, 0xF6, 0x00},
+		{0x01, 0x00, 0x00, 0x00, 0x01},
+	}
+	if len(reports) != len(want) {
+		t.Fatalf("got %d reports, want %d", len(reports), len(want))
+	}
+	for i, r := range reports {
+		if r.Cmd != 0x05 || !bytes.Equal(r.Data, want[i]) {
+			t.Errorf("report %d: got cmd 0x%02X data %X, want %X", i, r.Cmd, r.Data, want[i])
+		}
+	}
+}
+
+func TestSchedulerKeepsButtonOrder(t *testing.T) {
+	c, emu := newRateLimitedController(t, 1)
+	emu.ClearReports()
+
+	c.ConstructAndSendCmd(&HIDCommand{Event: EventTypeMouseMove, MouseAbsX: 100, MouseAbsY: 100})
+	c.ConstructAndSendCmd(&HIDCommand{Event: EventTypeMousePress, MouseButton: 1})
+	c.ConstructAndSendCmd(&HIDCommand{Event: EventTypeMouseMove, MouseAbsX: 200, MouseAbsY: 200, MouseMoveButtonState: buttonState(0x01)})
+	c.FlushMouse()
+
+	// The first move may already be sent by the scheduler or flushed by the press,
+	// either way it must be sent before the button goes down
+	reports := waitForReports(t, emu, 3)
+	want := []struct {
+		cmd  byte
+		data []byte
+	}{
+		{0x04, []byte{0x02, 0x00, 0x64, 0x00, 0x64, 0x00, 0x00}},
+		{0x05, []byte{0x01, 0x01, 0x00, 0x00, 0x00}},
+		{0x04, []byte{0x02, 0x01, 0xC8, 0x00, 0xC8, 0x00, 0x00}},
+	}
+	if len(reports) != len(want) {
+		t.Fatalf("got %d reports, want %d: %+v", len(reports), len(want), reports)
+	}
+	for i, r := range reports {
+		if r.Cmd != want[i].cmd || !bytes.Equal(r.Data, want[i].data) {
+			t.Errorf("report %d: got cmd 0x%02X data %X, want cmd 0x%02X data %X", i, r.Cmd, r.Data, want[i].cmd, want[i].data)
+		}
+	}
+}
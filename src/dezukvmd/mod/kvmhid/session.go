@@ -0,0 +1,336 @@
+package kvmhid
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// CommandListener is called with every command a HID session successfully sent to the controller
+type CommandListener func(sessionID string, cmd *HIDCommand)
+
+// SessionListener is called when a HID session connects or disconnects
+type SessionListener func(info SessionInfo, connected bool)
+
+// hidSession holds the input settings of a single HID websocket connection.
+// Settings here only affect the connection that set them, so different
+// clients connected to the same controller can use different mouse modes.
+// The session also tracks which keys and buttons it is holding down, so they
+// can be released when the connection goes away.
+type hidSession struct {
+	id            string
+	controlToken  string                // Secret proving REST input comes from this session, only ever sent to its own client
+	name          string                // Display name given by the client
+	remoteAddr    string                // Network address of the client
+	connectedAt   int64                 // Unix time in milliseconds
+	seq           uint64                // Connection order, tells sessions connected in the same millisecond apart
+	push          func(msg interface{}) // Sends a message to the client, nil if not connected
+	mouseMode     MouseMode
+	relativeMouse *RelativeMouse
+
+	PressedInputs // Inputs held down by this session
+	mu            sync.Mutex
+}
+
+// PressedInputs tracks the keys and buttons held down by one source of input,
+// e.g. a HID session or a macro playback, so they can be released later without
+// touching inputs held by others on the same controller. The zero value is ready
+// to use, it is not safe for concurrent use.
+type PressedInputs struct {
+	pressedKeys      map[uint8]bool  // HID usage codes, including modifiers
+	pressedButtons   uint8           // Mouse button bits as in HIDState.MouseButtons
+	pressedMediaKeys map[string]bool // Multimedia and system key names
+}
+
+var sessionSeq atomic.Uint64
+
+// newHIDSession creates a new session in absolute mouse mode
+func newHIDSession() *hidSession {
+	return &hidSession{
+		id:            uuid.NewString(),
+		controlToken:  uuid.NewString(),
+		connectedAt:   time.Now().UnixMilli(),
+		seq:           sessionSeq.Add(1),
+		mouseMode:     MouseModeAbsolute,
+		relativeMouse: NewRelativeMouse(1.0, 0),
+	}
+}
+
+// setMouseMode switches the mouse mode of this session
+func (s *hidSession) setMouseMode(cmd *HIDCommand) error {
+	switch cmd.MouseMode {
+	case MouseModeAbsolute, MouseModeRelative:
+		s.mouseMode = cmd.MouseMode
+	default:
+		return fmt.Errorf("invalid mouse mode: %d", cmd.MouseMode)
+	}
+	s.relativeMouse = NewRelativeMouse(cmd.MouseSensitivity, cmd.MouseAcceleration)
+	return nil
+}
+
+// handleCommand applies the session settings to the command and sends it to the controller
+func (s *hidSession) handleCommand(c *Controller, cmd *HIDCommand) ([]byte, error) {
+	if requiresControl(cmd.Event) && !c.hasControl(s.id) {
+		return nil, ErrNoInputControl
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch cmd.Event {
+	case EventTypeSetMouseMode:
+		return nil, s.setMouseMode(cmd)
+	case EventTypeMouseMove:
+		if s.mouseMode == MouseModeRelative {
+			// Relative mode ignores absolute coordinates and scales the deltas
+			cmd.MouseAbsX, cmd.MouseAbsY = 0, 0
+			cmd.MouseRelX, cmd.MouseRelY = s.relativeMouse.Apply(cmd.MouseRelX, cmd.MouseRelY)
+		} else {
+			cmd.MouseRelX, cmd.MouseRelY = 0, 0
+		}
+	}
+	resp, err := c.ConstructAndSendCmd(cmd)
+	if err == nil {
+		s.Track(cmd)
+		c.notifyCommandListeners(s.id, cmd)
+	}
+	return resp, err
+}
+
+// Track updates the held inputs after the command was sent
+func (p *PressedInputs) Track(cmd *HIDCommand) {
+	if p.pressedKeys == nil {
+		p.clearPressed()
+	}
+	switch cmd.Event {
+	case EventTypeKeyPress, EventTypeKeyRelease, EventTypeKeyCodePress, EventTypeKeyCodeRelease:
+		usage, pressed, _ := cmd.KeyUsage()
+		p.setKeyPressed(usage, pressed)
+	case EventTypeMousePress:
+		p.pressedButtons |= mouseButtonToBit(cmd.MouseButton)
+	case EventTypeMouseRelease:
+		p.pressedButtons &^= mouseButtonToBit(cmd.MouseButton)
+	case EventTypeMouseMove:
+		// Move events may carry the full button state in the browser bit order
+		if cmd.MouseMoveButtonState == nil {
+			break
+		}
+		p.pressedButtons = 0x00
+		for button := 1; button <= 3; button++ {
+			if *cmd.MouseMoveButtonState&browserButtonBit(button) != 0 {
+				p.pressedButtons |= mouseButtonToBit(button)
+			}
+		}
+	case EventTypeMediaKeyPress:
+		p.pressedMediaKeys[cmd.MediaKey] = true
+	case EventTypeMediaKeyRelease:
+		delete(p.pressedMediaKeys, cmd.MediaKey)
+	case EventTypeReleaseAll, EventTypeHIDReset:
+		p.clearPressed()
+	}
+}
+
+func (p *PressedInputs) setKeyPressed(usage uint8, pressed bool) {
+	if usage == 0x00 {
+		return
+	}
+	if pressed {
+		p.pressedKeys[usage] = true
+	} else {
+		delete(p.pressedKeys, usage)
+	}
+}
+
+// Empty checks if no input is held
+func (p *PressedInputs) Empty() bool {
+	return len(p.pressedKeys) == 0 && p.pressedButtons == 0x00 && len(p.pressedMediaKeys) == 0
+}
+
+// Release releases every held key and button on the controller and forgets them
+func (p *PressedInputs) Release(c *Controller) {
+	for usage := range p.pressedKeys {
+		if _, err := c.ReleaseHIDUsage(usage); err != nil {
+			log.Printf("Failed to release key 0x%02X: %v", usage, err)
+		}
+	}
+	for button := 1; button <= 3; button++ {
+		if p.pressedButtons&mouseButtonToBit(button) != 0 {
+			if _, err := c.MouseButtonRelease(uint8(button)); err != nil {
+				log.Printf("Failed to release mouse button %d: %v", button, err)
+			}
+		}
+	}
+	for name := range p.pressedMediaKeys {
+		if _, err := c.ReleaseMediaKey(name); err != nil {
+			log.Printf("Failed to release media key %s: %v", name, err)
+		}
+	}
+	p.clearPressed()
+}
+
+func (p *PressedInputs) clearPressed() {
+	p.pressedKeys = make(map[uint8]bool)
+	p.pressedButtons = 0x00
+	p.pressedMediaKeys = make(map[string]bool)
+}
+
+// releasePressed releases every key and button still held by this session.
+// Inputs held by other sessions on the same controller are left alone.
+func (s *hidSession) releasePressed(c *Controller) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.Empty() {
+		return
+	}
+
+	log.Printf("Releasing %d keys, %d media keys and mouse buttons 0x%02X held by HID session %s", len(s.pressedKeys), len(s.pressedMediaKeys), s.pressedButtons, s.id)
+	s.Release(c)
+}
+
+// send pushes a message to the client of this session
+func (s *hidSession) send(msg interface{}) {
+	if s.push != nil {
+		s.push(msg)
+	}
+}
+
+// info returns the public description of this session
+func (s *hidSession) info(hasControl bool) SessionInfo {
+	return SessionInfo{
+		ID:          s.id,
+		Name:        s.name,
+		RemoteAddr:  s.remoteAddr,
+		HasControl:  hasControl,
+		ConnectedAt: s.connectedAt,
+	}
+}
+
+// legacyKeyToHIDUsage converts a JavaScript keycode event into the HID usage it presses
+func legacyKeyToHIDUsage(keycode int, isRight bool) uint8 {
+	modifiers := map[int][2]uint8{
+		17: {0xE0, 0xE4}, // Ctrl
+		16: {0xE1, 0xE5}, // Shift
+		18: {0xE2, 0xE6}, // Alt
+		91: {0xE3, 0xE7}, // Meta
+	}
+	if usages, ok := modifiers[keycode]; ok {
+		if isRight {
+			return usages[1]
+		}
+		return usages[0]
+	}
+	if keycode == 13 && isRight {
+		// Numpad enter
+		return javaScriptKeycodeToHIDOpcode(146)
+	}
+	return javaScriptKeycodeToHIDOpcode(uint8(keycode))
+}
+
+// KeyUsage returns the HID usage pressed or released by a key event,
+// ok is false for other events
+func (cmd *HIDCommand) KeyUsage() (usage uint8, pressed bool, ok bool) {
+	switch cmd.Event {
+	case EventTypeKeyPress, EventTypeKeyRelease:
+		usage = legacyKeyToHIDUsage(cmd.Keycode, cmd.IsRightModKey)
+		pressed = cmd.Event == EventTypeKeyPress
+	case EventTypeKeyCodePress, EventTypeKeyCodeRelease:
+		usage, _ = KeyboardCodeToHIDUsage(cmd.Code)
+		pressed = cmd.Event == EventTypeKeyCodePress
+	default:
+		return 0x00, false, false
+	}
+	return usage, pressed, usage != 0x00
+}
+
+// mouseButtonToBit converts a mouse button number (1 left, 2 right, 3 middle) to its HIDState.MouseButtons bit
+func mouseButtonToBit(button int) uint8 {
+	switch button {
+	case 1:
+		return 0x01
+	case 2:
+		return 0x02
+	case 3:
+		return 0x04
+	}
+	return 0x00
+}
+
+// browserButtonBit converts a mouse button number to its bit in HIDCommand.MouseMoveButtonState
+func browserButtonBit(button int) int {
+	switch button {
+	case 1:
+		return 0x01
+	case 2:
+		return 0x04
+	case 3:
+		return 0x02
+	}
+	return 0x00
+}
+
+// AddCommandListener registers a listener for commands sent by HID sessions
+// and returns an ID that can be used to remove it later
+func (c *Controller) AddCommandListener(listener CommandListener) int {
+	c.listenersMu.Lock()
+	defer c.listenersMu.Unlock()
+	c.nextListenerID++
+	c.commandListeners[c.nextListenerID] = listener
+	return c.nextListenerID
+}
+
+// RemoveCommandListener removes a listener added with AddCommandListener
+func (c *Controller) RemoveCommandListener(id int) {
+	c.listenersMu.Lock()
+	defer c.listenersMu.Unlock()
+	delete(c.commandListeners, id)
+}
+
+// AddSessionListener registers a listener for HID sessions connecting and
+// disconnecting and returns an ID that can be used to remove it later
+func (c *Controller) AddSessionListener(listener SessionListener) int {
+	c.listenersMu.Lock()
+	defer c.listenersMu.Unlock()
+	c.nextListenerID++
+	c.sessionListeners[c.nextListenerID] = listener
+	return c.nextListenerID
+}
+
+// RemoveSessionListener removes a listener added with AddSessionListener
+func (c *Controller) RemoveSessionListener(id int) {
+	c.listenersMu.Lock()
+	defer c.listenersMu.Unlock()
+	delete(c.sessionListeners, id)
+}
+
+func (c *Controller) notifySessionListeners(info SessionInfo, connected bool) {
+	c.listenersMu.Lock()
+	defer c.listenersMu.Unlock()
+	for _, listener := range c.sessionListeners {
+		listener(info, connected)
+	}
+}
+
+func (c *Controller) notifyCommandListeners(sessionID string, cmd *HIDCommand) {
+	c.listenersMu.Lock()
+	defer c.listenersMu.Unlock()
+	for _, listener := range c.commandListeners {
+		listener(sessionID, cmd)
+	}
+}
+
+// IsInputEvent checks if the event type is a keyboard or mouse input event
+// rather than a control event like mode switching or chip reset
+func IsInputEvent(event EventType) bool {
+	switch event {
+	case EventTypeKeyPress, EventTypeKeyRelease,
+		EventTypeKeyCodePress, EventTypeKeyCodeRelease,
+		EventTypeMediaKeyPress, EventTypeMediaKeyRelease,
+		EventTypeMouseMove, EventTypeMousePress,
+		EventTypeMouseRelease, EventTypeMouseScroll:
+		return true
+	}
+	return false
+}
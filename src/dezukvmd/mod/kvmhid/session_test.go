@@ -0,0 +1,96 @@
+package kvmhid
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSessionReleasesItsKeys(t *testing.T) {
+	c, emu := newEmulatedController(t)
+	s := newHIDSession()
+	c.registerSession(s)
+
+	for _, cmd := range []HIDCommand{
+		{Event: EventTypeKeyCodePress, Code: "ControlLeft"},
+		{Event: EventTypeKeyPress, Keycode: 65},
+		{Event: EventTypeMousePress, MouseButton: 2},
+		{Event: EventTypeMediaKeyPress, MediaKey: "mute"},
+	} {
+		if _, err := s.handleCommand(c, &cmd); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s.releasePressed(c)
+	if got := lastKeyboardReport(t, emu); !bytes.Equal(got, make([]byte, 8)) {
+		t.Errorf("keyboard not released: %X", got)
+	}
+	if c.hidState.MouseButtons != 0x00 || c.hidState.MediaKeys != [3]uint8{} {
+		t.Errorf("mouse buttons 0x%02X or media keys %X still held", c.hidState.MouseButtons, c.hidState.MediaKeys)
+	}
+
+	// Nothing left to release, no reports should be sent
+	emu.ClearReports()
+	s.releasePressed(c)
+	if len(emu.Reports()) != 0 {
+		t.Errorf("unexpected reports after second release: %+v", emu.Reports())
+	}
+}
+
+func TestSessionTracksReleasedKeys(t *testing.T) {
+	c, emu := newEmulatedController(t)
+	s := newHIDSession()
+	c.registerSession(s)
+	for _, cmd := range []HIDCommand{
+		{Event: EventTypeKeyPress, Keycode: 16, IsRightModKey: true},
+		{Event: EventTypeKeyRelease, Keycode: 16, IsRightModKey: true},
+	} {
+		if _, err := s.handleCommand(c, &cmd); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(s.pressedKeys) != 0 {
+		t.Errorf("released key still tracked: %v", s.pressedKeys)
+	}
+
+	emu.ClearReports()
+	s.releasePressed(c)
+	if len(emu.Reports()) != 0 {
+		t.Error("session without held keys should not send reports")
+	}
+}
+
+func TestSessionRelativeMoveKeepsButtonHeld(t *testing.T) {
+	c, _ := newEmulatedController(t)
+	s := newHIDSession()
+	c.registerSession(s)
+
+	// Pointer lock moves do not always carry the button state, a drag must not be released by them
+	for _, cmd := range []HIDCommand{
+		{Event: EventTypeMousePress, MouseButton: 1},
+		{Event: EventTypeMouseMove, MouseRelX: 10, MouseRelY: -4},
+	} {
+		if _, err := s.handleCommand(c, &cmd); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c.FlushMouse()
+	if c.hidState.MouseButtons != 0x01 || s.pressedButtons != 0x01 {
+		t.Fatalf("left button released by a relative move: state 0x%02X, session 0x%02X", c.hidState.MouseButtons, s.pressedButtons)
+	}
+
+	// A move with an explicit state still sets the buttons
+	move := HIDCommand{Event: EventTypeMouseMove, MouseRelX: 1, MouseMoveButtonState: buttonState(0x00)}
+	if _, err := s.handleCommand(c, &move); err != nil {
+		t.Fatal(err)
+	}
+	c.FlushMouse()
+	if c.hidState.MouseButtons != 0x00 || s.pressedButtons != 0x00 {
+		t.Errorf("left button still held: state 0x%02X, session 0x%02X", c.hidState.MouseButtons, s.pressedButtons)
+	}
+}
+
+// buttonState returns a mouse move button state for HIDCommand.MouseMoveButtonState
+func buttonState(state int) *int {
+	return &state
+}
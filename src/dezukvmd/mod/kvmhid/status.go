@@ -0,0 +1,118 @@
+package kvmhid
+
+import (
+	"log"
+	"time"
+)
+
+/*
+	status.go
+
+	Query the HID backend, e.g. the CH9329 GET_INFO command (0x01), to
+	find out if the target has enumerated the USB device and which
+	keyboard LEDs (Num / Caps / Scroll Lock) are on.
+*/
+
+// StatusListener is called when the chip status changes
+type StatusListener func(status ChipStatus)
+
+// GetChipInfo queries the chip version, target USB connection and keyboard LED state
+func (c *Controller) GetChipInfo() (*ChipStatus, error) {
+	status, err := c.backend.GetStatus()
+	if err != nil {
+		return nil, err
+	}
+
+	leds := uint8(0x00)
+	if status.NumLock {
+		leds |= LED_NUM_LOCK
+	}
+	if status.CapsLock {
+		leds |= LED_CAPS_LOCK
+	}
+	if status.ScrollLock {
+		leds |= LED_SCROLL_LOCK
+	}
+	c.executeState(func() {
+		c.hidState.Leds = leds
+	})
+	return status, nil
+}
+
+// GetChipStatus returns the chip status from the last poll
+func (c *Controller) GetChipStatus() ChipStatus {
+	c.chipStatusMu.Lock()
+	defer c.chipStatusMu.Unlock()
+	return c.chipStatus
+}
+
+// AddStatusListener registers a listener for chip status changes and returns its id
+func (c *Controller) AddStatusListener(l StatusListener) int {
+	c.listenersMu.Lock()
+	defer c.listenersMu.Unlock()
+	c.nextListenerID++
+	c.statusListeners[c.nextListenerID] = l
+	return c.nextListenerID
+}
+
+// RemoveStatusListener removes a status listener by its id
+func (c *Controller) RemoveStatusListener(id int) {
+	c.listenersMu.Lock()
+	defer c.listenersMu.Unlock()
+	delete(c.statusListeners, id)
+}
+
+// pollChipStatus queries the chip status periodically until stop is closed
+func (c *Controller) pollChipStatus(stop chan struct{}) {
+	interval := c.Config.StatusPollInterval
+	if interval <= 0 {
+		interval = DefaultStatusPollInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		c.updateChipStatus()
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// updateChipStatus queries the chip and notifies the listeners if anything changed
+func (c *Controller) updateChipStatus() {
+	status, err := c.GetChipInfo()
+	if err != nil {
+		c.chipStatusMu.Lock()
+		// Keep the last known values but mark the chip as offline
+		status = &ChipStatus{}
+		*status = c.chipStatus
+		c.chipStatusMu.Unlock()
+		if status.Online {
+			log.Println("HID status query failed: " + err.Error())
+		}
+		status.Online = false
+		status.UpdatedAt = time.Now().UnixMilli()
+	}
+
+	c.chipStatusMu.Lock()
+	previous := c.chipStatus
+	c.chipStatus = *status
+	c.chipStatusMu.Unlock()
+
+	previous.UpdatedAt = status.UpdatedAt
+	if previous == *status {
+		return
+	}
+
+	c.listenersMu.Lock()
+	listeners := make([]StatusListener, 0, len(c.statusListeners))
+	for _, l := range c.statusListeners {
+		listeners = append(listeners, l)
+	}
+	c.listenersMu.Unlock()
+	for _, l := range listeners {
+		l(*status)
+	}
+}
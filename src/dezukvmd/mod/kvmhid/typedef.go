@@ -1,7 +1,10 @@
 package kvmhid
 
 import (
-	"github.com/tarm/serial"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type EventType int
@@ -14,16 +17,59 @@ const (
 	EventTypeMouseRelease
 	EventTypeMouseScroll
 	EventTypeHIDCommand
+	EventTypeSetMouseMode
+	EventTypeTypeText
+	EventTypeTypeTextCancel
+	EventTypeKeyCodePress
+	EventTypeKeyCodeRelease
+	EventTypeMediaKeyPress
+	EventTypeMediaKeyRelease
+	EventTypeReleaseAll
+	EventTypeRequestControl
+	EventTypeGrantControl
+	EventTypeDenyControl
+	EventTypeTakeControl
+	EventTypeReleaseControl
 	EventTypeHIDReset = 0xFF
 )
 
-const MinCusorEventInterval = 25 // Minimum interval between cursor events in milliseconds
+type MouseMode int
+
+const (
+	MouseModeAbsolute MouseMode = iota // Mouse move events carry absolute coordinates (0 - 4095)
+	MouseModeRelative                  // Mouse move events carry relative deltas
+)
+
+const DefaultStatusPollInterval = time.Second // Interval between chip status queries
+
+const DefaultSessionIdleTimeout = 30 * time.Second // Release keys held by a HID session after no input for this long
+
+// Keyboard LED bits reported by the target
+const (
+	LED_NUM_LOCK    = 0x01
+	LED_CAPS_LOCK   = 0x02
+	LED_SCROLL_LOCK = 0x04
+)
 
 type Config struct {
 	/* Serial port configs */
-	PortName          string
-	BaudRate          int
-	ScrollSensitivity uint8 // Mouse scroll sensitivity, range 0x00 to 0x7E
+	PortName           string
+	BaudRate           int
+	ScrollSensitivity  uint8         // Mouse scroll sensitivity, range 0x00 to 0x7E
+	StatusPollInterval time.Duration // Interval between chip status queries, default 1 second
+	SessionIdleTimeout time.Duration // Release keys held by an idle HID session after this long, default 30 seconds
+	MaxMouseReportRate int           // Maximum mouse reports per second, default 125, lowered automatically for slow baud rates
+	Backend            string        // HID backend of the USB KVM firmware, BackendCH9329 (default), BackendRemdesHID, BackendHIDGadget or BackendAuto
+
+	/* USB gadget configs, PortName is the keyboard device of the hidg backend */
+	GadgetMouseDevice string // Absolute mouse device of the hidg backend, default /dev/hidg1
+}
+
+// Transport is the byte stream to the HID chip, usually a serial port.
+// Read should return after a short timeout if no data is available so
+// the reader can be stopped.
+type Transport interface {
+	io.ReadWriteCloser
 }
 
 type HIDState struct {
@@ -31,6 +77,8 @@ type HIDState struct {
 	Modkey          uint8    // Modifier key state
 	KeyboardButtons [6]uint8 // Keyboard buttons state
 	Leds            uint8    // LED state
+	MediaKeys       [3]uint8 // Multimedia keys state
+	SystemKeys      uint8    // ACPI system keys state (power, sleep, wake)
 
 	/* Mouse state */
 	MouseButtons uint8 // Mouse buttons state
@@ -43,24 +91,79 @@ type Controller struct {
 	Config *Config
 
 	/* Internal state */
-	serialPort          *serial.Port
-	hidState            HIDState // Current state of the HID device
-	serialRunning       bool
-	writeQueue          chan []byte
-	incomingDataQueue   chan []byte // Queue for incoming data
-	lastCursorEventTime int64
-	readCloseChan       chan bool
+	hidState           HIDState // Current state of the HID device
+	backend            Backend  // Protocol of the USB KVM firmware, see backend.go
+	serialRunning      atomic.Bool
+	writeQueue         chan []byte
+	transportStop      chan struct{} // Stops the supervised serial I/O
+	transportDone      chan struct{} // Closed when the supervised serial I/O has stopped
+	connStatus         ConnectionStatus
+	connMu             sync.Mutex
+	frameParser        frameParser       // Decodes frames from the serial port, only used by the reader
+	pendingCommands    []*pendingCommand // Commands waiting for a reply, oldest first
+	pendingMu          sync.Mutex
+	mouseScheduler     *mouseScheduler // Coalesces and rate-limits mouse input
+	mouseSchedulerStop chan struct{}
+	executor           *commandExecutor // Owns hidState, see executor.go
+
+	/* Absolute pointer calibration */
+	pointerCalibration PointerCalibration
+	pointerMu          sync.Mutex
+
+	/* Chip status */
+	chipStatus      ChipStatus
+	chipStatusMu    sync.Mutex
+	statusPollStop  chan struct{}
+	statusListeners map[int]StatusListener
+
+	/* Text typing */
+	typeTextJob *TypeTextJob
+	typeTextMu  sync.Mutex
+	keyChordMu  sync.Mutex // Held while a key chord sequence runs
+
+	/* Input arbitration between HID sessions */
+	sessions     map[string]*hidSession
+	controlOwner string // Session ID holding input control
+	controlMu    sync.Mutex
+	inputJob     string // Name of the running background input job, e.g. a macro
+	inputJobMu   sync.Mutex
+
+	/* Command and session listeners, e.g. macro recorders and input audit */
+	commandListeners map[int]CommandListener
+	sessionListeners map[int]SessionListener
+	nextListenerID   int
+	listenersMu      sync.Mutex
+}
+
+// ChipStatus is the status reported by the HID device, e.g. the CH9329 GET_INFO command
+type ChipStatus struct {
+	Online          bool   `json:"online"`           // Chip replied to the last status query
+	Version         string `json:"version"`          // Chip firmware version, e.g. V1.0
+	TargetConnected bool   `json:"target_connected"` // USB device is enumerated by the target
+	NumLock         bool   `json:"num_lock"`
+	CapsLock        bool   `json:"caps_lock"`
+	ScrollLock      bool   `json:"scroll_lock"`
+	UpdatedAt       int64  `json:"updated_at"` // Unix time in milliseconds of the last query
 }
 
 type HIDCommand struct {
 	Event                EventType `json:"event"`
-	Keycode              int       `json:"keycode,omitempty"`
+	Keycode              int       `json:"keycode,omitempty"`                 // Legacy JavaScript keyCode, used with EventTypeKeyPress / EventTypeKeyRelease
+	Code                 string    `json:"code,omitempty"`                    // KeyboardEvent.code, used with EventTypeKeyCodePress / EventTypeKeyCodeRelease
 	IsRightModKey        bool      `json:"is_right_modifier_key,omitempty"`   // true if the key is a right modifier key (Ctrl, Shift, Alt, GUI)
 	MouseAbsX            int       `json:"mouse_x,omitempty"`                 // Absolute mouse position in X direction
 	MouseAbsY            int       `json:"mouse_y,omitempty"`                 // Absolute mouse position in Y direction
 	MouseRelX            int       `json:"mouse_rel_x,omitempty"`             // Relative mouse movement in X direction
 	MouseRelY            int       `json:"mouse_rel_y,omitempty"`             // Relative mouse movement in Y direction
-	MouseMoveButtonState int       `json:"mouse_move_button_state,omitempty"` // Mouse button state during move,
+	MouseMoveButtonState *int      `json:"mouse_move_button_state,omitempty"` // Mouse button state during move, 0x01 left, 0x02 middle, 0x04 right. Held buttons are kept if not set
 	MouseButton          int       `json:"mouse_button,omitempty"`            //0x01 for left click, 0x02 for right click, 0x03 for middle clicks
 	MouseScroll          int       `json:"mouse_scroll,omitempty"`            // Positive for scroll up, negative for scroll down, max 127
+	MouseMode            MouseMode `json:"mouse_mode,omitempty"`              // Mouse mode to switch to, used with EventTypeSetMouseMode
+	MouseSensitivity     float64   `json:"mouse_sensitivity,omitempty"`       // Relative mouse sensitivity multiplier, used with EventTypeSetMouseMode
+	MouseAcceleration    float64   `json:"mouse_acceleration,omitempty"`      // Relative mouse acceleration factor, used with EventTypeSetMouseMode
+	Text                 string    `json:"text,omitempty"`                    // Text to type, used with EventTypeTypeText
+	Layout               string    `json:"layout,omitempty"`                  // Target keyboard layout for typing text, e.g. us, uk, de, fr, jp
+	KeyInterval          int       `json:"key_interval,omitempty"`            // Delay between typed keys in milliseconds
+	TargetSession        string    `json:"target_session,omitempty"`          // Session to grant or deny input control, used with EventTypeGrantControl / EventTypeDenyControl
+	MediaKey             string    `json:"media_key,omitempty"`               // Multimedia or system key name, e.g. volume_up or power, used with EventTypeMediaKeyPress / EventTypeMediaKeyRelease
 }
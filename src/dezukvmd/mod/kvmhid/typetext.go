@@ -0,0 +1,241 @@
+package kvmhid
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+/*
+	typetext.go
+
+	Type arbitrary text on the target as a sequence of key strokes.
+	Typing runs in the background as a job so long text can report
+	progress and be cancelled half way.
+*/
+
+const (
+	DefaultTypeTextKeyInterval = 20 * time.Millisecond // Delay between key press and release, and between keys
+	MaxTypeTextLength          = 65536                 // Maximum number of characters per typing job
+)
+
+// ErrTypeTextBusy is returned if another typing job is running on the controller
+var ErrTypeTextBusy = errors.New("another text typing job is already running")
+
+type TypeTextState string
+
+const (
+	TypeTextStateRunning   TypeTextState = "running"
+	TypeTextStateDone      TypeTextState = "done"
+	TypeTextStateCancelled TypeTextState = "cancelled"
+	TypeTextStateFailed    TypeTextState = "failed"
+)
+
+// TypeTextJob is a running or finished text typing job
+type TypeTextJob struct {
+	layout      string
+	keyInterval time.Duration
+	strokes     []KeyStroke
+	typed       int
+	state       TypeTextState
+	err         error
+	cancel      context.CancelFunc
+	done        chan struct{}
+	mu          sync.Mutex
+}
+
+// TypeTextStatus is a snapshot of the progress of a typing job
+type TypeTextStatus struct {
+	State  TypeTextState `json:"state"`
+	Layout string        `json:"layout"`
+	Typed  int           `json:"typed"`
+	Total  int           `json:"total"`
+	Error  string        `json:"error,omitempty"`
+}
+
+// StartTypeText converts the text with the given layout and starts typing it in the background.
+// Only one typing job can run on a controller at a time, and not while another input job
+// such as a macro holds the controller.
+func (c *Controller) StartTypeText(text string, layoutName string, keyInterval time.Duration) (*TypeTextJob, error) {
+	if len(text) == 0 {
+		return nil, errors.New("text is empty")
+	}
+	if len([]rune(text)) > MaxTypeTextLength {
+		return nil, errors.New("text is too long")
+	}
+	layout, err := GetKeyboardLayout(layoutName)
+	if err != nil {
+		return nil, err
+	}
+	strokes, err := layout.Convert(text)
+	if err != nil {
+		return nil, err
+	}
+	if keyInterval <= 0 {
+		keyInterval = DefaultTypeTextKeyInterval
+	}
+
+	c.typeTextMu.Lock()
+	defer c.typeTextMu.Unlock()
+	if c.typeTextJob != nil && c.typeTextJob.Status().State == TypeTextStateRunning {
+		return nil, ErrTypeTextBusy
+	}
+	endInputJob, err := c.BeginInputJob("text typing")
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	job := &TypeTextJob{
+		layout:      layout.Name,
+		keyInterval: keyInterval,
+		strokes:     strokes,
+		state:       TypeTextStateRunning,
+		cancel:      cancel,
+		done:        make(chan struct{}),
+	}
+	c.typeTextJob = job
+	go c.runTypeTextJob(ctx, job, endInputJob)
+	return job, nil
+}
+
+// GetTypeTextJob returns the current or last typing job, nil if nothing was typed yet
+func (c *Controller) GetTypeTextJob() *TypeTextJob {
+	c.typeTextMu.Lock()
+	defer c.typeTextMu.Unlock()
+	return c.typeTextJob
+}
+
+// CancelTypeText cancels the running typing job, if any
+func (c *Controller) CancelTypeText() {
+	job := c.GetTypeTextJob()
+	if job != nil {
+		job.Cancel()
+	}
+}
+
+func (c *Controller) runTypeTextJob(ctx context.Context, job *TypeTextJob, endInputJob func()) {
+	defer close(job.done)
+	typeErr := c.typeStrokes(ctx, job.strokes, job.keyInterval, func(typed int) {
+		job.mu.Lock()
+		job.typed = typed
+		job.mu.Unlock()
+	})
+
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	// Free the controller before the job shows as finished, so a new job can start right away
+	endInputJob()
+	switch {
+	case errors.Is(typeErr, context.Canceled):
+		job.state = TypeTextStateCancelled
+	case typeErr != nil:
+		job.state = TypeTextStateFailed
+		job.err = typeErr
+	default:
+		job.state = TypeTextStateDone
+	}
+}
+
+// TypeText types the text on the target and blocks until it is done or the context is cancelled
+func (c *Controller) TypeText(ctx context.Context, text string, layoutName string, keyInterval time.Duration) error {
+	layout, err := GetKeyboardLayout(layoutName)
+	if err != nil {
+		return err
+	}
+	strokes, err := layout.Convert(text)
+	if err != nil {
+		return err
+	}
+	if keyInterval <= 0 {
+		keyInterval = DefaultTypeTextKeyInterval
+	}
+	return c.typeStrokes(ctx, strokes, keyInterval, nil)
+}
+
+// typeStrokes types the key strokes one by one, progress is called after each typed stroke if set
+func (c *Controller) typeStrokes(ctx context.Context, strokes []KeyStroke, interval time.Duration, progress func(typed int)) error {
+	var typeErr error
+	for i, stroke := range strokes {
+		if err := c.typeKeyStroke(ctx, stroke, interval); err != nil {
+			typeErr = err
+			break
+		}
+		if progress != nil {
+			progress(i + 1)
+		}
+	}
+
+	// Restore whatever keys the user is holding on the target
+	c.execute(OpKeyboard, func() ([]byte, error) {
+		return keyboardSendKeyCombinations(c)
+	})
+	return typeErr
+}
+
+// typeKeyStroke presses and releases a single key stroke
+func (c *Controller) typeKeyStroke(ctx context.Context, stroke KeyStroke, interval time.Duration) error {
+	if _, err := c.executeKeyboardReport(stroke.Modifier, [6]uint8{stroke.Usage}); err != nil {
+		return err
+	}
+	if err := sleepContext(ctx, interval); err != nil {
+		c.executeKeyboardReport(0x00, [6]uint8{})
+		return err
+	}
+	if _, err := c.executeKeyboardReport(0x00, [6]uint8{}); err != nil {
+		return err
+	}
+	if err := sleepContext(ctx, interval); err != nil {
+		return err
+	}
+
+	if stroke.Dead {
+		// Dead keys only produce their character when followed by a space
+		return c.typeKeyStroke(ctx, KeyStroke{Usage: hidUsageSpace}, interval)
+	}
+	return nil
+}
+
+// executeKeyboardReport sends a keyboard report on the executor without changing the HID state
+func (c *Controller) executeKeyboardReport(modifier uint8, keys [6]uint8) ([]byte, error) {
+	return c.execute(OpKeyboard, func() ([]byte, error) {
+		return c.sendKeyboardReport(modifier, keys)
+	})
+}
+
+// sleepContext waits for the given duration or until the context is cancelled
+func sleepContext(ctx context.Context, d time.Duration) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(d):
+		return nil
+	}
+}
+
+// Cancel stops the typing job, keys already typed are not undone
+func (j *TypeTextJob) Cancel() {
+	j.cancel()
+}
+
+// Wait blocks until the typing job has finished
+func (j *TypeTextJob) Wait() {
+	<-j.done
+}
+
+// Status returns the current progress of the typing job
+func (j *TypeTextJob) Status() TypeTextStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	status := TypeTextStatus{
+		State:  j.state,
+		Layout: j.layout,
+		Typed:  j.typed,
+		Total:  len(j.strokes),
+	}
+	if j.err != nil {
+		status.Error = j.err.Error()
+	}
+	return status
+}
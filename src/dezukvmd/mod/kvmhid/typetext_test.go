@@ -0,0 +1,37 @@
+package kvmhid
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestHandleTypeTextStatusCodes(t *testing.T) {
+	c, _ := newEmulatedController(t)
+	post := func(form url.Values) int {
+		req := httptest.NewRequest(http.MethodPost, "/type", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+		c.HandleTypeText(rec, req)
+		return rec.Code
+	}
+
+	tests := []struct {
+		name string
+		form url.Values
+		want int
+	}{
+		{"unknown layout", url.Values{"text": {"a"}, "layout": {"xx"}}, http.StatusBadRequest},
+		{"unsupported character", url.Values{"text": {"¥"}}, http.StatusBadRequest},
+		{"started", url.Values{"text": {"abcdef"}, "interval": {"200"}}, http.StatusOK},
+		{"busy", url.Values{"text": {"a"}}, http.StatusConflict},
+	}
+	for _, tt := range tests {
+		if code := post(tt.form); code != tt.want {
+			t.Errorf("%s: got status %d, want %d", tt.name, code, tt.want)
+		}
+	}
+	c.CancelTypeText()
+}
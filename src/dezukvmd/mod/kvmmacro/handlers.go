@@ -0,0 +1,140 @@
+package kvmmacro
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"imuslab.com/dezukvm/dezukvmd/mod/kvmhid"
+)
+
+// HandleStartRecording starts recording macro on the given instance
+// Accept optional POST parameter session to only record a single HID session
+func (m *Manager) HandleStartRecording(w http.ResponseWriter, r *http.Request, instanceUUID string, controller *kvmhid.Controller) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Invalid form data", http.StatusBadRequest)
+		return
+	}
+	if err := m.StartRecording(instanceUUID, controller, r.Form.Get("session")); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("OK"))
+}
+
+// HandleStopRecording stops the recording on the given instance and saves it
+// Accept POST parameter name, or discard=true to drop the recording
+func (m *Manager) HandleStopRecording(w http.ResponseWriter, r *http.Request, instanceUUID string) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Invalid form data", http.StatusBadRequest)
+		return
+	}
+	if r.Form.Get("discard") == "true" {
+		if err := m.DiscardRecording(instanceUUID); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("OK"))
+		return
+	}
+
+	macro, err := m.StopRecording(instanceUUID, r.Form.Get("name"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(macro.Info())
+}
+
+// HandlePlay plays a stored macro on the given instance
+// Accept POST parameters name and speed (optional, default 1.0), only from the session holding input control
+func (m *Manager) HandlePlay(w http.ResponseWriter, r *http.Request, instanceUUID string, controller *kvmhid.Controller) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Invalid form data", http.StatusBadRequest)
+		return
+	}
+	name := r.Form.Get("name")
+	if name == "" {
+		http.Error(w, "Missing or invalid name parameter", http.StatusBadRequest)
+		return
+	}
+	speed := 1.0
+	if speedStr := r.Form.Get("speed"); speedStr != "" {
+		var err error
+		speed, err = strconv.ParseFloat(speedStr, 64)
+		if err != nil {
+			http.Error(w, "Invalid speed parameter", http.StatusBadRequest)
+			return
+		}
+	}
+	if err := m.Play(instanceUUID, controller, name, speed, kvmhid.RequestControlToken(r)); err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, kvmhid.ErrNoInputControl) || errors.Is(err, kvmhid.ErrInputJobBusy) {
+			status = http.StatusConflict
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("OK"))
+}
+
+// HandleAbort aborts the macro playing on the given instance, only from the session holding input control
+func (m *Manager) HandleAbort(w http.ResponseWriter, r *http.Request, instanceUUID string, controller *kvmhid.Controller) {
+	if err := controller.CheckControl(kvmhid.RequestControlToken(r)); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err := m.Abort(instanceUUID); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("OK"))
+}
+
+// HandlePlaybackStatus returns the recording and playback status of the given instance
+func (m *Manager) HandlePlaybackStatus(w http.ResponseWriter, r *http.Request, instanceUUID string) {
+	status, _ := m.GetPlaybackStatus(instanceUUID)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"recording": m.IsRecording(instanceUUID),
+		"playback":  status,
+	})
+}
+
+// HandleListMacros lists all stored macros
+func (m *Manager) HandleListMacros(w http.ResponseWriter, r *http.Request) {
+	macros, err := m.ListMacros()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(macros)
+}
+
+// HandleGetMacro returns a stored macro with all its events
+func (m *Manager) HandleGetMacro(w http.ResponseWriter, r *http.Request, name string) {
+	macro, err := m.GetMacro(name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(macro)
+}
+
+// HandleDeleteMacro removes a stored macro
+func (m *Manager) HandleDeleteMacro(w http.ResponseWriter, r *http.Request, name string) {
+	if err := m.DeleteMacro(name); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("OK"))
+}
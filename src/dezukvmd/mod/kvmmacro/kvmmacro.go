@@ -0,0 +1,382 @@
+package kvmmacro
+
+/*
+	kvmmacro - HID macro recording and playback
+
+	Record the HID commands sent by websocket sessions of an instance,
+	store them as named macros in the system database and replay them
+	on any instance with adjustable speed.
+*/
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"imuslab.com/dezukvm/dezukvmd/mod/kvmhid"
+)
+
+const (
+	macroBucket = "macros"
+
+	MinPlaybackSpeed = 0.1  // Slowest playback speed multiplier
+	MaxPlaybackSpeed = 10.0 // Fastest playback speed multiplier
+	MaxMacroNameLen  = 64
+)
+
+// NewManager creates a new macro manager using the given database
+func NewManager(db *bolt.DB) (*Manager, error) {
+	if db == nil {
+		return nil, errors.New("database is not initialized")
+	}
+	err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte(macroBucket))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Manager{
+		db:         db,
+		recordings: make(map[string]*recording),
+		playbacks:  make(map[string]*playback),
+	}, nil
+}
+
+/* Storage */
+
+// SaveMacro stores the macro, overwriting any macro with the same name
+func (m *Manager) SaveMacro(macro *Macro) error {
+	if err := validateMacroName(macro.Name); err != nil {
+		return err
+	}
+	data, err := json.Marshal(macro)
+	if err != nil {
+		return err
+	}
+	return m.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(macroBucket))
+		return b.Put([]byte(macro.Name), data)
+	})
+}
+
+// GetMacro loads a macro by name
+func (m *Manager) GetMacro(name string) (*Macro, error) {
+	var macro *Macro
+	err := m.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(macroBucket))
+		data := b.Get([]byte(name))
+		if data == nil {
+			return errors.New("macro not found")
+		}
+		macro = &Macro{}
+		return json.Unmarshal(data, macro)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return macro, nil
+}
+
+// DeleteMacro removes a macro by name
+func (m *Manager) DeleteMacro(name string) error {
+	return m.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(macroBucket))
+		if b.Get([]byte(name)) == nil {
+			return errors.New("macro not found")
+		}
+		return b.Delete([]byte(name))
+	})
+}
+
+// ListMacros returns a summary of all stored macros sorted by name
+func (m *Manager) ListMacros() ([]*MacroInfo, error) {
+	results := []*MacroInfo{}
+	err := m.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(macroBucket))
+		return b.ForEach(func(k, v []byte) error {
+			macro := Macro{}
+			if err := json.Unmarshal(v, &macro); err != nil {
+				log.Printf("Skipping corrupted macro %s: %v", string(k), err)
+				return nil
+			}
+			results = append(results, macro.Info())
+			return nil
+		})
+	})
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Name < results[j].Name
+	})
+	return results, err
+}
+
+// Info returns a summary of the macro
+func (macro *Macro) Info() *MacroInfo {
+	var duration int64
+	for _, evt := range macro.Events {
+		duration += evt.Delay
+	}
+	return &MacroInfo{
+		Name:       macro.Name,
+		CreatedAt:  macro.CreatedAt,
+		EventCount: len(macro.Events),
+		Duration:   duration,
+	}
+}
+
+func validateMacroName(name string) error {
+	if strings.TrimSpace(name) == "" {
+		return errors.New("macro name cannot be empty")
+	}
+	if len(name) > MaxMacroNameLen {
+		return errors.New("macro name is too long")
+	}
+	return nil
+}
+
+/* Recording */
+
+// StartRecording starts recording the input commands sent to the controller of an instance.
+// If sessionID is not empty, only commands from that HID session are recorded.
+func (m *Manager) StartRecording(instanceUUID string, controller *kvmhid.Controller, sessionID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.recordings[instanceUUID]; ok {
+		return errors.New("a macro is already being recorded on this instance")
+	}
+
+	rec := &recording{
+		controller: controller,
+		sessionID:  sessionID,
+		events:     []MacroEvent{},
+	}
+	rec.listenerID = controller.AddCommandListener(rec.handleCommand)
+	m.recordings[instanceUUID] = rec
+	return nil
+}
+
+// StopRecording stops the recording on an instance and saves it with the given name
+func (m *Manager) StopRecording(instanceUUID string, name string) (*Macro, error) {
+	if err := validateMacroName(name); err != nil {
+		return nil, err
+	}
+	macro, err := m.takeRecording(instanceUUID)
+	if err != nil {
+		return nil, err
+	}
+	macro.Name = name
+	if err := m.SaveMacro(macro); err != nil {
+		return nil, err
+	}
+	return macro, nil
+}
+
+// DiscardRecording stops the recording on an instance without saving it
+func (m *Manager) DiscardRecording(instanceUUID string) error {
+	_, err := m.takeRecording(instanceUUID)
+	return err
+}
+
+// IsRecording checks if a macro is being recorded on the instance
+func (m *Manager) IsRecording(instanceUUID string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.recordings[instanceUUID]
+	return ok
+}
+
+// takeRecording detaches the recording of an instance and returns the recorded events
+func (m *Manager) takeRecording(instanceUUID string) (*Macro, error) {
+	m.mu.Lock()
+	rec, ok := m.recordings[instanceUUID]
+	delete(m.recordings, instanceUUID)
+	m.mu.Unlock()
+	if !ok {
+		return nil, errors.New("no macro is being recorded on this instance")
+	}
+
+	rec.controller.RemoveCommandListener(rec.listenerID)
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	return &Macro{
+		CreatedAt: time.Now().Unix(),
+		Events:    rec.events,
+	}, nil
+}
+
+func (r *recording) handleCommand(sessionID string, cmd *kvmhid.HIDCommand) {
+	if r.sessionID != "" && r.sessionID != sessionID {
+		return
+	}
+	// Typed text is recorded as one event and typed again in full on playback
+	if !kvmhid.IsInputEvent(cmd.Event) && cmd.Event != kvmhid.EventTypeTypeText {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now().UnixMilli()
+	var delay int64
+	if r.lastEvent != 0 {
+		delay = now - r.lastEvent
+	}
+	r.lastEvent = now
+	r.events = append(r.events, MacroEvent{
+		Delay:   delay,
+		Command: *cmd,
+	})
+}
+
+/* Playback */
+
+// Play replays a stored macro on the controller of an instance in the background.
+// speed is a multiplier of the recorded timing, e.g. 2.0 plays twice as fast.
+// Playback stops once the HID session it was started from loses input control. Returns
+// kvmhid.ErrInputJobBusy while another input job, e.g. a script, runs on the controller.
+func (m *Manager) Play(instanceUUID string, controller *kvmhid.Controller, name string, speed float64, controlToken string) error {
+	if speed == 0 {
+		speed = 1.0
+	}
+	if speed < MinPlaybackSpeed || speed > MaxPlaybackSpeed {
+		return errors.New("playback speed out of range")
+	}
+	macro, err := m.GetMacro(name)
+	if err != nil {
+		return err
+	}
+	if err := controller.CheckControl(controlToken); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	endInputJob, err := controller.BeginInputJob("macro " + name)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &playback{
+		macro:        macro,
+		speed:        speed,
+		controlToken: controlToken,
+		state:        PlaybackStateRunning,
+		cancel:       cancel,
+		done:         make(chan struct{}),
+	}
+	m.playbacks[instanceUUID] = p
+	go p.run(ctx, controller, endInputJob)
+	return nil
+}
+
+// Abort stops the macro playing on an instance and waits for the keys to be released
+func (m *Manager) Abort(instanceUUID string) error {
+	m.mu.Lock()
+	p, ok := m.playbacks[instanceUUID]
+	m.mu.Unlock()
+	if !ok {
+		return errors.New("no macro is playing on this instance")
+	}
+	p.cancel()
+	<-p.done
+	return nil
+}
+
+// GetPlaybackStatus returns the status of the current or last playback on an instance
+func (m *Manager) GetPlaybackStatus(instanceUUID string) (*PlaybackStatus, error) {
+	m.mu.Lock()
+	p, ok := m.playbacks[instanceUUID]
+	m.mu.Unlock()
+	if !ok {
+		return nil, errors.New("no macro has been played on this instance")
+	}
+	status := p.status()
+	return &status, nil
+}
+
+func (p *playback) run(ctx context.Context, controller *kvmhid.Controller, endInputJob func()) {
+	defer close(p.done)
+	var playErr error
+	var pressed kvmhid.PressedInputs // Keys and buttons held by the macro
+	var typingTime time.Duration     // Time spent typing text, already part of the recorded delay of the next event
+	for i, evt := range p.macro.Events {
+		// Typing runs at its own pace and the recorded delay covers it at 1x,
+		// so only the time left after typing is scaled by the playback speed
+		delay := time.Duration(float64(time.Duration(evt.Delay)*time.Millisecond-typingTime) / p.speed)
+		if delay < 0 {
+			delay = 0
+		}
+		typingTime = 0
+		select {
+		case <-ctx.Done():
+			playErr = ctx.Err()
+		case <-time.After(delay):
+		}
+		if playErr != nil {
+			break
+		}
+
+		if err := controller.CheckControl(p.controlToken); err != nil {
+			playErr = err
+			break
+		}
+		cmd := evt.Command
+		if cmd.Event == kvmhid.EventTypeTypeText {
+			// Type in the foreground, the events after it must not interleave with the text
+			started := time.Now()
+			if err := controller.TypeText(ctx, cmd.Text, cmd.Layout, time.Duration(cmd.KeyInterval)*time.Millisecond); err != nil {
+				playErr = err
+				break
+			}
+			typingTime = time.Since(started)
+		} else {
+			if _, err := controller.ConstructAndSendCmd(&cmd); err != nil {
+				playErr = err
+				break
+			}
+			pressed.Track(&cmd)
+		}
+		p.mu.Lock()
+		p.played = i + 1
+		p.mu.Unlock()
+	}
+
+	// Never leave keys or buttons pressed by the macro held on the target,
+	// inputs held by sessions on the controller are left alone
+	pressed.Release(controller)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	// Free the controller before the playback shows as finished, so a new job can start right away
+	endInputJob()
+	switch {
+	case errors.Is(playErr, context.Canceled):
+		p.state = PlaybackStateAborted
+	case playErr != nil:
+		p.state = PlaybackStateFailed
+		p.err = playErr
+	default:
+		p.state = PlaybackStateDone
+	}
+}
+
+func (p *playback) status() PlaybackStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	status := PlaybackStatus{
+		Macro:  p.macro.Name,
+		State:  p.state,
+		Played: p.played,
+		Total:  len(p.macro.Events),
+		Speed:  p.speed,
+	}
+	if p.err != nil {
+		status.Error = p.err.Error()
+	}
+	return status
+}
@@ -0,0 +1,242 @@
+package kvmmacro
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/gorilla/websocket"
+	"imuslab.com/dezukvm/dezukvmd/mod/kvmhid"
+)
+
+// newTestManager creates a macro manager and a controller connected to a CH9329 emulator
+func newTestManager(t *testing.T) (*Manager, *kvmhid.Controller, *kvmhid.Emulator) {
+	t.Helper()
+	db, err := bolt.Open(filepath.Join(t.TempDir(), "macros.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	m, err := NewManager(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	emu := kvmhid.NewEmulator()
+	c := kvmhid.NewHIDController(&kvmhid.Config{
+		PortName:           "emulator",
+		BaudRate:           115200,
+		ScrollSensitivity:  0x01,
+		StatusPollInterval: time.Hour,
+	})
+	if err := c.ConnectTransport(emu); err != nil {
+		t.Fatalf("failed to connect to emulator: %v", err)
+	}
+	t.Cleanup(c.Close)
+	return m, c, emu
+}
+
+// sendCommands sends the commands over the HID websocket, as the web UI does, and waits for their replies
+func sendCommands(t *testing.T, c *kvmhid.Controller, cmds []kvmhid.HIDCommand) {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(c.HIDWebSocketHandler))
+	defer server.Close()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for _, cmd := range cmds {
+		if err := conn.WriteJSON(cmd); err != nil {
+			t.Fatal(err)
+		}
+		// Skip pushed status until the reply, which is the sent bytes or an error
+		for {
+			_, msg, err := conn.ReadMessage()
+			if err != nil {
+				t.Fatalf("no reply to %+v: %v", cmd, err)
+			}
+			if strings.Contains(string(msg), `"error"`) {
+				t.Fatalf("command %+v failed: %s", cmd, msg)
+			}
+			if !strings.HasPrefix(string(msg), "{") {
+				break
+			}
+		}
+	}
+}
+
+// waitForEvents waits until the recording on the instance holds n events
+func waitForEvents(t *testing.T, m *Manager, instanceUUID string, n int) {
+	t.Helper()
+	m.mu.Lock()
+	rec := m.recordings[instanceUUID]
+	m.mu.Unlock()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		rec.mu.Lock()
+		got := len(rec.events)
+		rec.mu.Unlock()
+		if got >= n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("recorded %d events, want %d", got, n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// playAndWait plays a stored macro and waits until the playback is done
+func playAndWait(t *testing.T, m *Manager, c *kvmhid.Controller, name string, speed float64) {
+	t.Helper()
+	if err := m.Play("test", c, name, speed, ""); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		status, err := m.GetPlaybackStatus("test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status.State != PlaybackStateRunning {
+			if status.State != PlaybackStateDone {
+				t.Fatalf("playback ended as %s: %s", status.State, status.Error)
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("playback did not finish")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// keyUsages returns the key usages of the keyboard reports, one per report with a key down
+func keyUsages(reports []kvmhid.EmulatorReport) []byte {
+	usages := []byte{}
+	for _, r := range reports {
+		if r.Cmd == 0x02 && len(r.Data) == 8 && r.Data[2] != 0x00 {
+			usages = append(usages, r.Data[2])
+		}
+	}
+	return usages
+}
+
+func TestRecordAndPlayTypeText(t *testing.T) {
+	m, c, emu := newTestManager(t)
+	if err := m.StartRecording("test", c, ""); err != nil {
+		t.Fatal(err)
+	}
+	sendCommands(t, c, []kvmhid.HIDCommand{
+		{Event: kvmhid.EventTypeKeyCodePress, Code: "KeyX"},
+		{Event: kvmhid.EventTypeKeyCodeRelease, Code: "KeyX"},
+		{Event: kvmhid.EventTypeTypeText, Text: "ab", KeyInterval: 1},
+	})
+	waitForEvents(t, m, "test", 3)
+	macro, err := m.StopRecording("test", "typed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last := macro.Events[len(macro.Events)-1].Command; last.Event != kvmhid.EventTypeTypeText || last.Text != "ab" {
+		t.Fatalf("typed text not recorded: %+v", last)
+	}
+
+	// Let the typing job of the recording finish before replaying
+	time.Sleep(200 * time.Millisecond)
+	emu.ClearReports()
+	playAndWait(t, m, c, "typed", MaxPlaybackSpeed)
+
+	// X, then a and b typed by the replayed text
+	if got, want := keyUsages(emu.Reports()), []byte{0x1B, 0x04, 0x05}; string(got) != string(want) {
+		t.Errorf("replayed key usages %X, want %X", got, want)
+	}
+}
+
+func TestPlaybackSpeedAfterTypeText(t *testing.T) {
+	m, c, _ := newTestManager(t)
+	// Typing "ab" takes about 400 ms, the recorded delay leaves 1600 ms after it
+	err := m.SaveMacro(&Macro{Name: "paced", Events: []MacroEvent{
+		{Command: kvmhid.HIDCommand{Event: kvmhid.EventTypeTypeText, Text: "ab", KeyInterval: 100}},
+		{Delay: 2000, Command: kvmhid.HIDCommand{Event: kvmhid.EventTypeKeyCodePress, Code: "KeyX"}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// At 4x the 1600 ms left after typing become 400 ms, not 500 ms minus the typing time
+	started := time.Now()
+	playAndWait(t, m, c, "paced", 4)
+	if elapsed := time.Since(started); elapsed < 700*time.Millisecond || elapsed > 1500*time.Millisecond {
+		t.Errorf("playback took %v, want about 800ms", elapsed)
+	}
+}
+
+func TestPlaybackReleasesOnlyItsKeys(t *testing.T) {
+	m, c, emu := newTestManager(t)
+	err := m.SaveMacro(&Macro{Name: "held", Events: []MacroEvent{
+		{Command: kvmhid.HIDCommand{Event: kvmhid.EventTypeKeyCodePress, Code: "KeyX"}},
+		{Command: kvmhid.HIDCommand{Event: kvmhid.EventTypeKeyCodePress, Code: "KeyY"}},
+		{Command: kvmhid.HIDCommand{Event: kvmhid.EventTypeKeyCodeRelease, Code: "KeyX"}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Shift is held by someone else, e.g. a HID session, and must stay down
+	if _, err := c.ConstructAndSendCmd(&kvmhid.HIDCommand{Event: kvmhid.EventTypeKeyCodePress, Code: "ShiftLeft"}); err != nil {
+		t.Fatal(err)
+	}
+	emu.ClearReports()
+	playAndWait(t, m, c, "held", MaxPlaybackSpeed)
+
+	var last []byte
+	for _, report := range emu.Reports() {
+		if report.Cmd == 0x02 {
+			last = report.Data
+		}
+	}
+	if last == nil || last[0] != kvmhid.MOD_LSHIFT || last[2] != 0x00 {
+		t.Errorf("last keyboard report %X, want only Shift held", last)
+	}
+}
+
+func TestPlayWhileInputJobRuns(t *testing.T) {
+	m, c, _ := newTestManager(t)
+	err := m.SaveMacro(&Macro{Name: "tap", Events: []MacroEvent{
+		{Command: kvmhid.HIDCommand{Event: kvmhid.EventTypeKeyCodePress, Code: "KeyX"}},
+		{Command: kvmhid.HIDCommand{Event: kvmhid.EventTypeKeyCodeRelease, Code: "KeyX"}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	end, err := c.BeginInputJob("script")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Play("test", c, "tap", 1, ""); !errors.Is(err, kvmhid.ErrInputJobBusy) {
+		t.Errorf("got %v, want %v", err, kvmhid.ErrInputJobBusy)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/play", strings.NewReader(url.Values{"name": {"tap"}}.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	m.HandlePlay(rec, req, "test", c)
+	if rec.Code != http.StatusConflict {
+		t.Errorf("got status %d while busy, want %d", rec.Code, http.StatusConflict)
+	}
+
+	// Once the other job ended, the macro plays and frees the controller again
+	end()
+	playAndWait(t, m, c, "tap", MaxPlaybackSpeed)
+	if job := c.RunningInputJob(); job != "" {
+		t.Errorf("input job %q still running after playback", job)
+	}
+}
@@ -0,0 +1,80 @@
+package kvmmacro
+
+import (
+	"context"
+	"sync"
+
+	"github.com/boltdb/bolt"
+	"imuslab.com/dezukvm/dezukvmd/mod/kvmhid"
+)
+
+type PlaybackState string
+
+const (
+	PlaybackStateRunning PlaybackState = "running"
+	PlaybackStateDone    PlaybackState = "done"
+	PlaybackStateAborted PlaybackState = "aborted"
+	PlaybackStateFailed  PlaybackState = "failed"
+)
+
+// Macro is a named sequence of recorded HID commands
+type Macro struct {
+	Name      string       `json:"name"`
+	CreatedAt int64        `json:"created_at"` // Unix timestamp in seconds
+	Events    []MacroEvent `json:"events"`
+}
+
+// MacroEvent is a single recorded HID command
+type MacroEvent struct {
+	Delay   int64             `json:"delay"` // Delay in milliseconds since the previous event
+	Command kvmhid.HIDCommand `json:"command"`
+}
+
+// MacroInfo is a summary of a stored macro
+type MacroInfo struct {
+	Name       string `json:"name"`
+	CreatedAt  int64  `json:"created_at"`
+	EventCount int    `json:"event_count"`
+	Duration   int64  `json:"duration"` // Total duration in milliseconds at normal speed
+}
+
+// PlaybackStatus is a snapshot of the progress of a macro playback
+type PlaybackStatus struct {
+	Macro  string        `json:"macro"`
+	State  PlaybackState `json:"state"`
+	Played int           `json:"played"`
+	Total  int           `json:"total"`
+	Speed  float64       `json:"speed"`
+	Error  string        `json:"error,omitempty"`
+}
+
+// recording is an ongoing macro recording on one instance
+type recording struct {
+	controller *kvmhid.Controller
+	listenerID int
+	sessionID  string // Only record commands from this session, empty for all sessions
+	lastEvent  int64  // Unix timestamp in milliseconds of the last recorded event
+	events     []MacroEvent
+	mu         sync.Mutex
+}
+
+// playback is an ongoing or finished macro playback on one instance
+type playback struct {
+	macro        *Macro
+	speed        float64
+	controlToken string // Control token of the HID session the playback was started from, it must keep input control
+	played       int
+	state        PlaybackState
+	err          error
+	cancel       context.CancelFunc
+	done         chan struct{}
+	mu           sync.Mutex
+}
+
+// Manager stores macros and handles recording and playback per instance
+type Manager struct {
+	db         *bolt.DB
+	recordings map[string]*recording // Instance UUID to ongoing recording
+	playbacks  map[string]*playback  // Instance UUID to current or last playback
+	mu         sync.Mutex
+}
@@ -0,0 +1,79 @@
+package kvmscript
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"imuslab.com/dezukvm/dezukvmd/mod/kvmhid"
+)
+
+// HandleRunScript starts running the posted script on the given instance
+// Accept POST parameters script and layout (optional, default us), only from the session holding input control
+func (r *Runner) HandleRunScript(w http.ResponseWriter, req *http.Request, instanceUUID string, controller *kvmhid.Controller) {
+	if err := req.ParseForm(); err != nil {
+		http.Error(w, "Invalid form data", http.StatusBadRequest)
+		return
+	}
+	source := req.Form.Get("script")
+	if source == "" {
+		http.Error(w, "Missing or invalid script parameter", http.StatusBadRequest)
+		return
+	}
+
+	status, errs, err := r.Start(instanceUUID, controller, source, req.Form.Get("layout"), kvmhid.RequestControlToken(req))
+	if err != nil {
+		code := http.StatusBadRequest
+		if errors.Is(err, kvmhid.ErrNoInputControl) || errors.Is(err, kvmhid.ErrInputJobBusy) {
+			code = http.StatusConflict
+		}
+		http.Error(w, err.Error(), code)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if len(errs) > 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{"errors": errs})
+		return
+	}
+	json.NewEncoder(w).Encode(status)
+}
+
+// HandleValidateScript parses the posted script without running it and returns all errors found
+// Accept POST parameters script and layout (optional, default us)
+func (r *Runner) HandleValidateScript(w http.ResponseWriter, req *http.Request) {
+	if err := req.ParseForm(); err != nil {
+		http.Error(w, "Invalid form data", http.StatusBadRequest)
+		return
+	}
+	_, errs := Parse(req.Form.Get("script"), req.Form.Get("layout"))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"valid":  len(errs) == 0,
+		"errors": errs,
+	})
+}
+
+// HandleScriptStatus returns the status of the current or last script job on the given instance
+func (r *Runner) HandleScriptStatus(w http.ResponseWriter, req *http.Request, instanceUUID string) {
+	status, err := r.GetStatus(instanceUUID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// HandleCancelScript cancels the script running on the given instance, only from the session holding input control
+func (r *Runner) HandleCancelScript(w http.ResponseWriter, req *http.Request, instanceUUID string, controller *kvmhid.Controller) {
+	if err := controller.CheckControl(kvmhid.RequestControlToken(req)); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err := r.Cancel(instanceUUID); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	r.HandleScriptStatus(w, req, instanceUUID)
+}
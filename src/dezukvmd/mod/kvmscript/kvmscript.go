@@ -0,0 +1,187 @@
+package kvmscript
+
+/*
+	kvmscript - DuckyScript payload runner
+
+	Parse DuckyScript style payloads and run them as cancellable jobs
+	against the HID controller of an instance.
+*/
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"imuslab.com/dezukvm/dezukvmd/mod/kvmhid"
+)
+
+const keyComboHoldTime = 30 * time.Millisecond // How long key combinations are held down
+
+// NewRunner creates a new script runner
+func NewRunner() *Runner {
+	return &Runner{
+		jobs: make(map[string]*job),
+	}
+}
+
+// Start parses the script and starts running it on the controller of an instance.
+// If the script contains errors, nothing is run and all errors are returned. err is
+// set if the script cannot start, e.g. without input control or while another input
+// job such as a macro runs on the controller (kvmhid.ErrInputJobBusy).
+// The job stops once the HID session of the control token loses input control.
+func (r *Runner) Start(instanceUUID string, controller *kvmhid.Controller, source string, layoutName string, controlToken string) (*JobStatus, []*ScriptError, error) {
+	script, errs := Parse(source, layoutName)
+	if len(errs) > 0 {
+		return nil, errs, nil
+	}
+	if err := controller.CheckControl(controlToken); err != nil {
+		return nil, nil, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	endInputJob, err := controller.BeginInputJob("script")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	j := &job{
+		script:       script,
+		layout:       layoutName,
+		controlToken: controlToken,
+		state:        JobStateRunning,
+		startedAt:    time.Now().Unix(),
+		cancel:       cancel,
+		done:         make(chan struct{}),
+	}
+	r.jobs[instanceUUID] = j
+	go j.run(ctx, controller, endInputJob)
+	status := j.status()
+	return &status, nil, nil
+}
+
+// Cancel stops the script running on an instance and waits for it to exit
+func (r *Runner) Cancel(instanceUUID string) error {
+	r.mu.Lock()
+	j, ok := r.jobs[instanceUUID]
+	r.mu.Unlock()
+	if !ok {
+		return errors.New("no script has been run on this instance")
+	}
+	j.cancel()
+	<-j.done
+	return nil
+}
+
+// GetStatus returns the status of the current or last script job on an instance
+func (r *Runner) GetStatus(instanceUUID string) (*JobStatus, error) {
+	r.mu.Lock()
+	j, ok := r.jobs[instanceUUID]
+	r.mu.Unlock()
+	if !ok {
+		return nil, errors.New("no script has been run on this instance")
+	}
+	status := j.status()
+	return &status, nil
+}
+
+func (j *job) run(ctx context.Context, controller *kvmhid.Controller, endInputJob func()) {
+	defer close(j.done)
+	var defaultDelay time.Duration
+	var previous *instruction
+	var runErr *ScriptError
+
+	for _, inst := range j.script.instructions {
+		j.mu.Lock()
+		j.currentLine = inst.line
+		j.mu.Unlock()
+
+		var err error
+		switch inst.kind {
+		case instructionDefaultDelay:
+			defaultDelay = inst.delay
+			continue
+		case instructionRepeat:
+			for i := 0; i < inst.repeat && err == nil; i++ {
+				err = j.execute(ctx, controller, previous)
+				if err == nil {
+					err = sleepContext(ctx, defaultDelay)
+				}
+			}
+		default:
+			err = j.execute(ctx, controller, inst)
+			previous = inst
+			if err == nil {
+				err = sleepContext(ctx, defaultDelay)
+			}
+		}
+
+		if err != nil {
+			runErr = &ScriptError{Line: inst.line, Message: err.Error()}
+			break
+		}
+	}
+
+	// Make sure nothing the script pressed stays down if it was cancelled half way,
+	// keys held by sessions on the controller are left alone
+	if err := controller.RestoreKeyboard(); err != nil {
+		log.Printf("Failed to release keys after script: %v", err)
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	// Free the controller before the job shows as finished, so a new job can start right away
+	endInputJob()
+	switch {
+	case ctx.Err() != nil:
+		j.state = JobStateCancelled
+	case runErr != nil:
+		j.state = JobStateFailed
+		j.err = runErr
+	default:
+		j.state = JobStateDone
+	}
+}
+
+// execute runs a single instruction on the controller
+func (j *job) execute(ctx context.Context, controller *kvmhid.Controller, inst *instruction) error {
+	if err := controller.CheckControl(j.controlToken); err != nil {
+		return err
+	}
+	switch inst.kind {
+	case instructionString:
+		return controller.TypeText(ctx, inst.text, j.layout, 0)
+	case instructionDelay:
+		return sleepContext(ctx, inst.delay)
+	case instructionKeyCombo:
+		return controller.SendKeyCombo(ctx, inst.modifiers, inst.keys, keyComboHoldTime)
+	}
+	return nil
+}
+
+func (j *job) status() JobStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return JobStatus{
+		State:       j.state,
+		CurrentLine: j.currentLine,
+		TotalLines:  j.script.lineCount,
+		StartedAt:   j.startedAt,
+		Error:       j.err,
+	}
+}
+
+// sleepContext waits for the given duration or until the context is cancelled
+func sleepContext(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(d):
+		return nil
+	}
+}
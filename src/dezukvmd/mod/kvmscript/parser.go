@@ -0,0 +1,229 @@
+package kvmscript
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"imuslab.com/dezukvm/dezukvmd/mod/kvmhid"
+)
+
+/*
+	parser.go
+
+	DuckyScript parser. Supported commands:
+
+	REM <comment>
+	STRING <text>
+	STRINGLN <text>            (STRING followed by Enter)
+	DELAY <ms>
+	DEFAULT_DELAY <ms>         (also DEFAULTDELAY)
+	REPEAT <n>                 (also REPLAY, repeat the previous command n times)
+	<KEY> [<KEY> ...]          (key combination, e.g. CTRL ALT DELETE or GUI r)
+*/
+
+const (
+	MaxScriptLines = 10000
+	MaxRepeatCount = 10000
+	MaxDelay       = 10 * time.Minute
+)
+
+var modifierNames = map[string]uint8{
+	"CTRL":    kvmhid.MOD_LCTRL,
+	"CONTROL": kvmhid.MOD_LCTRL,
+	"SHIFT":   kvmhid.MOD_LSHIFT,
+	"ALT":     kvmhid.MOD_LALT,
+	"OPTION":  kvmhid.MOD_LALT,
+	"GUI":     kvmhid.MOD_LGUI,
+	"WINDOWS": kvmhid.MOD_LGUI,
+	"COMMAND": kvmhid.MOD_LGUI,
+	"META":    kvmhid.MOD_LGUI,
+}
+
+// keyNames maps DuckyScript key names to KeyboardEvent.code values
+var keyNames = map[string]string{
+	"ENTER":       "Enter",
+	"RETURN":      "Enter",
+	"ESC":         "Escape",
+	"ESCAPE":      "Escape",
+	"TAB":         "Tab",
+	"SPACE":       "Space",
+	"BACKSPACE":   "Backspace",
+	"DELETE":      "Delete",
+	"DEL":         "Delete",
+	"INSERT":      "Insert",
+	"HOME":        "Home",
+	"END":         "End",
+	"PAGEUP":      "PageUp",
+	"PAGEDOWN":    "PageDown",
+	"UP":          "ArrowUp",
+	"UPARROW":     "ArrowUp",
+	"DOWN":        "ArrowDown",
+	"DOWNARROW":   "ArrowDown",
+	"LEFT":        "ArrowLeft",
+	"LEFTARROW":   "ArrowLeft",
+	"RIGHT":       "ArrowRight",
+	"RIGHTARROW":  "ArrowRight",
+	"CAPSLOCK":    "CapsLock",
+	"NUMLOCK":     "NumLock",
+	"SCROLLLOCK":  "ScrollLock",
+	"PRINTSCREEN": "PrintScreen",
+	"PAUSE":       "Pause",
+	"BREAK":       "Pause",
+	"MENU":        "ContextMenu",
+	"APP":         "ContextMenu",
+	"SYSRQ":       "PrintScreen",
+}
+
+// Parse parses a DuckyScript. STRING commands are checked against the given target
+// keyboard layout. All errors found are returned, each with its line number.
+func Parse(source string, layoutName string) (*Script, []*ScriptError) {
+	layout, err := kvmhid.GetKeyboardLayout(layoutName)
+	if err != nil {
+		return nil, []*ScriptError{{Line: 0, Message: err.Error()}}
+	}
+
+	source = strings.ReplaceAll(source, "\r\n", "\n")
+	lines := strings.Split(source, "\n")
+	if len(lines) > MaxScriptLines {
+		return nil, []*ScriptError{{Line: MaxScriptLines + 1, Message: "script is too long"}}
+	}
+
+	script := &Script{
+		instructions: []*instruction{},
+		lineCount:    len(lines),
+	}
+	errs := []*ScriptError{}
+	var previous *instruction
+	for i, rawLine := range lines {
+		lineNo := i + 1
+		line := strings.TrimLeft(rawLine, " \t")
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		command, arg, _ := strings.Cut(line, " ")
+		command = strings.ToUpper(strings.TrimSpace(command))
+		if command == "REM" {
+			continue
+		}
+
+		inst, err := parseInstruction(lineNo, command, arg, line, layout, previous)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		script.instructions = append(script.instructions, inst)
+		if inst.kind != instructionRepeat {
+			previous = inst
+		}
+	}
+
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return script, nil
+}
+
+func parseInstruction(lineNo int, command string, arg string, line string, layout *kvmhid.KeyboardLayout, previous *instruction) (*instruction, *ScriptError) {
+	switch command {
+	case "STRING", "STRINGLN":
+		text := arg
+		if command == "STRINGLN" {
+			text += "\n"
+		}
+		if text == "" {
+			return nil, &ScriptError{Line: lineNo, Message: command + " requires text"}
+		}
+		if _, err := layout.Convert(text); err != nil {
+			return nil, &ScriptError{Line: lineNo, Message: err.Error()}
+		}
+		return &instruction{line: lineNo, kind: instructionString, text: text}, nil
+	case "DELAY", "DEFAULT_DELAY", "DEFAULTDELAY":
+		ms, err := strconv.Atoi(strings.TrimSpace(arg))
+		if err != nil || ms < 0 {
+			return nil, &ScriptError{Line: lineNo, Message: command + " requires a non-negative delay in milliseconds"}
+		}
+		delay := time.Duration(ms) * time.Millisecond
+		if delay > MaxDelay {
+			return nil, &ScriptError{Line: lineNo, Message: "delay is too long"}
+		}
+		kind := instructionDelay
+		if command != "DELAY" {
+			kind = instructionDefaultDelay
+		}
+		return &instruction{line: lineNo, kind: kind, delay: delay}, nil
+	case "REPEAT", "REPLAY":
+		if previous == nil {
+			return nil, &ScriptError{Line: lineNo, Message: command + " has no previous command to repeat"}
+		}
+		count, err := strconv.Atoi(strings.TrimSpace(arg))
+		if err != nil || count < 1 {
+			return nil, &ScriptError{Line: lineNo, Message: command + " requires a positive repeat count"}
+		}
+		if count > MaxRepeatCount {
+			return nil, &ScriptError{Line: lineNo, Message: "repeat count is too large"}
+		}
+		return &instruction{line: lineNo, kind: instructionRepeat, repeat: count}, nil
+	default:
+		return parseKeyCombo(lineNo, line)
+	}
+}
+
+// parseKeyCombo parses a line like "CTRL ALT DELETE", "GUI r" or "CTRL-SHIFT ESC"
+func parseKeyCombo(lineNo int, line string) (*instruction, *ScriptError) {
+	tokens := []string{}
+	for _, field := range strings.Fields(line) {
+		if len(field) > 1 && strings.Contains(field, "-") {
+			for _, part := range strings.Split(field, "-") {
+				if part != "" {
+					tokens = append(tokens, part)
+				}
+			}
+			continue
+		}
+		tokens = append(tokens, field)
+	}
+
+	inst := &instruction{line: lineNo, kind: instructionKeyCombo, keys: []uint8{}}
+	for _, token := range tokens {
+		if bit, ok := modifierNames[strings.ToUpper(token)]; ok {
+			inst.modifiers |= bit
+			continue
+		}
+		usage, err := keyNameToHIDUsage(token)
+		if err != nil {
+			return nil, &ScriptError{Line: lineNo, Message: err.Error()}
+		}
+		inst.keys = append(inst.keys, usage)
+	}
+	if len(inst.keys) > 6 {
+		return nil, &ScriptError{Line: lineNo, Message: "too many keys pressed at once, at most 6 are allowed"}
+	}
+	return inst, nil
+}
+
+// keyNameToHIDUsage converts a DuckyScript key name or single character into a HID usage code
+func keyNameToHIDUsage(name string) (uint8, error) {
+	upper := strings.ToUpper(name)
+	if code, ok := keyNames[upper]; ok {
+		return kvmhid.KeyboardCodeToHIDUsage(code)
+	}
+	if len(upper) >= 2 && upper[0] == 'F' {
+		// Function keys F1 - F24
+		if n, err := strconv.Atoi(upper[1:]); err == nil {
+			return kvmhid.KeyboardCodeToHIDUsage("F" + strconv.Itoa(n))
+		}
+	}
+
+	runes := []rune(name)
+	if len(runes) == 1 {
+		// Single characters refer to key positions on a US keyboard, like the original DuckyScript
+		usLayout, _ := kvmhid.GetKeyboardLayout("us")
+		if stroke, ok := usLayout.Lookup(runes[0]); ok {
+			return stroke.Usage, nil
+		}
+	}
+	return 0, errors.New("unknown key or command: " + name)
+}
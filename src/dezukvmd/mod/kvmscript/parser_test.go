@@ -0,0 +1,229 @@
+package kvmscript
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"imuslab.com/dezukvm/dezukvmd/mod/kvmhid"
+)
+
+// newEmulatedController creates a HID controller connected to a CH9329 emulator
+func newEmulatedController(t *testing.T) (*kvmhid.Controller, *kvmhid.Emulator) {
+	t.Helper()
+	emu := kvmhid.NewEmulator()
+	c := kvmhid.NewHIDController(&kvmhid.Config{
+		PortName:           "emulator",
+		BaudRate:           115200,
+		ScrollSensitivity:  0x01,
+		StatusPollInterval: time.Hour,
+	})
+	if err := c.ConnectTransport(emu); err != nil {
+		t.Fatalf("failed to connect to emulator: %v", err)
+	}
+	t.Cleanup(c.Close)
+	emu.ClearReports()
+	return c, emu
+}
+
+// runAndWait runs the script on the controller and waits until it is done
+func runAndWait(t *testing.T, c *kvmhid.Controller, source string) {
+	t.Helper()
+	r := NewRunner()
+	if _, errs, err := r.Start("test", c, source, "us", ""); err != nil || len(errs) > 0 {
+		t.Fatal(err, errs)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		status, err := r.GetStatus("test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status.State != JobStateRunning {
+			if status.State != JobStateDone {
+				t.Fatalf("script ended as %s: %+v", status.State, status.Error)
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("script did not finish")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		want   []instruction
+	}{
+		{"string", "STRING Hello World", []instruction{
+			{line: 1, kind: instructionString, text: "Hello World"},
+		}},
+		{"stringln", "STRINGLN ls -la", []instruction{
+			{line: 1, kind: instructionString, text: "ls -la\n"},
+		}},
+		{"comments and blank lines", "REM open run\n\n  \r\nGUI r", []instruction{
+			{line: 4, kind: instructionKeyCombo, modifiers: kvmhid.MOD_LGUI, keys: []uint8{0x15}},
+		}},
+		{"delays", "DEFAULT_DELAY 100\nDEFAULTDELAY 50\nDELAY 500", []instruction{
+			{line: 1, kind: instructionDefaultDelay, delay: 100 * time.Millisecond},
+			{line: 2, kind: instructionDefaultDelay, delay: 50 * time.Millisecond},
+			{line: 3, kind: instructionDelay, delay: 500 * time.Millisecond},
+		}},
+		{"repeat", "ENTER\nREPEAT 3\nreplay 2", []instruction{
+			{line: 1, kind: instructionKeyCombo, keys: []uint8{0x28}},
+			{line: 2, kind: instructionRepeat, repeat: 3},
+			{line: 3, kind: instructionRepeat, repeat: 2},
+		}},
+		{"key combos", "CTRL ALT DELETE\nCTRL-SHIFT ESC\nalt F4\nF24", []instruction{
+			{line: 1, kind: instructionKeyCombo, modifiers: kvmhid.MOD_LCTRL | kvmhid.MOD_LALT, keys: []uint8{0x4C}},
+			{line: 2, kind: instructionKeyCombo, modifiers: kvmhid.MOD_LCTRL | kvmhid.MOD_LSHIFT, keys: []uint8{0x29}},
+			{line: 3, kind: instructionKeyCombo, modifiers: kvmhid.MOD_LALT, keys: []uint8{0x3D}},
+			{line: 4, kind: instructionKeyCombo, keys: []uint8{0x73}},
+		}},
+	}
+	for _, tt := range tests {
+		script, errs := Parse(tt.source, "us")
+		if len(errs) > 0 {
+			t.Errorf("%s: unexpected errors %v", tt.name, errs)
+			continue
+		}
+		got := []instruction{}
+		for _, inst := range script.instructions {
+			got = append(got, *inst)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		layout string
+		want   []ScriptError
+	}{
+		{"unknown command", "STRING ok\nFOO", "us", []ScriptError{
+			{Line: 2, Message: "unknown key or command: FOO"},
+		}},
+		{"all errors reported", "DELAY\nDELAY -5\nREPEAT 0", "us", []ScriptError{
+			{Line: 1, Message: "DELAY requires a non-negative delay in milliseconds"},
+			{Line: 2, Message: "DELAY requires a non-negative delay in milliseconds"},
+			{Line: 3, Message: "REPEAT has no previous command to repeat"},
+		}},
+		{"repeat count", "ENTER\nREPEAT x\nREPEAT 10001", "us", []ScriptError{
+			{Line: 2, Message: "REPEAT requires a positive repeat count"},
+			{Line: 3, Message: "repeat count is too large"},
+		}},
+		{"delay too long", "DEFAULT_DELAY 600001", "us", []ScriptError{
+			{Line: 1, Message: "delay is too long"},
+		}},
+		{"empty string", "STRING", "us", []ScriptError{
+			{Line: 1, Message: "STRING requires text"},
+		}},
+		{"too many keys", "a b c d e f g", "us", []ScriptError{
+			{Line: 1, Message: "too many keys pressed at once, at most 6 are allowed"},
+		}},
+		{"unknown layout", "STRING a", "xx", []ScriptError{
+			{Line: 0, Message: "unsupported keyboard layout: xx"},
+		}},
+	}
+	for _, tt := range tests {
+		script, errs := Parse(tt.source, tt.layout)
+		if script != nil {
+			t.Errorf("%s: script returned despite errors", tt.name)
+		}
+		got := []ScriptError{}
+		for _, err := range errs {
+			got = append(got, *err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+
+	// Characters are checked against the target layout
+	if _, errs := Parse("STRING ¥", "us"); len(errs) != 1 || errs[0].Line != 1 {
+		t.Errorf("got %v, want an unsupported character error at line 1", errs)
+	}
+	if _, errs := Parse("STRING ¥", "jp"); len(errs) != 0 {
+		t.Errorf("¥ should be typeable on the Japanese layout: %v", errs)
+	}
+
+	if _, errs := Parse(strings.Repeat("ENTER\n", MaxScriptLines), "us"); len(errs) != 1 || errs[0].Line != MaxScriptLines+1 {
+		t.Errorf("got %v, want a script too long error", errs)
+	}
+}
+
+func TestRunScript(t *testing.T) {
+	c, emu := newEmulatedController(t)
+	runAndWait(t, c, "GUI r\nSTRING ab\nREPEAT 1")
+
+	// Keyboard reports with a key down, as modifiers and first key
+	got := [][2]byte{}
+	var last []byte
+	for _, report := range emu.Reports() {
+		if report.Cmd != 0x02 {
+			continue
+		}
+		if report.Data[2] != 0x00 {
+			got = append(got, [2]byte{report.Data[0], report.Data[2]})
+		}
+		last = report.Data
+	}
+	want := [][2]byte{
+		{kvmhid.MOD_LGUI, 0x15},
+		{0x00, 0x04}, {0x00, 0x05},
+		{0x00, 0x04}, {0x00, 0x05},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got keys %X, want %X", got, want)
+	}
+	if last == nil || last[0] != 0x00 || last[2] != 0x00 {
+		t.Errorf("keys still held after the script: %X", last)
+	}
+}
+
+func TestRunScriptWhileInputJobRuns(t *testing.T) {
+	c, _ := newEmulatedController(t)
+	end, err := c.BeginInputJob("macro Login")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer end()
+	r := NewRunner()
+	if _, errs, err := r.Start("test", c, "STRING a", "us", ""); len(errs) > 0 || !errors.Is(err, kvmhid.ErrInputJobBusy) {
+		t.Errorf("got %v %v, want %v", err, errs, kvmhid.ErrInputJobBusy)
+	}
+	if _, err := r.GetStatus("test"); err == nil {
+		t.Error("a job was created although the controller is busy")
+	}
+}
+
+func TestRunScriptKeepsHeldKeys(t *testing.T) {
+	c, emu := newEmulatedController(t)
+	// Shift is held by someone else, e.g. a HID session, and must stay down
+	if _, err := c.ConstructAndSendCmd(&kvmhid.HIDCommand{Event: kvmhid.EventTypeKeyCodePress, Code: "ShiftLeft"}); err != nil {
+		t.Fatal(err)
+	}
+	runAndWait(t, c, "CTRL c")
+
+	var last []byte
+	for _, report := range emu.Reports() {
+		if report.Cmd == 0x02 {
+			last = report.Data
+		}
+	}
+	if last == nil || last[0] != kvmhid.MOD_LSHIFT || last[2] != 0x00 {
+		t.Errorf("last keyboard report %X, want only Shift held", last)
+	}
+	if job := c.RunningInputJob(); job != "" {
+		t.Errorf("input job %q still running after the script", job)
+	}
+}
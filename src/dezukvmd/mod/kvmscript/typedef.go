@@ -0,0 +1,83 @@
+package kvmscript
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+type instructionType int
+
+const (
+	instructionString       instructionType = iota // Type text
+	instructionDelay                               // Wait for a fixed time
+	instructionDefaultDelay                        // Change the delay between instructions
+	instructionKeyCombo                            // Press and release a key combination
+	instructionRepeat                              // Repeat the previous instruction
+)
+
+type JobState string
+
+const (
+	JobStateRunning   JobState = "running"
+	JobStateDone      JobState = "done"
+	JobStateCancelled JobState = "cancelled"
+	JobStateFailed    JobState = "failed"
+)
+
+// ScriptError is an error at a specific line of a script
+type ScriptError struct {
+	Line    int    `json:"line"` // 1 based line number
+	Message string `json:"message"`
+}
+
+func (e *ScriptError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Message)
+}
+
+// instruction is a single parsed script command
+type instruction struct {
+	line      int
+	kind      instructionType
+	text      string        // Text to type for instructionString
+	delay     time.Duration // Delay for instructionDelay and instructionDefaultDelay
+	modifiers uint8         // Modifier bits for instructionKeyCombo
+	keys      []uint8       // HID usage codes for instructionKeyCombo
+	repeat    int           // Repeat count for instructionRepeat
+}
+
+// Script is a parsed DuckyScript ready to run
+type Script struct {
+	instructions []*instruction
+	lineCount    int
+}
+
+// JobStatus is a snapshot of the progress of a script job
+type JobStatus struct {
+	State       JobState     `json:"state"`
+	CurrentLine int          `json:"current_line"` // Line being executed, 0 before start
+	TotalLines  int          `json:"total_lines"`
+	StartedAt   int64        `json:"started_at"` // Unix timestamp in seconds
+	Error       *ScriptError `json:"error,omitempty"`
+}
+
+// job is a running or finished script execution on one instance
+type job struct {
+	script       *Script
+	layout       string
+	controlToken string // Control token of the HID session the job was started from, it must keep input control
+	currentLine  int
+	state        JobState
+	err          *ScriptError
+	startedAt    int64
+	cancel       context.CancelFunc
+	done         chan struct{}
+	mu           sync.Mutex
+}
+
+// Runner runs scripts as jobs, at most one job per instance at a time
+type Runner struct {
+	jobs map[string]*job // Instance UUID to current or last job
+	mu   sync.Mutex
+}
@@ -0,0 +1,133 @@
+package usbcapture
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/jpeg"
+	"time"
+)
+
+/*
+	active_area.go
+
+	Detect the active picture area of captured frames. When the target outputs
+	a resolution with a different aspect ratio than the capture resolution
+	(e.g. 4:3 BIOS screens captured at 1920x1080), the MS2109 scales the picture
+	to fit and fills the rest of the frame with black bars.
+*/
+
+const (
+	activeAreaBlackLevel   = 24   // Pixels with a luma at or below this level count as black
+	activeAreaMinLitRatio  = 0.02 // A row or column with less lit pixels than this ratio is a black bar
+	activeAreaSampleStep   = 2    // Sample every n-th pixel when scanning rows and columns
+	latestFrameMaxAge      = time.Second
+	captureFrameMaxTimeout = 5 * time.Second
+)
+
+// DetectActiveArea returns the bounds of the picture inside the letterbox or
+// pillarbox bars of a JPEG frame, together with the full frame size
+func DetectActiveArea(frame []byte) (area image.Rectangle, frameSize image.Point, err error) {
+	img, err := jpeg.Decode(bytes.NewReader(frame))
+	if err != nil {
+		return image.Rectangle{}, image.Point{}, err
+	}
+	bounds := img.Bounds()
+	frameSize = bounds.Size()
+
+	rowLit := func(y int) bool {
+		lit, total := 0, 0
+		for x := bounds.Min.X; x < bounds.Max.X; x += activeAreaSampleStep {
+			if luma(img, x, y) > activeAreaBlackLevel {
+				lit++
+			}
+			total++
+		}
+		return float64(lit) >= float64(total)*activeAreaMinLitRatio
+	}
+	colLit := func(x, minY, maxY int) bool {
+		lit, total := 0, 0
+		for y := minY; y < maxY; y += activeAreaSampleStep {
+			if luma(img, x, y) > activeAreaBlackLevel {
+				lit++
+			}
+			total++
+		}
+		return total > 0 && float64(lit) >= float64(total)*activeAreaMinLitRatio
+	}
+
+	top := bounds.Min.Y
+	for top < bounds.Max.Y && !rowLit(top) {
+		top++
+	}
+	if top == bounds.Max.Y {
+		return image.Rectangle{}, frameSize, errors.New("no picture found, the frame is black")
+	}
+	bottom := bounds.Max.Y
+	for bottom > top && !rowLit(bottom-1) {
+		bottom--
+	}
+	left := bounds.Min.X
+	for left < bounds.Max.X && !colLit(left, top, bottom) {
+		left++
+	}
+	right := bounds.Max.X
+	for right > left && !colLit(right-1, top, bottom) {
+		right--
+	}
+
+	area = image.Rect(left, top, right, bottom).Sub(bounds.Min)
+	return area, frameSize, nil
+}
+
+// luma returns the 8 bit brightness of a pixel
+func luma(img image.Image, x, y int) uint8 {
+	if ycc, ok := img.(*image.YCbCr); ok {
+		return ycc.Y[ycc.YOffset(x, y)]
+	}
+	r, g, b, _ := img.At(x, y).RGBA()
+	return uint8((299*r + 587*g + 114*b) / 1000 >> 8)
+}
+
+// ErrNoVideoStream is returned by CaptureFrame when no client is streaming, so no recent frame is available
+var ErrNoVideoStream = errors.New("no client is streaming the video")
+
+// CaptureFrame returns the last frame sent to the streaming client, waiting for a
+// new one if it is older than latestFrameMaxAge. The device buffer belongs to the
+// stream and is never read here, so without a client ErrNoVideoStream is returned.
+func (i *Instance) CaptureFrame(timeout time.Duration) ([]byte, error) {
+	if !i.Capturing {
+		return nil, errors.New("video capture is not started")
+	}
+	if timeout <= 0 || timeout > captureFrameMaxTimeout {
+		timeout = captureFrameMaxTimeout
+	}
+
+	deadline := time.After(timeout)
+	for {
+		i.latestFrameMu.Lock()
+		frame, capturedAt := i.latestFrame, i.latestFrameTime
+		i.latestFrameMu.Unlock()
+		if frame != nil && time.Since(capturedAt) < latestFrameMaxAge {
+			return frame, nil
+		}
+		if !i.IsStreaming() {
+			return nil, ErrNoVideoStream
+		}
+
+		// A stream is running, wait for it to pass on a frame
+		select {
+		case <-time.After(50 * time.Millisecond):
+		case <-deadline:
+			return nil, errors.New("timeout waiting for video frame")
+		}
+	}
+}
+
+// storeLatestFrame keeps a frame for CaptureFrame
+func (i *Instance) storeLatestFrame(frame []byte) {
+	i.latestFrameMu.Lock()
+	i.latestFrame = frame
+	i.latestFrameTime = time.Now()
+	i.latestFrameMu.Unlock()
+}
@@ -0,0 +1,88 @@
+package usbcapture
+
+import (
+	"bytes"
+	"errors"
+	"image/jpeg"
+	"math"
+)
+
+/*
+	frame_signature.go
+
+	Coarse fingerprints of captured frames, used to tell when the target
+	screen changes (e.g. from a boot logo to the firmware setup menu)
+	without comparing full frames that differ by JPEG noise alone.
+*/
+
+const (
+	signatureColumns = 32
+	signatureRows    = 18
+)
+
+// FrameSignature is the average brightness of each cell of a coarse grid over a frame
+type FrameSignature []uint8
+
+// NewFrameSignature computes the signature of a JPEG frame
+func NewFrameSignature(frame []byte) (FrameSignature, error) {
+	img, err := jpeg.Decode(bytes.NewReader(frame))
+	if err != nil {
+		return nil, err
+	}
+	bounds := img.Bounds()
+	// Every cell must get at least one sample, which are activeAreaSampleStep pixels apart
+	if bounds.Dx() < signatureColumns*activeAreaSampleStep || bounds.Dy() < signatureRows*activeAreaSampleStep {
+		return nil, errors.New("frame is too small")
+	}
+
+	sums := make([]int, signatureColumns*signatureRows)
+	counts := make([]int, signatureColumns*signatureRows)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y += activeAreaSampleStep {
+		row := (y - bounds.Min.Y) * signatureRows / bounds.Dy()
+		for x := bounds.Min.X; x < bounds.Max.X; x += activeAreaSampleStep {
+			col := (x - bounds.Min.X) * signatureColumns / bounds.Dx()
+			sums[row*signatureColumns+col] += int(luma(img, x, y))
+			counts[row*signatureColumns+col]++
+		}
+	}
+
+	sig := make(FrameSignature, len(sums))
+	for i := range sums {
+		sig[i] = uint8(sums[i] / counts[i])
+	}
+	return sig, nil
+}
+
+// Brightness returns the average brightness of the frame, 0 to 255
+func (s FrameSignature) Brightness() float64 {
+	if len(s) == 0 {
+		return 0
+	}
+	total := 0
+	for _, v := range s {
+		total += int(v)
+	}
+	return float64(total) / float64(len(s))
+}
+
+// IsBlack checks if the frame shows no picture, e.g. the target is off or has no signal
+func (s FrameSignature) IsBlack() bool {
+	for _, v := range s {
+		if v > activeAreaBlackLevel {
+			return false
+		}
+	}
+	return true
+}
+
+// Difference returns the average brightness difference per cell between two signatures, 0 to 255
+func (s FrameSignature) Difference(other FrameSignature) float64 {
+	if len(s) != len(other) || len(s) == 0 {
+		return math.MaxUint8
+	}
+	total := 0.0
+	for i := range s {
+		total += math.Abs(float64(s[i]) - float64(other[i]))
+	}
+	return total / float64(len(s))
+}
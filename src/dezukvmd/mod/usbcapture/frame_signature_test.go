@@ -0,0 +1,52 @@
+package usbcapture
+
+import (
+	"bytes"
+	"image"
+	"image/jpeg"
+	"testing"
+)
+
+// encodeGrayFrame encodes a JPEG frame of the given size and brightness
+func encodeGrayFrame(t *testing.T, width, height int, level uint8) []byte {
+	t.Helper()
+	img := image.NewGray(image.Rect(0, 0, width, height))
+	for i := range img.Pix {
+		img.Pix[i] = level
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, nil); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestNewFrameSignatureSmallFrames(t *testing.T) {
+	tests := []struct {
+		width, height int
+		wantErr       bool
+	}{
+		{32, 18, true},
+		{40, 36, true}, // Some columns would get no sample
+		{64, 35, true},
+		{64, 36, false},
+		{65, 37, false},
+		{1920, 1080, false},
+	}
+	for _, tt := range tests {
+		sig, err := NewFrameSignature(encodeGrayFrame(t, tt.width, tt.height, 0xFF))
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%dx%d: got no error for a frame that is too small", tt.width, tt.height)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%dx%d: %v", tt.width, tt.height, err)
+			continue
+		}
+		if len(sig) != signatureColumns*signatureRows || sig.IsBlack() {
+			t.Errorf("%dx%d: unexpected signature %v", tt.width, tt.height, sig)
+		}
+	}
+}
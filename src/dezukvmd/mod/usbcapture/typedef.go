@@ -2,6 +2,8 @@ package usbcapture
 
 import (
 	"context"
+	"sync"
+	"time"
 
 	"github.com/vladimirvivien/go4vl/device"
 	"github.com/vladimirvivien/go4vl/v4l2"
@@ -48,12 +50,16 @@ type Instance struct {
 	width              int
 	height             int
 	streamInfo         string
+	latestFrame        []byte    // Last frame sent to a stream client, used for picture area detection
+	latestFrameTime    time.Time // Time the latest frame was captured
+	latestFrameMu      sync.Mutex
 
 	/* audio capture device */
 	isAudioStreaming bool      // Whether audio is currently being captured
 	audiostopchan    chan bool // Channel to stop audio capture
 
 	/* Concurrent access */
-	accessCount       int       // The number of current access, in theory each instance should at most have 1 access
-	videoTakeoverChan chan bool // Channel to signal video takeover request
+	accessCount       int        // The number of current access, in theory each instance should at most have 1 access
+	accessMu          sync.Mutex // Guards accessCount
+	videoTakeoverChan chan bool  // Channel to signal video takeover request
 }
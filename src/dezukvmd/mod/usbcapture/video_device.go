@@ -132,7 +132,11 @@ func (i *Instance) StartVideoCapture(openWithResolution *CaptureResolution) erro
 	// start capture
 	ctx, cancel := context.WithCancel(context.TODO())
 	if err := camera.Start(ctx); err != nil {
-		log.Fatalf("stream capture: %s", err)
+		// e.g. the capture card hung or was just power cycled, let the caller retry
+		cancel()
+		camera.Close()
+		i.camera = nil
+		return fmt.Errorf("failed to start stream capture: %w", err)
 	}
 	i.cameraStartContext = cancel
 
@@ -147,20 +151,32 @@ func (i *Instance) StartVideoCapture(openWithResolution *CaptureResolution) erro
 // start http service
 func (i *Instance) ServeVideoStream(w http.ResponseWriter, req *http.Request) {
 	//Check if the access count is already 1, if so, kick out the previous access
-	if i.accessCount >= 1 {
+	i.accessMu.Lock()
+	takeover := i.accessCount >= 1
+	i.accessCount++
+	i.accessMu.Unlock()
+	if takeover {
 		log.Println("Another client is already connected, kicking out the previous client...")
 		if i.videoTakeoverChan != nil {
 			i.videoTakeoverChan <- true
 		}
 		log.Println("Previous client kicked out, taking over the stream...")
 	}
-	i.accessCount++
 
 	err := i.streamMJPEG(w, req)
 	if err != nil {
 		log.Printf("video stream error: %v", err)
 	}
+	i.accessMu.Lock()
 	i.accessCount--
+	i.accessMu.Unlock()
+}
+
+// IsStreaming checks if a client is receiving the video stream
+func (i *Instance) IsStreaming() bool {
+	i.accessMu.Lock()
+	defer i.accessMu.Unlock()
+	return i.accessCount > 0
 }
 
 func isJPEG(frame []byte) bool {
@@ -208,6 +224,7 @@ func (i *Instance) streamMJPEG(w http.ResponseWriter, req *http.Request) error {
 		if !isJPEG(frame) {
 			continue
 		}
+		i.storeLatestFrame(frame)
 
 		partWriter, err := mimeWriter.CreatePart(partHeader)
 		if err != nil {
@@ -7,6 +7,7 @@ import (
 	"os/exec"
 
 	"imuslab.com/dezukvm/dezukvmd/mod/dezukvm"
+	"imuslab.com/dezukvm/dezukvmd/mod/kvmhid"
 	"imuslab.com/dezukvm/dezukvmd/mod/usbcapture"
 )
 
@@ -37,6 +38,17 @@ func handle_debug_tool() error {
 		if err != nil {
 			return err
 		}
+	case "setup-hid-gadget":
+		err := setup_hid_gadget()
+		if err != nil {
+			return err
+		}
+	case "remove-hid-gadget":
+		err := kvmhid.RemoveGadget(kvmhid.GadgetConfig{Name: HID_GADGET_NAME})
+		if err != nil {
+			return err
+		}
+		log.Println("USB HID gadget removed")
 	default:
 		return fmt.Errorf("please specify a valid tool with -tool option")
 	}
@@ -77,6 +89,23 @@ func list_usb_kvm_devcies() error {
 	return nil
 }
 
+// setup_hid_gadget creates the USB gadget keyboard and mouse for the hidg backend
+func setup_hid_gadget() error {
+	cfg := kvmhid.GadgetConfig{Name: HID_GADGET_NAME}
+	err := kvmhid.SetupGadget(cfg)
+	if err != nil {
+		return err
+	}
+	keyboard, mouse, err := kvmhid.GadgetDevices(cfg)
+	if err != nil {
+		return err
+	}
+	log.Println("USB HID gadget is ready")
+	log.Printf(" - Keyboard: %s\n", keyboard)
+	log.Printf(" - Mouse: %s\n", mouse)
+	return nil
+}
+
 // list_all_audio_devices lists all available audio capture devices
 func list_all_audio_devices() error {
 	log.Println("Starting in List Audio Devices mode...")
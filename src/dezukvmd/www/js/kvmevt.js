@@ -18,6 +18,10 @@ let mouseMoveAbsolute = true; // Set to true for absolute mouse coordinates, fal
 let mouseIsOutside = false; //Mouse is outside capture element
 let audioFrontendStarted = false; //Audio frontend has been started
 let kvmDeviceUUID = ""; //UUID of the device being controlled
+let hidSessionID = ""; //HID session ID assigned by the server
+let hidControlToken = ""; //Secret sent as X-HID-Control-Token with REST input, never share it
+let hidChipStatus = null; //Target USB connection and keyboard LED state reported by the server
+let hidControlState = null; //Which HID session holds input control, others are view-only
 
 
 if (window.location.hash.length > 1){
@@ -41,10 +45,15 @@ function setStreamingSource(deviceUUID) {
 
 /* Mouse events */
 function handleMouseMove(event) {
+    if (!mouseMoveAbsolute) {
+        handleMouseMoveRelative(event);
+        return;
+    }
     const hidCommand = {
         event: 2,
         mouse_x: event.clientX,
         mouse_y: event.clientY,
+        mouse_move_button_state: moveButtonState(event),
     };
 
     const rect = event.target.getBoundingClientRect();
@@ -75,6 +84,55 @@ function handleMouseMove(event) {
     }
 }
 
+// Held buttons of a move, event.buttons has right and middle swapped
+// compared to the 0x01 left, 0x02 middle, 0x04 right order of the server
+function moveButtonState(event) {
+    return (event.buttons & 0x01) | ((event.buttons & 0x04) >> 1) | ((event.buttons & 0x02) << 1);
+}
+
+// Relative mode sends the raw movement deltas, used with pointer lock
+function handleMouseMoveRelative(event) {
+    if (document.pointerLockElement !== remoteCaptureEle) {
+        return;
+    }
+    const hidCommand = {
+        event: 2,
+        mouse_rel_x: event.movementX,
+        mouse_rel_y: event.movementY,
+        mouse_move_button_state: moveButtonState(event),
+    };
+
+    if (enableKvmEventDebugPrintout) {
+        console.log(`Mouse move relative delta: (${event.movementX}, ${event.movementY})`);
+    }
+
+    if (hidsocket && hidsocket.readyState === WebSocket.OPEN) {
+        hidsocket.send(JSON.stringify(hidCommand));
+    } else {
+        console.error("WebSocket is not open.");
+    }
+}
+
+// Switch between absolute and relative mouse mode for this session
+// sensitivity and acceleration are only used in relative mode
+function setMouseMode(absolute, sensitivity=1.0, acceleration=0) {
+    mouseMoveAbsolute = absolute;
+    const hidCommand = {
+        event: 7,
+        mouse_mode: absolute ? 0 : 1,
+        mouse_sensitivity: sensitivity,
+        mouse_acceleration: acceleration
+    };
+    if (hidsocket && hidsocket.readyState === WebSocket.OPEN) {
+        hidsocket.send(JSON.stringify(hidCommand));
+    } else {
+        console.error("WebSocket is not open.");
+    }
+
+    if (absolute && document.pointerLockElement === remoteCaptureEle) {
+        document.exitPointerLock();
+    }
+}
 
 function handleMousePress(event) {
     event.preventDefault();
@@ -83,6 +141,11 @@ function handleMousePress(event) {
         console.warn("Mouse is outside the capture area, ignoring mouse press.");
         return;
     }
+    if (!mouseMoveAbsolute && document.pointerLockElement !== remoteCaptureEle) {
+        // Relative mode requires pointer lock, the first click only captures the cursor
+        remoteCaptureEle.requestPointerLock();
+        return;
+    }
     /* Mouse buttons: 1=left, 2=right, 3=middle */
     const buttonMap = {
         0: 1, 
@@ -170,9 +233,32 @@ function isNumpadEvent(event) {
     return event.location === 3;
 }
 
+// Send a key press (10) or release (11) event by KeyboardEvent.code
+function sendKeyCodeEvent(eventType, code) {
+    const hidCommand = {
+        event: eventType,
+        code: code
+    };
+
+    if (enableKvmEventDebugPrintout) {
+        console.log(`Key ${eventType === 10 ? "down" : "up"}: ${code}`);
+    }
+
+    if (hidsocket && hidsocket.readyState === WebSocket.OPEN) {
+        hidsocket.send(JSON.stringify(hidCommand));
+    } else {
+        console.error("WebSocket is not open.");
+    }
+}
+
 function handleKeyDown(event) {
     event.preventDefault();
     event.stopImmediatePropagation();
+    if (event.code) {
+        // Prefer the physical key code, fallback to legacy keyCode for old browsers
+        sendKeyCodeEvent(10, event.code);
+        return;
+    }
     const key = event.key;
     let hidCommand = {
         event: 0,
@@ -204,6 +290,10 @@ function handleKeyDown(event) {
 function handleKeyUp(event) {
     event.preventDefault();
     event.stopImmediatePropagation();
+    if (event.code) {
+        sendKeyCodeEvent(11, event.code);
+        return;
+    }
     const key = event.key;
     
     let hidCommand = {
@@ -256,8 +346,49 @@ function startHidWebSocket(){
     });
 
     hidsocket.addEventListener('message', function(event) {
-        //Todo: handle control signals from server if needed
+        //Todo: handle other control signals from server if needed
         //console.log('Message from server ', event.data);
+        if (event.data.startsWith("{")) {
+            const msg = JSON.parse(event.data);
+            if (msg.session_id) {
+                // Used to record macros from this session only
+                hidSessionID = msg.session_id;
+            }
+            if (msg.control_token) {
+                // Only this tab receives it, REST input is checked against it
+                hidControlToken = msg.control_token;
+            }
+            if (msg.control) {
+                // Input ownership changed, only the holder can send input
+                hidControlState = msg.control;
+                document.dispatchEvent(new CustomEvent('hidcontrol', { detail: hidControlState }));
+            }
+            if (msg.control_request) {
+                // Another session asks for input control
+                const requester = msg.control_request.name || msg.control_request.id;
+                const granted = confirm(`${requester} requests control of this KVM. Hand over control?`);
+                hidsocket.send(JSON.stringify({
+                    event: granted ? 16 : 17,
+                    target_session: msg.control_request.id
+                }));
+            }
+            if (msg.control_denied) {
+                alert("Request for control was denied");
+            }
+            if (msg.error) {
+                if (msg.error == "session does not hold input control") {
+                    // Input from a view-only session is dropped by the server
+                    showViewOnlyNotice();
+                } else {
+                    console.error("HID command failed: " + msg.error);
+                }
+            }
+            if (msg.chip_status) {
+                // Pushed on connect and whenever target connection or LEDs change
+                hidChipStatus = msg.chip_status;
+                document.dispatchEvent(new CustomEvent('hidchipstatus', { detail: hidChipStatus }));
+            }
+        }
     });
 
   
@@ -417,3 +548,55 @@ function disconnectRemote(){
     stopAudioWebSocket();
     stopWebSocket();
 }
+
+/* Input control between sessions */
+function hasInputControl() {
+    return hidControlState != null && hidControlState.owner == hidSessionID;
+}
+
+// Ask the session holding control to hand it over, granted right away if nobody holds it
+function requestInputControl() {
+    hidsocket.send(JSON.stringify({ event: 15 }));
+}
+
+// Take input control without asking the current holder
+function takeInputControl() {
+    hidsocket.send(JSON.stringify({ event: 18 }));
+}
+
+// Give up input control
+function releaseInputControl() {
+    hidsocket.send(JSON.stringify({ event: 19 }));
+}
+
+// Request control, or give it up if this session already holds it
+function toggleInputControl() {
+    if (hasInputControl()) {
+        releaseInputControl();
+    } else {
+        requestInputControl();
+    }
+}
+
+function showViewOnlyNotice() {
+    $('#viewOnlyNotice').show();
+}
+
+// Keep the control button and view-only notice in sync with the control state
+document.addEventListener('hidcontrol', function(event) {
+    const btn = document.getElementById('btnInputControl');
+    const icon = btn.querySelector('i');
+    if (hasInputControl()) {
+        btn.title = "Release Control";
+        icon.className = "hand rock icon";
+        $('#viewOnlyNotice').hide();
+    } else {
+        btn.title = "Request Control";
+        icon.className = "hand paper outline icon";
+        if (event.detail.owner != "") {
+            showViewOnlyNotice();
+        } else {
+            $('#viewOnlyNotice').hide();
+        }
+    }
+});